@@ -0,0 +1,232 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// EmbeddingDimensions is the size of the event embeddings, fixed by the vector column that stores them. Providers
+// must return vectors of this size.
+const EmbeddingDimensions = 768
+
+// embeddingTextLimit caps the text embedded for an event; payloads can be much larger than what carries its meaning.
+const embeddingTextLimit = 2000
+
+const (
+	EmbeddingProviderFake   = "fake"
+	EmbeddingProviderOpenAI = "openai"
+)
+
+// EmbeddingProvider turns texts into vectors of EmbeddingDimensions, comparable by cosine similarity. Vectors of
+// different models are not comparable, so they are stored with the model that computed them.
+type EmbeddingProvider interface {
+	Model() string
+	Embed(ctx context.Context, texts []string) ([][]float32, error)
+}
+
+type EmbeddingConfig struct {
+	Provider string // fake or openai; empty disables embeddings
+	BaseURL  string
+	APIKey   string
+	Model    string
+}
+
+// LoadEmbeddingConfig reads the embedding settings, shared by the services that embed events and the ones that
+// search them, which have to use the same model.
+func LoadEmbeddingConfig() EmbeddingConfig {
+	return EmbeddingConfig{
+		Provider: strings.ToLower(strings.TrimSpace(os.Getenv("EMBEDDING_PROVIDER"))),
+		BaseURL:  os.Getenv("EMBEDDING_BASE_URL"),
+		APIKey:   os.Getenv("EMBEDDING_API_KEY"),
+		Model:    os.Getenv("EMBEDDING_MODEL"),
+	}
+}
+
+// NewEmbeddingProvider creates the configured provider, or returns nil when embeddings are disabled.
+func NewEmbeddingProvider(cfg EmbeddingConfig) (EmbeddingProvider, error) {
+	switch cfg.Provider {
+	case "":
+		return nil, nil
+	case EmbeddingProviderFake:
+		return FakeEmbeddingProvider{}, nil
+	case EmbeddingProviderOpenAI:
+		if cfg.BaseURL == "" || cfg.Model == "" {
+			return nil, fmt.Errorf("the openai embedding provider needs EMBEDDING_BASE_URL and EMBEDDING_MODEL")
+		}
+		return &OpenAIEmbeddingProvider{
+			baseURL: strings.TrimRight(cfg.BaseURL, "/"),
+			apiKey:  cfg.APIKey,
+			model:   cfg.Model,
+			client:  &http.Client{Timeout: 30 * time.Second},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown embedding provider %q", cfg.Provider)
+	}
+}
+
+// EventEmbeddingText is the text embedded for an event: what kind of event it is and its payload, but not its ID or
+// timestamp, which say nothing about its meaning.
+func EventEmbeddingText(e Event) string {
+	text := e.Type + " " + e.Source + " " + e.Severity.String()
+	if len(e.Payload) > 0 {
+		payload, _ := json.Marshal(e.Payload)
+		text += " " + string(payload)
+	}
+	if len(text) > embeddingTextLimit {
+		// cut on a rune boundary, so that the text stays valid UTF-8
+		cut := embeddingTextLimit
+		for cut > 0 && !utf8.RuneStart(text[cut]) {
+			cut--
+		}
+		text = text[:cut]
+	}
+	return text
+}
+
+// FormatVector formats a vector in the text representation of pgvector, e.g. [0.1,0.2], for passing it as a query
+// parameter cast to vector.
+func FormatVector(v []float32) string {
+	var b strings.Builder
+	b.WriteByte('[')
+	for i, x := range v {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(strconv.FormatFloat(float64(x), 'g', -1, 32))
+	}
+	b.WriteByte(']')
+	return b.String()
+}
+
+// FakeEmbeddingProvider embeds texts locally and deterministically by hashing their words and word pairs into the
+// vector, so that texts sharing words are similar. It needs no model, for tests and local runs.
+type FakeEmbeddingProvider struct{}
+
+func (FakeEmbeddingProvider) Model() string { return "fake-hashing" }
+
+func (FakeEmbeddingProvider) Embed(_ context.Context, texts []string) ([][]float32, error) {
+	vectors := make([][]float32, len(texts))
+	for i, text := range texts {
+		vectors[i] = hashingEmbedding(text)
+	}
+	return vectors, nil
+}
+
+func hashingEmbedding(text string) []float32 {
+	v := make([]float32, EmbeddingDimensions)
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	add := func(feature string, weight float32) {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(feature))
+		sum := h.Sum64()
+		// the sign comes from another bit of the hash, so that colliding features don't only add up
+		if sum&(1<<63) != 0 {
+			weight = -weight
+		}
+		v[sum%EmbeddingDimensions] += weight
+	}
+	for i, word := range words {
+		add(word, 1)
+		if i > 0 {
+			add(words[i-1]+" "+word, 0.5)
+		}
+	}
+	normalize(v)
+	return v
+}
+
+func normalize(v []float32) {
+	var sum float64
+	for _, x := range v {
+		sum += float64(x) * float64(x)
+	}
+	if sum == 0 {
+		return
+	}
+	norm := float32(math.Sqrt(sum))
+	for i := range v {
+		v[i] /= norm
+	}
+}
+
+// OpenAIEmbeddingProvider calls any OpenAI-compatible embeddings API (OpenAI, vLLM, Ollama, ...). The vectors are
+// requested at EmbeddingDimensions, which models that can't shorten theirs must already have.
+type OpenAIEmbeddingProvider struct {
+	baseURL string
+	apiKey  string
+	model   string
+	client  *http.Client
+}
+
+func (o *OpenAIEmbeddingProvider) Model() string { return o.model }
+
+func (o *OpenAIEmbeddingProvider) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	body, err := json.Marshal(map[string]any{
+		"model":           o.model,
+		"input":           texts,
+		"dimensions":      EmbeddingDimensions,
+		"encoding_format": "float",
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.baseURL+"/embeddings", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if o.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+o.apiKey)
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		errBody, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("embeddings api error: status %d: %s", resp.StatusCode, strings.TrimSpace(string(errBody)))
+	}
+
+	var parsed struct {
+		Data []struct {
+			Index     int       `json:"index"`
+			Embedding []float32 `json:"embedding"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&parsed); err != nil {
+		return nil, fmt.Errorf("decode embeddings response: %w", err)
+	}
+	if len(parsed.Data) != len(texts) {
+		return nil, fmt.Errorf("embeddings api returned %d vectors for %d texts", len(parsed.Data), len(texts))
+	}
+	vectors := make([][]float32, len(texts))
+	for _, d := range parsed.Data {
+		if d.Index < 0 || d.Index >= len(texts) {
+			return nil, fmt.Errorf("embeddings api returned an out of range index %d", d.Index)
+		}
+		if vectors[d.Index] != nil {
+			return nil, fmt.Errorf("embeddings api returned index %d twice", d.Index)
+		}
+		if len(d.Embedding) != EmbeddingDimensions {
+			return nil, fmt.Errorf("model %s returned %d dimensions, expected %d", o.model, len(d.Embedding), EmbeddingDimensions)
+		}
+		vectors[d.Index] = d.Embedding
+	}
+	return vectors, nil
+}
@@ -0,0 +1,131 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func cosine(a, b []float32) float64 {
+	var dot float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+	}
+	return dot // the fake vectors are normalized
+}
+
+func TestFakeEmbeddingsAreDeterministicAndSimilarByWords(t *testing.T) {
+	p, err := NewEmbeddingProvider(EmbeddingConfig{Provider: EmbeddingProviderFake})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vectors, err := p.Embed(context.Background(), []string{
+		"login_failed auth user admin from 10.0.0.4",
+		"login_failed auth user root from 10.0.0.9",
+		"disk usage above threshold on db-01",
+		"login_failed auth user admin from 10.0.0.4",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vectors[0]) != EmbeddingDimensions {
+		t.Fatalf("got %d dimensions, want %d", len(vectors[0]), EmbeddingDimensions)
+	}
+	if cosine(vectors[0], vectors[3]) < 0.999 {
+		t.Error("the same text embedded differently")
+	}
+	if similar, unrelated := cosine(vectors[0], vectors[1]), cosine(vectors[0], vectors[2]); similar <= unrelated {
+		t.Errorf("similar texts at %.2f, unrelated ones at %.2f", similar, unrelated)
+	}
+}
+
+func TestNewEmbeddingProviderDisabled(t *testing.T) {
+	p, err := NewEmbeddingProvider(EmbeddingConfig{})
+	if p != nil || err != nil {
+		t.Errorf("expected no provider, got %v, %v", p, err)
+	}
+	if _, err := NewEmbeddingProvider(EmbeddingConfig{Provider: "word2vec"}); err == nil {
+		t.Error("expected an unknown provider to be rejected")
+	}
+}
+
+func TestOpenAIEmbeddingProvider(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Model      string   `json:"model"`
+			Input      []string `json:"input"`
+			Dimensions int      `json:"dimensions"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || r.URL.Path != "/v1/embeddings" {
+			t.Errorf("unexpected request %s: %v", r.URL.Path, err)
+		}
+		if req.Model != "nomic-embed-text" || req.Dimensions != EmbeddingDimensions {
+			t.Errorf("unexpected model %q or dimensions %d", req.Model, req.Dimensions)
+		}
+		// answered out of order, as the API allows
+		type datum struct {
+			Index     int       `json:"index"`
+			Embedding []float32 `json:"embedding"`
+		}
+		data := make([]datum, len(req.Input))
+		for i := range req.Input {
+			v := make([]float32, EmbeddingDimensions)
+			v[i] = 1
+			data[len(req.Input)-1-i] = datum{Index: i, Embedding: v}
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"data": data})
+	}))
+	defer srv.Close()
+
+	p, err := NewEmbeddingProvider(EmbeddingConfig{Provider: EmbeddingProviderOpenAI, BaseURL: srv.URL + "/v1/", Model: "nomic-embed-text"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vectors, err := p.Embed(context.Background(), []string{"a", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vectors[0][0] != 1 || vectors[1][1] != 1 {
+		t.Error("vectors not matched to their inputs by index")
+	}
+}
+
+func TestOpenAIEmbeddingProviderRejectsDuplicateIndexes(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v := make([]float32, EmbeddingDimensions)
+		_ = json.NewEncoder(w).Encode(map[string]any{"data": []map[string]any{
+			{"index": 0, "embedding": v},
+			{"index": 0, "embedding": v},
+		}})
+	}))
+	defer srv.Close()
+
+	p, err := NewEmbeddingProvider(EmbeddingConfig{Provider: EmbeddingProviderOpenAI, BaseURL: srv.URL, Model: "m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Embed(context.Background(), []string{"a", "b"}); err == nil {
+		t.Error("expected a response missing an index to be rejected")
+	}
+}
+
+func TestEventEmbeddingTextStaysValidUTF8(t *testing.T) {
+	// padded so that the limit falls on every byte of a multi-byte rune
+	for pad := range 3 {
+		payload := map[string]any{"text": strings.Repeat("a", pad) + strings.Repeat("€", embeddingTextLimit)}
+		text := EventEmbeddingText(Event{Type: "note", Payload: payload})
+		if len(text) > embeddingTextLimit || !utf8.ValidString(text) {
+			t.Errorf("truncated to %d bytes, valid UTF-8: %v", len(text), utf8.ValidString(text))
+		}
+	}
+}
+
+func TestFormatVector(t *testing.T) {
+	if got := FormatVector([]float32{0.5, -1, 0}); got != "[0.5,-1,0]" {
+		t.Errorf("FormatVector = %s", got)
+	}
+}
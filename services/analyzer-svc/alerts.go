@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/andreionoie/llm-event-analysis/pkg/common"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	alertChannelWebhook = "webhook"
+	alertChannelSlack   = "slack"
+	alertChannelSMTP    = "smtp"
+
+	alertDispatchTimeout = 5 * time.Minute
+	alertShutdownGrace   = 10 * time.Second
+)
+
+// alertPriorities are the finding priorities that can raise an alert at all; routes narrow them down further.
+var alertPriorities = []string{"P1", "P2"}
+
+const (
+	defaultAlertSubject = `[{{.Finding.Priority}}] {{.Finding.Category}}: {{truncate .Finding.Summary 80}}`
+	defaultAlertText    = `[{{.Finding.Priority}}] {{.Finding.Category}}: {{.Finding.Summary}}
+Triage job {{.JobID}}, events {{timeFmt .TimeRange.Start}} - {{timeFmt .TimeRange.End}}
+Evidence: {{join .Finding.EventIDs ", "}}`
+)
+
+// AlertsConfig is loaded from the YAML file at ALERTS_CONFIG. ${VAR} references are expanded from the environment,
+// so that secrets don't have to be stored in the file.
+type AlertsConfig struct {
+	Channels []AlertChannelConfig `yaml:"channels"`
+	Routes   []AlertRoute         `yaml:"routes"`
+	Retry    AlertRetryConfig     `yaml:"retry"`
+}
+
+type AlertChannelConfig struct {
+	Name string `yaml:"name"`
+	Type string `yaml:"type"` // webhook, slack or smtp
+
+	URL    string `yaml:"url"`    // webhook and slack
+	Secret string `yaml:"secret"` // webhook: HMAC-SHA256 signing key
+
+	SMTP AlertSMTPConfig `yaml:"smtp"`
+
+	// text/template over Alert; defaults to a one-line summary with the evidence
+	Subject string `yaml:"subject"` // smtp only
+	Text    string `yaml:"text"`
+}
+
+type AlertSMTPConfig struct {
+	Addr     string   `yaml:"addr"` // host:port
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"`
+	From     string   `yaml:"from"`
+	To       []string `yaml:"to"`
+}
+
+// AlertRoute sends matching findings to its channels. Empty priorities or categories match any.
+type AlertRoute struct {
+	Priorities []string `yaml:"priorities"`
+	Categories []string `yaml:"categories"`
+	Channels   []string `yaml:"channels"`
+}
+
+type AlertRetryConfig struct {
+	MaxAttempts    int           `yaml:"max_attempts"`
+	InitialBackoff time.Duration `yaml:"initial_backoff"`
+	MaxBackoff     time.Duration `yaml:"max_backoff"`
+}
+
+// Alert is a high-priority finding of a triage job, as passed to the message templates.
+type Alert struct {
+	JobID      string           `json:"job_id"`
+	ScheduleID string           `json:"schedule_id,omitempty"`
+	TimeRange  common.TimeRange `json:"time_range"`
+	Finding    TriageFinding    `json:"finding"`
+	Text       string           `json:"text"` // rendered message
+	CreatedAt  time.Time        `json:"created_at"`
+}
+
+// alertChannel delivers an alert once; retries are handled by the Alerter.
+type alertChannel interface {
+	Send(ctx context.Context, alert *Alert) error
+}
+
+// permanentError marks delivery errors that retrying won't fix, like a rejected request.
+type permanentError struct{ err error }
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+type Alerter struct {
+	channels map[string]alertChannel
+	texts    map[string]*template.Template
+	routes   []AlertRoute
+	retry    AlertRetryConfig
+
+	// background deliveries, cancelled by Shutdown
+	wg     sync.WaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func loadAlerter(path string) (*Alerter, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg AlertsConfig
+	if err := yaml.Unmarshal([]byte(os.ExpandEnv(string(raw))), &cfg); err != nil {
+		return nil, fmt.Errorf("parse alerts config: %w", err)
+	}
+	return newAlerter(cfg)
+}
+
+func newAlerter(cfg AlertsConfig) (*Alerter, error) {
+	a := &Alerter{
+		channels: map[string]alertChannel{},
+		texts:    map[string]*template.Template{},
+		routes:   cfg.Routes,
+		retry:    cfg.Retry,
+	}
+	a.ctx, a.cancel = context.WithCancel(context.Background())
+	if a.retry.MaxAttempts <= 0 {
+		a.retry.MaxAttempts = 5
+	}
+	if a.retry.InitialBackoff <= 0 {
+		a.retry.InitialBackoff = time.Second
+	}
+	if a.retry.MaxBackoff <= 0 {
+		a.retry.MaxBackoff = 30 * time.Second
+	}
+
+	for _, ch := range cfg.Channels {
+		if ch.Name == "" {
+			return nil, fmt.Errorf("alert channel without name")
+		}
+		if _, ok := a.channels[ch.Name]; ok {
+			return nil, fmt.Errorf("duplicate alert channel %q", ch.Name)
+		}
+
+		text, err := parseAlertTemplate(ch.Name, ch.Text, defaultAlertText)
+		if err != nil {
+			return nil, err
+		}
+		a.texts[ch.Name] = text
+
+		switch ch.Type {
+		case alertChannelWebhook:
+			if ch.URL == "" {
+				return nil, fmt.Errorf("alert channel %q: url is required", ch.Name)
+			}
+			a.channels[ch.Name] = newWebhookChannel(ch.URL, ch.Secret)
+		case alertChannelSlack:
+			if ch.URL == "" {
+				return nil, fmt.Errorf("alert channel %q: url is required", ch.Name)
+			}
+			a.channels[ch.Name] = newSlackChannel(ch.URL)
+		case alertChannelSMTP:
+			if ch.SMTP.Addr == "" || ch.SMTP.From == "" || len(ch.SMTP.To) == 0 {
+				return nil, fmt.Errorf("alert channel %q: smtp addr, from and to are required", ch.Name)
+			}
+			subject, err := parseAlertTemplate(ch.Name+"-subject", ch.Subject, defaultAlertSubject)
+			if err != nil {
+				return nil, err
+			}
+			a.channels[ch.Name] = newSMTPChannel(ch.SMTP, subject)
+		default:
+			return nil, fmt.Errorf("alert channel %q: unknown type %q", ch.Name, ch.Type)
+		}
+	}
+
+	for i, route := range cfg.Routes {
+		if len(route.Channels) == 0 {
+			return nil, fmt.Errorf("alert route %d has no channels", i)
+		}
+		for _, name := range route.Channels {
+			if _, ok := a.channels[name]; !ok {
+				return nil, fmt.Errorf("alert route %d: unknown channel %q", i, name)
+			}
+		}
+	}
+
+	return a, nil
+}
+
+func parseAlertTemplate(name, text, fallback string) (*template.Template, error) {
+	if strings.TrimSpace(text) == "" {
+		text = fallback
+	}
+	tmpl, err := template.New(name).Funcs(alertFuncMap()).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("alert channel %q: parse template: %w", name, err)
+	}
+	return tmpl, nil
+}
+
+func alertFuncMap() template.FuncMap {
+	funcs := promptFuncMap()
+	funcs["join"] = strings.Join
+	return funcs
+}
+
+// channelsFor returns the channels the finding is routed to, each at most once.
+func (a *Alerter) channelsFor(f TriageFinding) []string {
+	if !slices.Contains(alertPriorities, f.Priority) {
+		return nil
+	}
+
+	var names []string
+	for _, route := range a.routes {
+		if len(route.Priorities) > 0 && !slices.Contains(route.Priorities, f.Priority) {
+			continue
+		}
+		if len(route.Categories) > 0 && !slices.ContainsFunc(route.Categories, func(c string) bool {
+			return strings.EqualFold(c, f.Category)
+		}) {
+			continue
+		}
+		for _, name := range route.Channels {
+			if !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// Notify alerts on the job's high-priority findings. Scheduled runs only alert on findings that are new since the
+// previous run, so that a persisting finding doesn't alert every time the schedule fires.
+func (a *Alerter) Notify(ctx context.Context, job *TriageJob) {
+	if a == nil {
+		return
+	}
+
+	findings := job.Findings
+	if job.Diff != nil {
+		findings = job.Diff.New
+	}
+
+	byChannel := map[string][]*Alert{}
+	for _, f := range findings {
+		for _, name := range a.channelsFor(f) {
+			byChannel[name] = append(byChannel[name], &Alert{
+				JobID:      job.ID,
+				ScheduleID: job.ScheduleID,
+				TimeRange:  job.TimeRange,
+				Finding:    f,
+				CreatedAt:  time.Now().UTC(),
+			})
+		}
+	}
+
+	// channels are delivered to concurrently, so that a slow or failing one doesn't hold up the others; each channel
+	// still gets its alerts in order
+	var wg sync.WaitGroup
+	for name, alerts := range byChannel {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, alert := range alerts {
+				if err := a.deliver(ctx, name, alert); err != nil {
+					slog.Error("failed to deliver alert", "channel", name, "job_id", job.ID,
+						"priority", alert.Finding.Priority, "category", alert.Finding.Category, "error", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Shutdown waits for the background deliveries, and cancels the ones still running after the grace period.
+func (a *Alerter) Shutdown(grace time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		a.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(grace):
+		slog.Warn("cancelling alert deliveries still running at shutdown")
+		a.cancel()
+		<-done
+	}
+	a.cancel()
+}
+
+// deliver renders the alert for the channel and sends it, retrying transient failures with exponential backoff.
+func (a *Alerter) deliver(ctx context.Context, name string, alert *Alert) error {
+	var text bytes.Buffer
+	if err := a.texts[name].Execute(&text, alert); err != nil {
+		return fmt.Errorf("render alert: %w", err)
+	}
+	alert.Text = strings.TrimSpace(text.String())
+
+	backoff := a.retry.InitialBackoff
+	var err error
+	for attempt := 1; attempt <= a.retry.MaxAttempts; attempt++ {
+		if err = a.channels[name].Send(ctx, alert); err == nil {
+			slog.Info("alert delivered", "channel", name, "job_id", alert.JobID, "attempt", attempt)
+			return nil
+		}
+		var permanent *permanentError
+		if errors.As(err, &permanent) || attempt == a.retry.MaxAttempts {
+			break
+		}
+
+		slog.Warn("alert delivery failed, retrying", "channel", name, "attempt", attempt, "error", err)
+		// full jitter, so that many alerts failing together don't retry in lockstep
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(rand.Int64N(int64(backoff)) + 1)):
+		}
+		backoff = min(backoff*2, a.retry.MaxBackoff)
+	}
+	return err
+}
+
+// notifyTriageAlerts alerts in the background, so that slow channels don't hold up the job. The delivery outlives the
+// job, but not the alerter: it is tracked until Shutdown.
+func (s *Server) notifyTriageAlerts(ctx context.Context, job *TriageJob) {
+	if s.alerts == nil || job.Status != "complete" {
+		return
+	}
+	s.alerts.wg.Add(1)
+	go func() {
+		defer s.alerts.wg.Done()
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), alertDispatchTimeout)
+		defer cancel()
+		stop := context.AfterFunc(s.alerts.ctx, cancel)
+		defer stop()
+		s.alerts.Notify(ctx, job)
+	}()
+}
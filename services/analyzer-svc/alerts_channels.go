@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	alertSignatureHeader = "X-Signature-256"
+	alertHTTPTimeout     = 10 * time.Second
+	alertErrorBodyLimit  = 512
+)
+
+var alertHTTPRequests = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "analyzer_alert_http_requests_total",
+		Help: "HTTP requests made by the webhook and Slack alert channels, partitioned by host and status code",
+	},
+	[]string{"host", "status"},
+)
+
+// webhookChannel posts the alert as JSON. With a secret, the body is signed with HMAC-SHA256 and the signature sent
+// as "sha256=<hex>" in the X-Signature-256 header.
+type webhookChannel struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+func newWebhookChannel(url, secret string) *webhookChannel {
+	return &webhookChannel{url: url, secret: secret, client: newAlertHTTPClient()}
+}
+
+func (w *webhookChannel) Send(ctx context.Context, alert *Alert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return &permanentError{err}
+	}
+
+	headers := map[string]string{}
+	if w.secret != "" {
+		headers[alertSignatureHeader] = signAlertBody(w.secret, body)
+	}
+	return postAlert(ctx, w.client, w.url, body, headers)
+}
+
+func signAlertBody(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// slackChannel posts to a Slack incoming webhook, or anything accepting the same {"text": ...} payload.
+type slackChannel struct {
+	url    string
+	client *http.Client
+}
+
+func newSlackChannel(url string) *slackChannel {
+	return &slackChannel{url: url, client: newAlertHTTPClient()}
+}
+
+func (s *slackChannel) Send(ctx context.Context, alert *Alert) error {
+	body, err := json.Marshal(map[string]string{"text": alert.Text})
+	if err != nil {
+		return &permanentError{err}
+	}
+	return postAlert(ctx, s.client, s.url, body, nil)
+}
+
+func newAlertHTTPClient() *http.Client {
+	return &http.Client{
+		Timeout: alertHTTPTimeout,
+		Transport: &loggingRoundTripper{
+			base:     http.DefaultTransport,
+			logger:   slog.Default().With("component", "alerts_http"),
+			name:     "alert",
+			requests: alertHTTPRequests,
+		},
+	}
+}
+
+// postAlert posts a JSON body. Server errors and rate limiting are retryable, other non-2xx responses are not.
+func postAlert(ctx context.Context, client *http.Client, url string, body []byte, headers map[string]string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return &permanentError{err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, alertErrorBodyLimit))
+	err = fmt.Errorf("alert endpoint returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return err
+	}
+	return &permanentError{err}
+}
+
+// smtpSendFunc matches sendMail, and is replaced in tests.
+type smtpSendFunc func(ctx context.Context, addr string, auth smtp.Auth, from string, to []string, msg []byte) error
+
+type smtpChannel struct {
+	cfg     AlertSMTPConfig
+	subject *template.Template
+	send    smtpSendFunc
+}
+
+func newSMTPChannel(cfg AlertSMTPConfig, subject *template.Template) *smtpChannel {
+	return &smtpChannel{cfg: cfg, subject: subject, send: sendMail}
+}
+
+func (m *smtpChannel) Send(ctx context.Context, alert *Alert) error {
+	var subject bytes.Buffer
+	if err := m.subject.Execute(&subject, alert); err != nil {
+		return &permanentError{fmt.Errorf("render alert subject: %w", err)}
+	}
+
+	var auth smtp.Auth
+	if m.cfg.Username != "" {
+		host, _, _ := net.SplitHostPort(m.cfg.Addr)
+		auth = smtp.PlainAuth("", m.cfg.Username, m.cfg.Password, host)
+	}
+
+	msg := buildAlertEmail(m.cfg.From, m.cfg.To, strings.TrimSpace(subject.String()), alert.Text)
+
+	return m.send(ctx, m.cfg.Addr, auth, m.cfg.From, m.cfg.To, msg)
+}
+
+// sendMail is smtp.SendMail bound to a context: the connection is closed as soon as the context is done, so that a
+// stuck server can't keep the delivery running past it.
+func sendMail(ctx context.Context, addr string, auth smtp.Auth, from string, to []string, msg []byte) (err error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer func() {
+		// errors of a connection closed by the context are reported as such
+		if !stop() && err != nil {
+			err = ctx.Err()
+		}
+	}()
+
+	host, _, _ := net.SplitHostPort(addr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if auth != nil {
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func buildAlertEmail(from string, to []string, subject, body string) []byte {
+	// header values must not contain line breaks
+	subject = strings.Join(strings.Fields(subject), " ")
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	msg.WriteString("\r\n")
+	return msg.Bytes()
+}
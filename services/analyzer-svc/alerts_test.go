@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andreionoie/llm-event-analysis/pkg/common"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// alertStub records the requests it receives, answering with the given statuses in order, then 200.
+type alertStub struct {
+	mu       sync.Mutex
+	statuses []int
+	bodies   [][]byte
+	headers  []http.Header
+}
+
+func (a *alertStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.bodies = append(a.bodies, body)
+	a.headers = append(a.headers, r.Header.Clone())
+	status := http.StatusOK
+	if len(a.statuses) > 0 {
+		status, a.statuses = a.statuses[0], a.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+func newTestAlerter(t *testing.T, channels []AlertChannelConfig, routes []AlertRoute) *Alerter {
+	t.Helper()
+	a, err := newAlerter(AlertsConfig{
+		Channels: channels,
+		Routes:   routes,
+		Retry:    AlertRetryConfig{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func testAlertJob(findings ...TriageFinding) *TriageJob {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	return &TriageJob{
+		ID:        "job-1",
+		TimeRange: common.TimeRange{Start: start, End: start.Add(15 * time.Minute)},
+		Status:    "complete",
+		Findings:  findings,
+	}
+}
+
+func TestWebhookAlertIsSignedAndRetried(t *testing.T) {
+	stub := &alertStub{statuses: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}}
+	srv := httptest.NewServer(stub)
+	defer srv.Close()
+
+	a := newTestAlerter(t,
+		[]AlertChannelConfig{{Name: "hook", Type: alertChannelWebhook, URL: srv.URL, Secret: "s3cret"}},
+		[]AlertRoute{{Channels: []string{"hook"}}},
+	)
+	a.Notify(context.Background(), testAlertJob(
+		TriageFinding{Priority: "P1", Category: "ransomware", Summary: "files encrypted", EventIDs: []string{"e1", "e2"}},
+	))
+
+	if len(stub.bodies) != 3 {
+		t.Fatalf("expected 2 retries before success, got %d requests", len(stub.bodies))
+	}
+	body := stub.bodies[2]
+	if got, want := stub.headers[2].Get(alertSignatureHeader), signAlertBody("s3cret", body); got != want {
+		t.Errorf("signature = %q, want %q", got, want)
+	}
+
+	var alert Alert
+	if err := json.Unmarshal(body, &alert); err != nil {
+		t.Fatal(err)
+	}
+	if alert.JobID != "job-1" || alert.Finding.Category != "ransomware" {
+		t.Errorf("unexpected payload %+v", alert)
+	}
+	if !strings.Contains(alert.Text, "[P1] ransomware: files encrypted") || !strings.Contains(alert.Text, "e1, e2") {
+		t.Errorf("unexpected text %q", alert.Text)
+	}
+}
+
+func TestSlackAlertTemplateAndNoRetryOnClientError(t *testing.T) {
+	stub := &alertStub{statuses: []int{http.StatusBadRequest}}
+	srv := httptest.NewServer(stub)
+	defer srv.Close()
+
+	a := newTestAlerter(t,
+		[]AlertChannelConfig{{Name: "slack", Type: alertChannelSlack, URL: srv.URL, Text: "{{.Finding.Priority}} in job {{.JobID}}"}},
+		[]AlertRoute{{Channels: []string{"slack"}}},
+	)
+	a.Notify(context.Background(), testAlertJob(TriageFinding{Priority: "P2", Category: "malware"}))
+
+	if len(stub.bodies) != 1 {
+		t.Fatalf("client errors should not be retried, got %d requests", len(stub.bodies))
+	}
+	var payload map[string]string
+	_ = json.Unmarshal(stub.bodies[0], &payload)
+	if payload["text"] != "P2 in job job-1" {
+		t.Errorf("unexpected slack payload %v", payload)
+	}
+	// deliveries are counted apart from the LLM requests
+	host := strings.TrimPrefix(srv.URL, "http://")
+	if got := testutil.ToFloat64(alertHTTPRequests.WithLabelValues(host, "400")); got != 1 {
+		t.Errorf("counted %v alert requests, want 1", got)
+	}
+	if got := testutil.ToFloat64(llmHTTPRequests.WithLabelValues(host, "400")); got != 0 {
+		t.Errorf("alert request counted as %v llm requests", got)
+	}
+}
+
+func TestAlertRouting(t *testing.T) {
+	hook := AlertChannelConfig{Type: alertChannelWebhook, URL: "http://localhost"}
+	channels := []AlertChannelConfig{hook, hook, hook}
+	channels[0].Name, channels[1].Name, channels[2].Name = "pager", "soc", "malware-team"
+
+	a := newTestAlerter(t, channels, []AlertRoute{
+		{Priorities: []string{"P1"}, Channels: []string{"pager", "soc"}},
+		{Priorities: []string{"P1", "P2"}, Channels: []string{"soc"}},
+		{Categories: []string{"Malware"}, Channels: []string{"malware-team"}},
+	})
+
+	cases := []struct {
+		finding TriageFinding
+		want    []string
+	}{
+		{TriageFinding{Priority: "P1", Category: "exfiltration"}, []string{"pager", "soc"}},
+		{TriageFinding{Priority: "P2", Category: "malware"}, []string{"soc", "malware-team"}},
+		{TriageFinding{Priority: "P3", Category: "malware"}, nil}, // below alerting priority
+	}
+	for _, tc := range cases {
+		if got := a.channelsFor(tc.finding); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("channelsFor(%s %s) = %v, want %v", tc.finding.Priority, tc.finding.Category, got, tc.want)
+		}
+	}
+}
+
+func TestScheduledRunsOnlyAlertOnNewFindings(t *testing.T) {
+	stub := &alertStub{}
+	srv := httptest.NewServer(stub)
+	defer srv.Close()
+
+	a := newTestAlerter(t,
+		[]AlertChannelConfig{{Name: "slack", Type: alertChannelSlack, URL: srv.URL}},
+		[]AlertRoute{{Channels: []string{"slack"}}},
+	)
+	persisting := TriageFinding{Priority: "P1", Category: "brute_force", Summary: "ongoing"}
+	fresh := TriageFinding{Priority: "P2", Category: "exfiltration", Summary: "new upload"}
+	job := testAlertJob(persisting, fresh)
+	job.Diff = &TriageDiff{New: []TriageFinding{fresh}, Persisting: []TriageFinding{persisting}}
+
+	a.Notify(context.Background(), job)
+	if len(stub.bodies) != 1 || !strings.Contains(string(stub.bodies[0]), "new upload") {
+		t.Errorf("expected a single alert for the new finding, got %d", len(stub.bodies))
+	}
+}
+
+func TestSMTPAlert(t *testing.T) {
+	a := newTestAlerter(t,
+		[]AlertChannelConfig{{
+			Name: "mail",
+			Type: alertChannelSMTP,
+			SMTP: AlertSMTPConfig{Addr: "smtp.example.com:587", From: "lea@example.com", To: []string{"soc@example.com"}},
+		}},
+		[]AlertRoute{{Channels: []string{"mail"}}},
+	)
+
+	var gotTo []string
+	var gotMsg string
+	a.channels["mail"].(*smtpChannel).send = func(_ context.Context, addr string, auth smtp.Auth, from string, to []string, msg []byte) error {
+		gotTo, gotMsg = to, string(msg)
+		return nil
+	}
+
+	a.Notify(context.Background(), testAlertJob(TriageFinding{Priority: "P1", Category: "ransomware", Summary: "files\nencrypted"}))
+
+	if !reflect.DeepEqual(gotTo, []string{"soc@example.com"}) {
+		t.Errorf("unexpected recipients %v", gotTo)
+	}
+	if !strings.Contains(gotMsg, "Subject: [P1] ransomware: files encrypted\r\n") {
+		t.Errorf("unexpected message:\n%s", gotMsg)
+	}
+}
+
+func TestAlertShutdownCancelsStuckDelivery(t *testing.T) {
+	stuck := &alertStub{}
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release // doesn't answer before the end of the test
+	}))
+	defer slow.Close()
+	defer close(release)
+	fast := httptest.NewServer(stuck)
+	defer fast.Close()
+
+	s := &Server{alerts: newTestAlerter(t,
+		[]AlertChannelConfig{
+			{Name: "slow", Type: alertChannelWebhook, URL: slow.URL},
+			{Name: "fast", Type: alertChannelWebhook, URL: fast.URL},
+		},
+		[]AlertRoute{{Channels: []string{"slow", "fast"}}},
+	)}
+	s.notifyTriageAlerts(context.Background(), testAlertJob(TriageFinding{Priority: "P1", Category: "ransomware"}))
+
+	// the fast channel is not held up by the slow one
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stuck.mu.Lock()
+		n := len(stuck.bodies)
+		stuck.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("fast channel got no alert")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.alerts.Shutdown(50 * time.Millisecond)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown did not cancel the stuck delivery")
+	}
+}
+
+func TestSendMailHonoursContext(t *testing.T) {
+	// a server that accepts connections but never greets
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = sendMail(ctx, ln.Addr().String(), nil, "lea@example.com", []string{"soc@example.com"}, []byte("hi"))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the deadline to end the delivery, got %v", err)
+	}
+}
+
+func TestNewAlerterRejectsUnknownChannel(t *testing.T) {
+	_, err := newAlerter(AlertsConfig{Routes: []AlertRoute{{Channels: []string{"missing"}}}})
+	if err == nil {
+		t.Error("expected route to unknown channel to be rejected")
+	}
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"log/slog"
 	"math/rand"
 	"net/http"
@@ -8,6 +11,7 @@ import (
 
 	"github.com/andreionoie/llm-event-analysis/pkg/common"
 	"github.com/labstack/echo/v4"
+	"google.golang.org/genai"
 )
 
 const eventsSampleLimit = 5
@@ -16,59 +20,177 @@ type AnalyzeRequest struct {
 	Question  string            `json:"question"`
 	MaxEvents int               `json:"max_events,omitempty"`
 	TimeRange *common.TimeRange `json:"time_range,omitempty"`
+	Filter    *EventFilter      `json:"filter,omitempty"`
+	// answer with claims citing the events they are based on, see AnalyzeResponse.Claims
+	Structured bool `json:"structured,omitempty"`
+	// pick the events closest in meaning to the question rather than the newest and most severe ones
+	Semantic bool `json:"semantic,omitempty"`
 }
 
 type AnalyzeResponse struct {
-	Answer       string   `json:"answer"`
-	EventsUsed   int      `json:"events_used"`
-	Cached       bool     `json:"cached,omitempty"`
-	SampleEvents []string `json:"sample_events,omitempty"`
+	Answer        string   `json:"answer"`
+	EventsUsed    int      `json:"events_used"`
+	Cached        bool     `json:"cached,omitempty"`
+	SampleEvents  []string `json:"sample_events,omitempty"`
+	PromptVersion string   `json:"prompt_version,omitempty"` // variant of the analyze prompt that answered
+
+	// structured answers only: the claims with the cited IDs that were in the prompt, and how many cited IDs weren't
+	Claims          []AnalyzeClaim `json:"claims,omitempty"`
+	HallucinatedIDs int            `json:"hallucinated_ids,omitempty"`
+}
+
+// AnalyzeClaim is a statement of a structured answer, with the IDs of the events supporting it.
+type AnalyzeClaim struct {
+	Statement string   `json:"statement"`
+	EventIDs  []string `json:"event_ids"`
+}
+
+var analyzeSchema = &genai.Schema{
+	Type: genai.TypeObject,
+	Properties: map[string]*genai.Schema{
+		"answer": {Type: genai.TypeString, Description: "Concise answer to the question"},
+		"claims": {
+			Type: genai.TypeArray,
+			Items: &genai.Schema{
+				Type: genai.TypeObject,
+				Properties: map[string]*genai.Schema{
+					"statement": {Type: genai.TypeString, Description: "One fact or conclusion of the answer"},
+					"event_ids": {
+						Type:        genai.TypeArray,
+						Items:       &genai.Schema{Type: genai.TypeString},
+						Description: "IDs of the events supporting the statement",
+					},
+				},
+				Required: []string{"statement", "event_ids"},
+			},
+		},
+	},
+	Required: []string{"answer", "claims"},
 }
 
 func (s *Server) handleAnalyze(c echo.Context) error {
+	req, err := bindAnalyzeRequest(c)
+	if err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+
+	// taken before the events are fetched, so that events inserted meanwhile make the cached answer stale
+	watermark := s.analyzeWatermark(ctx, req)
+	if cached := s.getCachedAnalyzeResponse(ctx, req, watermark); cached != nil {
+		cached.Cached = true
+		return c.JSON(http.StatusOK, *cached)
+	}
+
+	events, prompt, err := s.prepareAnalyzePrompt(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	var resp AnalyzeResponse
+	if req.Structured {
+		resp, err = s.generateStructuredAnswer(ctx, prompt, events)
+	} else {
+		resp.Answer, err = s.generateContent(ctx, prompt)
+	}
+	if err != nil {
+		slog.Error("analysis failed", "error", err)
+		return llmHTTPError(err, "analysis failed")
+	}
+	resp.EventsUsed = len(events)
+	resp.SampleEvents = sampleEventIDs(events)
+	resp.PromptVersion = prompt.Config.Version
+
+	s.cacheAnalyzeResponse(ctx, req, watermark, prompt, resp)
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+func bindAnalyzeRequest(c echo.Context) (AnalyzeRequest, error) {
 	var req AnalyzeRequest
 	if err := c.Bind(&req); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "invalid request body")
+		return req, echo.NewHTTPError(http.StatusBadRequest, "invalid request body")
 	}
 	if strings.TrimSpace(req.Question) == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "question is required")
+		return req, echo.NewHTTPError(http.StatusBadRequest, "question is required")
 	}
 	if req.TimeRange != nil {
 		if err := req.TimeRange.Validate(); err != nil {
-			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			return req, echo.NewHTTPError(http.StatusBadRequest, err.Error())
 		}
 	}
-
-	ctx := c.Request().Context()
-
-	if cached := s.getCachedAnalyzeResponse(ctx, req); cached != nil {
-		cached.Cached = true
-		return c.JSON(http.StatusOK, *cached)
+	if err := req.Filter.Validate(); err != nil {
+		return req, echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
+	return req, nil
+}
 
+// prepareAnalyzePrompt fetches the events in scope of the request and renders them into the analyze prompt.
+// Errors are already mapped to HTTP errors.
+func (s *Server) prepareAnalyzePrompt(ctx context.Context, req AnalyzeRequest) ([]common.Event, *PromptPair, error) {
 	maxEvents := req.MaxEvents
 	if maxEvents <= 0 || maxEvents > s.cfg.MaxEvents {
 		maxEvents = s.cfg.MaxEvents
 	}
 
-	events, err := s.fetchEvents(ctx, req.TimeRange, maxEvents)
+	if req.Semantic && s.embedder == nil {
+		return nil, nil, echo.NewHTTPError(http.StatusServiceUnavailable, "embeddings are not configured")
+	}
+
+	q := EventQuery{TimeRange: req.TimeRange, Filter: req.Filter, Limit: maxEvents}
+	var events []common.Event
+	var err error
+	if req.Semantic {
+		events, err = s.semanticContextEvents(ctx, req.Question, q)
+	} else {
+		events, err = s.queryContextEvents(ctx, q)
+	}
 	if err != nil {
 		slog.Error("failed to fetch events", "error", err)
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fetch events")
+		return nil, nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to fetch events")
 	}
 
-	prompt, err := s.prompts.RenderAnalyzePrompt(req.Question, events)
+	render := s.prompts.RenderAnalyzePrompt
+	if req.Structured {
+		render = s.prompts.RenderStructuredAnalyzePrompt
+	}
+	prompt, err := render(req.Question, events)
 	if err != nil {
 		slog.Error("analysis failed", "error", err)
-		return echo.NewHTTPError(http.StatusInternalServerError, "analysis failed")
+		return nil, nil, echo.NewHTTPError(http.StatusInternalServerError, "analysis failed")
 	}
+	return events, prompt, nil
+}
 
-	answer, err := s.generateContent(ctx, prompt)
+// generateStructuredAnswer asks for claims citing event IDs, and keeps only the IDs of the events the prompt showed,
+// like triage does with its findings.
+func (s *Server) generateStructuredAnswer(ctx context.Context, prompt *PromptPair, events []common.Event) (AnalyzeResponse, error) {
+	raw, err := s.generateContentWithSchema(ctx, prompt, analyzeSchema)
 	if err != nil {
-		slog.Error("analysis failed", "error", err)
-		return echo.NewHTTPError(http.StatusInternalServerError, "analysis failed")
+		return AnalyzeResponse{}, err
+	}
+	var resp AnalyzeResponse
+	if err := json.Unmarshal([]byte(raw), &resp); err != nil {
+		return AnalyzeResponse{}, fmt.Errorf("failed to parse structured answer: %w", err)
+	}
+
+	validIDs := make(map[string]bool, len(prompt.events))
+	for _, e := range prompt.events {
+		validIDs[e.Id] = true
+	}
+	cited, kept := 0, 0
+	for i := range resp.Claims {
+		cited += len(resp.Claims[i].EventIDs)
+		resp.Claims[i].EventIDs = nonNil(filterValidIDs(resp.Claims[i].EventIDs, validIDs))
+		kept += len(resp.Claims[i].EventIDs)
 	}
+	resp.HallucinatedIDs = cited - kept
+	countCitedIDs(prompt.Config, cited, resp.HallucinatedIDs)
+	return resp, nil
+}
 
+func sampleEventIDs(events []common.Event) []string {
 	samplesCount := min(eventsSampleLimit, len(events))
 	sampleIDs := make([]string, samplesCount)
 	// randomize samples
@@ -78,14 +200,5 @@ func (s *Server) handleAnalyze(c echo.Context) error {
 	for i := range samplesCount {
 		sampleIDs[i] = events[i].Id
 	}
-
-	resp := AnalyzeResponse{
-		Answer:       answer,
-		EventsUsed:   len(events),
-		SampleEvents: sampleIDs,
-	}
-
-	s.cacheAnalyzeResponse(ctx, req, resp)
-
-	return c.JSON(http.StatusOK, resp)
+	return sampleIDs
 }
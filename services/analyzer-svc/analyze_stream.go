@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	sseEventToken = "token"
+	sseEventDone  = "done"
+	sseEventError = "error"
+)
+
+type analyzeStreamToken struct {
+	Text   string `json:"text"`
+	Cached bool   `json:"cached,omitempty"` // the whole answer, served from the cache in a single event
+}
+
+// AnalyzeStreamDone is the final event of a stream, carrying everything from AnalyzeResponse except the answer.
+type AnalyzeStreamDone struct {
+	EventsUsed    int      `json:"events_used"`
+	Cached        bool     `json:"cached"`
+	SampleEvents  []string `json:"sample_events,omitempty"`
+	PromptVersion string   `json:"prompt_version,omitempty"`
+}
+
+// handleAnalyzeStream answers like handleAnalyze, but streams the answer over server-sent events as it is generated.
+func (s *Server) handleAnalyzeStream(c echo.Context) error {
+	req, err := bindAnalyzeRequest(c)
+	if err != nil {
+		return err
+	}
+	if req.Structured {
+		return echo.NewHTTPError(http.StatusBadRequest, "structured answers can't be streamed, use /analyze")
+	}
+
+	ctx := c.Request().Context()
+
+	watermark := s.analyzeWatermark(ctx, req)
+	if cached := s.getCachedAnalyzeResponse(ctx, req, watermark); cached != nil {
+		startSSE(c)
+		if err := writeSSE(c, sseEventToken, analyzeStreamToken{Text: cached.Answer, Cached: true}); err != nil {
+			return nil
+		}
+		_ = writeSSE(c, sseEventDone, AnalyzeStreamDone{
+			EventsUsed:    cached.EventsUsed,
+			Cached:        true,
+			SampleEvents:  cached.SampleEvents,
+			PromptVersion: cached.PromptVersion,
+		})
+		return nil
+	}
+
+	// errors before the first byte is written can still be reported with a regular status code
+	events, prompt, err := s.prepareAnalyzePrompt(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	startSSE(c)
+	answer, err := s.generateContentStream(ctx, prompt, func(chunk string) error {
+		return writeSSE(c, sseEventToken, analyzeStreamToken{Text: chunk})
+	})
+	if err != nil {
+		slog.Error("streaming analysis failed", "error", err)
+		_ = writeSSE(c, sseEventError, map[string]string{"error": llmErrorMessage(err, "analysis failed")})
+		return nil
+	}
+
+	resp := AnalyzeResponse{
+		Answer:        answer,
+		EventsUsed:    len(events),
+		SampleEvents:  sampleEventIDs(events),
+		PromptVersion: prompt.Config.Version,
+	}
+	s.cacheAnalyzeResponse(ctx, req, watermark, prompt, resp)
+
+	_ = writeSSE(c, sseEventDone, AnalyzeStreamDone{
+		EventsUsed:    resp.EventsUsed,
+		SampleEvents:  resp.SampleEvents,
+		PromptVersion: resp.PromptVersion,
+	})
+	return nil
+}
+
+func startSSE(c echo.Context) {
+	h := c.Response().Header()
+	h.Set(echo.HeaderContentType, "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Connection", "keep-alive")
+	h.Set("X-Accel-Buffering", "no") // disable proxy buffering (nginx)
+	c.Response().WriteHeader(http.StatusOK)
+	c.Response().Flush()
+}
+
+func writeSSE(c echo.Context, event string, data any) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(c.Response(), "event: %s\ndata: %s\n\n", event, payload); err != nil {
+		return err
+	}
+	c.Response().Flush()
+	return nil
+}
@@ -13,7 +13,27 @@ import (
 )
 
 const analyzeResponseTTL = 30 * time.Minute
-const triageJobTTL = 30 * time.Minute
+const triageJobTTL = 30 * time.Minute // jobs are persisted in postgres, redis only caches them
+
+// DataWatermark identifies the state of the events a cached answer was computed from: events inserted into (or
+// deleted from) the queried range change it.
+type DataWatermark struct {
+	Count         int64     `json:"count"`
+	LastCreatedAt time.Time `json:"last_created_at"`
+}
+
+// Equal compares watermarks, ignoring the time zones the database returned.
+func (w DataWatermark) Equal(other DataWatermark) bool {
+	return w.Count == other.Count && w.LastCreatedAt.Equal(other.LastCreatedAt)
+}
+
+// analyzeCacheEntry is a cached answer, with what it was computed from. It is only served while none of that changed.
+type analyzeCacheEntry struct {
+	Response      AnalyzeResponse `json:"response"`
+	Watermark     DataWatermark   `json:"watermark"`
+	PromptVersion string          `json:"prompt_version"`
+	Model         string          `json:"model"`
+}
 
 func computeAnalyzeCacheKey(req AnalyzeRequest) string {
 	str, err := json.Marshal(req)
@@ -27,9 +47,22 @@ func computeAnalyzeCacheKey(req AnalyzeRequest) string {
 	return fmt.Sprintf("analyze:%s", hashStr[:12])
 }
 
-func (s *Server) getCachedAnalyzeResponse(ctx context.Context, req AnalyzeRequest) *AnalyzeResponse {
+// analyzeWatermark returns the watermark of the events in scope of the request, or nil if it can't be computed, in
+// which case the cache is bypassed.
+func (s *Server) analyzeWatermark(ctx context.Context, req AnalyzeRequest) *DataWatermark {
+	w, err := s.eventsWatermark(ctx, EventQuery{TimeRange: req.TimeRange, Filter: req.Filter})
+	if err != nil {
+		slog.Warn("failed to compute events watermark, bypassing cache", "error", err)
+		return nil
+	}
+	return &w
+}
+
+// getCachedAnalyzeResponse returns the cached answer to the request, if it was computed from the same events, by a
+// prompt variant and model that are still active.
+func (s *Server) getCachedAnalyzeResponse(ctx context.Context, req AnalyzeRequest, watermark *DataWatermark) *AnalyzeResponse {
 	key := computeAnalyzeCacheKey(req)
-	if key == "" {
+	if key == "" || watermark == nil {
 		return nil
 	}
 
@@ -39,17 +72,33 @@ func (s *Server) getCachedAnalyzeResponse(ctx context.Context, req AnalyzeReques
 		return nil
 	}
 
-	var cached AnalyzeResponse
+	var cached analyzeCacheEntry
 	if err := json.Unmarshal([]byte(cachedRaw), &cached); err != nil {
 		slog.Debug("failed to unmarshal cached response", "error", err, "response", cachedRaw)
 		return nil
 	}
+	if !cached.Watermark.Equal(*watermark) {
+		slog.Debug("cached response is stale, events changed", "key", key)
+		return nil
+	}
+	if !s.prompts.isActive("analyze", cached.PromptVersion, cached.Model) {
+		slog.Debug("cached response is stale, prompt changed", "key", key, "version", cached.PromptVersion)
+		return nil
+	}
 
-	return &cached
+	return &cached.Response
 }
 
-func (s *Server) cacheAnalyzeResponse(ctx context.Context, req AnalyzeRequest, resp AnalyzeResponse) {
-	val, err := json.Marshal(resp)
+func (s *Server) cacheAnalyzeResponse(ctx context.Context, req AnalyzeRequest, watermark *DataWatermark, prompt *PromptPair, resp AnalyzeResponse) {
+	if watermark == nil {
+		return
+	}
+	val, err := json.Marshal(analyzeCacheEntry{
+		Response:      resp,
+		Watermark:     *watermark,
+		PromptVersion: prompt.Config.Version,
+		Model:         prompt.Config.Model,
+	})
 	if err != nil {
 		slog.Debug("failed to marshal response for caching", "error", err, "response", resp)
 		return
@@ -66,8 +115,11 @@ func (s *Server) cacheAnalyzeResponse(ctx context.Context, req AnalyzeRequest, r
 	}
 }
 
-func triageResultsCacheKey(tr common.TimeRange) string {
-	data, _ := json.Marshal(tr)
+func triageResultsCacheKey(tr common.TimeRange, filter *EventFilter) string {
+	data, _ := json.Marshal(struct {
+		common.TimeRange
+		Filter *EventFilter `json:"filter,omitempty"`
+	}{tr, filter})
 	hash := sha256.Sum256(data)
 	return "triage:" + hex.EncodeToString(hash[:])[:12]
 }
@@ -109,3 +161,9 @@ func (s *Server) getCachedTriageJobByKey(ctx context.Context, cacheKey string) *
 	}
 	return s.getCachedTriageJob(ctx, jobID)
 }
+
+func (s *Server) invalidateCachedTriageJob(ctx context.Context, jobID string) {
+	if err := s.cache.Del(ctx, triageJobKey(jobID)).Err(); err != nil {
+		slog.Debug("failed to invalidate cached triage job", "job_id", jobID, "error", err)
+	}
+}
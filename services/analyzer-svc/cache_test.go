@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// newTestCache returns a client of an in-memory Redis, closed at the end of the test.
+func newTestCache(t *testing.T) (*redis.Client, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { _ = rdb.Close() })
+	return rdb, mr
+}
+
+func TestCachedAnalyzeResponseRequiresActivePrompt(t *testing.T) {
+	prompts, err := NewPromptLibrary(promptsFS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{prompts: prompts}
+	s.cache, _ = newTestCache(t)
+	ctx := context.Background()
+
+	req := AnalyzeRequest{Question: "what happened?"}
+	watermark := &DataWatermark{Count: 3, LastCreatedAt: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	active := prompts.current().Analyze.Config
+
+	s.cacheAnalyzeResponse(ctx, req, watermark, &PromptPair{Config: active}, AnalyzeResponse{Answer: "cached"})
+	if cached := s.getCachedAnalyzeResponse(ctx, req, watermark); cached == nil || cached.Answer != "cached" {
+		t.Fatalf("expected the cached answer, got %+v", cached)
+	}
+	newer := &DataWatermark{Count: 4, LastCreatedAt: watermark.LastCreatedAt.Add(time.Second)}
+	if cached := s.getCachedAnalyzeResponse(ctx, req, newer); cached != nil {
+		t.Error("answer served although events were added")
+	}
+
+	retired := *active
+	retired.Version = "0.0.0-retired"
+	s.cacheAnalyzeResponse(ctx, req, watermark, &PromptPair{Config: &retired}, AnalyzeResponse{Answer: "cached"})
+	if cached := s.getCachedAnalyzeResponse(ctx, req, watermark); cached != nil {
+		t.Error("answer of an inactive prompt version served")
+	}
+}
+
+func TestAnalyzeCacheInvalidatedByNewEvents(t *testing.T) {
+	db := newTestDB(t)
+	scripted := &scriptedProvider{respond: func(req *LLMRequest) string {
+		return fmt.Sprintf("%d events", strings.Count(req.User, "\n- "))
+	}}
+	prompts, err := NewPromptLibrary(promptsFS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		db:          db,
+		prompts:     prompts,
+		llm:         map[string]LLMProvider{"scripted": scripted},
+		llmDefault:  "scripted",
+		llmBreakers: newLLMBreakers(),
+	}
+	s.cache, _ = newTestCache(t)
+	s.cfg.MaxEvents = 100
+	insertTestEvents(t, s, testEvents())
+
+	if resp := callAnalyze(t, s, "what happened?"); resp.Cached {
+		t.Fatal("first answer can't be cached")
+	}
+	if resp := callAnalyze(t, s, "what happened?"); !resp.Cached {
+		t.Error("unchanged events should be answered from the cache")
+	}
+
+	_, err = db.Exec(context.Background(),
+		`INSERT INTO events (id, timestamp, source, severity, event_type, payload) VALUES ('evt-4', $1, 'auth', 0, 'logout', '{}')`,
+		testEventTime.Add(3*time.Second),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := callAnalyze(t, s, "what happened?"); resp.Cached || resp.EventsUsed != 4 {
+		t.Errorf("expected a fresh answer over the new event, got %+v", resp)
+	}
+	if calls := scripted.calls.Load(); calls != 2 {
+		t.Errorf("LLM called %d times, want 2", calls)
+	}
+}
@@ -4,29 +4,96 @@ import (
 	"context"
 	"encoding/json"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/andreionoie/llm-event-analysis/pkg/common"
+	"github.com/jackc/pgx/v5"
 )
 
 func (s *Server) fetchEvents(ctx context.Context, timeRange *common.TimeRange, limit int) ([]common.Event, error) {
-	query := `SELECT id, timestamp, source, severity, event_type, payload FROM events`
-	var args []any
+	return s.queryEvents(ctx, EventQuery{TimeRange: timeRange, Limit: limit})
+}
 
-	if timeRange != nil {
-		query += ` WHERE timestamp >= $1 AND timestamp <= $2`
-		args = append(args, timeRange.Start, timeRange.End)
+// queryEvents returns a page of events matching the query, ordered by (timestamp, id) descending so that pages can be
+// continued with a keyset cursor.
+func (s *Server) queryEvents(ctx context.Context, q EventQuery) ([]common.Event, error) {
+	conds := q.conditions()
+	query := `SELECT id, timestamp, source, severity, event_type, payload FROM events` + conds.whereClause() +
+		` ORDER BY timestamp DESC, id DESC LIMIT ` + conds.nextPlaceholder()
+	args := append(conds.args, q.Limit)
+
+	rows, err := s.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
 	}
+	return scanEvents(rows, q.Limit)
+}
 
-	query += ` ORDER BY timestamp DESC LIMIT $` + strconv.Itoa(len(args)+1)
-	args = append(args, limit)
+// queryContextEvents returns the candidate events for the context of a prompt: the newest q.Limit events matching the
+// query, and the q.Limit most severe ones at warn and above, so that a burst of info events can't hide them. Newest
+// first, like queryEvents.
+func (s *Server) queryContextEvents(ctx context.Context, q EventQuery) ([]common.Event, error) {
+	newest := q.conditions()
+	severe := q.conditions()
+	severe.add("severity >= %s", int(common.SeverityWarn))
+	limit := severe.nextPlaceholder()
+	query := `(SELECT id, timestamp, source, severity, event_type, payload FROM events` + newest.whereClause() +
+		` ORDER BY timestamp DESC, id DESC LIMIT ` + limit + `)
+		 UNION
+		 (SELECT id, timestamp, source, severity, event_type, payload FROM events` + severe.whereClause() +
+		` ORDER BY severity DESC, timestamp DESC, id DESC LIMIT ` + limit + `)
+		 ORDER BY timestamp DESC, id DESC`
+	args := append(severe.args, q.Limit)
 
 	rows, err := s.db.Query(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
+	return scanEvents(rows, 2*q.Limit)
+}
+
+// fetchEventsByIDs returns the events with the given IDs, newest first. Unknown IDs are skipped.
+func (s *Server) fetchEventsByIDs(ctx context.Context, ids []string) ([]common.Event, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	rows, err := s.db.Query(ctx,
+		`SELECT id, timestamp, source, severity, event_type, payload FROM events
+		 WHERE id = ANY($1)
+		 ORDER BY timestamp DESC`,
+		ids,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanEvents(rows, len(ids))
+}
+
+// eventsWatermark returns the watermark of the events matching the query. Without a time range, only the latest
+// insertion is looked at, since counting every event would be too slow.
+func (s *Server) eventsWatermark(ctx context.Context, q EventQuery) (DataWatermark, error) {
+	var w DataWatermark
+	var last *time.Time
+	conds := q.conditions()
+	var err error
+	if q.TimeRange == nil {
+		err = s.db.QueryRow(ctx, `SELECT max(created_at) FROM events`+conds.whereClause(), conds.args...).Scan(&last)
+	} else {
+		err = s.db.QueryRow(ctx, `SELECT count(*), max(created_at) FROM events`+conds.whereClause(), conds.args...).
+			Scan(&w.Count, &last)
+	}
+	if last != nil {
+		w.LastCreatedAt = last.UTC()
+	}
+	return w, err
+}
+
+func scanEvents(rows pgx.Rows, capacity int) ([]common.Event, error) {
 	defer rows.Close()
 
-	events := make([]common.Event, 0, limit)
+	events := make([]common.Event, 0, capacity)
 	for rows.Next() {
 		var event common.Event
 		var sev int
@@ -110,3 +177,108 @@ func (s *Server) fetchSummaries(ctx context.Context, timeRange *common.TimeRange
 
 	return summaries, rows.Err()
 }
+
+// countEventsByField groups events by one of the whitelisted columns, most frequent values first.
+func (s *Server) countEventsByField(ctx context.Context, timeRange *common.TimeRange, column string, limit int) ([]FieldCount, error) {
+	query := `SELECT ` + column + `::text, COUNT(*) FROM events`
+	var args []any
+
+	if timeRange != nil {
+		query += ` WHERE timestamp >= $1 AND timestamp <= $2`
+		args = append(args, timeRange.Start, timeRange.End)
+	}
+
+	query += ` GROUP BY 1 ORDER BY 2 DESC, 1 LIMIT $` + strconv.Itoa(len(args)+1)
+	args = append(args, limit)
+
+	rows, err := s.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make([]FieldCount, 0, limit)
+	for rows.Next() {
+		var fc FieldCount
+		if err := rows.Scan(&fc.Value, &fc.Count); err != nil {
+			return nil, err
+		}
+		counts = append(counts, fc)
+	}
+	return counts, rows.Err()
+}
+
+// likeEscaper escapes the LIKE wildcards in a value matched literally.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// fetchEventsForEntity returns the newest events mentioning the entity (an IP, user, host, ...) either as their
+// source or anywhere in their payload. The payload match is a LIKE on the payload text, so that it can use the
+// trigram index processor-svc keeps on it.
+func (s *Server) fetchEventsForEntity(ctx context.Context, timeRange *common.TimeRange, entity string, limit int) ([]common.Event, error) {
+	query := `SELECT id, timestamp, source, severity, event_type, payload FROM events
+		WHERE (source = $1 OR payload::text LIKE $2)`
+	args := []any{entity, "%" + likeEscaper.Replace(entity) + "%"}
+
+	if timeRange != nil {
+		query += ` AND timestamp >= $3 AND timestamp <= $4`
+		args = append(args, timeRange.Start, timeRange.End)
+	}
+
+	query += ` ORDER BY timestamp DESC LIMIT $` + strconv.Itoa(len(args)+1)
+	args = append(args, limit)
+
+	rows, err := s.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanEvents(rows, limit)
+}
+
+// aggregateSummaries computes summary buckets on the fly from the events matching a filter, since the pre-computed
+// event_summaries only cover all events. Returns the newest limit buckets, without sample events.
+func (s *Server) aggregateSummaries(ctx context.Context, timeRange *common.TimeRange, filter *EventFilter, limit int) ([]common.EventSummary, error) {
+	bucketSeconds := int(s.cfg.SummaryBucket.Seconds())
+	conds := EventQuery{TimeRange: timeRange, Filter: filter}.conditions()
+	bucketArg := conds.nextPlaceholder()
+	query := `SELECT to_timestamp(floor(extract(epoch FROM timestamp) / ` + bucketArg + `) * ` + bucketArg + `) AS bucket,
+		severity, event_type, COUNT(*)
+		FROM events` + conds.whereClause() + `
+		GROUP BY 1, 2, 3
+		ORDER BY 1 DESC`
+	args := append(conds.args, bucketSeconds)
+
+	rows, err := s.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	summaries := make([]common.EventSummary, 0, limit)
+	for rows.Next() {
+		var bucket time.Time
+		var sev, count int
+		var eventType string
+		if err := rows.Scan(&bucket, &sev, &eventType, &count); err != nil {
+			return nil, err
+		}
+
+		// rows come ordered by bucket, so a new bucket always starts a new summary
+		if n := len(summaries); n == 0 || !summaries[n-1].BucketStart.Equal(bucket) {
+			if n == limit {
+				break
+			}
+			summaries = append(summaries, common.EventSummary{
+				BucketStart: bucket.UTC(),
+				BucketEnd:   bucket.UTC().Add(s.cfg.SummaryBucket),
+				BySeverity:  map[string]int{},
+				ByType:      map[string]int{},
+			})
+		}
+		summary := &summaries[len(summaries)-1]
+		summary.TotalCount += count
+		summary.BySeverity[common.Severity(sev).String()] += count
+		summary.ByType[eventType] += count
+	}
+
+	return summaries, rows.Err()
+}
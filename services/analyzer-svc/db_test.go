@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andreionoie/llm-event-analysis/pkg/common"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// testEventsSchema mirrors the tables owned by processor-svc, which the analyzer only reads.
+const testEventsSchema = `
+CREATE TABLE events (
+    id          TEXT PRIMARY KEY,
+    timestamp   TIMESTAMPTZ NOT NULL,
+    source      TEXT NOT NULL,
+    severity    SMALLINT NOT NULL,
+    event_type  TEXT NOT NULL,
+    payload     JSONB NOT NULL DEFAULT '{}',
+    created_at  TIMESTAMPTZ DEFAULT NOW()
+);
+CREATE TABLE event_summaries (
+    bucket_start  TIMESTAMPTZ NOT NULL PRIMARY KEY,
+    bucket_end    TIMESTAMPTZ NOT NULL,
+    total_count   INT NOT NULL,
+    by_severity   JSONB NOT NULL DEFAULT '{}',
+    by_type       JSONB NOT NULL DEFAULT '{}',
+    sample_events JSONB NOT NULL DEFAULT '[]'
+);`
+
+// newTestDB migrates a schema of its own in the database of TEST_DATABASE_URL, and drops it at the end of the test.
+// Tests that need Postgres are skipped when the variable is not set.
+func newTestDB(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	ctx := context.Background()
+
+	admin, err := pgxpool.New(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := "analyzer_test_" + strings.ReplaceAll(uuid.NewString(), "-", "")[:12]
+	if _, err := admin.Exec(ctx, `CREATE SCHEMA `+schema); err != nil {
+		admin.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.Exec(context.Background(), `DROP SCHEMA `+schema+` CASCADE`); err != nil {
+			t.Logf("failed to drop test schema %s: %v", schema, err)
+		}
+		admin.Close()
+	})
+
+	config, err := pgxpool.ParseConfig(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// public too, for the types of the extensions installed there, like the vector of pgvector
+	config.ConnConfig.RuntimeParams["search_path"] = schema + ", public"
+	db, err := pgxpool.NewWithConfig(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+
+	if _, err := db.Exec(ctx, testEventsSchema); err != nil {
+		t.Fatal(err)
+	}
+	if err := runMigrations(db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+var testEventTime = time.Date(2026, 1, 1, 0, 1, 0, 0, time.UTC)
+
+// insertTestEvents stores the events, and the summary of the 5 minute bucket they fall in.
+func insertTestEvents(t *testing.T, s *Server, events []common.Event) {
+	t.Helper()
+	ctx := context.Background()
+	byType := map[string]int{}
+	bySeverity := map[string]int{}
+	for _, e := range events {
+		payload, _ := json.Marshal(e.Payload)
+		_, err := s.db.Exec(ctx,
+			`INSERT INTO events (id, timestamp, source, severity, event_type, payload) VALUES ($1, $2, $3, $4, $5, $6)`,
+			e.Id, e.Timestamp, e.Source, int(e.Severity), e.Type, payload,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		byType[e.Type]++
+		bySeverity[e.Severity.String()]++
+	}
+	types, _ := json.Marshal(byType)
+	severities, _ := json.Marshal(bySeverity)
+	bucket := testEventTime.Truncate(5 * time.Minute)
+	_, err := s.db.Exec(ctx,
+		`INSERT INTO event_summaries (bucket_start, bucket_end, total_count, by_severity, by_type)
+		 VALUES ($1, $2, $3, $4, $5)`,
+		bucket, bucket.Add(5*time.Minute), len(events), severities, types,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testEvents() []common.Event {
+	return []common.Event{
+		{Id: "evt-1", Timestamp: testEventTime, Source: "edr", Severity: common.SeverityCritical, Type: "ransomware_detected",
+			Payload: map[string]any{"host": "web-1"}},
+		{Id: "evt-2", Timestamp: testEventTime.Add(time.Second), Source: "edr", Severity: common.SeverityErr, Type: "file_encrypted",
+			Payload: map[string]any{"host": "web-1"}},
+		{Id: "evt-3", Timestamp: testEventTime.Add(2 * time.Second), Source: "auth", Severity: common.SeverityInfo, Type: "login_success",
+			Payload: map[string]any{"user": "alice"}},
+	}
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/andreionoie/llm-event-analysis/pkg/common"
+)
+
+// Scores reported by the eval command. A score whose denominator is zero, e.g. the precision of a run that flagged
+// nothing, is left out rather than reported as 0 or 1.
+const (
+	scoreBucketPrecision  = "bucket_precision"    // flagged buckets that were expected
+	scoreBucketRecall     = "bucket_recall"       // expected buckets that were flagged
+	scoreValidBuckets     = "valid_bucket_rate"   // rated bucket IDs that were in the input
+	scoreFindingPrecision = "finding_precision"   // findings matching an expected one
+	scoreFindingRecall    = "finding_recall"      // expected findings that were found
+	scorePriorityAccuracy = "priority_accuracy"   // matched findings with the expected priority
+	scoreValidEvidence    = "valid_evidence_rate" // cited event IDs that were in the input
+	scoreAnswerCoverage   = "answer_coverage"     // expected mentions found in the answer
+)
+
+// EvalScenario is a golden dataset: events along with what the prompts are expected to make of them. Each part is
+// optional, and is run through every variant of its prompt.
+type EvalScenario struct {
+	Name        string           `json:"name"` // defaults to the file name
+	Description string           `json:"description,omitempty"`
+	Tier1       *EvalTier1Case   `json:"tier1,omitempty"`
+	Tier2       *EvalTier2Case   `json:"tier2,omitempty"`
+	Analyze     *EvalAnalyzeCase `json:"analyze,omitempty"`
+}
+
+// EvalTier1Case lists the summary buckets to rate, and the IDs of those that should be rated high or medium risk.
+type EvalTier1Case struct {
+	Summaries []common.EventSummary `json:"summaries"`
+	Flagged   []string              `json:"flagged"`
+}
+
+// EvalTier2Case lists the events to classify and the findings expected. A finding matches an expected one of the
+// same category; the event IDs of the expected findings only break ties.
+type EvalTier2Case struct {
+	Events   []evalEvent     `json:"events"`
+	Findings []TriageFinding `json:"findings"`
+}
+
+// EvalAnalyzeCase is a question on the events, with the terms (IDs, IPs, users, ...) the answer should mention.
+type EvalAnalyzeCase struct {
+	Question string      `json:"question"`
+	Events   []evalEvent `json:"events"`
+	Mentions []string    `json:"mentions"`
+}
+
+// evalEvent is an event as written in scenario files, with its severity by name as in ingested events.
+type evalEvent struct {
+	common.Event
+	Severity string `json:"severity"`
+}
+
+// EvalResult scores the answer of one prompt version on one scenario.
+type EvalResult struct {
+	Scenario string             `json:"scenario"`
+	Prompt   string             `json:"prompt"`
+	Version  string             `json:"version"`
+	Scores   map[string]float64 `json:"scores,omitempty"`
+	Error    string             `json:"error,omitempty"`
+}
+
+// EvalReport is the output of the eval command, which a later run can be compared with.
+type EvalReport struct {
+	CreatedAt time.Time    `json:"created_at"`
+	Provider  string       `json:"provider"`
+	Results   []EvalResult `json:"results"`
+}
+
+// runEval implements `analyzer-svc eval`: it runs the scenarios through every prompt variant with the provider
+// configured as for the service (LLM_PROVIDER, PROMPTS_DIR, LLM_CASSETTE_MODE, ...), prints the scores next to
+// those of a baseline report, and returns the exit code.
+func runEval(args []string) int {
+	flags := flag.NewFlagSet("eval", flag.ContinueOnError)
+	scenariosDir := flags.String("scenarios", "evals", "directory of the scenario files (*.json)")
+	out := flags.String("out", "", "file to write the report to, as JSON")
+	baselinePath := flags.String("baseline", "", "report of an earlier run to compare the scores with")
+	maxRegression := flags.Float64("max-regression", 0,
+		"fail when a score is lower than in the baseline by more than this (0 disables)")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	var baseline *EvalReport
+	if *baselinePath != "" {
+		data, err := os.ReadFile(*baselinePath)
+		if err == nil {
+			err = json.Unmarshal(data, &baseline)
+		}
+		if err != nil {
+			slog.Error("failed to load baseline report", "path", *baselinePath, "error", err)
+			return 1
+		}
+	}
+	scenarios, err := loadEvalScenarios(*scenariosDir)
+	if err != nil {
+		slog.Error("failed to load eval scenarios", "dir", *scenariosDir, "error", err)
+		return 1
+	}
+
+	var cfg Config
+	cfg.loadLLMEnv()
+	prompts, err := NewPromptLibraryWithDir(promptsFS, cfg.PromptsDir)
+	if err != nil {
+		slog.Error("failed to load prompts", "error", err)
+		return 1
+	}
+	providers, defaultProvider, err := setupLLMProviders(context.Background(), cfg)
+	if err != nil {
+		slog.Error("failed to create LLM providers", "error", err)
+		return 1
+	}
+	s := &Server{
+		cfg:         cfg,
+		prompts:     prompts,
+		llm:         providers,
+		llmDefault:  defaultProvider,
+		llmBreakers: newLLMBreakers(),
+	}
+
+	report := s.runEvalScenarios(context.Background(), scenarios)
+	if *out != "" {
+		data, _ := json.MarshalIndent(report, "", "  ")
+		if err := os.WriteFile(*out, data, 0o644); err != nil {
+			slog.Error("failed to write eval report", "path", *out, "error", err)
+			return 1
+		}
+	}
+
+	comparisons := compareEvalReports(report, baseline)
+	writeEvalComparisons(os.Stdout, comparisons)
+
+	code := 0
+	for _, r := range report.Results {
+		if r.Error != "" {
+			slog.Error("eval scenario failed", "scenario", r.Scenario, "prompt", r.Prompt, "version", r.Version,
+				"error", r.Error)
+			code = 1
+		}
+	}
+	if *maxRegression > 0 {
+		for _, c := range comparisons {
+			if c.Baseline != nil && *c.Baseline-c.Score > *maxRegression {
+				slog.Error("score regressed", "scenario", c.Scenario, "prompt", c.Prompt, "version", c.Version,
+					"score", c.Metric, "value", c.Score, "baseline", *c.Baseline)
+				code = 1
+			}
+		}
+	}
+	return code
+}
+
+// loadEvalScenarios reads every *.json file of the directory, in name order.
+func loadEvalScenarios(dir string) ([]EvalScenario, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no scenario files in %s", dir)
+	}
+	sort.Strings(files)
+
+	scenarios := make([]EvalScenario, 0, len(files))
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var sc EvalScenario
+		if err := json.Unmarshal(data, &sc); err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		if sc.Name == "" {
+			sc.Name = strings.TrimSuffix(filepath.Base(file), ".json")
+		}
+		var eventSets [][]evalEvent
+		if sc.Tier2 != nil {
+			eventSets = append(eventSets, sc.Tier2.Events)
+		}
+		if sc.Analyze != nil {
+			eventSets = append(eventSets, sc.Analyze.Events)
+		}
+		for _, events := range eventSets {
+			for i := range events {
+				if err := events[i].resolve(); err != nil {
+					return nil, fmt.Errorf("%s: event %s: %w", file, events[i].Id, err)
+				}
+			}
+		}
+		scenarios = append(scenarios, sc)
+	}
+	return scenarios, nil
+}
+
+// resolve parses the severity name into the event.
+func (e *evalEvent) resolve() error {
+	if e.Severity == "" {
+		e.Event.Severity = common.SeverityInfo
+		return nil
+	}
+	sev, err := common.ParseSeverity(e.Severity)
+	if err != nil {
+		return err
+	}
+	e.Event.Severity = sev
+	return nil
+}
+
+func commonEvents(events []evalEvent) []common.Event {
+	out := make([]common.Event, len(events))
+	for i, e := range events {
+		out[i] = e.Event
+	}
+	return out
+}
+
+// runEvalScenarios scores every variant of the prompts on every scenario. The calls are made one at a time, so that
+// recorded responses are replayed in a stable order.
+func (s *Server) runEvalScenarios(ctx context.Context, scenarios []EvalScenario) *EvalReport {
+	report := &EvalReport{CreatedAt: time.Now().UTC(), Provider: s.llmDefault, Results: []EvalResult{}}
+	set := s.prompts.current()
+	for _, sc := range scenarios {
+		if sc.Tier1 != nil {
+			for _, t := range set.variants["triage_tier1"] {
+				report.Results = append(report.Results, s.evalTier1(ctx, sc.Name, t, sc.Tier1))
+			}
+		}
+		if sc.Tier2 != nil {
+			for _, t := range set.variants["triage_tier2"] {
+				report.Results = append(report.Results, s.evalTier2(ctx, sc.Name, t, sc.Tier2))
+			}
+		}
+		if sc.Analyze != nil {
+			for _, t := range set.variants["analyze"] {
+				report.Results = append(report.Results, s.evalAnalyze(ctx, sc.Name, t, sc.Analyze))
+			}
+		}
+	}
+	return report
+}
+
+func newEvalResult(scenario string, t *PromptTemplate) EvalResult {
+	return EvalResult{Scenario: scenario, Prompt: t.Config.Name, Version: t.Config.Version, Scores: map[string]float64{}}
+}
+
+// setScore records num/den as the score, unless den is zero.
+func (r *EvalResult) setScore(name string, num, den int) {
+	if den > 0 {
+		r.Scores[name] = float64(num) / float64(den)
+	}
+}
+
+func (s *Server) evalTier1(ctx context.Context, scenario string, t *PromptTemplate, c *EvalTier1Case) EvalResult {
+	res := newEvalResult(scenario, t)
+	prompts := &jobPrompts{promptSet: &promptSet{Tier1Triaging: t}, runs: map[string]*PromptRun{}}
+	result, valid, err := s.classifyTier1(ctx, prompts, c.Summaries)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+
+	rated, validRated := 0, 0
+	for _, buckets := range [][]BucketRisk{result.HighRisk, result.MediumRisk, result.LowRisk} {
+		rated += len(buckets)
+		validRated += len(filterValidBuckets(buckets, valid))
+	}
+	var flagged []string
+	for _, b := range filterValidBuckets(slices.Concat(result.HighRisk, result.MediumRisk), valid) {
+		flagged = append(flagged, b.BucketID)
+	}
+	flagged = uniqueStrings(flagged)
+	hits := 0
+	for _, id := range flagged {
+		if slices.Contains(c.Flagged, id) {
+			hits++
+		}
+	}
+
+	res.setScore(scoreBucketPrecision, hits, len(flagged))
+	res.setScore(scoreBucketRecall, hits, len(uniqueStrings(c.Flagged)))
+	res.setScore(scoreValidBuckets, validRated, rated)
+	return res
+}
+
+func (s *Server) evalTier2(ctx context.Context, scenario string, t *PromptTemplate, c *EvalTier2Case) EvalResult {
+	res := newEvalResult(scenario, t)
+	prompts := &jobPrompts{promptSet: &promptSet{Tier2Triaging: t}, runs: map[string]*PromptRun{}}
+	findings, err := s.classifyTier2(ctx, prompts, commonEvents(c.Events), nil)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	findings = mergeFindings(findings)
+
+	matches := matchEvalFindings(c.Findings, findings)
+	samePriority := 0
+	for expected, actual := range matches {
+		if strings.EqualFold(c.Findings[expected].Priority, findings[actual].Priority) {
+			samePriority++
+		}
+	}
+	res.setScore(scoreFindingPrecision, len(matches), len(findings))
+	res.setScore(scoreFindingRecall, len(matches), len(c.Findings))
+	res.setScore(scorePriorityAccuracy, samePriority, len(matches))
+	if run := prompts.snapshot()[t.Config.Name]; run != nil {
+		res.setScore(scoreValidEvidence, run.CitedIDs-run.HallucinatedIDs, run.CitedIDs)
+	}
+	return res
+}
+
+// matchEvalFindings pairs expected findings with actual ones of the same category, each used once, preferring the
+// actual finding citing most of the expected evidence. Returns the index of the actual finding by expected one.
+func matchEvalFindings(expected, actual []TriageFinding) map[int]int {
+	matches := map[int]int{}
+	used := make([]bool, len(actual))
+	for i, want := range expected {
+		best, bestShared := -1, -1
+		for j, got := range actual {
+			if used[j] || !strings.EqualFold(want.Category, got.Category) {
+				continue
+			}
+			shared := 0
+			for _, id := range got.EventIDs {
+				if slices.Contains(want.EventIDs, id) {
+					shared++
+				}
+			}
+			if shared > bestShared {
+				best, bestShared = j, shared
+			}
+		}
+		if best >= 0 {
+			used[best] = true
+			matches[i] = best
+		}
+	}
+	return matches
+}
+
+func (s *Server) evalAnalyze(ctx context.Context, scenario string, t *PromptTemplate, c *EvalAnalyzeCase) EvalResult {
+	res := newEvalResult(scenario, t)
+	prompt, err := (&promptSet{Analyze: t}).renderAnalyze(c.Question, commonEvents(c.Events), false)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	answer, err := s.generateContent(ctx, prompt)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+
+	mentioned := 0
+	for _, term := range c.Mentions {
+		if strings.Contains(strings.ToLower(answer), strings.ToLower(term)) {
+			mentioned++
+		}
+	}
+	res.setScore(scoreAnswerCoverage, mentioned, len(c.Mentions))
+	return res
+}
+
+// EvalComparison is one score of a result, along with the score of the same scenario and prompt in the baseline.
+type EvalComparison struct {
+	Scenario        string
+	Prompt          string
+	Version         string
+	Metric          string
+	Score           float64
+	BaselineVersion string
+	Baseline        *float64 // nil when the baseline has no such score
+}
+
+// compareEvalReports lists every score of the report next to the baseline's. A result is compared with the
+// baseline result of the same scenario, prompt and version if there is one, or else with the first one of the same
+// scenario and prompt, so that a new version of a prompt is compared with the version it replaces.
+func compareEvalReports(report, baseline *EvalReport) []EvalComparison {
+	var comparisons []EvalComparison
+	for _, r := range report.Results {
+		var base *EvalResult
+		if baseline != nil {
+			for i := range baseline.Results {
+				b := &baseline.Results[i]
+				if b.Scenario != r.Scenario || b.Prompt != r.Prompt {
+					continue
+				}
+				if base == nil || b.Version == r.Version {
+					base = b
+				}
+				if b.Version == r.Version {
+					break
+				}
+			}
+		}
+		for _, metric := range sortedKeys(r.Scores) {
+			c := EvalComparison{
+				Scenario: r.Scenario,
+				Prompt:   r.Prompt,
+				Version:  r.Version,
+				Metric:   metric,
+				Score:    r.Scores[metric],
+			}
+			if base != nil {
+				c.BaselineVersion = base.Version
+				if score, ok := base.Scores[metric]; ok {
+					c.Baseline = &score
+				}
+			}
+			comparisons = append(comparisons, c)
+		}
+	}
+	return comparisons
+}
+
+func writeEvalComparisons(w io.Writer, comparisons []EvalComparison) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SCENARIO\tPROMPT\tVERSION\tSCORE\tVALUE\tBASELINE\tDELTA")
+	for _, c := range comparisons {
+		baseline, delta := "-", ""
+		if c.Baseline != nil {
+			baseline = fmt.Sprintf("%.2f (%s)", *c.Baseline, c.BaselineVersion)
+			delta = fmt.Sprintf("%+.2f", c.Score-*c.Baseline)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%.2f\t%s\t%s\n", c.Scenario, c.Prompt, c.Version, c.Metric, c.Score, baseline,
+			delta)
+	}
+	_ = tw.Flush()
+}
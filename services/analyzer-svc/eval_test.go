@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"github.com/andreionoie/llm-event-analysis/pkg/common"
+)
+
+func TestLoadEvalScenarios(t *testing.T) {
+	scenarios, err := loadEvalScenarios("evals")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scenarios) < 2 || scenarios[0].Name != "quiet_hours" {
+		t.Fatalf("expected the scenarios in name order, named after their files, got %d", len(scenarios))
+	}
+	for _, sc := range scenarios {
+		if sc.Tier1 == nil && sc.Tier2 == nil && sc.Analyze == nil {
+			t.Errorf("scenario %s has nothing to evaluate", sc.Name)
+		}
+	}
+	if sev := scenarios[1].Tier2.Events[4].Event.Severity; sev != common.SeverityErr {
+		t.Errorf("severity names should be parsed, got %s", sev)
+	}
+}
+
+func TestRunEvalScenarios(t *testing.T) {
+	scenarios, err := loadEvalScenarios("evals")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prompts, err := NewPromptLibrary(promptsFS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scripted := &scriptedProvider{respond: answerByPrompt(map[string]func(req *LLMRequest) string{
+		"triage_tier1": func(*LLMRequest) string {
+			return `{"summary": "login burst",
+				"high_risk": [{"bucket_id": "2026-01-01T10:05:00Z", "reason": "failed logins", "confidence": 0.9}],
+				"medium_risk": [{"bucket_id": "2026-01-01T10:10:00Z", "reason": "logins", "confidence": 0.5}],
+				"low_risk": [{"bucket_id": "2026-01-01T11:00:00Z", "reason": "made up", "confidence": 0.1}]}`
+		},
+		"triage_tier2": func(*LLMRequest) string {
+			return `[{"priority": "P1", "category": "brute_force", "summary": "guessing", "event_ids": ["evt-101", "evt-999"]},
+				{"priority": "P3", "category": "persistence", "summary": "new account", "event_ids": ["evt-105"]},
+				{"priority": "P4", "category": "recon", "summary": "health checks", "event_ids": []}]`
+		},
+		"analyze": func(*LLMRequest) string { return "Yes: root logged in from 203.0.113.7." },
+	})}
+	s := &Server{
+		prompts:     prompts,
+		llm:         map[string]LLMProvider{"scripted": scripted},
+		llmDefault:  "scripted",
+		llmBreakers: newLLMBreakers(),
+	}
+
+	report := s.runEvalScenarios(context.Background(), scenarios[1:2])
+	want := map[string]map[string]float64{
+		"triage_tier1": {
+			scoreBucketPrecision: 0.5,
+			scoreBucketRecall:    1,
+			scoreValidBuckets:    2.0 / 3,
+		},
+		"triage_tier2": {
+			scoreFindingPrecision: 2.0 / 3,
+			scoreFindingRecall:    1,
+			scorePriorityAccuracy: 0.5,
+			scoreValidEvidence:    2.0 / 3,
+		},
+		"analyze": {
+			scoreAnswerCoverage: 2.0 / 3,
+		},
+	}
+	if len(report.Results) != len(want) {
+		t.Fatalf("expected a result per prompt, got %+v", report.Results)
+	}
+	for _, r := range report.Results {
+		if r.Error != "" {
+			t.Fatalf("%s failed: %s", r.Prompt, r.Error)
+		}
+		for metric, score := range want[r.Prompt] {
+			if got, ok := r.Scores[metric]; !ok || math.Abs(got-score) > 1e-9 {
+				t.Errorf("%s %s = %v, want %v", r.Prompt, metric, got, score)
+			}
+		}
+		if len(r.Scores) != len(want[r.Prompt]) {
+			t.Errorf("%s has unexpected scores %v", r.Prompt, r.Scores)
+		}
+	}
+}
+
+func TestCompareEvalReports(t *testing.T) {
+	baseline := &EvalReport{Results: []EvalResult{
+		{Scenario: "ssh", Prompt: "triage_tier2", Version: "1.0.0", Scores: map[string]float64{scoreFindingRecall: 1}},
+		{Scenario: "ssh", Prompt: "triage_tier2", Version: "1.1.0", Scores: map[string]float64{scoreFindingRecall: 0.5}},
+	}}
+	report := &EvalReport{Results: []EvalResult{
+		{Scenario: "ssh", Prompt: "triage_tier2", Version: "1.1.0", Scores: map[string]float64{scoreFindingRecall: 0.75}},
+		{Scenario: "ssh", Prompt: "triage_tier2", Version: "2.0.0", Scores: map[string]float64{scoreFindingRecall: 0.25}},
+		{Scenario: "new", Prompt: "analyze", Version: "1.0.0", Scores: map[string]float64{scoreAnswerCoverage: 1}},
+	}}
+
+	got := compareEvalReports(report, baseline)
+	if len(got) != 3 {
+		t.Fatalf("expected a comparison per score, got %+v", got)
+	}
+	if got[0].BaselineVersion != "1.1.0" || *got[0].Baseline != 0.5 {
+		t.Errorf("same version should be compared first, got %+v", got[0])
+	}
+	if got[1].BaselineVersion != "1.0.0" || *got[1].Baseline != 1 {
+		t.Errorf("a new version should be compared with the first baseline version, got %+v", got[1])
+	}
+	if got[2].Baseline != nil {
+		t.Errorf("a scenario missing from the baseline has nothing to compare with, got %+v", got[2])
+	}
+}
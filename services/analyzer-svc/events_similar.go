@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andreionoie/llm-event-analysis/pkg/common"
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+)
+
+const defaultSimilarLimit = 10
+
+// SimilarEvent is an event found by meaning, with the cosine similarity of its embedding to the one searched for.
+type SimilarEvent struct {
+	common.Event
+	Similarity float64 `json:"similarity"`
+}
+
+type SearchEventsRequest struct {
+	Query     string            `json:"query"`
+	Limit     int               `json:"limit,omitempty"`
+	TimeRange *common.TimeRange `json:"time_range,omitempty"`
+	Filter    *EventFilter      `json:"filter,omitempty"`
+}
+
+// handleSimilarEvents returns the events closest in meaning to an event, compared by their stored embeddings. It
+// takes the same time range and filter params as /events.
+func (s *Server) handleSimilarEvents(c echo.Context) error {
+	id := c.Param("id")
+	timeRange, err := parseTimeRangeParams(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	limit, err := parseLimitParam(c, defaultSimilarLimit, s.cfg.MaxEvents)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	filter, err := parseEventFilterParams(c.QueryParams())
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	// without embeddings, the processor doesn't create the table of embeddings either
+	if s.embedder == nil {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "embeddings are not configured")
+	}
+
+	ctx := c.Request().Context()
+	model, vector, err := s.fetchEventEmbedding(ctx, id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		events, err := s.fetchEventsByIDs(ctx, []string{id})
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fetch event")
+		}
+		if len(events) == 0 {
+			return echo.NewHTTPError(http.StatusNotFound, "event not found")
+		}
+		return echo.NewHTTPError(http.StatusNotFound, "event has no embedding yet")
+	}
+	if err != nil {
+		slog.Error("failed to fetch event embedding", "event_id", id, "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fetch event embedding")
+	}
+
+	similar, err := s.querySimilarEvents(ctx, EventQuery{TimeRange: timeRange, Filter: filter, Limit: limit}, model, vector, id)
+	if err != nil {
+		slog.Error("failed to query similar events", "event_id", id, "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to query similar events")
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"events": similar,
+		"count":  len(similar),
+	})
+}
+
+// handleSearchEvents returns the events closest in meaning to a free-text query.
+func (s *Server) handleSearchEvents(c echo.Context) error {
+	var req SearchEventsRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid request body")
+	}
+	if strings.TrimSpace(req.Query) == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "query is required")
+	}
+	if req.TimeRange != nil {
+		if err := req.TimeRange.Validate(); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+	}
+	if err := req.Filter.Validate(); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if s.embedder == nil {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "embeddings are not configured")
+	}
+	limit := req.Limit
+	if limit <= 0 {
+		limit = defaultSimilarLimit
+	}
+	limit = min(limit, s.cfg.MaxEvents)
+
+	ctx := c.Request().Context()
+	similar, err := s.searchEvents(ctx, req.Query, EventQuery{TimeRange: req.TimeRange, Filter: req.Filter, Limit: limit})
+	if err != nil {
+		slog.Error("semantic search failed", "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "semantic search failed")
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"events": similar,
+		"count":  len(similar),
+	})
+}
+
+// searchEvents embeds the text and returns the events matching the query closest to it, most similar first.
+func (s *Server) searchEvents(ctx context.Context, text string, q EventQuery) ([]SimilarEvent, error) {
+	vectors, err := s.embedder.Embed(ctx, []string{text})
+	if err != nil {
+		return nil, err
+	}
+	return s.querySimilarEvents(ctx, q, s.embedder.Model(), common.FormatVector(vectors[0]), "")
+}
+
+// semanticContextEvents returns the candidate events for the context of a prompt closest in meaning to the question,
+// most similar first.
+func (s *Server) semanticContextEvents(ctx context.Context, question string, q EventQuery) ([]common.Event, error) {
+	similar, err := s.searchEvents(ctx, question, q)
+	if err != nil {
+		return nil, err
+	}
+	events := make([]common.Event, len(similar))
+	for i, e := range similar {
+		events[i] = e.Event
+	}
+	return events, nil
+}
+
+// fetchEventEmbedding returns the stored embedding of an event, in the pgvector text format, preferably of the model
+// the service embeds with.
+func (s *Server) fetchEventEmbedding(ctx context.Context, id string) (model, vector string, err error) {
+	preferred := s.embedder.Model()
+	err = s.db.QueryRow(ctx,
+		`SELECT model, embedding::text FROM event_embeddings
+		 WHERE event_id = $1
+		 ORDER BY model = $2 DESC, embedded_at DESC
+		 LIMIT 1`,
+		id, preferred,
+	).Scan(&model, &vector)
+	return model, vector, err
+}
+
+// querySimilarEvents returns the events matching the query whose embeddings of the model are closest to the vector,
+// most similar first, leaving out the event of excludeID.
+func (s *Server) querySimilarEvents(ctx context.Context, q EventQuery, model, vector, excludeID string) ([]SimilarEvent, error) {
+	conds := q.conditions()
+	conds.add("m.model = %s", model)
+	if excludeID != "" {
+		conds.add("e.id <> %s", excludeID)
+	}
+	vectorParam := conds.nextPlaceholder()
+	limitParam := "$" + strconv.Itoa(len(conds.args)+2)
+	query := `SELECT e.id, e.timestamp, e.source, e.severity, e.event_type, e.payload,
+		 1 - (m.embedding <=> ` + vectorParam + `::vector) AS similarity
+		 FROM event_embeddings m JOIN events e ON e.id = m.event_id` + conds.whereClause() + `
+		 ORDER BY m.embedding <=> ` + vectorParam + `::vector
+		 LIMIT ` + limitParam
+	args := append(conds.args, vector, q.Limit)
+
+	rows, err := s.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	similar := make([]SimilarEvent, 0, q.Limit)
+	for rows.Next() {
+		var event SimilarEvent
+		var sev int
+		var payload []byte
+		if err := rows.Scan(&event.Id, &event.Timestamp, &event.Source, &sev, &event.Type, &payload, &event.Similarity); err != nil {
+			return nil, err
+		}
+		event.Severity = common.Severity(sev)
+		if len(payload) > 0 {
+			if err := json.Unmarshal(payload, &event.Payload); err != nil {
+				return nil, err
+			}
+		}
+		similar = append(similar, event)
+	}
+	return similar, rows.Err()
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andreionoie/llm-event-analysis/pkg/common"
+	"github.com/labstack/echo/v4"
+)
+
+// testEmbeddingsSchema mirrors the embeddings table owned by processor-svc.
+const testEmbeddingsSchema = `
+CREATE TABLE event_embeddings (
+    event_id     TEXT NOT NULL REFERENCES events(id) ON DELETE CASCADE,
+    model        TEXT NOT NULL,
+    embedding    vector(768) NOT NULL,
+    embedded_at  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (event_id, model)
+);`
+
+// newTestEmbeddingsServer returns a server over a test database with the events embedded by the fake provider. The
+// test database must have pgvector.
+func newTestEmbeddingsServer(t *testing.T, events []common.Event) *Server {
+	t.Helper()
+	db := newTestDB(t)
+	ctx := context.Background()
+	if _, err := db.Exec(ctx, `CREATE EXTENSION IF NOT EXISTS vector SCHEMA public`); err != nil {
+		t.Fatalf("pgvector is not available: %v", err)
+	}
+	if _, err := db.Exec(ctx, testEmbeddingsSchema); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{db: db, embedder: common.FakeEmbeddingProvider{}}
+	s.cfg.MaxEvents = 100
+	insertTestEvents(t, s, events)
+	texts := make([]string, len(events))
+	for i, e := range events {
+		texts[i] = common.EventEmbeddingText(e)
+	}
+	vectors, err := s.embedder.Embed(ctx, texts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, e := range events {
+		_, err := db.Exec(ctx, `INSERT INTO event_embeddings (event_id, model, embedding) VALUES ($1, $2, $3::vector)`,
+			e.Id, s.embedder.Model(), common.FormatVector(vectors[i]))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
+}
+
+func similarTestEvents() []common.Event {
+	events := testEvents()
+	return append(events,
+		common.Event{Id: "evt-4", Timestamp: testEventTime.Add(3 * time.Second), Source: "edr", Severity: common.SeverityCritical,
+			Type: "ransomware_detected", Payload: map[string]any{"host": "db-1"}},
+		common.Event{Id: "evt-5", Timestamp: testEventTime.Add(4 * time.Second), Source: "auth", Severity: common.SeverityInfo,
+			Type: "login_success", Payload: map[string]any{"user": "bob"}},
+	)
+}
+
+func decodeSimilarEvents(t *testing.T, rec *httptest.ResponseRecorder) []SimilarEvent {
+	t.Helper()
+	var resp struct {
+		Events []SimilarEvent `json:"events"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp.Events
+}
+
+func TestSimilarEvents(t *testing.T) {
+	s := newTestEmbeddingsServer(t, similarTestEvents())
+
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, "/events/evt-1/similar?limit=2", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.SetParamNames("id")
+	c.SetParamValues("evt-1")
+	if err := s.handleSimilarEvents(c); err != nil {
+		t.Fatal(err)
+	}
+	similar := decodeSimilarEvents(t, rec)
+	if len(similar) != 2 || similar[0].Id != "evt-4" {
+		t.Fatalf("expected the other ransomware event first, got %+v", similar)
+	}
+	if similar[0].Similarity <= similar[1].Similarity {
+		t.Errorf("events not ordered by similarity: %+v", similar)
+	}
+
+	c = e.NewContext(httptest.NewRequest(http.MethodGet, "/events/evt-9/similar", nil), httptest.NewRecorder())
+	c.SetParamNames("id")
+	c.SetParamValues("evt-9")
+	var httpErr *echo.HTTPError
+	if err := s.handleSimilarEvents(c); !errors.As(err, &httpErr) || httpErr.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown event, got %v", err)
+	}
+}
+
+func TestSearchEvents(t *testing.T) {
+	s := newTestEmbeddingsServer(t, similarTestEvents())
+
+	req := httptest.NewRequest(http.MethodPost, "/events/search",
+		strings.NewReader(`{"query":"login_success auth","limit":2,"filter":{"sources":["auth"]}}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	if err := s.handleSearchEvents(echo.New().NewContext(req, rec)); err != nil {
+		t.Fatal(err)
+	}
+	similar := decodeSimilarEvents(t, rec)
+	if len(similar) != 2 {
+		t.Fatalf("expected the 2 login events, got %+v", similar)
+	}
+	for _, e := range similar {
+		if e.Type != "login_success" {
+			t.Errorf("unexpected match %+v", e)
+		}
+	}
+}
+
+func TestSemanticSearchNeedsEmbeddings(t *testing.T) {
+	s := &Server{}
+	s.cfg.MaxEvents = 100
+
+	req := httptest.NewRequest(http.MethodPost, "/events/search", strings.NewReader(`{"query":"ransomware"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	var httpErr *echo.HTTPError
+	if err := s.handleSearchEvents(echo.New().NewContext(req, httptest.NewRecorder())); !errors.As(err, &httpErr) ||
+		httpErr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 without embeddings, got %v", err)
+	}
+
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/events/evt-1/similar", nil), httptest.NewRecorder())
+	c.SetParamNames("id")
+	c.SetParamValues("evt-1")
+	if err := s.handleSimilarEvents(c); !errors.As(err, &httpErr) || httpErr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 for similar events without embeddings, got %v", err)
+	}
+
+	_, _, err := s.prepareAnalyzePrompt(context.Background(), AnalyzeRequest{Question: "ransomware?", Semantic: true})
+	if !errors.As(err, &httpErr) || httpErr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 for a semantic analysis without embeddings, got %v", err)
+	}
+}
@@ -28,16 +28,34 @@ func (s *Server) handleEvents(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
+	filter, err := parseEventFilterParams(c.QueryParams())
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	var after *EventCursor
+	if raw := strings.TrimSpace(c.QueryParam("cursor")); raw != "" {
+		if after, err = decodeEventCursor(raw); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+	}
+
 	ctx := c.Request().Context()
-	events, err := s.fetchEvents(ctx, timeRange, limit)
+	events, err := s.queryEvents(ctx, EventQuery{TimeRange: timeRange, Filter: filter, After: after, Limit: limit})
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fetch events")
 	}
 
-	return c.JSON(http.StatusOK, map[string]any{
+	resp := map[string]any{
 		"events": events,
 		"count":  len(events),
-	})
+	}
+	// a full page means there may be more; the client passes next_cursor back as cursor
+	if len(events) == limit {
+		last := events[len(events)-1]
+		resp["next_cursor"] = EventCursor{Timestamp: last.Timestamp, ID: last.Id}.Encode()
+	}
+	return c.JSON(http.StatusOK, resp)
 }
 
 func (s *Server) handleSummaries(c echo.Context) error {
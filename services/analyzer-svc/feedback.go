@@ -0,0 +1,441 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andreionoie/llm-event-analysis/pkg/common"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	feedbackKindFinding = "finding"
+	feedbackKindBucket  = "bucket"
+
+	feedbackCorrect       = "correct"
+	feedbackFalsePositive = "false_positive"
+
+	feedbackExampleEvents = 5   // evidence events shown per finding example
+	feedbackPoolSize      = 500 // newest labelled ratings considered per kind
+	feedbackPoolTTL       = time.Minute
+	feedbackPoolRetry     = 5 * time.Second // after a failed load
+	feedbackPoolTimeout   = 10 * time.Second
+
+	defaultFeedbackLimit = 50
+	maxFeedbackLimit     = 200
+)
+
+var (
+	feedbackKinds  = []string{feedbackKindFinding, feedbackKindBucket}
+	feedbackLabels = []string{feedbackCorrect, feedbackFalsePositive}
+
+	errTriageFeedbackNotFound = errors.New("triage feedback not found")
+)
+
+// TriageFeedback is an analyst's verdict on a tier 2 finding or a tier 1 bucket rating. It keeps a copy of what the
+// model was shown and answered, so that it can serve as a few-shot example after the job is gone.
+type TriageFeedback struct {
+	ID        string    `json:"id"`
+	JobID     string    `json:"job_id,omitempty"`
+	Kind      string    `json:"kind"`   // finding or bucket
+	Target    string    `json:"target"` // finding number or bucket ID
+	Label     string    `json:"label"`  // correct or false_positive
+	Note      string    `json:"note,omitempty"`
+	Author    string    `json:"author,omitempty"`
+	Input     string    `json:"input"`
+	Output    string    `json:"output"`
+	Features  []string  `json:"features"` // event types and sources, for picking relevant examples
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// TriageFeedbackRequest labels either a finding or a bucket rating of the job.
+type TriageFeedbackRequest struct {
+	Finding  int    `json:"finding,omitempty"`   // 1-based position in the job's findings
+	BucketID string `json:"bucket_id,omitempty"` // bucket rated by tier 1
+	Label    string `json:"label"`
+	Note     string `json:"note,omitempty"`
+	Author   string `json:"author,omitempty"`
+}
+
+// FewShotExample is a labelled past rating, as rendered into the triage prompts.
+type FewShotExample struct {
+	Input  string
+	Output string
+	Label  string
+	Note   string
+}
+
+// handleCreateTriageFeedback records a verdict on a finding or bucket rating of a completed job. Labelling the same
+// target again replaces the previous verdict.
+func (s *Server) handleCreateTriageFeedback(c echo.Context) error {
+	var req TriageFeedbackRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid request body")
+	}
+	if !slices.Contains(feedbackLabels, req.Label) {
+		return echo.NewHTTPError(http.StatusBadRequest, "label must be one of "+strings.Join(feedbackLabels, ", "))
+	}
+	if (req.Finding > 0) == (req.BucketID != "") {
+		return echo.NewHTTPError(http.StatusBadRequest, "exactly one of finding or bucket_id is required")
+	}
+
+	ctx := c.Request().Context()
+	job, err := s.getTriageJob(ctx, c.Param("id"))
+	if err != nil {
+		if errors.Is(err, errTriageJobNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "job not found")
+		}
+		slog.Error("failed to load triage job", "job_id", c.Param("id"), "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to load job")
+	}
+	if job.Status != "complete" {
+		return echo.NewHTTPError(http.StatusConflict, "job is not complete")
+	}
+
+	var fb *TriageFeedback
+	if req.Finding > 0 {
+		fb, err = s.findingFeedback(ctx, job, req.Finding)
+	} else {
+		fb, err = s.bucketFeedback(ctx, job, req.BucketID)
+	}
+	if err != nil {
+		return err
+	}
+	fb.JobID = job.ID
+	fb.Label = req.Label
+	fb.Note = strings.TrimSpace(req.Note)
+	fb.Author = strings.TrimSpace(req.Author)
+
+	if err := s.upsertTriageFeedback(ctx, fb); err != nil {
+		slog.Error("failed to save triage feedback", "job_id", job.ID, "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to save feedback")
+	}
+	s.fewShot.invalidate()
+	recordPromptFeedback(job, fb)
+
+	return c.JSON(http.StatusOK, fb)
+}
+
+func (s *Server) handleListTriageFeedback(c echo.Context) error {
+	limit, err := parseLimitParam(c, defaultFeedbackLimit, maxFeedbackLimit)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	q := TriageFeedbackQuery{
+		Kind:  strings.TrimSpace(c.QueryParam("kind")),
+		Label: strings.TrimSpace(c.QueryParam("label")),
+		JobID: strings.TrimSpace(c.QueryParam("job_id")),
+		Limit: limit,
+	}
+	if q.Kind != "" && !slices.Contains(feedbackKinds, q.Kind) {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid kind")
+	}
+	if q.Label != "" && !slices.Contains(feedbackLabels, q.Label) {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid label")
+	}
+
+	feedback, err := s.listTriageFeedback(c.Request().Context(), q)
+	if err != nil {
+		slog.Error("failed to list triage feedback", "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to list feedback")
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"feedback": feedback,
+		"count":    len(feedback),
+	})
+}
+
+func (s *Server) handleDeleteTriageFeedback(c echo.Context) error {
+	err := s.deleteTriageFeedback(c.Request().Context(), c.Param("id"))
+	if errors.Is(err, errTriageFeedbackNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, "feedback not found")
+	}
+	if err != nil {
+		slog.Error("failed to delete triage feedback", "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete feedback")
+	}
+	s.fewShot.invalidate()
+	return c.NoContent(http.StatusNoContent)
+}
+
+// findingFeedback captures the finding with the evidence events it was based on.
+func (s *Server) findingFeedback(ctx context.Context, job *TriageJob, seq int) (*TriageFeedback, error) {
+	if seq > len(job.Findings) {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("job has %d findings", len(job.Findings)))
+	}
+	f := job.Findings[seq-1]
+
+	ids := f.EventIDs
+	if len(ids) > feedbackExampleEvents {
+		ids = ids[:feedbackExampleEvents]
+	}
+	events, err := s.fetchEventsByIDs(ctx, ids)
+	if err != nil {
+		slog.Error("failed to fetch finding evidence", "job_id", job.ID, "error", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to load finding evidence")
+	}
+
+	return &TriageFeedback{
+		Kind:     feedbackKindFinding,
+		Target:   strconv.Itoa(seq),
+		Input:    formatTier2Example(events),
+		Output:   fmt.Sprintf("%s %s: %s", f.Priority, f.Category, f.Summary),
+		Features: sortedKeys(eventFeatures(events)),
+	}, nil
+}
+
+// bucketFeedback captures the tier 1 rating of the bucket with the bucket's summary as the model saw it. Jobs from
+// before the summary was stored with the rating get it recomputed for the job's filter, which may differ if events
+// arrived late.
+func (s *Server) bucketFeedback(ctx context.Context, job *TriageJob, bucketID string) (*TriageFeedback, error) {
+	risk, level := findBucketRating(job.Tier1, bucketID)
+	if risk == nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "bucket was not rated by this job")
+	}
+	output := fmt.Sprintf("%s (confidence %.2f): %s", level, risk.Confidence, risk.Reason)
+	if risk.Input != "" {
+		return &TriageFeedback{
+			Kind:     feedbackKindBucket,
+			Target:   bucketID,
+			Input:    risk.Input,
+			Output:   output,
+			Features: risk.Features,
+		}, nil
+	}
+
+	start, err := time.Parse(time.RFC3339, bucketID)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "invalid bucket_id")
+	}
+
+	tr := common.TimeRange{Start: start, End: start.Add(s.cfg.SummaryBucket - time.Nanosecond)}
+	summaries, err := s.aggregateSummaries(ctx, &tr, job.Filter, 1)
+	if err != nil {
+		slog.Error("failed to summarize bucket", "job_id", job.ID, "bucket", bucketID, "error", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to load bucket summary")
+	}
+	if len(summaries) == 0 {
+		return nil, echo.NewHTTPError(http.StatusConflict, "bucket has no events anymore")
+	}
+
+	return &TriageFeedback{
+		Kind:     feedbackKindBucket,
+		Target:   bucketID,
+		Input:    formatTier1Example(summaries[0]),
+		Output:   output,
+		Features: sortedKeys(summaryFeatures(summaries)),
+	}, nil
+}
+
+func findBucketRating(tier1 *Tier1Result, bucketID string) (*BucketRisk, string) {
+	if tier1 == nil {
+		return nil, ""
+	}
+	levels := []struct {
+		name    string
+		buckets []BucketRisk
+	}{
+		{"high_risk", tier1.HighRisk},
+		{"medium_risk", tier1.MediumRisk},
+		{"low_risk", tier1.LowRisk},
+	}
+	for _, level := range levels {
+		for i := range level.buckets {
+			if level.buckets[i].BucketID == bucketID {
+				return &level.buckets[i], level.name
+			}
+		}
+	}
+	return nil, ""
+}
+
+// formatTier1Example renders a bucket summary like the tier 1 prompt does, without the timestamp. The event types are
+// escaped, since the example ends up in the system prompt.
+func formatTier1Example(sum common.EventSummary) string {
+	guarded, _ := guardSummaries([]common.EventSummary{sum})
+	sum = guarded[0]
+	return fmt.Sprintf("Total: %d | Severity: %s | Types: %s", sum.TotalCount, formatCounts(sum.BySeverity),
+		formatCounts(sum.ByType))
+}
+
+// formatTier2Example renders events like the tier 2 prompt does, without their IDs, which the model must not cite. The
+// sources and types are escaped, since the example ends up in the system prompt.
+func formatTier2Example(events []common.Event) string {
+	lines := make([]string, len(events))
+	for i, e := range events {
+		lines[i] = fmt.Sprintf("%s | %s | %s | %s | %s", e.Timestamp.Format(time.RFC3339), e.Severity,
+			escapeUntrusted(e.Source), escapeUntrusted(e.Type), truncatePayload(e.Payload, 150))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func formatCounts(counts map[string]int) string {
+	parts := make([]string, 0, len(counts))
+	for _, k := range sortedKeys(counts) {
+		parts = append(parts, fmt.Sprintf("%s=%d", k, counts[k]))
+	}
+	return strings.Join(parts, " ")
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func summaryFeatures(summaries []common.EventSummary) map[string]bool {
+	features := map[string]bool{}
+	for _, sum := range summaries {
+		for t := range sum.ByType {
+			features["type:"+t] = true
+		}
+	}
+	return features
+}
+
+func eventFeatures(events []common.Event) map[string]bool {
+	features := map[string]bool{}
+	for _, e := range events {
+		features["type:"+e.Type] = true
+		features["source:"+e.Source] = true
+	}
+	return features
+}
+
+// selectFewShotExamples picks up to limit examples most similar to the current input, by the overlap (Jaccard index)
+// of their event types and sources. Examples sharing nothing with the input are left out. The pool is ordered
+// newest first, which breaks ties.
+func selectFewShotExamples(pool []TriageFeedback, features map[string]bool, limit int) []FewShotExample {
+	type scored struct {
+		fb    *TriageFeedback
+		score float64
+	}
+	var candidates []scored
+	for i := range pool {
+		shared := 0
+		for _, f := range pool[i].Features {
+			if features[f] {
+				shared++
+			}
+		}
+		if shared == 0 {
+			continue
+		}
+		union := len(pool[i].Features) + len(features) - shared
+		candidates = append(candidates, scored{&pool[i], float64(shared) / float64(union)})
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].score > candidates[j].score })
+
+	if len(candidates) > limit {
+		candidates = candidates[:limit]
+	}
+	examples := make([]FewShotExample, len(candidates))
+	for i, c := range candidates {
+		examples[i] = FewShotExample{Input: c.fb.Input, Output: c.fb.Output, Label: c.fb.Label, Note: c.fb.Note}
+	}
+	return examples
+}
+
+// fewShotPool caches the newest labelled ratings of each kind, so that tier 1 chunks and tier 2 batches don't each
+// query them. Concurrent callers share a single load, and a failed load is not retried for feedbackPoolRetry, so
+// that a database outage doesn't add a query to every prompt.
+type fewShotPool struct {
+	load func(ctx context.Context) (map[string][]TriageFeedback, error)
+
+	mu         sync.Mutex
+	loaded     time.Time
+	failed     bool
+	generation int // bumped on invalidation, so that a load started before it isn't kept
+	byKind     map[string][]TriageFeedback
+	loading    singleflight.Group
+}
+
+func newFewShotPool(load func(ctx context.Context) (map[string][]TriageFeedback, error)) *fewShotPool {
+	return &fewShotPool{load: load}
+}
+
+func (p *fewShotPool) invalidate() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.loaded = time.Time{}
+	p.generation++
+}
+
+// examples returns the cached ratings of the kind, reloading them first if they are stale. After a failed load the
+// previous ratings, if any, are used.
+func (p *fewShotPool) examples(ctx context.Context, kind string) []TriageFeedback {
+	p.mu.Lock()
+	ttl := feedbackPoolTTL
+	if p.failed {
+		ttl = feedbackPoolRetry
+	}
+	fresh := time.Since(p.loaded) <= ttl
+	generation := p.generation
+	p.mu.Unlock()
+
+	if !fresh {
+		_, _, _ = p.loading.Do("pool", func() (any, error) {
+			// shared by all waiting callers, so not cancelled with the first one
+			loadCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), feedbackPoolTimeout)
+			defer cancel()
+			byKind, err := p.load(loadCtx)
+			if err != nil {
+				slog.Warn("failed to load few-shot examples", "error", err)
+			}
+
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			if p.generation != generation {
+				return nil, nil
+			}
+			p.loaded, p.failed = time.Now(), err != nil
+			if err == nil {
+				p.byKind = byKind
+			}
+			return nil, nil
+		})
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.byKind[kind]
+}
+
+// loadFewShotPool lists the newest labelled ratings of every kind.
+func (s *Server) loadFewShotPool(ctx context.Context) (map[string][]TriageFeedback, error) {
+	byKind := map[string][]TriageFeedback{}
+	for _, k := range feedbackKinds {
+		fb, err := s.listTriageFeedback(ctx, TriageFeedbackQuery{Kind: k, Limit: feedbackPoolSize})
+		if err != nil {
+			return nil, err
+		}
+		byKind[k] = fb
+	}
+	return byKind, nil
+}
+
+// fewShotExamples returns the labelled examples of the kind most relevant to the input features. Failing to load
+// them is not fatal, the prompt is then rendered without.
+func (s *Server) fewShotExamples(ctx context.Context, kind string, features map[string]bool) []FewShotExample {
+	if s.fewShot == nil || s.cfg.FewShotExamples <= 0 {
+		return nil
+	}
+	return selectFewShotExamples(s.fewShot.examples(ctx, kind), features, s.cfg.FewShotExamples)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// TriageFeedbackQuery selects feedback, most recently updated first. Empty fields don't filter.
+type TriageFeedbackQuery struct {
+	Kind  string
+	Label string
+	JobID string
+	Limit int
+}
+
+const triageFeedbackSelect = `SELECT id, COALESCE(job_id, ''), kind, target, label, note, author, input, output,
+	features, created_at, updated_at
+	FROM triage_feedback`
+
+func scanTriageFeedback(row pgx.Row) (*TriageFeedback, error) {
+	var fb TriageFeedback
+	var features []byte
+	err := row.Scan(&fb.ID, &fb.JobID, &fb.Kind, &fb.Target, &fb.Label, &fb.Note, &fb.Author, &fb.Input, &fb.Output,
+		&features, &fb.CreatedAt, &fb.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(features, &fb.Features); err != nil {
+		return nil, err
+	}
+	return &fb, nil
+}
+
+// upsertTriageFeedback saves the feedback, replacing an earlier verdict on the same target. ID and CreatedAt are set
+// from the stored row.
+func (s *Server) upsertTriageFeedback(ctx context.Context, fb *TriageFeedback) error {
+	features, err := json.Marshal(nonNil(fb.Features))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	fb.UpdatedAt = now
+	return s.db.QueryRow(ctx,
+		`INSERT INTO triage_feedback (id, job_id, kind, target, label, note, author, input, output, features,
+		     created_at, updated_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $11)
+		 ON CONFLICT (job_id, kind, target) DO UPDATE SET label = EXCLUDED.label, note = EXCLUDED.note,
+		     author = EXCLUDED.author, input = EXCLUDED.input, output = EXCLUDED.output,
+		     features = EXCLUDED.features, updated_at = EXCLUDED.updated_at
+		 RETURNING id, created_at`,
+		uuid.NewString(), fb.JobID, fb.Kind, fb.Target, fb.Label, fb.Note, fb.Author, fb.Input, fb.Output, features,
+		now,
+	).Scan(&fb.ID, &fb.CreatedAt)
+}
+
+func (s *Server) listTriageFeedback(ctx context.Context, q TriageFeedbackQuery) ([]TriageFeedback, error) {
+	conds := &sqlConditions{}
+	if q.Kind != "" {
+		conds.add("kind = %s", q.Kind)
+	}
+	if q.Label != "" {
+		conds.add("label = %s", q.Label)
+	}
+	if q.JobID != "" {
+		conds.add("job_id = %s", q.JobID)
+	}
+	query := triageFeedbackSelect + conds.whereClause() + ` ORDER BY updated_at DESC LIMIT ` + conds.nextPlaceholder()
+	args := append(conds.args, q.Limit)
+
+	rows, err := s.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	feedback := make([]TriageFeedback, 0, q.Limit)
+	for rows.Next() {
+		fb, err := scanTriageFeedback(rows)
+		if err != nil {
+			return nil, err
+		}
+		feedback = append(feedback, *fb)
+	}
+	return feedback, rows.Err()
+}
+
+func (s *Server) deleteTriageFeedback(ctx context.Context, id string) error {
+	tag, err := s.db.Exec(ctx, `DELETE FROM triage_feedback WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errTriageFeedbackNotFound
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/andreionoie/llm-event-analysis/pkg/common"
+)
+
+func TestSelectFewShotExamples(t *testing.T) {
+	// newest first, as loaded from the database
+	pool := []TriageFeedback{
+		{Output: "newest, unrelated", Features: []string{"type:dns_query"}},
+		{Output: "partial", Features: []string{"type:login_failed", "type:file_access", "source:vpn"}},
+		{Output: "exact", Features: []string{"type:login_failed", "source:auth"}, Label: feedbackFalsePositive},
+		{Output: "older partial", Features: []string{"type:login_failed", "type:file_access", "source:vpn"}},
+	}
+	features := map[string]bool{"type:login_failed": true, "source:auth": true}
+
+	got := selectFewShotExamples(pool, features, 2)
+	if len(got) != 2 {
+		t.Fatalf("expected 2 examples, got %+v", got)
+	}
+	if got[0].Output != "exact" || got[0].Label != feedbackFalsePositive {
+		t.Errorf("most similar example should come first, got %+v", got[0])
+	}
+	if got[1].Output != "partial" {
+		t.Errorf("ties should go to the newer example, got %+v", got[1])
+	}
+
+	if got := selectFewShotExamples(pool, map[string]bool{"type:process_start": true}, 3); len(got) != 0 {
+		t.Errorf("unrelated examples should be left out, got %+v", got)
+	}
+}
+
+func TestTier1PromptIncludesExamples(t *testing.T) {
+	lib, err := NewPromptLibrary(promptsFS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	summary := common.EventSummary{
+		BucketStart: time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC),
+		TotalCount:  12,
+		BySeverity:  map[string]int{"WARNING": 2, "INFO": 10},
+		ByType:      map[string]int{"login_failed": 12},
+	}
+
+	plain, err := lib.RenderTier1TriagingPrompt([]common.EventSummary{summary}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(plain.System, "Analyst verdict") {
+		t.Error("prompt without examples should not mention them")
+	}
+
+	example := FewShotExample{
+		Input:  formatTier1Example(summary),
+		Output: "high_risk (confidence 0.90): burst of failed logins",
+		Label:  feedbackFalsePositive,
+		Note:   "nightly password rotation job",
+	}
+	if example.Input != "Total: 12 | Severity: INFO=10 WARNING=2 | Types: login_failed=12" {
+		t.Errorf("unexpected example input %q", example.Input)
+	}
+
+	prompt, err := lib.RenderTier1TriagingPrompt([]common.EventSummary{summary}, []FewShotExample{example})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{example.Input, example.Output, "Analyst verdict: false_positive - nightly password rotation job"} {
+		if !strings.Contains(prompt.System, want) {
+			t.Errorf("system prompt misses %q:\n%s", want, prompt.System)
+		}
+	}
+}
+
+func TestFindBucketRating(t *testing.T) {
+	tier1 := &Tier1Result{
+		HighRisk: []BucketRisk{{BucketID: "2026-01-01T10:00:00Z", Confidence: 0.9}},
+		LowRisk:  []BucketRisk{{BucketID: "2026-01-01T10:05:00Z", Confidence: 0.7}},
+	}
+	if risk, level := findBucketRating(tier1, "2026-01-01T10:05:00Z"); risk == nil || level != "low_risk" {
+		t.Errorf("got %v %q, want the low risk bucket", risk, level)
+	}
+	if risk, _ := findBucketRating(tier1, "2026-01-01T10:10:00Z"); risk != nil {
+		t.Errorf("unrated bucket should not be found, got %v", risk)
+	}
+}
+
+func TestFewShotPoolSharesLoadsAndCachesFailures(t *testing.T) {
+	var loads atomic.Int32
+	release := make(chan struct{})
+	fail := atomic.Bool{}
+	pool := newFewShotPool(func(ctx context.Context) (map[string][]TriageFeedback, error) {
+		loads.Add(1)
+		<-release
+		if fail.Load() {
+			return nil, errors.New("database is down")
+		}
+		return map[string][]TriageFeedback{feedbackKindBucket: {{Output: "rated"}}}, nil
+	})
+
+	// concurrent callers wait for a single load
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if got := pool.examples(context.Background(), feedbackKindBucket); len(got) != 1 {
+				t.Errorf("expected the loaded rating, got %+v", got)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n := loads.Load(); n != 1 {
+		t.Errorf("expected a single load, got %d", n)
+	}
+
+	// a failed reload keeps the previous ratings, and is not retried right away
+	fail.Store(true)
+	pool.invalidate()
+	for range 3 {
+		if got := pool.examples(context.Background(), feedbackKindBucket); len(got) != 1 {
+			t.Errorf("expected the previous rating after a failed load, got %+v", got)
+		}
+	}
+	if n := loads.Load(); n != 2 {
+		t.Errorf("expected the failure to be cached, got %d loads", n)
+	}
+}
+
+func TestAttachTier1Inputs(t *testing.T) {
+	summary := common.EventSummary{
+		BucketStart: time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC),
+		TotalCount:  12,
+		ByType:      map[string]int{"login_failed": 12},
+	}
+	result := &Tier1Result{
+		HighRisk: []BucketRisk{{BucketID: "2026-01-01T10:00:00Z"}},
+		LowRisk:  []BucketRisk{{BucketID: "2026-01-01T10:05:00Z"}}, // hallucinated
+	}
+	attachTier1Inputs(result, []common.EventSummary{summary})
+
+	if got := result.HighRisk[0]; got.Input != formatTier1Example(summary) || strings.Join(got.Features, ",") != "type:login_failed" {
+		t.Errorf("unexpected input %q, features %v", got.Input, got.Features)
+	}
+	if got := result.LowRisk[0]; got.Input != "" {
+		t.Errorf("unknown bucket should get no input, got %q", got.Input)
+	}
+}
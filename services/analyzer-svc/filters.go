@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andreionoie/llm-event-analysis/pkg/common"
+)
+
+const (
+	payloadParamPrefix = "payload."
+	maxPayloadFilters  = 10
+)
+
+// EventFilter narrows down events beyond their time range. Empty fields don't filter.
+type EventFilter struct {
+	Sources     []string `json:"sources,omitempty"`
+	Types       []string `json:"types,omitempty"`
+	MinSeverity string   `json:"min_severity,omitempty"`
+	MaxSeverity string   `json:"max_severity,omitempty"`
+	// Payload matches exact values at dot-separated JSON paths, e.g. {"user.name": "bob"}
+	Payload map[string]string `json:"payload,omitempty"`
+}
+
+func (f *EventFilter) IsEmpty() bool {
+	return f == nil || (len(f.Sources) == 0 && len(f.Types) == 0 && f.MinSeverity == "" && f.MaxSeverity == "" &&
+		len(f.Payload) == 0)
+}
+
+func (f *EventFilter) Validate() error {
+	if f == nil {
+		return nil
+	}
+
+	minSev, maxSev, err := f.severityBounds()
+	if err != nil {
+		return err
+	}
+	if minSev != nil && maxSev != nil && *minSev > *maxSev {
+		return fmt.Errorf("min_severity must not be above max_severity")
+	}
+
+	if len(f.Payload) > maxPayloadFilters {
+		return fmt.Errorf("at most %d payload filters are allowed", maxPayloadFilters)
+	}
+	for path := range f.Payload {
+		for _, segment := range strings.Split(path, ".") {
+			if strings.TrimSpace(segment) == "" {
+				return fmt.Errorf("invalid payload path %q", path)
+			}
+		}
+	}
+	return nil
+}
+
+func (f *EventFilter) severityBounds() (*common.Severity, *common.Severity, error) {
+	var minSev, maxSev *common.Severity
+	if f.MinSeverity != "" {
+		sev, err := common.ParseSeverity(f.MinSeverity)
+		if err != nil {
+			return nil, nil, fmt.Errorf("min_severity: %w", err)
+		}
+		minSev = &sev
+	}
+	if f.MaxSeverity != "" {
+		sev, err := common.ParseSeverity(f.MaxSeverity)
+		if err != nil {
+			return nil, nil, fmt.Errorf("max_severity: %w", err)
+		}
+		maxSev = &sev
+	}
+	return minSev, maxSev, nil
+}
+
+// apply adds the filter conditions to a query over the events table. The filter must have been validated.
+func (f *EventFilter) apply(conds *sqlConditions) {
+	if f == nil {
+		return
+	}
+	if len(f.Sources) > 0 {
+		conds.add("source = ANY(%s)", f.Sources)
+	}
+	if len(f.Types) > 0 {
+		conds.add("event_type = ANY(%s)", f.Types)
+	}
+
+	minSev, maxSev, _ := f.severityBounds()
+	if minSev != nil {
+		conds.add("severity >= %s", int(*minSev))
+	}
+	if maxSev != nil {
+		conds.add("severity <= %s", int(*maxSev))
+	}
+
+	// sorted for a stable query text
+	paths := make([]string, 0, len(f.Payload))
+	for path := range f.Payload {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		conds.add("payload #>> %s = %s", strings.Split(path, "."), f.Payload[path])
+	}
+}
+
+// parseEventFilterParams reads a filter from query params: source and type (repeated or comma-separated),
+// min_severity, max_severity and payload.<path>=<value>. Returns nil when no filter param is set.
+func parseEventFilterParams(params url.Values) (*EventFilter, error) {
+	filter := &EventFilter{
+		Sources:     splitListParam(params["source"]),
+		Types:       splitListParam(params["type"]),
+		MinSeverity: strings.TrimSpace(params.Get("min_severity")),
+		MaxSeverity: strings.TrimSpace(params.Get("max_severity")),
+	}
+	for key, values := range params {
+		path, ok := strings.CutPrefix(key, payloadParamPrefix)
+		if !ok || len(values) == 0 {
+			continue
+		}
+		if filter.Payload == nil {
+			filter.Payload = map[string]string{}
+		}
+		filter.Payload[path] = values[0]
+	}
+
+	if filter.IsEmpty() {
+		return nil, nil
+	}
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+func splitListParam(values []string) []string {
+	var out []string
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				out = append(out, part)
+			}
+		}
+	}
+	return out
+}
+
+// EventCursor is the keyset position of the last event of a page; pages are ordered by (timestamp, id) descending.
+type EventCursor struct {
+	Timestamp time.Time `json:"t"`
+	ID        string    `json:"id"`
+}
+
+func (c EventCursor) Encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeEventCursor(raw string) (*EventCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	var cursor EventCursor
+	if err := json.Unmarshal(data, &cursor); err != nil || cursor.ID == "" || cursor.Timestamp.IsZero() {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return &cursor, nil
+}
+
+// EventQuery selects a page of events, newest first.
+type EventQuery struct {
+	TimeRange *common.TimeRange
+	Filter    *EventFilter
+	After     *EventCursor // continue after this position
+	Limit     int
+}
+
+func (q EventQuery) conditions() *sqlConditions {
+	conds := &sqlConditions{}
+	if q.TimeRange != nil {
+		conds.add("timestamp >= %s AND timestamp <= %s", q.TimeRange.Start, q.TimeRange.End)
+	}
+	q.Filter.apply(conds)
+	if q.After != nil {
+		conds.add("(timestamp, id) < (%s, %s)", q.After.Timestamp, q.After.ID)
+	}
+	return conds
+}
+
+// sqlConditions collects WHERE conditions and their positional arguments.
+type sqlConditions struct {
+	where []string
+	args  []any
+}
+
+// add appends a condition; every %s in the format is replaced by the placeholder of the matching argument.
+func (c *sqlConditions) add(format string, args ...any) {
+	placeholders := make([]any, len(args))
+	for i, arg := range args {
+		c.args = append(c.args, arg)
+		placeholders[i] = "$" + strconv.Itoa(len(c.args))
+	}
+	c.where = append(c.where, fmt.Sprintf(format, placeholders...))
+}
+
+func (c *sqlConditions) whereClause() string {
+	if len(c.where) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(c.where, " AND ")
+}
+
+// nextPlaceholder returns the placeholder for an argument appended after the conditions.
+func (c *sqlConditions) nextPlaceholder() string {
+	return "$" + strconv.Itoa(len(c.args)+1)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/andreionoie/llm-event-analysis/pkg/common"
+)
+
+func TestParseEventFilterParams(t *testing.T) {
+	params, _ := url.ParseQuery("source=auth,firewall&source=vpn&type=login_failed&min_severity=warn&payload.user.name=bob")
+	filter, err := parseEventFilterParams(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &EventFilter{
+		Sources:     []string{"auth", "firewall", "vpn"},
+		Types:       []string{"login_failed"},
+		MinSeverity: "warn",
+		Payload:     map[string]string{"user.name": "bob"},
+	}
+	if !reflect.DeepEqual(filter, want) {
+		t.Errorf("got %+v, want %+v", filter, want)
+	}
+
+	filter, err = parseEventFilterParams(url.Values{"limit": {"10"}})
+	if err != nil || filter != nil {
+		t.Errorf("expected no filter without filter params, got %+v, %v", filter, err)
+	}
+}
+
+func TestEventFilterValidate(t *testing.T) {
+	bad := []*EventFilter{
+		{MinSeverity: "loud"},
+		{MinSeverity: "critical", MaxSeverity: "info"},
+		{Payload: map[string]string{"user..name": "bob"}},
+	}
+	for _, filter := range bad {
+		if err := filter.Validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", filter)
+		}
+	}
+
+	var nilFilter *EventFilter
+	if err := nilFilter.Validate(); err != nil || !nilFilter.IsEmpty() {
+		t.Errorf("nil filter should be valid and empty")
+	}
+}
+
+func TestEventQueryConditions(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	cursor := &EventCursor{Timestamp: start.Add(time.Hour), ID: "e-9"}
+	query := EventQuery{
+		TimeRange: &common.TimeRange{Start: start, End: start.Add(2 * time.Hour)},
+		Filter: &EventFilter{
+			Sources:     []string{"auth"},
+			MinSeverity: "error",
+			Payload:     map[string]string{"user.name": "bob", "action": "login"},
+		},
+		After: cursor,
+	}
+
+	conds := query.conditions()
+	wantWhere := " WHERE timestamp >= $1 AND timestamp <= $2 AND source = ANY($3) AND severity >= $4" +
+		" AND payload #>> $5 = $6 AND payload #>> $7 = $8 AND (timestamp, id) < ($9, $10)"
+	if got := conds.whereClause(); got != wantWhere {
+		t.Errorf("where clause:\n got %q\nwant %q", got, wantWhere)
+	}
+	if len(conds.args) != 10 || conds.nextPlaceholder() != "$11" {
+		t.Errorf("unexpected args %v", conds.args)
+	}
+	if !reflect.DeepEqual(conds.args[6], []string{"user", "name"}) {
+		t.Errorf("payload path not split, got %v", conds.args[6])
+	}
+}
+
+func TestEventCursorRoundTrip(t *testing.T) {
+	cursor := EventCursor{Timestamp: time.Date(2026, 3, 4, 5, 6, 7, 8, time.UTC), ID: "e-1"}
+	decoded, err := decodeEventCursor(cursor.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Timestamp.Equal(cursor.Timestamp) || decoded.ID != cursor.ID {
+		t.Errorf("got %+v, want %+v", decoded, cursor)
+	}
+
+	for _, bad := range []string{"not base64!", "e30"} {
+		if _, err := decodeEventCursor(bad); err == nil {
+			t.Errorf("expected %q to be an invalid cursor", bad)
+		}
+	}
+}
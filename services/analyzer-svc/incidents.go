@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	incidentOpen          = "open"
+	incidentAcknowledged  = "acknowledged"
+	incidentResolved      = "resolved"
+	incidentFalsePositive = "false_positive"
+
+	defaultIncidentPriority = "P3"
+	defaultIncidentsLimit   = 50
+	maxIncidentsLimit       = 200
+	maxIncidentTitleLen     = 200
+)
+
+var (
+	incidentStatuses    = []string{incidentOpen, incidentAcknowledged, incidentResolved, incidentFalsePositive}
+	findingPriorities   = []string{"P1", "P2", "P3", "P4", "P5"}
+	errIncidentNotFound = errors.New("incident not found")
+)
+
+// Incident groups the triage findings about one security issue, across triage runs, and tracks its handling.
+// Open and acknowledged incidents are active: findings of new runs in the same category that share evidence or an
+// entity with them are attached instead of opening a new incident.
+type Incident struct {
+	ID         string            `json:"id"`
+	Title      string            `json:"title"`
+	Category   string            `json:"category"`
+	Priority   string            `json:"priority"`
+	Status     string            `json:"status"`
+	Assignee   string            `json:"assignee,omitempty"`
+	EventIDs   []string          `json:"event_ids"`
+	CreatedAt  time.Time         `json:"created_at"`
+	UpdatedAt  time.Time         `json:"updated_at"`
+	ResolvedAt *time.Time        `json:"resolved_at,omitempty"`
+	Comments   []IncidentComment `json:"comments,omitempty"`
+	Findings   []IncidentFinding `json:"findings,omitempty"`
+}
+
+type IncidentComment struct {
+	ID        string    `json:"id"`
+	Author    string    `json:"author"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// IncidentFinding is a triage finding attached to an incident, identified by its job and position in the job.
+type IncidentFinding struct {
+	JobID      string    `json:"job_id"`
+	Seq        int       `json:"seq"`
+	Priority   string    `json:"priority"`
+	Summary    string    `json:"summary"`
+	EventIDs   []string  `json:"event_ids"`
+	AttachedAt time.Time `json:"attached_at"`
+}
+
+type CreateIncidentRequest struct {
+	Title    string   `json:"title"`
+	Category string   `json:"category"`
+	Priority string   `json:"priority,omitempty"` // defaults to P3
+	Assignee string   `json:"assignee,omitempty"`
+	EventIDs []string `json:"event_ids,omitempty"`
+}
+
+type UpdateIncidentRequest struct {
+	Title    *string `json:"title,omitempty"`
+	Priority *string `json:"priority,omitempty"`
+	Status   *string `json:"status,omitempty"`
+	Assignee *string `json:"assignee,omitempty"` // "" unassigns
+}
+
+type CreateIncidentCommentRequest struct {
+	Author string `json:"author"`
+	Body   string `json:"body"`
+}
+
+type LinkIncidentEventsRequest struct {
+	EventIDs []string `json:"event_ids"`
+}
+
+func isActiveIncidentStatus(status string) bool {
+	return status == incidentOpen || status == incidentAcknowledged
+}
+
+// apply validates the requested changes and applies them to the incident. Moving to resolved or false_positive
+// sets ResolvedAt, and reopening clears it.
+func (req *UpdateIncidentRequest) apply(inc *Incident, now time.Time) error {
+	if req.Title != nil {
+		title := strings.TrimSpace(*req.Title)
+		if title == "" || len(title) > maxIncidentTitleLen {
+			return errors.New("title must be between 1 and 200 characters")
+		}
+		inc.Title = title
+	}
+	if req.Priority != nil {
+		if !slices.Contains(findingPriorities, *req.Priority) {
+			return errors.New("priority must be one of P1 to P5")
+		}
+		inc.Priority = *req.Priority
+	}
+	if req.Assignee != nil {
+		inc.Assignee = strings.TrimSpace(*req.Assignee)
+	}
+	if req.Status != nil && *req.Status != inc.Status {
+		if !slices.Contains(incidentStatuses, *req.Status) {
+			return errors.New("status must be one of " + strings.Join(incidentStatuses, ", "))
+		}
+		inc.Status = *req.Status
+		if isActiveIncidentStatus(inc.Status) {
+			inc.ResolvedAt = nil
+		} else {
+			inc.ResolvedAt = &now
+		}
+	}
+	inc.UpdatedAt = now
+	return nil
+}
+
+func (s *Server) handleCreateIncident(c echo.Context) error {
+	var req CreateIncidentRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid request body")
+	}
+	req.Title = strings.TrimSpace(req.Title)
+	if req.Title == "" || len(req.Title) > maxIncidentTitleLen {
+		return echo.NewHTTPError(http.StatusBadRequest, "title must be between 1 and 200 characters")
+	}
+	req.Category = strings.TrimSpace(req.Category)
+	if req.Category == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "category is required")
+	}
+	if req.Priority == "" {
+		req.Priority = defaultIncidentPriority
+	}
+	if !slices.Contains(findingPriorities, req.Priority) {
+		return echo.NewHTTPError(http.StatusBadRequest, "priority must be one of P1 to P5")
+	}
+
+	ctx := c.Request().Context()
+	eventIDs, err := s.validateIncidentEventIDs(ctx, req.EventIDs)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	inc := &Incident{
+		ID:        uuid.NewString(),
+		Title:     req.Title,
+		Category:  req.Category,
+		Priority:  req.Priority,
+		Status:    incidentOpen,
+		Assignee:  strings.TrimSpace(req.Assignee),
+		EventIDs:  eventIDs,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := insertIncidentWith(ctx, s.db, inc); err != nil {
+		return incidentError(err)
+	}
+	return c.JSON(http.StatusCreated, inc)
+}
+
+func (s *Server) handleListIncidents(c echo.Context) error {
+	limit, err := parseLimitParam(c, defaultIncidentsLimit, maxIncidentsLimit)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	status := strings.TrimSpace(c.QueryParam("status"))
+	if status != "" && !slices.Contains(incidentStatuses, status) {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid status")
+	}
+
+	incidents, err := s.listIncidents(c.Request().Context(), IncidentQuery{
+		Status:   status,
+		Assignee: strings.TrimSpace(c.QueryParam("assignee")),
+		Category: strings.TrimSpace(c.QueryParam("category")),
+		JobID:    strings.TrimSpace(c.QueryParam("job_id")),
+		Limit:    limit,
+	})
+	if err != nil {
+		return incidentError(err)
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"incidents": incidents,
+		"count":     len(incidents),
+	})
+}
+
+func (s *Server) handleGetIncident(c echo.Context) error {
+	inc, err := s.loadIncident(c.Request().Context(), c.Param("id"))
+	if err != nil {
+		return incidentError(err)
+	}
+	return c.JSON(http.StatusOK, inc)
+}
+
+func (s *Server) handleUpdateIncident(c echo.Context) error {
+	var req UpdateIncidentRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid request body")
+	}
+
+	ctx := c.Request().Context()
+	var invalid error
+	err := s.modifyIncident(ctx, c.Param("id"), func(inc *Incident) error {
+		invalid = req.apply(inc, time.Now().UTC())
+		return invalid
+	})
+	if invalid != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, invalid.Error())
+	}
+	if err != nil {
+		return incidentError(err)
+	}
+
+	inc, err := s.loadIncident(ctx, c.Param("id"))
+	if err != nil {
+		return incidentError(err)
+	}
+	return c.JSON(http.StatusOK, inc)
+}
+
+func (s *Server) handleCreateIncidentComment(c echo.Context) error {
+	var req CreateIncidentCommentRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid request body")
+	}
+	req.Author = strings.TrimSpace(req.Author)
+	req.Body = strings.TrimSpace(req.Body)
+	if req.Author == "" || req.Body == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "author and body are required")
+	}
+
+	comment := &IncidentComment{
+		ID:        uuid.NewString(),
+		Author:    req.Author,
+		Body:      req.Body,
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := s.insertIncidentComment(c.Request().Context(), c.Param("id"), comment); err != nil {
+		return incidentError(err)
+	}
+	return c.JSON(http.StatusCreated, comment)
+}
+
+func (s *Server) handleLinkIncidentEvents(c echo.Context) error {
+	var req LinkIncidentEventsRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid request body")
+	}
+	if len(req.EventIDs) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "event_ids is required")
+	}
+
+	ctx := c.Request().Context()
+	eventIDs, err := s.validateIncidentEventIDs(ctx, req.EventIDs)
+	if err != nil {
+		return err
+	}
+	inc, err := s.linkIncidentEvents(ctx, c.Param("id"), eventIDs)
+	if err != nil {
+		return incidentError(err)
+	}
+	return c.JSON(http.StatusOK, inc)
+}
+
+func (s *Server) handleUnlinkIncidentEvent(c echo.Context) error {
+	inc, err := s.unlinkIncidentEvent(c.Request().Context(), c.Param("id"), c.Param("event_id"))
+	if err != nil {
+		return incidentError(err)
+	}
+	return c.JSON(http.StatusOK, inc)
+}
+
+// validateIncidentEventIDs rejects event IDs that don't exist, and returns the rest without duplicates.
+func (s *Server) validateIncidentEventIDs(ctx context.Context, ids []string) ([]string, error) {
+	ids = uniqueStrings(ids)
+	if len(ids) == 0 {
+		return []string{}, nil
+	}
+
+	events, err := s.fetchEventsByIDs(ctx, ids)
+	if err != nil {
+		slog.Error("failed to look up incident events", "error", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to look up events")
+	}
+	found := make(map[string]bool, len(events))
+	for _, ev := range events {
+		found[ev.Id] = true
+	}
+	for _, id := range ids {
+		if !found[id] {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "unknown event ID "+id)
+		}
+	}
+	return ids, nil
+}
+
+func incidentError(err error) error {
+	if errors.Is(err, errIncidentNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, "incident not found")
+	}
+	slog.Error("incident operation failed", "error", err)
+	return echo.NewHTTPError(http.StatusInternalServerError, "incident operation failed")
+}
+
+// attachTriageFindings files the findings of a completed job under incidents. It runs after the job is saved, so a
+// failure here leaves the job's results intact.
+func (s *Server) attachTriageFindings(ctx context.Context, job *TriageJob) {
+	if job.Status != "complete" || len(job.Findings) == 0 {
+		return
+	}
+	attached, opened, err := s.fileFindingsAsIncidents(ctx, job)
+	if err != nil {
+		slog.Error("failed to attach triage findings to incidents", "job_id", job.ID, "error", err)
+		return
+	}
+	slog.Info("triage findings filed as incidents", "job_id", job.ID, "attached", attached, "opened", opened)
+}
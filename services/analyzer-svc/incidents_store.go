@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// IncidentQuery selects incidents, most recently updated first. Empty fields don't filter.
+type IncidentQuery struct {
+	Status   string
+	Assignee string
+	Category string
+	JobID    string // incidents with a finding of this triage job
+	Limit    int
+}
+
+const incidentSelect = `SELECT id, title, category, priority, status, assignee, event_ids, created_at, updated_at,
+	resolved_at
+	FROM incidents`
+
+// mergeIncidentEventIDs is the SET expression adding the text[] parameter to event_ids, without duplicates.
+const mergeIncidentEventIDs = `event_ids = (SELECT COALESCE(jsonb_agg(DISTINCT eid ORDER BY eid), '[]')
+	FROM jsonb_array_elements_text(event_ids || to_jsonb(%s::text[])) AS eid)`
+
+func scanIncident(row pgx.Row) (*Incident, error) {
+	var inc Incident
+	var eventIDs []byte
+	err := row.Scan(&inc.ID, &inc.Title, &inc.Category, &inc.Priority, &inc.Status, &inc.Assignee, &eventIDs,
+		&inc.CreatedAt, &inc.UpdatedAt, &inc.ResolvedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(eventIDs, &inc.EventIDs); err != nil {
+		return nil, err
+	}
+	return &inc, nil
+}
+
+func insertIncidentWith(ctx context.Context, db dbExecutor, inc *Incident) error {
+	eventIDs, err := json.Marshal(nonNil(inc.EventIDs))
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(ctx,
+		`INSERT INTO incidents (id, title, category, priority, status, assignee, event_ids, created_at, updated_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $8)`,
+		inc.ID, inc.Title, inc.Category, inc.Priority, inc.Status, inc.Assignee, eventIDs, inc.CreatedAt,
+	)
+	return err
+}
+
+// loadIncident returns the incident with its comments and attached findings.
+func (s *Server) loadIncident(ctx context.Context, id string) (*Incident, error) {
+	inc, err := scanIncident(s.db.QueryRow(ctx, incidentSelect+` WHERE id = $1`, id))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, errIncidentNotFound
+		}
+		return nil, err
+	}
+
+	rows, err := s.db.Query(ctx,
+		`SELECT id, author, body, created_at FROM incident_comments WHERE incident_id = $1 ORDER BY created_at`,
+		id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var comment IncidentComment
+		if err := rows.Scan(&comment.ID, &comment.Author, &comment.Body, &comment.CreatedAt); err != nil {
+			return nil, err
+		}
+		inc.Comments = append(inc.Comments, comment)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = s.db.Query(ctx,
+		`SELECT job_id, seq, priority, summary, event_ids, attached_at FROM incident_findings
+		 WHERE incident_id = $1 ORDER BY attached_at, seq`,
+		id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var f IncidentFinding
+		var eventIDs []byte
+		if err := rows.Scan(&f.JobID, &f.Seq, &f.Priority, &f.Summary, &eventIDs, &f.AttachedAt); err != nil {
+			return nil, err
+		}
+		_ = json.Unmarshal(eventIDs, &f.EventIDs)
+		inc.Findings = append(inc.Findings, f)
+	}
+	return inc, rows.Err()
+}
+
+// listIncidents returns incidents without their comments and findings.
+func (s *Server) listIncidents(ctx context.Context, q IncidentQuery) ([]Incident, error) {
+	conds := &sqlConditions{}
+	if q.Status != "" {
+		conds.add("status = %s", q.Status)
+	}
+	if q.Assignee != "" {
+		conds.add("assignee = %s", q.Assignee)
+	}
+	if q.Category != "" {
+		conds.add("lower(category) = lower(%s)", q.Category)
+	}
+	if q.JobID != "" {
+		conds.add("id IN (SELECT incident_id FROM incident_findings WHERE job_id = %s)", q.JobID)
+	}
+	query := incidentSelect + conds.whereClause() + ` ORDER BY updated_at DESC LIMIT ` + conds.nextPlaceholder()
+	args := append(conds.args, q.Limit)
+
+	rows, err := s.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	incidents := make([]Incident, 0, q.Limit)
+	for rows.Next() {
+		inc, err := scanIncident(rows)
+		if err != nil {
+			return nil, err
+		}
+		incidents = append(incidents, *inc)
+	}
+	return incidents, rows.Err()
+}
+
+// modifyIncident applies a change to the fields editable through PATCH, with the incident row locked from read to
+// write, so that the change can't undo a concurrent update such as triage raising the priority. Event IDs are
+// changed by the link functions only. Returns the error of change as is, without saving anything.
+func (s *Server) modifyIncident(ctx context.Context, id string, change func(inc *Incident) error) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	inc, err := scanIncident(tx.QueryRow(ctx, incidentSelect+` WHERE id = $1 FOR UPDATE`, id))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return errIncidentNotFound
+		}
+		return err
+	}
+	if err := change(inc); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx,
+		`UPDATE incidents SET title = $2, priority = $3, status = $4, assignee = $5, resolved_at = $6, updated_at = $7
+		 WHERE id = $1`,
+		inc.ID, inc.Title, inc.Priority, inc.Status, inc.Assignee, inc.ResolvedAt, inc.UpdatedAt,
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func (s *Server) insertIncidentComment(ctx context.Context, incidentID string, comment *IncidentComment) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	tag, err := tx.Exec(ctx, `UPDATE incidents SET updated_at = $2 WHERE id = $1`, incidentID, comment.CreatedAt)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errIncidentNotFound
+	}
+	_, err = tx.Exec(ctx,
+		`INSERT INTO incident_comments (id, incident_id, author, body, created_at) VALUES ($1, $2, $3, $4, $5)`,
+		comment.ID, incidentID, comment.Author, comment.Body, comment.CreatedAt,
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func (s *Server) linkIncidentEvents(ctx context.Context, id string, eventIDs []string) (*Incident, error) {
+	inc, err := scanIncident(s.db.QueryRow(ctx,
+		`UPDATE incidents SET `+fmt.Sprintf(mergeIncidentEventIDs, "$2")+`, updated_at = NOW()
+		 WHERE id = $1
+		 RETURNING id, title, category, priority, status, assignee, event_ids, created_at, updated_at, resolved_at`,
+		id, eventIDs,
+	))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errIncidentNotFound
+	}
+	return inc, err
+}
+
+func (s *Server) unlinkIncidentEvent(ctx context.Context, id, eventID string) (*Incident, error) {
+	inc, err := scanIncident(s.db.QueryRow(ctx,
+		`UPDATE incidents SET event_ids = event_ids - $2::text, updated_at = NOW()
+		 WHERE id = $1
+		 RETURNING id, title, category, priority, status, assignee, event_ids, created_at, updated_at, resolved_at`,
+		id, eventID,
+	))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errIncidentNotFound
+	}
+	return inc, err
+}
+
+// fileFindingsAsIncidents attaches every finding of the job to the most recently updated active incident of the same
+// category that shares evidence with it, or has an attached finding naming one of its entities (see
+// incidentEntities), or else opens a new incident for it. Findings without evidence nor entities are
+// attached to an incident with a finding of the same summary. The incident takes the union of the event IDs and the
+// highest priority. Findings that were filed already are skipped.
+func (s *Server) fileFindingsAsIncidents(ctx context.Context, job *TriageJob) (attached, opened int, err error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	rows, err := tx.Query(ctx, `SELECT seq FROM incident_findings WHERE job_id = $1`, job.ID)
+	if err != nil {
+		return 0, 0, err
+	}
+	filed, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		return 0, 0, err
+	}
+
+	now := time.Now().UTC()
+	for i, f := range job.Findings {
+		if slices.Contains(filed, i+1) {
+			continue
+		}
+
+		// serialize with other replicas filing findings of the same category, so that two runs finding the same
+		// issue at once don't both open an incident
+		if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext('incident:' || lower($1)))`, f.Category); err != nil {
+			return 0, 0, err
+		}
+
+		eventIDs := nonNil(uniqueStrings(f.EventIDs))
+		entities := nonNil(incidentEntities(f))
+		var summary *string
+		if trimmed := strings.TrimSpace(f.Summary); trimmed != "" {
+			summary = &trimmed
+		}
+
+		var incidentID string
+		err := tx.QueryRow(ctx,
+			`SELECT id FROM incidents i
+			 WHERE status IN ('open', 'acknowledged') AND lower(category) = lower($1)
+			   AND (event_ids ?| $2::text[]
+			        OR EXISTS (SELECT 1 FROM incident_findings f WHERE f.incident_id = i.id
+			                   AND (f.entities ?| $3::text[] OR lower(trim(f.summary)) = lower($4))))
+			 ORDER BY updated_at DESC LIMIT 1`,
+			f.Category, eventIDs, entities, summary,
+		).Scan(&incidentID)
+
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			inc := &Incident{
+				ID:        uuid.NewString(),
+				Title:     incidentTitle(f),
+				Category:  f.Category,
+				Priority:  f.Priority,
+				Status:    incidentOpen,
+				EventIDs:  eventIDs,
+				CreatedAt: now,
+				UpdatedAt: now,
+			}
+			if err := insertIncidentWith(ctx, tx, inc); err != nil {
+				return 0, 0, err
+			}
+			incidentID = inc.ID
+			opened++
+		case err != nil:
+			return 0, 0, err
+		default:
+			// P1 sorts before P5
+			_, err := tx.Exec(ctx,
+				`UPDATE incidents SET `+fmt.Sprintf(mergeIncidentEventIDs, "$2")+`,
+				     priority = LEAST(priority, $3), updated_at = $4
+				 WHERE id = $1`,
+				incidentID, eventIDs, f.Priority, now,
+			)
+			if err != nil {
+				return 0, 0, err
+			}
+			attached++
+		}
+
+		findingIDs, _ := json.Marshal(eventIDs)
+		entityList, _ := json.Marshal(entities)
+		_, err = tx.Exec(ctx,
+			`INSERT INTO incident_findings (incident_id, job_id, seq, priority, summary, event_ids, entities, attached_at)
+			 VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+			incidentID, job.ID, i+1, f.Priority, f.Summary, findingIDs, entityList, now,
+		)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return attached, opened, tx.Commit(ctx)
+}
+
+// incidentEntityPattern matches the entities that tell an incident apart: IPv4 addresses, emails and file hashes. Host
+// and file names are left out, since unrelated findings of a category often name the same ones.
+var incidentEntityPattern = regexp.MustCompile(
+	`\b(?:\d{1,3}\.){3}\d{1,3}\b|[\w.+-]+@[\w-]+(?:\.[\w-]+)+|\b[a-fA-F0-9]{32,}\b`)
+
+// incidentEntities returns the entities named in the summary of a finding, lowercased. They are matched whole, so
+// that 10.0.0.1 does not match 10.0.0.12.
+func incidentEntities(f TriageFinding) []string {
+	matches := incidentEntityPattern.FindAllString(f.Summary, -1)
+	for i, m := range matches {
+		matches[i] = strings.ToLower(m)
+	}
+	return uniqueStrings(matches)
+}
+
+// incidentTitle is the first line of the finding's summary, or its category when there is no summary.
+func incidentTitle(f TriageFinding) string {
+	title, _, _ := strings.Cut(strings.TrimSpace(f.Summary), "\n")
+	if title == "" {
+		return f.Category
+	}
+	return truncateString(title, maxIncidentTitleLen)
+}
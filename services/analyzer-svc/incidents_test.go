@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andreionoie/llm-event-analysis/pkg/common"
+	"github.com/labstack/echo/v4"
+)
+
+func TestUpdateIncidentRequestApply(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	inc := &Incident{Title: "brute force", Priority: "P2", Status: incidentOpen}
+
+	str := func(s string) *string { return &s }
+
+	req := UpdateIncidentRequest{Status: str(incidentFalsePositive), Assignee: str(" alice ")}
+	if err := req.apply(inc, now); err != nil {
+		t.Fatal(err)
+	}
+	if inc.Status != incidentFalsePositive || inc.Assignee != "alice" {
+		t.Errorf("unexpected incident %+v", inc)
+	}
+	if inc.ResolvedAt == nil || !inc.ResolvedAt.Equal(now) || !inc.UpdatedAt.Equal(now) {
+		t.Errorf("closing should set resolved_at, got %v", inc.ResolvedAt)
+	}
+
+	// reopening clears resolved_at
+	req = UpdateIncidentRequest{Status: str(incidentAcknowledged)}
+	if err := req.apply(inc, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if inc.ResolvedAt != nil {
+		t.Errorf("reopening should clear resolved_at, got %v", inc.ResolvedAt)
+	}
+
+	for _, bad := range []UpdateIncidentRequest{
+		{Status: str("closed")},
+		{Priority: str("P0")},
+		{Title: str("  ")},
+	} {
+		if err := bad.apply(inc, now); err == nil {
+			t.Errorf("expected %+v to be rejected", bad)
+		}
+	}
+}
+
+func TestIncidentTitle(t *testing.T) {
+	cases := []struct {
+		finding TriageFinding
+		want    string
+	}{
+		{TriageFinding{Category: "malware", Summary: "beacon to 10.0.0.5\nseen on 3 hosts"}, "beacon to 10.0.0.5"},
+		{TriageFinding{Category: "malware", Summary: " "}, "malware"},
+	}
+	for _, tc := range cases {
+		if got := incidentTitle(tc.finding); got != tc.want {
+			t.Errorf("incidentTitle(%q) = %q, want %q", tc.finding.Summary, got, tc.want)
+		}
+	}
+}
+
+// insertTestTriageJob stores a completed job with the given findings, which incident findings refer to.
+func insertTestTriageJob(t *testing.T, s *Server, id string, findings ...TriageFinding) *TriageJob {
+	t.Helper()
+	now := time.Now().UTC()
+	tr := common.TimeRange{Start: now.Add(-time.Hour), End: now}
+	job := &TriageJob{ID: id, TimeRange: tr, Status: "complete", Findings: findings, CreatedAt: now, UpdatedAt: now}
+	if err := s.insertTriageJob(context.Background(), job, triageResultsCacheKey(tr, nil)); err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+func TestIncidentEntities(t *testing.T) {
+	got := incidentEntities(TriageFinding{
+		Summary: "vssadmin.exe run on web-01.corp.example by Bob@Corp.example from 10.0.0.12, dropping " +
+			"d41d8cd98f00b204e9800998ecf8427e",
+	})
+	want := []string{"bob@corp.example", "10.0.0.12", "d41d8cd98f00b204e9800998ecf8427e"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestFileFindingsAsIncidents(t *testing.T) {
+	s := &Server{db: newTestDB(t)}
+	ctx := context.Background()
+
+	first := insertTestTriageJob(t, s, "job-1",
+		TriageFinding{Priority: "P3", Category: "brute_force", Summary: "failed logins from 203.0.113.7", EventIDs: []string{"e1"}},
+		TriageFinding{Priority: "P3", Category: "malware", Summary: "beacon to 198.51.100.23"},
+	)
+	if attached, opened, err := s.fileFindingsAsIncidents(ctx, first); err != nil || attached != 0 || opened != 2 {
+		t.Fatalf("first run: attached %d, opened %d, err %v", attached, opened, err)
+	}
+
+	second := insertTestTriageJob(t, s, "job-2",
+		// shares evidence
+		TriageFinding{Priority: "P1", Category: "brute_force", Summary: "password spraying", EventIDs: []string{"e1", "e2"}},
+		// cites no event, names the same address
+		TriageFinding{Priority: "P2", Category: "malware", Summary: "more traffic to 198.51.100.23 from dropper.exe"},
+		// cites no event, names an address that only starts like the tracked one
+		TriageFinding{Priority: "P2", Category: "malware", Summary: "beacon to 198.51.100.2 from dropper.exe"},
+	)
+	if attached, opened, err := s.fileFindingsAsIncidents(ctx, second); err != nil || attached != 2 || opened != 1 {
+		t.Fatalf("second run: attached %d, opened %d, err %v", attached, opened, err)
+	}
+	// filing the same job again changes nothing
+	if attached, opened, err := s.fileFindingsAsIncidents(ctx, second); err != nil || attached != 0 || opened != 0 {
+		t.Fatalf("refiling: attached %d, opened %d, err %v", attached, opened, err)
+	}
+
+	incidents, err := s.listIncidents(ctx, IncidentQuery{Category: "brute_force", Limit: 10})
+	if err != nil || len(incidents) != 1 {
+		t.Fatalf("expected one brute force incident, got %v, %v", incidents, err)
+	}
+	if inc := incidents[0]; inc.Priority != "P1" || strings.Join(inc.EventIDs, ",") != "e1,e2" {
+		t.Errorf("attaching should merge evidence and raise the priority, got %s %v", inc.Priority, inc.EventIDs)
+	}
+
+	incidents, err = s.listIncidents(ctx, IncidentQuery{Category: "malware", Limit: 10})
+	if err != nil || len(incidents) != 2 {
+		t.Fatalf("expected two malware incidents, got %v, %v", incidents, err)
+	}
+	for _, inc := range incidents {
+		full, err := s.loadIncident(ctx, inc.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantFindings := 1
+		if strings.Contains(inc.Title, "198.51.100.23") {
+			wantFindings = 2
+		}
+		if len(full.Findings) != wantFindings {
+			t.Errorf("incident %q has %d findings, want %d", inc.Title, len(full.Findings), wantFindings)
+		}
+	}
+}
+
+func TestPatchIncidentKeepsConcurrentPriorityRaise(t *testing.T) {
+	s := &Server{db: newTestDB(t)}
+	ctx := context.Background()
+
+	now := time.Now().UTC()
+	inc := &Incident{ID: "inc-1", Title: "brute force", Category: "brute_force", Priority: "P3", Status: incidentOpen,
+		CreatedAt: now, UpdatedAt: now}
+	if err := insertIncidentWith(ctx, s.db, inc); err != nil {
+		t.Fatal(err)
+	}
+
+	// triage raises the priority while the edit is in progress; it waits for the edit instead of being undone
+	raised := make(chan error, 1)
+	err := s.modifyIncident(ctx, inc.ID, func(inc *Incident) error {
+		go func() {
+			_, err := s.db.Exec(ctx, `UPDATE incidents SET priority = LEAST(priority, 'P1') WHERE id = $1`, inc.ID)
+			raised <- err
+		}()
+		time.Sleep(100 * time.Millisecond)
+		inc.Assignee = "alice"
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-raised; err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.loadIncident(ctx, inc.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Priority != "P1" || got.Assignee != "alice" {
+		t.Errorf("expected both changes to be kept, got priority %s, assignee %q", got.Priority, got.Assignee)
+	}
+
+	// PATCH only changes the fields it is given, and saves nothing when one is invalid
+	patch := func(body string) int {
+		req := httptest.NewRequest(http.MethodPatch, "/incidents/"+inc.ID, strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(req, rec)
+		c.SetParamNames("id")
+		c.SetParamValues(inc.ID)
+		if err := s.handleUpdateIncident(c); err != nil {
+			if he, ok := err.(*echo.HTTPError); ok {
+				return he.Code
+			}
+			t.Fatal(err)
+		}
+		return rec.Code
+	}
+	if code := patch(`{"status":"acknowledged"}`); code != http.StatusOK {
+		t.Fatalf("PATCH returned %d", code)
+	}
+	if code := patch(`{"status":"resolved","priority":"P0"}`); code != http.StatusBadRequest {
+		t.Fatalf("invalid PATCH returned %d", code)
+	}
+	got, err = s.loadIncident(ctx, inc.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != incidentAcknowledged || got.Priority != "P1" || got.Assignee != "alice" {
+		t.Errorf("unexpected incident after PATCH: %s %s %q", got.Status, got.Priority, got.Assignee)
+	}
+}
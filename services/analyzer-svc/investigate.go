@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/andreionoie/llm-event-analysis/pkg/common"
+	"github.com/labstack/echo/v4"
+	"google.golang.org/genai"
+)
+
+const (
+	agentActionTool  = "tool"
+	agentActionFinal = "final"
+)
+
+type InvestigateRequest struct {
+	Question  string            `json:"question"`
+	TimeRange *common.TimeRange `json:"time_range,omitempty"`
+	MaxSteps  int               `json:"max_steps,omitempty"`
+}
+
+type InvestigateResponse struct {
+	Answer        string     `json:"answer"`
+	StepsUsed     int        `json:"steps_used"`
+	Truncated     bool       `json:"truncated,omitempty"` // step limit reached before the model concluded
+	ToolCalls     []ToolCall `json:"tool_calls"`
+	PromptVersion string     `json:"prompt_version,omitempty"`
+}
+
+// ToolCall is one audited step of an investigation.
+type ToolCall struct {
+	Step   int      `json:"step"`
+	Tool   string   `json:"tool"`
+	Reason string   `json:"reason,omitempty"`
+	Args   ToolArgs `json:"args"`
+	Result string   `json:"result,omitempty"`
+	Error  string   `json:"error,omitempty"`
+}
+
+// ArgsJSON renders the arguments compactly for the prompt transcript.
+func (t ToolCall) ArgsJSON() string {
+	data, _ := json.Marshal(t.Args)
+	return string(data)
+}
+
+type InvestigatePromptData struct {
+	Tools     []investigationTool
+	Question  string
+	TimeRange *common.TimeRange
+	Steps     []ToolCall
+	FinalStep bool
+}
+
+// agentStep is the structured output of every step: either a tool call, or the final answer.
+type agentStep struct {
+	Action string   `json:"action"`
+	Tool   string   `json:"tool"`
+	Reason string   `json:"reason"`
+	Args   ToolArgs `json:"args"`
+	Answer string   `json:"answer"`
+}
+
+var agentStepSchema = &genai.Schema{
+	Type: genai.TypeObject,
+	Properties: map[string]*genai.Schema{
+		"action": {
+			Type:        genai.TypeString,
+			Description: "Call a tool, or give the final answer",
+			Enum:        []string{agentActionTool, agentActionFinal},
+		},
+		"tool": {
+			Type:        genai.TypeString,
+			Description: "Tool to call when action is tool",
+			Enum:        investigationToolNames(),
+		},
+		"reason": {Type: genai.TypeString, Description: "Why this tool call helps answer the question"},
+		"args": {
+			Type: genai.TypeObject,
+			Properties: map[string]*genai.Schema{
+				"start":  {Type: genai.TypeString, Description: "RFC3339 start of the time range"},
+				"end":    {Type: genai.TypeString, Description: "RFC3339 end of the time range"},
+				"limit":  {Type: genai.TypeInteger, Description: "Maximum number of results"},
+				"field":  {Type: genai.TypeString, Description: "Field to count by: source, event_type or severity"},
+				"entity": {Type: genai.TypeString, Description: "Entity to look up, e.g. an IP address or user name"},
+			},
+		},
+		"answer": {Type: genai.TypeString, Description: "Final answer when action is final"},
+	},
+	Required: []string{"action"},
+}
+
+func (s *Server) handleInvestigate(c echo.Context) error {
+	var req InvestigateRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid request body")
+	}
+	if strings.TrimSpace(req.Question) == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "question is required")
+	}
+	if req.TimeRange != nil {
+		if err := req.TimeRange.Validate(); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+	}
+
+	maxSteps := req.MaxSteps
+	if maxSteps <= 0 || maxSteps > s.cfg.InvestigationMaxSteps {
+		maxSteps = s.cfg.InvestigationMaxSteps
+	}
+
+	resp, err := s.investigate(c.Request().Context(), req.Question, req.TimeRange, maxSteps)
+	if err != nil {
+		slog.Error("investigation failed", "error", err)
+		return llmHTTPError(err, "investigation failed")
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+// investigate runs the agent loop: each step the model either calls a tool, whose result is fed back in the next
+// step, or concludes. The loop is bounded by maxSteps.
+func (s *Server) investigate(ctx context.Context, question string, timeRange *common.TimeRange, maxSteps int) (*InvestigateResponse, error) {
+	resp := &InvestigateResponse{ToolCalls: []ToolCall{}}
+
+	// one variant for every step, so that the transcript is always rendered the same way
+	prompts := s.prompts.forKey("")
+	for step := 1; step <= maxSteps; step++ {
+		finalStep := step == maxSteps
+		prompt, err := prompts.renderInvestigate(InvestigatePromptData{
+			Tools:     investigationTools,
+			Question:  question,
+			TimeRange: timeRange,
+			Steps:     resp.ToolCalls,
+			FinalStep: finalStep,
+		})
+		if err != nil {
+			return nil, err
+		}
+		resp.PromptVersion = prompt.Config.Version
+
+		raw, err := s.generateContentWithSchema(ctx, prompt, agentStepSchema)
+		if err != nil {
+			return nil, err
+		}
+		var next agentStep
+		if err := json.Unmarshal([]byte(raw), &next); err != nil {
+			return nil, fmt.Errorf("failed to parse agent step %d: %w", step, err)
+		}
+		resp.StepsUsed = step
+
+		if next.Action == agentActionFinal || finalStep {
+			resp.Answer = strings.TrimSpace(next.Answer)
+			if next.Action != agentActionFinal {
+				resp.Truncated = true
+				if resp.Answer == "" {
+					resp.Answer = fmt.Sprintf("investigation stopped after %d steps without a conclusion", step)
+				}
+			}
+			return resp, nil
+		}
+
+		call := ToolCall{Step: step, Tool: next.Tool, Reason: next.Reason, Args: next.Args}
+		result, err := s.runTool(ctx, next.Tool, next.Args, timeRange)
+		if err != nil {
+			// tool errors go back to the model, which can correct its arguments in the next step
+			slog.Debug("investigation tool failed", "tool", next.Tool, "error", err)
+			call.Error = err.Error()
+		} else {
+			call.Result = result
+		}
+		resp.ToolCalls = append(resp.ToolCalls, call)
+	}
+
+	return resp, nil
+}
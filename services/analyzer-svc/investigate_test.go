@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/andreionoie/llm-event-analysis/pkg/common"
+)
+
+// sequenceProvider answers each call with the next scripted response.
+type sequenceProvider struct {
+	responses []string
+	calls     int
+}
+
+func (p *sequenceProvider) Name() string { return "sequence" }
+
+func (p *sequenceProvider) Generate(context.Context, *LLMRequest) (*LLMResponse, error) {
+	text := p.responses[min(p.calls, len(p.responses)-1)]
+	p.calls++
+	return &LLMResponse{Text: text}, nil
+}
+
+func (p *sequenceProvider) GenerateStream(ctx context.Context, req *LLMRequest, onChunk func(string) error) (*LLMResponse, error) {
+	resp, _ := p.Generate(ctx, req)
+	return resp, onChunk(resp.Text)
+}
+
+func newSequenceTestServer(t *testing.T, responses ...string) (*Server, *sequenceProvider) {
+	t.Helper()
+	prompts, err := NewPromptLibrary(promptsFS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := &sequenceProvider{responses: responses}
+	return &Server{
+		cfg:         Config{MaxEvents: 100, InvestigationMaxSteps: 6},
+		prompts:     prompts,
+		llm:         map[string]LLMProvider{"sequence": provider},
+		llmDefault:  "sequence",
+		llmBreakers: newLLMBreakers(),
+	}, provider
+}
+
+func TestInvestigateRecordsToolCalls(t *testing.T) {
+	s, provider := newSequenceTestServer(t,
+		`{"action":"tool","tool":"count_by_field","reason":"group","args":{"field":"ip"}}`,
+		`{"action":"final","answer":"nothing conclusive"}`,
+	)
+
+	resp, err := s.investigate(context.Background(), "who is scanning us?", nil, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Answer != "nothing conclusive" || resp.StepsUsed != 2 || resp.Truncated {
+		t.Errorf("unexpected response %+v", resp)
+	}
+	if len(resp.ToolCalls) != 1 || resp.ToolCalls[0].Tool != "count_by_field" || resp.ToolCalls[0].Error == "" {
+		t.Errorf("expected one failed count_by_field call, got %+v", resp.ToolCalls)
+	}
+	if provider.calls != 2 {
+		t.Errorf("provider called %d times, want 2", provider.calls)
+	}
+}
+
+func TestInvestigateStepLimit(t *testing.T) {
+	s, provider := newSequenceTestServer(t, `{"action":"tool","tool":"no_such_tool"}`)
+
+	resp, err := s.investigate(context.Background(), "q", nil, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Truncated || resp.StepsUsed != 3 || len(resp.ToolCalls) != 2 || resp.Answer == "" {
+		t.Errorf("unexpected response %+v", resp)
+	}
+	if provider.calls != 3 {
+		t.Errorf("provider called %d times, want 3", provider.calls)
+	}
+}
+
+func TestResolveToolTimeRange(t *testing.T) {
+	def := &common.TimeRange{
+		Start: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+		End:   time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC),
+	}
+
+	if got, err := resolveToolTimeRange(ToolArgs{}, def); err != nil || got != def {
+		t.Errorf("no args should keep the default range, got %v, %v", got, err)
+	}
+
+	got, err := resolveToolTimeRange(ToolArgs{Start: "2026-01-01T12:00:00Z"}, def)
+	if err != nil || !got.Start.Equal(def.Start.Add(12*time.Hour)) || !got.End.Equal(def.End) {
+		t.Errorf("start override not applied: %v, %v", got, err)
+	}
+
+	got, err = resolveToolTimeRange(ToolArgs{Start: "2025-12-01T00:00:00Z", End: "2026-01-05T00:00:00Z"}, def)
+	if err != nil || !got.Start.Equal(def.Start) || !got.End.Equal(def.End) {
+		t.Errorf("range should be clamped to the default range: %v, %v", got, err)
+	}
+	if _, err := resolveToolTimeRange(ToolArgs{Start: "2026-01-03T00:00:00Z", End: "2026-01-04T00:00:00Z"}, def); err == nil {
+		t.Error("range outside the default range should be rejected")
+	}
+
+	if _, err := resolveToolTimeRange(ToolArgs{Start: "yesterday"}, def); err == nil {
+		t.Error("invalid start should be rejected")
+	}
+	if _, err := resolveToolTimeRange(ToolArgs{Start: "2026-01-01T00:00:00Z"}, nil); err == nil {
+		t.Error("open-ended range should be rejected")
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/andreionoie/llm-event-analysis/pkg/common"
+)
+
+const (
+	toolDefaultLimit     = 20
+	toolResultMaxChars   = 4000
+	toolPayloadMaxLength = 150
+)
+
+// ToolArgs are the arguments the model may pass to any tool; each tool reads the ones it needs.
+type ToolArgs struct {
+	Start  string `json:"start,omitempty"`
+	End    string `json:"end,omitempty"`
+	Limit  int    `json:"limit,omitempty"`
+	Field  string `json:"field,omitempty"`
+	Entity string `json:"entity,omitempty"`
+}
+
+type FieldCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+type investigationTool struct {
+	Name        string
+	Description string
+	run         func(ctx context.Context, s *Server, args ToolArgs, timeRange *common.TimeRange, limit int) (string, error)
+}
+
+// countableFields maps the field names exposed to the model onto event columns.
+var countableFields = map[string]string{
+	"source":     "source",
+	"event_type": "event_type",
+	"type":       "event_type",
+	"severity":   "severity",
+}
+
+var investigationTools = []investigationTool{
+	{
+		Name:        "fetch_events",
+		Description: "newest events in the time range, with ID, timestamp, severity, source, type and payload",
+		run: func(ctx context.Context, s *Server, _ ToolArgs, timeRange *common.TimeRange, limit int) (string, error) {
+			events, err := s.fetchEvents(ctx, timeRange, limit)
+			if err != nil {
+				return "", err
+			}
+			return formatToolEvents(events), nil
+		},
+	},
+	{
+		Name:        "fetch_summaries",
+		Description: "newest 5-minute summary buckets in the time range, with total counts by severity and type",
+		run: func(ctx context.Context, s *Server, _ ToolArgs, timeRange *common.TimeRange, limit int) (string, error) {
+			summaries, err := s.fetchSummaries(ctx, timeRange, limit)
+			if err != nil {
+				return "", err
+			}
+			if len(summaries) == 0 {
+				return "no summaries", nil
+			}
+			summaries, suspected := guardSummaries(summaries)
+			countSuspectedInjections("investigate", suspected)
+			var b strings.Builder
+			for _, sum := range summaries {
+				fmt.Fprintf(&b, "[%s] total=%d severity=%v types=%v\n",
+					sum.BucketStart.Format(time.RFC3339), sum.TotalCount, sum.BySeverity, sum.ByType)
+			}
+			return b.String(), nil
+		},
+	},
+	{
+		Name:        "count_by_field",
+		Description: "event counts grouped by field (source, event_type or severity), most frequent first",
+		run: func(ctx context.Context, s *Server, args ToolArgs, timeRange *common.TimeRange, limit int) (string, error) {
+			column, ok := countableFields[strings.ToLower(strings.TrimSpace(args.Field))]
+			if !ok {
+				return "", fmt.Errorf("field must be one of source, event_type, severity")
+			}
+			counts, err := s.countEventsByField(ctx, timeRange, column, limit)
+			if err != nil {
+				return "", err
+			}
+			if len(counts) == 0 {
+				return "no events", nil
+			}
+			var b strings.Builder
+			for _, fc := range counts {
+				value := escapeUntrusted(fc.Value)
+				if column == "severity" {
+					value = severityLabel(value)
+				}
+				fmt.Fprintf(&b, "%s=%d\n", value, fc.Count)
+			}
+			return b.String(), nil
+		},
+	},
+	{
+		Name:        "events_for_entity",
+		Description: "newest events mentioning an entity (IP, user, host, file hash, ...) in their source or payload",
+		run: func(ctx context.Context, s *Server, args ToolArgs, timeRange *common.TimeRange, limit int) (string, error) {
+			entity := strings.TrimSpace(args.Entity)
+			if entity == "" {
+				return "", fmt.Errorf("entity is required")
+			}
+			events, err := s.fetchEventsForEntity(ctx, timeRange, entity, limit)
+			if err != nil {
+				return "", err
+			}
+			return formatToolEvents(events), nil
+		},
+	},
+}
+
+func findInvestigationTool(name string) *investigationTool {
+	for i := range investigationTools {
+		if investigationTools[i].Name == name {
+			return &investigationTools[i]
+		}
+	}
+	return nil
+}
+
+func investigationToolNames() []string {
+	names := make([]string, len(investigationTools))
+	for i, tool := range investigationTools {
+		names[i] = tool.Name
+	}
+	return names
+}
+
+// runTool executes a tool call, resolving its time range and limit against the investigation defaults.
+func (s *Server) runTool(ctx context.Context, name string, args ToolArgs, defaultRange *common.TimeRange) (string, error) {
+	tool := findInvestigationTool(name)
+	if tool == nil {
+		return "", fmt.Errorf("unknown tool %q", name)
+	}
+
+	timeRange, err := resolveToolTimeRange(args, defaultRange)
+	if err != nil {
+		return "", err
+	}
+
+	limit := args.Limit
+	if limit <= 0 {
+		limit = toolDefaultLimit
+	}
+	limit = min(limit, s.cfg.MaxEvents)
+
+	result, err := tool.run(ctx, s, args, timeRange, limit)
+	if err != nil {
+		return "", err
+	}
+	return truncateString(result, toolResultMaxChars), nil
+}
+
+// resolveToolTimeRange applies the start and end the model asked for, clamped to the investigation's own range.
+func resolveToolTimeRange(args ToolArgs, defaultRange *common.TimeRange) (*common.TimeRange, error) {
+	if args.Start == "" && args.End == "" {
+		return defaultRange, nil
+	}
+
+	timeRange := &common.TimeRange{}
+	if defaultRange != nil {
+		*timeRange = *defaultRange
+	}
+	if args.Start != "" {
+		start, err := time.Parse(time.RFC3339, args.Start)
+		if err != nil {
+			return nil, fmt.Errorf("invalid start time")
+		}
+		timeRange.Start = start
+	}
+	if args.End != "" {
+		end, err := time.Parse(time.RFC3339, args.End)
+		if err != nil {
+			return nil, fmt.Errorf("invalid end time")
+		}
+		timeRange.End = end
+	}
+	if defaultRange != nil {
+		if timeRange.Start.Before(defaultRange.Start) {
+			timeRange.Start = defaultRange.Start
+		}
+		if timeRange.End.After(defaultRange.End) {
+			timeRange.End = defaultRange.End
+		}
+		if timeRange.Start.After(timeRange.End) {
+			return nil, fmt.Errorf("time range must overlap %s to %s",
+				defaultRange.Start.Format(time.RFC3339), defaultRange.End.Format(time.RFC3339))
+		}
+	}
+	if err := timeRange.Validate(); err != nil {
+		return nil, err
+	}
+	return timeRange, nil
+}
+
+func formatToolEvents(events []common.Event) string {
+	if len(events) == 0 {
+		return "no events"
+	}
+	events, suspected := guardEvents(events)
+	countSuspectedInjections("investigate", len(suspected))
+	var b strings.Builder
+	for _, e := range events {
+		marker := ""
+		if suspected[e.Id] {
+			marker = suspectedInjectionMarker + " "
+		}
+		fmt.Fprintf(&b, "%s[%s] %s | %s | %s | %s | %s\n", marker,
+			e.Id, e.Timestamp.Format(time.RFC3339), e.Severity, e.Source, e.Type, truncatePayload(e.Payload, toolPayloadMaxLength))
+	}
+	return b.String()
+}
+
+// severityLabel turns a severity stored as a number back into its name.
+func severityLabel(raw string) string {
+	var sev int
+	if _, err := fmt.Sscanf(raw, "%d", &sev); err != nil {
+		return raw
+	}
+	return common.Severity(sev).String()
+}
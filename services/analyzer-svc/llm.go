@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"google.golang.org/genai"
+)
+
+const (
+	providerGemini = "gemini"
+	providerOpenAI = "openai"
+	providerFake   = "fake"
+)
+
+// LLMProvider is a backend able to complete a rendered prompt, optionally constrained by a response schema.
+type LLMProvider interface {
+	Name() string
+	Generate(ctx context.Context, req *LLMRequest) (*LLMResponse, error)
+	// GenerateStream calls onChunk with each piece of text as it is generated, and returns the full response at
+	// the end. An error returned by onChunk aborts the generation.
+	GenerateStream(ctx context.Context, req *LLMRequest, onChunk func(string) error) (*LLMResponse, error)
+}
+
+type LLMRequest struct {
+	Model  string
+	System string
+	User   string
+	Config *PromptConfig
+	Schema *genai.Schema // nil for free-form text output
+}
+
+type LLMResponse struct {
+	Text  string
+	Model string // model that actually answered, when the provider reports it
+	Usage LLMUsage
+}
+
+// LLMUsage is the token usage reported by the provider for a single call. Cached tokens are the part of the input
+// served from the provider's prompt cache.
+type LLMUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+	CachedTokens int `json:"cached_tokens"`
+}
+
+// newLLMProviders initializes every provider that has enough configuration, plus the fake provider which is always
+// available. Returns the providers keyed by name and the name of the default provider.
+func newLLMProviders(ctx context.Context, cfg Config) (map[string]LLMProvider, string, error) {
+	providers := map[string]LLMProvider{
+		providerFake: &fakeProvider{},
+	}
+
+	if cfg.GeminiAPIKey != "" {
+		gemini, err := newGeminiProvider(ctx, cfg.GeminiAPIKey)
+		if err != nil {
+			return nil, "", fmt.Errorf("create gemini provider: %w", err)
+		}
+		providers[providerGemini] = gemini
+		slog.Info("google genai client initialized")
+	}
+
+	if cfg.OpenAIBaseURL != "" {
+		models, err := parseModelMap(cfg.OpenAIModelMap)
+		if err != nil {
+			return nil, "", fmt.Errorf("OPENAI_MODEL_MAP: %w", err)
+		}
+		providers[providerOpenAI] = newOpenAIProvider(cfg.OpenAIBaseURL, cfg.OpenAIAPIKey, cfg.OpenAIModel, models)
+		slog.Info("openai-compatible client initialized", "base_url", cfg.OpenAIBaseURL)
+	}
+
+	defaultProvider := strings.ToLower(strings.TrimSpace(cfg.LLMProvider))
+	switch {
+	case defaultProvider != "":
+		if _, ok := providers[defaultProvider]; !ok {
+			return nil, "", fmt.Errorf("LLM provider %q is not configured", defaultProvider)
+		}
+	case providers[providerGemini] != nil:
+		defaultProvider = providerGemini
+	case providers[providerOpenAI] != nil:
+		defaultProvider = providerOpenAI
+	default:
+		defaultProvider = providerFake
+		slog.Warn("no LLM provider configured (GEMINI_API_KEY or OPENAI_BASE_URL), analysis will use the fake provider")
+	}
+
+	return providers, defaultProvider, nil
+}
+
+// setupLLMProviders creates the providers of newLLMProviders, wrapped in cassettes when LLM_CASSETTE_MODE is set.
+func setupLLMProviders(ctx context.Context, cfg Config) (map[string]LLMProvider, string, error) {
+	providers, defaultProvider, err := newLLMProviders(ctx, cfg)
+	if err != nil {
+		return nil, "", err
+	}
+	if cfg.CassetteMode != "" {
+		dir := cfg.CassetteDir
+		if dir == "" {
+			dir = "cassettes"
+		}
+		if err := wrapWithCassettes(providers, dir, cfg.CassetteMode); err != nil {
+			return nil, "", fmt.Errorf("set up LLM cassettes: %w", err)
+		}
+	}
+	return providers, defaultProvider, nil
+}
+
+// clientStreamError is a failure on the client side of a streamed answer: a failed write, or a client that went
+// away. It says nothing about the health of the LLM, so the circuit breaker ignores it.
+type clientStreamError struct {
+	err error
+}
+
+func (e *clientStreamError) Error() string { return e.err.Error() }
+func (e *clientStreamError) Unwrap() error { return e.err }
+
+// llmProviderFor resolves the provider requested by a prompt, falling back to the default one.
+func (s *Server) llmProviderFor(config *PromptConfig) LLMProvider {
+	if config != nil && config.Provider != "" {
+		if provider, ok := s.llm[config.Provider]; ok {
+			return provider
+		}
+		slog.Warn("prompt requested an unconfigured LLM provider, using default",
+			"provider", config.Provider, "default", s.llmDefault)
+	}
+	return s.llm[s.llmDefault]
+}
+
+func (s *Server) generateContent(ctx context.Context, prompt *PromptPair) (string, error) {
+	return s.generateContentWithSchema(ctx, prompt, nil)
+}
+
+func newLLMRequest(prompt *PromptPair, schema *genai.Schema) *LLMRequest {
+	return &LLMRequest{
+		Model:  prompt.Config.Model,
+		System: prompt.System,
+		User:   prompt.User,
+		Config: prompt.Config,
+		Schema: schema,
+	}
+}
+
+func (s *Server) generateContentWithSchema(ctx context.Context, prompt *PromptPair, schema *genai.Schema) (string, error) {
+	provider := s.llmProviderFor(prompt.Config)
+	req := newLLMRequest(prompt, schema)
+
+	slog.Debug("calling LLM", "provider", provider.Name(), "model", req.Model, "structured", schema != nil, "prompt", prompt.User)
+
+	reserved, err := s.reserveTokenBudget(ctx, prompt)
+	if err != nil {
+		return "", err
+	}
+	start := time.Now()
+	resp, err := s.callLLM(ctx, provider, req, func(req *LLMRequest) (*LLMResponse, error) {
+		return provider.Generate(ctx, req)
+	})
+	s.recordLLMCall(ctx, prompt, provider.Name(), reserved, resp, time.Since(start), err)
+	if err != nil {
+		return "", err
+	}
+	slog.Debug("LLM responded", "provider", provider.Name(), "model", req.Model, "structured", schema != nil, "body", resp.Text)
+
+	return prompt.redaction.restore(strings.TrimSpace(resp.Text), schema != nil), nil
+}
+
+// generateContentStream is the streaming counterpart of generateContent; onChunk receives the text as it arrives.
+func (s *Server) generateContentStream(ctx context.Context, prompt *PromptPair, onChunk func(string) error) (string, error) {
+	provider := s.llmProviderFor(prompt.Config)
+	req := newLLMRequest(prompt, nil)
+
+	slog.Debug("calling LLM", "provider", provider.Name(), "model", req.Model, "stream", true, "prompt", prompt.User)
+
+	reserved, err := s.reserveTokenBudget(ctx, prompt)
+	if err != nil {
+		return "", err
+	}
+	write, flush := prompt.redaction.restoreStream(onChunk)
+	start := time.Now()
+	resp, err := s.callLLM(ctx, provider, req, func(req *LLMRequest) (*LLMResponse, error) {
+		started := false
+		resp, err := provider.GenerateStream(ctx, req, func(chunk string) error {
+			started = true
+			if err := write(chunk); err != nil {
+				return &clientStreamError{err}
+			}
+			return nil
+		})
+		if err == nil {
+			if err := flush(); err != nil {
+				return resp, &clientStreamError{err}
+			}
+		}
+		if err != nil && ctx.Err() != nil {
+			// the request context is the client's, so the generation was cut short by a disconnect
+			err = &clientStreamError{err}
+		}
+		if err != nil && started {
+			err = &partialStreamError{err}
+		}
+		return resp, err
+	})
+	s.recordLLMCall(ctx, prompt, provider.Name(), reserved, resp, time.Since(start), err)
+	if err != nil {
+		return "", err
+	}
+	slog.Debug("LLM responded", "provider", provider.Name(), "model", req.Model, "stream", true, "body", resp.Text)
+
+	return prompt.redaction.restore(strings.TrimSpace(resp.Text), false), nil
+}
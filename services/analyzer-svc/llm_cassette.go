@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	cassetteModeRecord = "record"
+	cassetteModeReplay = "replay"
+)
+
+var errCassetteMiss = errors.New("no recorded LLM response for request")
+
+// Cassette is a single recorded LLM request/response pair, stored as one JSON file per request hash.
+type Cassette struct {
+	Hash       string          `json:"hash"`
+	Provider   string          `json:"provider"`
+	Model      string          `json:"model"`
+	System     string          `json:"system,omitempty"`
+	User       string          `json:"user"`
+	Schema     json.RawMessage `json:"schema,omitempty"`
+	Output     string          `json:"output"`
+	Usage      *LLMUsage       `json:"usage,omitempty"` // as reported when recorded
+	RecordedAt time.Time       `json:"recorded_at"`
+}
+
+// cassetteProvider records every call of the wrapped provider to disk, or replays previous recordings
+// without calling the wrapped provider at all.
+type cassetteProvider struct {
+	inner LLMProvider
+	dir   string
+	mode  string
+}
+
+func newCassetteProvider(inner LLMProvider, dir, mode string) (*cassetteProvider, error) {
+	switch mode {
+	case cassetteModeRecord:
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+	case cassetteModeReplay:
+	default:
+		return nil, fmt.Errorf("unknown cassette mode %q", mode)
+	}
+	return &cassetteProvider{inner: inner, dir: dir, mode: mode}, nil
+}
+
+// wrapWithCassettes puts every provider behind a cassette in the given mode.
+func wrapWithCassettes(providers map[string]LLMProvider, dir, mode string) error {
+	for name, provider := range providers {
+		wrapped, err := newCassetteProvider(provider, dir, mode)
+		if err != nil {
+			return err
+		}
+		providers[name] = wrapped
+	}
+	slog.Info("LLM cassettes enabled", "mode", mode, "dir", dir)
+	return nil
+}
+
+func (c *cassetteProvider) Name() string {
+	return c.inner.Name()
+}
+
+func (c *cassetteProvider) Generate(ctx context.Context, req *LLMRequest) (*LLMResponse, error) {
+	return c.generate(ctx, req, nil)
+}
+
+func (c *cassetteProvider) GenerateStream(ctx context.Context, req *LLMRequest, onChunk func(string) error) (*LLMResponse, error) {
+	return c.generate(ctx, req, onChunk)
+}
+
+// generate replays or records a single call; onChunk is nil for non-streaming calls.
+func (c *cassetteProvider) generate(ctx context.Context, req *LLMRequest, onChunk func(string) error) (*LLMResponse, error) {
+	hash, schema, err := cassetteHash(req)
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(c.dir, hash+".json")
+
+	if c.mode == cassetteModeReplay {
+		cassette, err := readCassette(path)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil, fmt.Errorf("%w (hash %s, model %s)", errCassetteMiss, hash, req.Model)
+			}
+			return nil, err
+		}
+		if onChunk != nil {
+			if err := emitWordChunks(cassette.Output, onChunk); err != nil {
+				return nil, err
+			}
+		}
+		resp := &LLMResponse{Text: cassette.Output, Model: cassette.Model}
+		if cassette.Usage != nil {
+			resp.Usage = *cassette.Usage
+		}
+		return resp, nil
+	}
+
+	var resp *LLMResponse
+	if onChunk != nil {
+		resp, err = c.inner.GenerateStream(ctx, req, onChunk)
+	} else {
+		resp, err = c.inner.Generate(ctx, req)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cassette := Cassette{
+		Hash:       hash,
+		Provider:   c.inner.Name(),
+		Model:      req.Model,
+		System:     req.System,
+		User:       req.User,
+		Schema:     schema,
+		Output:     resp.Text,
+		Usage:      &resp.Usage,
+		RecordedAt: time.Now().UTC(),
+	}
+	if err := writeCassette(path, cassette); err != nil {
+		// a failed recording should not fail the live request
+		slog.Warn("failed to record LLM cassette", "path", path, "error", err)
+	}
+	return resp, nil
+}
+
+// cassetteHash identifies a request by everything that influences the model output. The provider is left out on
+// purpose, so recordings made against one backend can be replayed when another one is configured.
+func cassetteHash(req *LLMRequest) (string, json.RawMessage, error) {
+	var schema json.RawMessage
+	if req.Schema != nil {
+		var err error
+		schema, err = json.Marshal(req.Schema)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	key := struct {
+		Model           string          `json:"model"`
+		System          string          `json:"system"`
+		User            string          `json:"user"`
+		Schema          json.RawMessage `json:"schema,omitempty"`
+		Temperature     *float32        `json:"temperature,omitempty"`
+		MaxOutputTokens *int            `json:"max_output_tokens,omitempty"`
+		StopSequences   []string        `json:"stop_sequences,omitempty"`
+	}{Model: req.Model, System: req.System, User: req.User, Schema: schema}
+	if req.Config != nil {
+		key.Temperature = req.Config.Temperature
+		key.MaxOutputTokens = req.Config.MaxOutputTokens
+		key.StopSequences = req.Config.StopSequences
+	}
+	data, err := json.Marshal(key)
+	if err != nil {
+		return "", nil, err
+	}
+
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])[:24], schema, nil
+}
+
+func readCassette(path string) (*Cassette, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cassette Cassette
+	if err := json.Unmarshal(data, &cassette); err != nil {
+		return nil, fmt.Errorf("parse cassette %s: %w", path, err)
+	}
+	return &cassette, nil
+}
+
+func writeCassette(path string, cassette Cassette) error {
+	data, err := json.MarshalIndent(cassette, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// write to a file of our own then rename, so that neither concurrent replays nor concurrent recordings of the
+	// same request observe a partial file
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/andreionoie/llm-event-analysis/pkg/common"
+	"github.com/labstack/echo/v4"
+)
+
+// scriptedProvider answers every request with respond(req) and counts how often it was called.
+type scriptedProvider struct {
+	respond func(req *LLMRequest) string
+	calls   atomic.Int32
+}
+
+func (p *scriptedProvider) Name() string { return "scripted" }
+
+func (p *scriptedProvider) Generate(_ context.Context, req *LLMRequest) (*LLMResponse, error) {
+	p.calls.Add(1)
+	return &LLMResponse{Text: p.respond(req)}, nil
+}
+
+func (p *scriptedProvider) GenerateStream(ctx context.Context, req *LLMRequest, onChunk func(string) error) (*LLMResponse, error) {
+	resp, _ := p.Generate(ctx, req)
+	return resp, emitWordChunks(resp.Text, onChunk)
+}
+
+// answerByPrompt responds with the answer for the prompt the request was rendered from.
+func answerByPrompt(answers map[string]func(req *LLMRequest) string) func(req *LLMRequest) string {
+	return func(req *LLMRequest) string {
+		if answer, ok := answers[req.Config.Name]; ok {
+			return answer(req)
+		}
+		return "no answer scripted for prompt " + req.Config.Name
+	}
+}
+
+// newCassetteTestServer records the scripted answers to every call made by exercise, then returns a server
+// replaying those recordings without any live provider. setup, when given, completes both servers, e.g. with a
+// database.
+func newCassetteTestServer(t *testing.T, respond func(req *LLMRequest) string, setup func(s *Server), exercise func(s *Server)) (*Server, *scriptedProvider) {
+	t.Helper()
+
+	prompts, err := NewPromptLibrary(promptsFS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	newServer := func(p LLMProvider) *Server {
+		s := &Server{
+			prompts:     prompts,
+			llm:         map[string]LLMProvider{"scripted": p},
+			llmDefault:  "scripted",
+			llmBreakers: newLLMBreakers(),
+		}
+		if setup != nil {
+			setup(s)
+		}
+		return s
+	}
+
+	scripted := &scriptedProvider{respond: respond}
+	recorder, err := newCassetteProvider(scripted, dir, cassetteModeRecord)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exercise(newServer(recorder))
+
+	player, err := newCassetteProvider(scripted, dir, cassetteModeReplay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newServer(player), scripted
+}
+
+func TestCassetteRecordReplay(t *testing.T) {
+	echoUser := func(req *LLMRequest) string { return "answer to " + req.User }
+	requests := []*LLMRequest{
+		{Model: "m", System: "sys", User: "what happened?"},
+		{Model: "m", System: "sys", User: "who did it?"},
+	}
+	s, scripted := newCassetteTestServer(t, echoUser, nil, func(s *Server) {
+		for _, req := range requests {
+			if _, err := s.llm["scripted"].Generate(context.Background(), req); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+
+	// replayed in reverse, so that answering in recording order would be caught
+	for i := len(requests) - 1; i >= 0; i-- {
+		resp, err := s.llm["scripted"].Generate(context.Background(), requests[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "answer to " + requests[i].User; resp.Text != want {
+			t.Errorf("replayed %q, want %q", resp.Text, want)
+		}
+	}
+	if calls := scripted.calls.Load(); calls != 2 {
+		t.Errorf("live provider called %d times, want 2 (recording only)", calls)
+	}
+
+	_, err := s.llm["scripted"].Generate(context.Background(), &LLMRequest{Model: "m", User: "something else"})
+	if !errors.Is(err, errCassetteMiss) {
+		t.Errorf("expected cassette miss, got %v", err)
+	}
+}
+
+func TestCassetteHashCoversGenerationConfig(t *testing.T) {
+	cold, hot := float32(0.1), float32(0.9)
+	base, _, err := cassetteHash(&LLMRequest{Model: "m", User: "q", Config: &PromptConfig{Temperature: &cold}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, config := range map[string]*PromptConfig{
+		"temperature":    {Temperature: &hot},
+		"max tokens":     {Temperature: &cold, MaxOutputTokens: new(int)},
+		"stop sequences": {Temperature: &cold, StopSequences: []string{"END"}},
+	} {
+		hash, _, err := cassetteHash(&LLMRequest{Model: "m", User: "q", Config: config})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hash == base {
+			t.Errorf("requests differing in %s share a cassette", name)
+		}
+	}
+}
+
+func TestClassifyTier2FromCassette(t *testing.T) {
+	ts := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	events := []common.Event{
+		{Id: "evt-1", Timestamp: ts, Source: "edr", Severity: common.SeverityCritical, Type: "ransomware_detected"},
+		{Id: "evt-2", Timestamp: ts, Source: "edr", Severity: common.SeverityErr, Type: "file_encrypted"},
+	}
+	answer := `[{"priority":"P1","category":"ransomware","summary":"encryption spree","event_ids":["evt-1","evt-404","evt-2"]}]`
+	respond := answerByPrompt(map[string]func(*LLMRequest) string{
+		"triage_tier2": func(*LLMRequest) string { return answer },
+	})
+
+	s, _ := newCassetteTestServer(t, respond, nil, func(s *Server) {
+		if _, err := s.classifyTier2(context.Background(), s.prompts.triagePrompts("test"), events, nil); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	findings, err := s.classifyTier2(context.Background(), s.prompts.triagePrompts("test"), events, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(findings) != 1 {
+		t.Fatalf("got %d findings, want 1", len(findings))
+	}
+	if want := []string{"evt-1", "evt-2"}; !reflect.DeepEqual(findings[0].EventIDs, want) {
+		t.Errorf("evidence IDs = %v, want %v", findings[0].EventIDs, want)
+	}
+}
+
+func TestClassifyTier1FromCassette(t *testing.T) {
+	bucket := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	summaries := []common.EventSummary{{
+		BucketStart: bucket,
+		BucketEnd:   bucket.Add(5 * time.Minute),
+		TotalCount:  12,
+		BySeverity:  map[string]int{"SeverityCritical": 3},
+		ByType:      map[string]int{"ransomware_detected": 3},
+	}}
+	answer := `{"summary":"spike","high_risk":[{"bucket_id":"2026-01-01T00:00:00Z","reason":"ransomware","confidence":0.9},` +
+		`{"bucket_id":"2030-01-01T00:00:00Z","reason":"made up","confidence":0.9}],"medium_risk":[],"low_risk":[]}`
+	respond := answerByPrompt(map[string]func(*LLMRequest) string{
+		"triage_tier1": func(*LLMRequest) string { return answer },
+	})
+
+	s, _ := newCassetteTestServer(t, respond, nil, func(s *Server) {
+		if _, _, err := s.classifyTier1(context.Background(), s.prompts.triagePrompts("test"), summaries); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	result, valid, err := s.classifyTier1(context.Background(), s.prompts.triagePrompts("test"), summaries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	high := filterValidBuckets(result.HighRisk, valid)
+	if len(high) != 1 || high[0].BucketID != "2026-01-01T00:00:00Z" {
+		t.Errorf("unexpected high risk buckets after validation: %+v", high)
+	}
+}
+
+func callAnalyze(t *testing.T, s *Server, question string) AnalyzeResponse {
+	t.Helper()
+	body := fmt.Sprintf(`{"question":%q}`, question)
+	req := httptest.NewRequest(http.MethodPost, "/analyze", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	if err := s.handleAnalyze(echo.New().NewContext(req, rec)); err != nil {
+		t.Fatal(err)
+	}
+	var resp AnalyzeResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestHandleAnalyzeFromCassette(t *testing.T) {
+	db := newTestDB(t)
+	// each server gets a cache of its own, so that replayed answers can't come from the recording's cache
+	setup := func(s *Server) {
+		s.db = db
+		s.cache, _ = newTestCache(t)
+		s.cfg.MaxEvents = 100
+	}
+	respond := answerByPrompt(map[string]func(*LLMRequest) string{
+		"analyze": func(req *LLMRequest) string {
+			if strings.Contains(req.User, "who") {
+				return "alice logged in"
+			}
+			return fmt.Sprintf("%d ransomware events", strings.Count(req.User, "ransomware_detected"))
+		},
+	})
+	questions := map[string]string{"what happened?": "1 ransomware events", "who logged in?": "alice logged in"}
+
+	s, scripted := newCassetteTestServer(t, respond, setup, func(s *Server) {
+		insertTestEvents(t, s, testEvents())
+		for question := range questions {
+			callAnalyze(t, s, question)
+		}
+	})
+	recorded := scripted.calls.Load()
+
+	for question, want := range questions {
+		resp := callAnalyze(t, s, question)
+		if resp.Answer != want || resp.Cached {
+			t.Errorf("%q: got %+v, want the replayed answer %q", question, resp, want)
+		}
+		if resp.EventsUsed != 3 || resp.PromptVersion == "" {
+			t.Errorf("%q: unexpected response %+v", question, resp)
+		}
+	}
+	if calls := scripted.calls.Load(); calls != recorded {
+		t.Errorf("live provider called during replay")
+	}
+}
+
+func TestStructuredAnalyzeFromCassette(t *testing.T) {
+	ts := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	events := []common.Event{
+		{Id: "evt-1", Timestamp: ts, Source: "edr", Severity: common.SeverityCritical, Type: "ransomware_detected"},
+		{Id: "evt-2", Timestamp: ts, Source: "auth", Severity: common.SeverityInfo, Type: "login_success"},
+	}
+	answer := `{"answer":"ransomware on one host","claims":[` +
+		`{"statement":"ransomware was detected","event_ids":["evt-1","evt-404"]},` +
+		`{"statement":"the host was compromised earlier","event_ids":["evt-999"]}]}`
+	respond := answerByPrompt(map[string]func(*LLMRequest) string{
+		"analyze": func(req *LLMRequest) string {
+			if !strings.Contains(req.User, "[evt-1]") {
+				return "event IDs missing from the prompt"
+			}
+			return answer
+		},
+	})
+
+	ask := func(s *Server) (AnalyzeResponse, error) {
+		prompt, err := s.prompts.RenderStructuredAnalyzePrompt("what happened?", events)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s.generateStructuredAnswer(context.Background(), prompt, events)
+	}
+	s, _ := newCassetteTestServer(t, respond, nil, func(s *Server) {
+		if _, err := ask(s); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	resp, err := ask(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []AnalyzeClaim{
+		{Statement: "ransomware was detected", EventIDs: []string{"evt-1"}},
+		{Statement: "the host was compromised earlier", EventIDs: []string{}},
+	}
+	if resp.Answer != "ransomware on one host" || !reflect.DeepEqual(resp.Claims, want) {
+		t.Errorf("unexpected answer %+v", resp)
+	}
+	if resp.HallucinatedIDs != 2 {
+		t.Errorf("hallucinated IDs = %d, want 2", resp.HallucinatedIDs)
+	}
+}
+
+var testEventIDPattern = regexp.MustCompile(`\[(evt-\d+)\]`)
+
+func TestProcessTriageJobFromCassette(t *testing.T) {
+	db := newTestDB(t)
+	setup := func(s *Server) {
+		s.db = db
+		s.cache, _ = newTestCache(t)
+		s.cfg.SummaryBucket = 5 * time.Minute
+		s.cfg.TriageMaxChunks = 48
+		s.cfg.TriageParallelism = 2
+		s.cfg.Tier2TokenBudget = 8000
+		s.cfg.Tier2MaxBatches = 20
+	}
+	respond := answerByPrompt(map[string]func(*LLMRequest) string{
+		"triage_tier1": func(*LLMRequest) string {
+			return `{"summary":"ransomware","high_risk":[{"bucket_id":"2026-01-01T00:00:00Z","reason":"encryption",` +
+				`"confidence":0.9}],"medium_risk":[],"low_risk":[]}`
+		},
+		// cites the events it was sent, plus one it was not
+		"triage_tier2": func(req *LLMRequest) string {
+			ids := []string{"evt-404"}
+			for _, m := range testEventIDPattern.FindAllStringSubmatch(req.User, -1) {
+				ids = append(ids, m[1])
+			}
+			cited, _ := json.Marshal(ids)
+			return `[{"priority":"P1","category":"ransomware","summary":"encryption spree","event_ids":` + string(cited) + `}]`
+		},
+	})
+	runJob := func(s *Server) *TriageJob {
+		ctx := context.Background()
+		tr := common.TimeRange{Start: testEventTime.Add(-time.Hour), End: testEventTime.Add(time.Hour)}
+		now := time.Now().UTC()
+		key := triageResultsCacheKey(tr, nil)
+		if err := s.insertTriageJob(ctx, &TriageJob{ID: fmt.Sprint("job-", now.UnixNano()), TimeRange: tr,
+			Status: "pending", CreatedAt: now, UpdatedAt: now}, key); err != nil {
+			t.Fatal(err)
+		}
+		job, err := s.claimTriageJob(ctx, "worker-1")
+		if err != nil || job == nil {
+			t.Fatalf("failed to claim the job: %v", err)
+		}
+		s.processTriageJob(ctx, job, key)
+		saved, err := s.loadTriageJob(ctx, job.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return saved
+	}
+
+	s, scripted := newCassetteTestServer(t, respond, setup, func(s *Server) {
+		insertTestEvents(t, s, testEvents())
+		if job := runJob(s); job.Status != "complete" {
+			t.Fatalf("recorded job ended %s: %s", job.Status, job.Error)
+		}
+	})
+	recorded := scripted.calls.Load()
+
+	job := runJob(s)
+	if job.Status != "complete" {
+		t.Fatalf("replayed job ended %s: %s", job.Status, job.Error)
+	}
+	if scripted.calls.Load() != recorded {
+		t.Error("live provider called during replay")
+	}
+	if len(job.Findings) != 1 {
+		t.Fatalf("got %d findings, want 1", len(job.Findings))
+	}
+	evidence := slices.Sorted(slices.Values(job.Findings[0].EventIDs))
+	if want := []string{"evt-1", "evt-2", "evt-3"}; !reflect.DeepEqual(evidence, want) {
+		t.Errorf("evidence IDs = %v, want %v", evidence, want)
+	}
+	if run := job.Prompts["triage_tier2"]; run == nil || run.CitedIDs != 4 || run.HallucinatedIDs != 1 {
+		t.Errorf("unexpected tier 2 prompt run %+v", run)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"google.golang.org/genai"
+)
+
+// fakeProvider returns deterministic output derived from the prompt, for local development and tests.
+// Structured requests get the smallest value that satisfies the schema.
+type fakeProvider struct{}
+
+func (f *fakeProvider) Name() string {
+	return providerFake
+}
+
+func (f *fakeProvider) Generate(_ context.Context, req *LLMRequest) (*LLMResponse, error) {
+	if req.Schema != nil {
+		data, err := json.Marshal(fakeValueForSchema(req.Schema))
+		if err != nil {
+			return nil, err
+		}
+		return &LLMResponse{Text: string(data), Usage: fakeUsage(req, string(data))}, nil
+	}
+
+	hash := sha256.Sum256([]byte(req.System + "\n" + req.User))
+	text := fmt.Sprintf("fake analysis %s (model %s, %d prompt characters)",
+		hex.EncodeToString(hash[:])[:12], req.Model, len(req.System)+len(req.User))
+	return &LLMResponse{Text: text, Usage: fakeUsage(req, text)}, nil
+}
+
+// fakeUsage estimates the usage a real model would report, so that accounting and budgets can be exercised locally.
+func fakeUsage(req *LLMRequest, output string) LLMUsage {
+	return LLMUsage{
+		InputTokens:  estimateTokens(req.System) + estimateTokens(req.User),
+		OutputTokens: estimateTokens(output),
+	}
+}
+
+func (f *fakeProvider) GenerateStream(ctx context.Context, req *LLMRequest, onChunk func(string) error) (*LLMResponse, error) {
+	resp, err := f.Generate(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if err := emitWordChunks(resp.Text, onChunk); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// emitWordChunks replays an already complete text as a stream, one word (with its trailing space) per chunk.
+func emitWordChunks(text string, onChunk func(string) error) error {
+	for len(text) > 0 {
+		end := strings.IndexByte(text, ' ')
+		if end < 0 {
+			end = len(text) - 1
+		}
+		if err := onChunk(text[:end+1]); err != nil {
+			return err
+		}
+		text = text[end+1:]
+	}
+	return nil
+}
+
+func fakeValueForSchema(schema *genai.Schema) any {
+	if len(schema.Enum) > 0 {
+		return schema.Enum[0]
+	}
+
+	switch schema.Type {
+	case genai.TypeObject:
+		names := make([]string, 0, len(schema.Properties))
+		for name := range schema.Properties {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		out := make(map[string]any, len(names))
+		for _, name := range names {
+			out[name] = fakeValueForSchema(schema.Properties[name])
+		}
+		return out
+	case genai.TypeArray:
+		return []any{}
+	case genai.TypeNumber:
+		return 0.0
+	case genai.TypeInteger:
+		return 0
+	case genai.TypeBoolean:
+		return false
+	default:
+		return "fake"
+	}
+}
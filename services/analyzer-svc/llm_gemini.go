@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+
+	"google.golang.org/genai"
+)
+
+type geminiProvider struct {
+	client *genai.Client
+}
+
+func newGeminiProvider(ctx context.Context, apiKey string) (*geminiProvider, error) {
+	httpLogger := slog.Default().With("component", "genai_http")
+	config := genai.ClientConfig{
+		APIKey:     apiKey,
+		HTTPClient: newLoggingHTTPClient(httpLogger),
+	}
+	client, err := genai.NewClient(ctx, &config)
+	if err != nil {
+		return nil, err
+	}
+	return &geminiProvider{client: client}, nil
+}
+
+func (g *geminiProvider) Name() string {
+	return providerGemini
+}
+
+func (g *geminiProvider) Generate(ctx context.Context, req *LLMRequest) (*LLMResponse, error) {
+	resp, err := g.client.Models.GenerateContent(ctx, req.Model, genai.Text(req.User), buildGenaiConfig(req))
+	if err != nil {
+		return nil, err
+	}
+	return &LLMResponse{Text: resp.Text(), Model: resp.ModelVersion, Usage: geminiUsage(resp.UsageMetadata)}, nil
+}
+
+func (g *geminiProvider) GenerateStream(ctx context.Context, req *LLMRequest, onChunk func(string) error) (*LLMResponse, error) {
+	var full strings.Builder
+	var model string
+	var usage LLMUsage
+	for resp, err := range g.client.Models.GenerateContentStream(ctx, req.Model, genai.Text(req.User), buildGenaiConfig(req)) {
+		if err != nil {
+			return nil, err
+		}
+		// usage is cumulative, the last chunk carries the totals
+		if resp.UsageMetadata != nil {
+			usage = geminiUsage(resp.UsageMetadata)
+		}
+		if resp.ModelVersion != "" {
+			model = resp.ModelVersion
+		}
+		chunk := resp.Text()
+		if chunk == "" {
+			continue
+		}
+		full.WriteString(chunk)
+		if err := onChunk(chunk); err != nil {
+			return nil, err
+		}
+	}
+	return &LLMResponse{Text: full.String(), Model: model, Usage: usage}, nil
+}
+
+// geminiUsage converts the usage metadata; thinking tokens are billed as output.
+func geminiUsage(meta *genai.GenerateContentResponseUsageMetadata) LLMUsage {
+	if meta == nil {
+		return LLMUsage{}
+	}
+	return LLMUsage{
+		InputTokens:  int(meta.PromptTokenCount),
+		OutputTokens: int(meta.CandidatesTokenCount + meta.ThoughtsTokenCount),
+		CachedTokens: int(meta.CachedContentTokenCount),
+	}
+}
+
+func buildGenaiConfig(req *LLMRequest) *genai.GenerateContentConfig {
+	genaiConfig := &genai.GenerateContentConfig{}
+	req.Config.ApplyTo(genaiConfig)
+	if req.System != "" {
+		genaiConfig.SystemInstruction = genai.NewContentFromText(req.System, genai.RoleUser)
+	}
+
+	if req.Schema != nil {
+		genaiConfig.ResponseMIMEType = "application/json"
+		genaiConfig.ResponseSchema = req.Schema
+	}
+	return genaiConfig
+}
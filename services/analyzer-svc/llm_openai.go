@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/andreionoie/llm-event-analysis/pkg/common"
+	"google.golang.org/genai"
+)
+
+const openAIErrorBodyLimit = 512
+
+// openAIProvider talks to any OpenAI-compatible chat completions API (OpenAI, vLLM, Ollama, ...).
+type openAIProvider struct {
+	baseURL string
+	apiKey  string
+	model   string            // when set, replaces Gemini models and unset models of the prompt config
+	models  map[string]string // explicit mappings of prompt models, checked first
+	client  *http.Client
+}
+
+func newOpenAIProvider(baseURL, apiKey, model string, models map[string]string) *openAIProvider {
+	return &openAIProvider{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		apiKey:  apiKey,
+		model:   model,
+		models:  models,
+		client:  newLoggingHTTPClient(slog.Default().With("component", "openai_http")),
+	}
+}
+
+// resolveModel maps the model named by the prompt to one the API serves. Prompts written for Gemini, or naming
+// no model, use OPENAI_MODEL; any other model is assumed to be served by the API and kept.
+func (o *openAIProvider) resolveModel(model string) string {
+	if mapped, ok := o.models[model]; ok {
+		return mapped
+	}
+	if o.model != "" && (model == "" || strings.HasPrefix(model, "gemini")) {
+		return o.model
+	}
+	return model
+}
+
+// parseModelMap parses OPENAI_MODEL_MAP, comma-separated from=to pairs.
+func parseModelMap(raw string) (map[string]string, error) {
+	models := map[string]string{}
+	if strings.TrimSpace(raw) == "" {
+		return models, nil
+	}
+	for _, pair := range common.SplitCommaSeparated(raw) {
+		from, to, ok := strings.Cut(pair, "=")
+		from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+		if !ok || from == "" || to == "" {
+			return nil, fmt.Errorf("invalid model mapping %q, expected from=to", pair)
+		}
+		models[from] = to
+	}
+	return models, nil
+}
+
+type openAIMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type openAIResponseFormat struct {
+	Type       string            `json:"type"`
+	JSONSchema *openAIJSONSchema `json:"json_schema,omitempty"`
+}
+
+type openAIJSONSchema struct {
+	Name   string         `json:"name"`
+	Schema map[string]any `json:"schema"`
+}
+
+type openAIChatRequest struct {
+	Model          string                `json:"model"`
+	Messages       []openAIMessage       `json:"messages"`
+	Temperature    *float32              `json:"temperature,omitempty"`
+	MaxTokens      int                   `json:"max_tokens,omitempty"`
+	Stop           []string              `json:"stop,omitempty"`
+	ResponseFormat *openAIResponseFormat `json:"response_format,omitempty"`
+	Stream         bool                  `json:"stream,omitempty"`
+	StreamOptions  *openAIStreamOptions  `json:"stream_options,omitempty"`
+}
+
+type openAIStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+type openAIUsage struct {
+	PromptTokens        int `json:"prompt_tokens"`
+	CompletionTokens    int `json:"completion_tokens"`
+	PromptTokensDetails struct {
+		CachedTokens int `json:"cached_tokens"`
+	} `json:"prompt_tokens_details"`
+}
+
+func (u *openAIUsage) toLLMUsage() LLMUsage {
+	if u == nil {
+		return LLMUsage{}
+	}
+	return LLMUsage{
+		InputTokens:  u.PromptTokens,
+		OutputTokens: u.CompletionTokens,
+		CachedTokens: u.PromptTokensDetails.CachedTokens,
+	}
+}
+
+type openAIChatResponse struct {
+	Model   string `json:"model"`
+	Choices []struct {
+		Message openAIMessage `json:"message"`
+	} `json:"choices"`
+	Usage *openAIUsage `json:"usage"`
+}
+
+type openAIChatChunk struct {
+	Model   string `json:"model"`
+	Choices []struct {
+		Delta openAIMessage `json:"delta"`
+	} `json:"choices"`
+	Usage *openAIUsage `json:"usage"` // only in the last chunk, which has no choices
+}
+
+// openAIError is returned for non-2xx responses of the chat completions API.
+type openAIError struct {
+	StatusCode int
+	Body       string
+	RetryAfter time.Duration // from the Retry-After header, 0 when absent
+}
+
+func (e *openAIError) Error() string {
+	return fmt.Sprintf("openai api error: status %d: %s", e.StatusCode, e.Body)
+}
+
+func (o *openAIProvider) Name() string {
+	return providerOpenAI
+}
+
+func (o *openAIProvider) Generate(ctx context.Context, req *LLMRequest) (*LLMResponse, error) {
+	httpResp, err := o.post(ctx, o.buildChatRequest(req))
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	var chatResp openAIChatResponse
+	if err := json.NewDecoder(httpResp.Body).Decode(&chatResp); err != nil {
+		return nil, fmt.Errorf("decode chat completion: %w", err)
+	}
+	if len(chatResp.Choices) == 0 {
+		return nil, fmt.Errorf("chat completion returned no choices")
+	}
+
+	return &LLMResponse{
+		Text:  chatResp.Choices[0].Message.Content,
+		Model: chatResp.Model,
+		Usage: chatResp.Usage.toLLMUsage(),
+	}, nil
+}
+
+func (o *openAIProvider) GenerateStream(ctx context.Context, req *LLMRequest, onChunk func(string) error) (*LLMResponse, error) {
+	chatReq := o.buildChatRequest(req)
+	chatReq.Stream = true
+	chatReq.StreamOptions = &openAIStreamOptions{IncludeUsage: true}
+	httpResp, err := o.post(ctx, chatReq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	// server-sent events, one JSON chunk per "data:" line, terminated by "data: [DONE]"
+	var full strings.Builder
+	resp := &LLMResponse{}
+	scanner := bufio.NewScanner(httpResp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue
+		}
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			break
+		}
+
+		var chunk openAIChatChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return nil, fmt.Errorf("decode chat completion chunk: %w", err)
+		}
+		if chunk.Model != "" {
+			resp.Model = chunk.Model
+		}
+		if chunk.Usage != nil {
+			resp.Usage = chunk.Usage.toLLMUsage()
+		}
+		if len(chunk.Choices) == 0 || chunk.Choices[0].Delta.Content == "" {
+			continue
+		}
+
+		text := chunk.Choices[0].Delta.Content
+		full.WriteString(text)
+		if err := onChunk(text); err != nil {
+			return nil, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	resp.Text = full.String()
+	return resp, nil
+}
+
+// post sends a chat completion request and returns the response if it was successful; the caller closes the body.
+func (o *openAIProvider) post(ctx context.Context, chatReq openAIChatRequest) (*http.Response, error) {
+	body, err := json.Marshal(chatReq)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, o.baseURL+"/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if o.apiKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+o.apiKey)
+	}
+
+	httpResp, err := o.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+
+	if httpResp.StatusCode < 200 || httpResp.StatusCode >= 300 {
+		defer httpResp.Body.Close()
+		errBody, _ := io.ReadAll(io.LimitReader(httpResp.Body, openAIErrorBodyLimit))
+		return nil, &openAIError{
+			StatusCode: httpResp.StatusCode,
+			Body:       strings.TrimSpace(string(errBody)),
+			RetryAfter: parseRetryAfter(httpResp.Header.Get("Retry-After")),
+		}
+	}
+	return httpResp, nil
+}
+
+func (o *openAIProvider) buildChatRequest(req *LLMRequest) openAIChatRequest {
+	chatReq := openAIChatRequest{Model: o.resolveModel(req.Model)}
+	if req.System != "" {
+		chatReq.Messages = append(chatReq.Messages, openAIMessage{Role: "system", Content: req.System})
+	}
+	chatReq.Messages = append(chatReq.Messages, openAIMessage{Role: "user", Content: req.User})
+
+	if req.Config != nil {
+		chatReq.Temperature = req.Config.Temperature
+		if req.Config.MaxOutputTokens != nil {
+			chatReq.MaxTokens = *req.Config.MaxOutputTokens
+		}
+		chatReq.Stop = req.Config.StopSequences
+	}
+
+	if req.Schema != nil {
+		chatReq.ResponseFormat = &openAIResponseFormat{
+			Type: "json_schema",
+			JSONSchema: &openAIJSONSchema{
+				Name:   "response",
+				Schema: jsonSchemaFromGenai(req.Schema),
+			},
+		}
+	}
+
+	return chatReq
+}
+
+// jsonSchemaFromGenai converts the genai schema dialect (upper-case OpenAPI types) into plain JSON schema.
+func jsonSchemaFromGenai(schema *genai.Schema) map[string]any {
+	if schema == nil {
+		return nil
+	}
+
+	out := map[string]any{}
+	if schema.Type != "" && schema.Type != genai.TypeUnspecified {
+		out["type"] = strings.ToLower(string(schema.Type))
+	}
+	if schema.Description != "" {
+		out["description"] = schema.Description
+	}
+	if len(schema.Enum) > 0 {
+		out["enum"] = schema.Enum
+	}
+	if schema.Items != nil {
+		out["items"] = jsonSchemaFromGenai(schema.Items)
+	}
+	if len(schema.Properties) > 0 {
+		props := make(map[string]any, len(schema.Properties))
+		for name, prop := range schema.Properties {
+			props[name] = jsonSchemaFromGenai(prop)
+		}
+		out["properties"] = props
+	}
+	if len(schema.Required) > 0 {
+		out["required"] = schema.Required
+	}
+	return out
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sony/gobreaker/v2"
+	"google.golang.org/genai"
+)
+
+var (
+	llmBreakerState = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "analyzer_llm_breaker_state",
+			Help: "State of the LLM circuit breakers (0 closed, 1 half-open, 2 open), partitioned by provider and model",
+		},
+		[]string{"provider", "model"},
+	)
+	llmBreakerTrips = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "analyzer_llm_breaker_trips_total",
+			Help: "Times an LLM circuit breaker opened, partitioned by provider and model",
+		},
+		[]string{"provider", "model"},
+	)
+	llmRetries = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "analyzer_llm_retries_total",
+			Help: "LLM calls retried after a retryable error, partitioned by prompt and HTTP status",
+		},
+		[]string{"prompt", "status"},
+	)
+	llmFallbacks = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "analyzer_llm_fallbacks_total",
+			Help: "LLM calls moved to a fallback model because the breaker of the previous one was open, partitioned by prompt and fallback model",
+		},
+		[]string{"prompt", "model"},
+	)
+)
+
+const (
+	defaultLLMMaxAttempts    = 3
+	defaultLLMInitialBackoff = 500 * time.Millisecond
+	defaultLLMMaxRetryWait   = 30 * time.Second
+)
+
+// llmBreakers holds a circuit breaker per provider and model, so that a model failing doesn't stop the calls to its
+// fallbacks.
+type llmBreakers struct {
+	mu       sync.Mutex
+	breakers map[[2]string]*gobreaker.CircuitBreaker[*LLMResponse]
+}
+
+func newLLMBreakers() *llmBreakers {
+	return &llmBreakers{breakers: map[[2]string]*gobreaker.CircuitBreaker[*LLMResponse]{}}
+}
+
+// get returns the breaker of the model, created closed on first use.
+func (b *llmBreakers) get(provider, model string) *gobreaker.CircuitBreaker[*LLMResponse] {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	key := [2]string{provider, model}
+	if breaker, ok := b.breakers[key]; ok {
+		return breaker
+	}
+	breaker := newLLMCircuitBreaker(provider, model)
+	b.breakers[key] = breaker
+	llmBreakerState.WithLabelValues(provider, model).Set(float64(gobreaker.StateClosed))
+	return breaker
+}
+
+// state returns the state of the model's breaker; models not called yet are closed.
+func (b *llmBreakers) state(provider, model string) gobreaker.State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if breaker, ok := b.breakers[[2]string{provider, model}]; ok {
+		return breaker.State()
+	}
+	return gobreaker.StateClosed
+}
+
+func newLLMCircuitBreaker(provider, model string) *gobreaker.CircuitBreaker[*LLMResponse] {
+	return gobreaker.NewCircuitBreaker[*LLMResponse](gobreaker.Settings{
+		Name: "llm-client:" + provider + "/" + model,
+		// in the closed state, failures are counted over a minute, so that a few scattered ones never add up
+		Interval: time.Minute,
+		Timeout:  30 * time.Second,
+		ReadyToTrip: func(counts gobreaker.Counts) bool {
+			return counts.ConsecutiveFailures >= 5 ||
+				(counts.Requests >= 10 && counts.TotalFailures*2 >= counts.Requests)
+		},
+		OnStateChange: func(name string, from gobreaker.State, to gobreaker.State) {
+			slog.Info("circuit breaker state change", "name", name, "from", from, "to", to)
+			llmBreakerState.WithLabelValues(provider, model).Set(float64(to))
+			if to == gobreaker.StateOpen {
+				llmBreakerTrips.WithLabelValues(provider, model).Inc()
+			}
+		},
+		IsExcluded: func(err error) bool {
+			var clientErr *clientStreamError
+			return errors.As(err, &clientErr)
+		},
+	})
+}
+
+// partialStreamError is a streamed generation that failed after some of its text was sent to the client. Retrying it
+// would send that text again, so it is not retried.
+type partialStreamError struct {
+	err error
+}
+
+func (e *partialStreamError) Error() string { return e.err.Error() }
+func (e *partialStreamError) Unwrap() error { return e.err }
+
+// callLLM runs call with the prompt's model through the breaker of that model, retrying retryable errors with
+// exponential backoff and full jitter. While the breaker of a model is open, the call moves on to the next fallback
+// model of the prompt. Fallback answers carry the model that gave them.
+func (s *Server) callLLM(ctx context.Context, provider LLMProvider, req *LLMRequest, call func(req *LLMRequest) (*LLMResponse, error)) (*LLMResponse, error) {
+	models := []string{req.Model}
+	if req.Config != nil {
+		models = append(models, req.Config.FallbackModels...)
+	}
+
+	var err error
+	for i, model := range models {
+		if i > 0 {
+			slog.Warn("LLM circuit breaker open, using fallback model",
+				"provider", provider.Name(), "model", models[i-1], "fallback", model)
+			llmFallbacks.WithLabelValues(promptName(req.Config), model).Inc()
+		}
+		attempt := *req
+		attempt.Model = model
+		var resp *LLMResponse
+		resp, err = s.retryLLM(ctx, s.llmBreakers.get(provider.Name(), model), &attempt, call)
+		if !errors.Is(err, gobreaker.ErrOpenState) && !errors.Is(err, gobreaker.ErrTooManyRequests) {
+			if resp != nil && resp.Model == "" && i > 0 {
+				resp.Model = model
+			}
+			return resp, err
+		}
+	}
+	return nil, err
+}
+
+// retryLLM makes the call through the breaker, up to LLM_MAX_ATTEMPTS times while it fails with a retryable error.
+func (s *Server) retryLLM(ctx context.Context, breaker *gobreaker.CircuitBreaker[*LLMResponse], req *LLMRequest, call func(req *LLMRequest) (*LLMResponse, error)) (*LLMResponse, error) {
+	maxAttempts := max(s.cfg.LLMMaxAttempts, 1)
+	backoff := s.cfg.LLMInitialBackoff
+	if backoff <= 0 {
+		backoff = defaultLLMInitialBackoff
+	}
+	maxWait := s.cfg.LLMMaxRetryWait
+	if maxWait <= 0 {
+		maxWait = defaultLLMMaxRetryWait
+	}
+
+	for attempt := 1; ; attempt++ {
+		resp, err := breaker.Execute(func() (*LLMResponse, error) {
+			return call(req)
+		})
+		if err == nil || attempt == maxAttempts {
+			return resp, err
+		}
+		status, retryAfter, ok := retryableLLMError(err)
+		if !ok {
+			return resp, err
+		}
+		// full jitter, so that calls failing together don't retry in lockstep, unless the provider said when to
+		delay := time.Duration(rand.Int64N(int64(backoff)) + 1)
+		if retryAfter > 0 {
+			delay = retryAfter
+		}
+		if delay > maxWait {
+			slog.Warn("LLM call failed, retry-after beyond the maximum wait", "model", req.Model, "retry_after", delay, "error", err)
+			return resp, err
+		}
+		slog.Warn("LLM call failed, retrying", "model", req.Model, "attempt", attempt, "delay", delay, "error", err)
+		llmRetries.WithLabelValues(promptName(req.Config), strconv.Itoa(status)).Inc()
+		select {
+		case <-ctx.Done():
+			return resp, err
+		case <-time.After(delay):
+		}
+		backoff = min(backoff*2, maxWait)
+	}
+}
+
+// retryableLLMError reports whether the error is a rate limit or a transient failure of the provider, with its HTTP
+// status and how long the provider asked to wait before retrying, if it did.
+func retryableLLMError(err error) (status int, retryAfter time.Duration, ok bool) {
+	var partial *partialStreamError
+	if errors.As(err, &partial) {
+		return 0, 0, false
+	}
+	var openAIErr *openAIError
+	var genaiErr genai.APIError
+	switch {
+	case errors.As(err, &openAIErr):
+		status, retryAfter = openAIErr.StatusCode, openAIErr.RetryAfter
+	case errors.As(err, &genaiErr):
+		status, retryAfter = genaiErr.Code, genaiRetryDelay(genaiErr)
+	default:
+		return 0, 0, false
+	}
+	switch status {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return status, retryAfter, true
+	}
+	return status, 0, false
+}
+
+// parseRetryAfter parses a Retry-After header, in seconds or as an HTTP date. Returns 0 when absent or invalid.
+func parseRetryAfter(header string) time.Duration {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return time.Duration(max(seconds, 0)) * time.Second
+	}
+	if at, err := http.ParseTime(header); err == nil {
+		return max(time.Until(at), 0)
+	}
+	return 0
+}
+
+// genaiRetryDelay returns the retry delay of a google.rpc.RetryInfo detail of a Gemini error, which is how the
+// Gemini API says when to retry after a 429.
+func genaiRetryDelay(err genai.APIError) time.Duration {
+	for _, detail := range err.Details {
+		if kind, _ := detail["@type"].(string); !strings.HasSuffix(kind, "google.rpc.RetryInfo") {
+			continue
+		}
+		if raw, _ := detail["retryDelay"].(string); raw != "" {
+			if delay, err := time.ParseDuration(raw); err == nil {
+				return delay
+			}
+		}
+	}
+	return 0
+}
+
+func promptName(config *PromptConfig) string {
+	if config == nil {
+		return ""
+	}
+	return config.Name
+}
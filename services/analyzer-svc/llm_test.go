@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sony/gobreaker/v2"
+	"google.golang.org/genai"
+)
+
+func TestFakeProviderMatchesSchema(t *testing.T) {
+	p := &fakeProvider{}
+
+	resp, err := p.Generate(context.Background(), &LLMRequest{Model: "m", User: "q", Schema: tier1Schema})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tier1 Tier1Result
+	if err := json.Unmarshal([]byte(resp.Text), &tier1); err != nil {
+		t.Fatalf("tier 1 output does not parse: %v (%s)", err, resp.Text)
+	}
+
+	resp, err = p.Generate(context.Background(), &LLMRequest{Model: "m", User: "q", Schema: tier2Schema})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var findings []TriageFinding
+	if err := json.Unmarshal([]byte(resp.Text), &findings); err != nil {
+		t.Fatalf("tier 2 output does not parse: %v (%s)", err, resp.Text)
+	}
+
+	// same prompt, same answer
+	a, _ := p.Generate(context.Background(), &LLMRequest{Model: "m", User: "hello"})
+	b, _ := p.Generate(context.Background(), &LLMRequest{Model: "m", User: "hello"})
+	c, _ := p.Generate(context.Background(), &LLMRequest{Model: "m", User: "world"})
+	if a.Text != b.Text || a.Text == c.Text {
+		t.Errorf("fake text output is not deterministic per prompt: %q %q %q", a.Text, b.Text, c.Text)
+	}
+}
+
+func TestOpenAIProviderGenerate(t *testing.T) {
+	var got openAIChatRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			t.Errorf("missing bearer token")
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+		_, _ = w.Write([]byte(`{"model":"llama3:8b","choices":[{"message":{"role":"assistant","content":"[]"}}],
+			"usage":{"prompt_tokens":120,"completion_tokens":8,"prompt_tokens_details":{"cached_tokens":100}}}`))
+	}))
+	defer srv.Close()
+
+	maxTokens := 64
+	p := newOpenAIProvider(srv.URL+"/v1/", "secret", "llama3", nil)
+	resp, err := p.Generate(context.Background(), &LLMRequest{
+		Model:  "gemini-3-flash-preview",
+		System: "sys",
+		User:   "usr",
+		Config: &PromptConfig{MaxOutputTokens: &maxTokens},
+		Schema: tier2Schema,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Text != "[]" {
+		t.Errorf("got %q, want []", resp.Text)
+	}
+	if resp.Model != "llama3:8b" || resp.Usage != (LLMUsage{InputTokens: 120, OutputTokens: 8, CachedTokens: 100}) {
+		t.Errorf("unexpected model %q and usage %+v", resp.Model, resp.Usage)
+	}
+
+	if got.Model != "llama3" {
+		t.Errorf("model override not applied, got %q", got.Model)
+	}
+	if len(got.Messages) != 2 || got.Messages[0].Role != "system" || got.Messages[1].Content != "usr" {
+		t.Errorf("unexpected messages %+v", got.Messages)
+	}
+	if got.MaxTokens != 64 {
+		t.Errorf("max tokens = %d, want 64", got.MaxTokens)
+	}
+	if got.ResponseFormat == nil || got.ResponseFormat.JSONSchema.Schema["type"] != "array" {
+		t.Errorf("expected json schema response format, got %+v", got.ResponseFormat)
+	}
+}
+
+func TestOpenAIProviderError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "slow down", http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	_, err := newOpenAIProvider(srv.URL, "", "", nil).Generate(context.Background(), &LLMRequest{User: "q"})
+	apiErr, ok := err.(*openAIError)
+	if !ok || apiErr.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected openAIError with 429, got %v", err)
+	}
+}
+
+func TestOpenAIProviderGenerateStream(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req openAIChatRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		if !req.Stream || req.StreamOptions == nil || !req.StreamOptions.IncludeUsage {
+			t.Errorf("stream flag or usage option not set")
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, chunk := range []string{"Brute ", "force ", "detected"} {
+			data, _ := json.Marshal(map[string]any{"choices": []any{map[string]any{"delta": map[string]string{"content": chunk}}}})
+			_, _ = w.Write([]byte("data: " + string(data) + "\n\n"))
+		}
+		_, _ = w.Write([]byte(`data: {"choices":[],"usage":{"prompt_tokens":40,"completion_tokens":3}}` + "\n\n"))
+		_, _ = w.Write([]byte("data: [DONE]\n\n"))
+	}))
+	defer srv.Close()
+
+	var chunks []string
+	resp, err := newOpenAIProvider(srv.URL, "", "", nil).GenerateStream(context.Background(), &LLMRequest{User: "q"},
+		func(chunk string) error {
+			chunks = append(chunks, chunk)
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Text != "Brute force detected" || len(chunks) != 3 {
+		t.Errorf("got %q in %d chunks, want full text in 3 chunks", resp.Text, len(chunks))
+	}
+	if resp.Usage != (LLMUsage{InputTokens: 40, OutputTokens: 3}) {
+		t.Errorf("unexpected usage %+v", resp.Usage)
+	}
+}
+
+func TestOpenAIProviderResolveModel(t *testing.T) {
+	models, err := parseModelMap("gemini-3-pro-preview=llama3:70b, gemini-3-flash-preview = llama3:8b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newOpenAIProvider("http://localhost", "", "llama3", models)
+	for model, want := range map[string]string{
+		"gemini-3-pro-preview":   "llama3:70b",
+		"gemini-3-flash-preview": "llama3:8b",
+		"gemini-2.5-flash":       "llama3",
+		"":                       "llama3",
+		"gpt-4o-mini":            "gpt-4o-mini",
+	} {
+		if got := p.resolveModel(model); got != want {
+			t.Errorf("resolveModel(%q) = %q, want %q", model, got, want)
+		}
+	}
+
+	if _, err := parseModelMap("gemini-3-pro-preview"); err == nil {
+		t.Error("expected a mapping without = to be rejected")
+	}
+}
+
+func TestStreamClientErrorsDoNotTripBreaker(t *testing.T) {
+	prompts, err := NewPromptLibrary(promptsFS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		prompts:     prompts,
+		llm:         map[string]LLMProvider{providerFake: &fakeProvider{}},
+		llmDefault:  providerFake,
+		llmBreakers: newLLMBreakers(),
+	}
+	prompt, err := prompts.RenderAnalyzePrompt("what happened?", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errGone := errors.New("client went away")
+	for range 10 {
+		_, err := s.generateContentStream(context.Background(), prompt, func(string) error { return errGone })
+		if !errors.Is(err, errGone) {
+			t.Fatalf("expected the write error, got %v", err)
+		}
+	}
+	if state := s.llmBreakers.state(providerFake, prompt.Config.Model); state != gobreaker.StateClosed {
+		t.Errorf("breaker is %s after client write errors, want closed", state)
+	}
+}
+
+func TestLLMRetriesRetryableErrors(t *testing.T) {
+	var calls int
+	badRequest := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		switch {
+		case badRequest:
+			http.Error(w, "bad request", http.StatusBadRequest)
+		case calls == 1:
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+		case calls == 2:
+			w.Header().Set("Retry-After", "0")
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+		default:
+			_, _ = w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"done"}}]}`))
+		}
+	}))
+	defer srv.Close()
+
+	prompts, err := NewPromptLibrary(promptsFS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		prompts:     prompts,
+		llm:         map[string]LLMProvider{providerOpenAI: newOpenAIProvider(srv.URL, "", "", nil)},
+		llmDefault:  providerOpenAI,
+		llmBreakers: newLLMBreakers(),
+	}
+	s.cfg.LLMMaxAttempts = 3
+	s.cfg.LLMInitialBackoff = time.Millisecond
+	prompt, err := prompts.RenderAnalyzePrompt("what happened?", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	answer, err := s.generateContent(context.Background(), prompt)
+	if err != nil || answer != "done" {
+		t.Fatalf("got %q, %v after %d calls", answer, err, calls)
+	}
+
+	// a client error is not retried
+	calls, badRequest = 0, true
+	if _, err := s.generateContent(context.Background(), prompt); err == nil || calls != 1 {
+		t.Errorf("expected a single failed call, got %d calls and %v", calls, err)
+	}
+}
+
+func TestRetryableLLMError(t *testing.T) {
+	for _, tc := range []struct {
+		err        error
+		retryable  bool
+		retryAfter time.Duration
+	}{
+		{&openAIError{StatusCode: http.StatusTooManyRequests, RetryAfter: 7 * time.Second}, true, 7 * time.Second},
+		{fmt.Errorf("call: %w", &openAIError{StatusCode: http.StatusBadGateway}), true, 0},
+		{&openAIError{StatusCode: http.StatusUnauthorized}, false, 0},
+		{genai.APIError{Code: http.StatusTooManyRequests, Details: []map[string]any{
+			{"@type": "type.googleapis.com/google.rpc.RetryInfo", "retryDelay": "12s"},
+		}}, true, 12 * time.Second},
+		{&partialStreamError{&openAIError{StatusCode: http.StatusServiceUnavailable}}, false, 0},
+		{errors.New("connection refused"), false, 0},
+	} {
+		_, retryAfter, ok := retryableLLMError(tc.err)
+		if ok != tc.retryable || retryAfter != tc.retryAfter {
+			t.Errorf("%v: retryable = %v after %s, want %v after %s", tc.err, ok, retryAfter, tc.retryable, tc.retryAfter)
+		}
+	}
+
+	if got := parseRetryAfter("120"); got != 2*time.Minute {
+		t.Errorf("parseRetryAfter(120) = %s", got)
+	}
+	if got := parseRetryAfter(time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)); got < 59*time.Minute {
+		t.Errorf("parseRetryAfter(date) = %s", got)
+	}
+}
+
+// modelFailingProvider fails every call to one model and answers the others with the model's name.
+type modelFailingProvider struct {
+	failing string
+	calls   map[string]int
+}
+
+func (p *modelFailingProvider) Name() string { return "failing" }
+
+func (p *modelFailingProvider) Generate(_ context.Context, req *LLMRequest) (*LLMResponse, error) {
+	p.calls[req.Model]++
+	if req.Model == p.failing {
+		return nil, &openAIError{StatusCode: http.StatusServiceUnavailable}
+	}
+	return &LLMResponse{Text: "answered by " + req.Model}, nil
+}
+
+func (p *modelFailingProvider) GenerateStream(ctx context.Context, req *LLMRequest, onChunk func(string) error) (*LLMResponse, error) {
+	resp, err := p.Generate(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return resp, onChunk(resp.Text)
+}
+
+func TestOpenBreakerUsesFallbackModels(t *testing.T) {
+	prompts, err := NewPromptLibrary(promptsFS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := &modelFailingProvider{failing: "primary", calls: map[string]int{}}
+	s := &Server{
+		prompts:     prompts,
+		llm:         map[string]LLMProvider{"failing": provider},
+		llmDefault:  "failing",
+		llmBreakers: newLLMBreakers(),
+	}
+	prompt, err := prompts.RenderAnalyzePrompt("what happened?", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := *prompt.Config
+	config.Model = "primary"
+	config.FallbackModels = []string{"secondary"}
+	prompt.Config = &config
+
+	for range 5 {
+		if _, err := s.generateContent(context.Background(), prompt); err == nil {
+			t.Fatal("expected the primary model to fail")
+		}
+	}
+	if state := s.llmBreakers.state("failing", "primary"); state != gobreaker.StateOpen {
+		t.Fatalf("breaker is %s after 5 failures, want open", state)
+	}
+
+	answer, err := s.generateContent(context.Background(), prompt)
+	if err != nil || answer != "answered by secondary" {
+		t.Fatalf("got %q, %v, want the fallback's answer", answer, err)
+	}
+	if provider.calls["primary"] != 5 {
+		t.Errorf("primary called %d times, want 5: the open breaker should skip it", provider.calls["primary"])
+	}
+
+	config.FallbackModels = nil
+	if _, err := s.generateContent(context.Background(), prompt); !errors.Is(err, gobreaker.ErrOpenState) {
+		t.Errorf("expected the open breaker error without fallbacks, got %v", err)
+	}
+}
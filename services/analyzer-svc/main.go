@@ -3,10 +3,12 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -14,46 +16,147 @@ import (
 	"github.com/andreionoie/llm-event-analysis/pkg/common"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/redis/go-redis/v9"
-	"github.com/sony/gobreaker/v2"
-	"google.golang.org/genai"
 )
 
 type Config struct {
-	Port         string
-	DatabaseURL  string
-	RedisAddr    string
-	GeminiAPIKey string
-	MaxEvents    int
+	Port           string
+	DatabaseURL    string
+	RedisAddr      string
+	LLMProvider    string
+	GeminiAPIKey   string
+	OpenAIBaseURL  string
+	OpenAIAPIKey   string
+	OpenAIModel    string
+	OpenAIModelMap string
+	CassetteMode   string
+	CassetteDir    string
+	PromptsDir     string
+	PromptsReload  time.Duration
+
+	LLMMaxAttempts    int
+	LLMInitialBackoff time.Duration
+	LLMMaxRetryWait   time.Duration
+
+	MaxEvents     int
+	SummaryBucket time.Duration
+
+	SessionHistoryTokens  int
+	InvestigationMaxSteps int
+
+	TriageWorkers    int
+	TriageMaxQueued  int
+	TriageJobTimeout time.Duration
+	TriageHeartbeat  time.Duration
+	TriageDedupTTL   time.Duration
+
+	TriageMaxChunks   int
+	TriageParallelism int
+	Tier2TokenBudget  int
+	Tier2MaxBatches   int
+	FewShotExamples   int
+
+	LLMDailyTokenBudget int
+
+	AlertsConfig    string
+	RedactionConfig string
+
+	Embedding common.EmbeddingConfig
 }
 
 func loadConfig() Config {
-	return Config{
-		Port:         common.GetenvOrDefault("PORT", "8080"),
-		DatabaseURL:  common.RequireEnv("DATABASE_URL"),
-		RedisAddr:    common.RequireEnv("REDIS_ADDR"),
-		GeminiAPIKey: os.Getenv("GEMINI_API_KEY"),
-		MaxEvents:    common.GetenvOrDefaultInt("ANALYZER_MAX_EVENTS", "100"),
+	c := Config{
+		Port:          common.GetenvOrDefault("PORT", "8080"),
+		DatabaseURL:   common.RequireEnv("DATABASE_URL"),
+		RedisAddr:     common.RequireEnv("REDIS_ADDR"),
+		PromptsReload: time.Second * time.Duration(common.GetenvOrDefaultInt("PROMPTS_RELOAD_SECONDS", "10")),
+		MaxEvents:     common.GetenvOrDefaultInt("ANALYZER_MAX_EVENTS", "100"),
+		SummaryBucket: time.Second * time.Duration(common.GetenvOrDefaultInt("SUMMARY_BUCKET_SECONDS", "300")),
+
+		SessionHistoryTokens:  common.GetenvOrDefaultInt("SESSION_HISTORY_TOKEN_BUDGET", "4000"),
+		InvestigationMaxSteps: common.GetenvOrDefaultInt("INVESTIGATION_MAX_STEPS", "6"),
+
+		TriageWorkers:    common.GetenvOrDefaultInt("TRIAGE_WORKERS", "4"),
+		TriageMaxQueued:  common.GetenvOrDefaultInt("TRIAGE_MAX_QUEUED", "100"),
+		TriageJobTimeout: time.Second * time.Duration(common.GetenvOrDefaultInt("TRIAGE_JOB_TIMEOUT_SECONDS", "600")),
+		TriageHeartbeat:  time.Second * time.Duration(common.GetenvOrDefaultInt("TRIAGE_HEARTBEAT_SECONDS", "10")),
+		TriageDedupTTL:   time.Second * time.Duration(common.GetenvOrDefaultInt("TRIAGE_DEDUP_TTL_SECONDS", "1800")),
+
+		TriageMaxChunks:   common.GetenvOrDefaultInt("TRIAGE_MAX_CHUNKS", "48"),
+		TriageParallelism: common.GetenvOrDefaultInt("TRIAGE_TIER1_PARALLELISM", "4"),
+		Tier2TokenBudget:  common.GetenvOrDefaultInt("TRIAGE_TIER2_TOKEN_BUDGET", "8000"),
+		Tier2MaxBatches:   common.GetenvOrDefaultInt("TRIAGE_TIER2_MAX_BATCHES", "20"),
+		FewShotExamples:   common.GetenvOrDefaultInt("TRIAGE_FEW_SHOT_EXAMPLES", "3"),
+
+		LLMDailyTokenBudget: common.GetenvOrDefaultInt("LLM_DAILY_TOKEN_BUDGET", "0"),
+
+		AlertsConfig:    os.Getenv("ALERTS_CONFIG"),
+		RedactionConfig: os.Getenv("REDACTION_CONFIG"),
+
+		Embedding: common.LoadEmbeddingConfig(),
 	}
+	c.loadLLMEnv()
+	return c
+}
+
+// loadLLMEnv reads the settings of the LLM providers and prompts, which the eval command shares with the service.
+func (c *Config) loadLLMEnv() {
+	c.LLMProvider = os.Getenv("LLM_PROVIDER")
+	c.GeminiAPIKey = os.Getenv("GEMINI_API_KEY")
+	c.OpenAIBaseURL = os.Getenv("OPENAI_BASE_URL")
+	c.OpenAIAPIKey = os.Getenv("OPENAI_API_KEY")
+	c.OpenAIModel = os.Getenv("OPENAI_MODEL")
+	c.OpenAIModelMap = os.Getenv("OPENAI_MODEL_MAP")
+	c.CassetteMode = os.Getenv("LLM_CASSETTE_MODE")
+	c.CassetteDir = os.Getenv("LLM_CASSETTE_DIR")
+	c.PromptsDir = os.Getenv("PROMPTS_DIR")
+	c.LLMMaxAttempts = common.GetenvOrDefaultInt("LLM_MAX_ATTEMPTS", "3")
+	c.LLMInitialBackoff = time.Millisecond * time.Duration(common.GetenvOrDefaultInt("LLM_RETRY_BACKOFF_MS", "500"))
+	c.LLMMaxRetryWait = time.Second * time.Duration(common.GetenvOrDefaultInt("LLM_RETRY_MAX_WAIT_SECONDS", "30"))
+}
+
+// validate rejects settings the service cannot run with, so that they fail the startup rather than misbehave later.
+func (c Config) validate() error {
+	if c.TriageWorkers < 1 {
+		return fmt.Errorf("TRIAGE_WORKERS must be at least 1, got %d", c.TriageWorkers)
+	}
+	if c.TriageParallelism < 1 {
+		return fmt.Errorf("TRIAGE_TIER1_PARALLELISM must be at least 1, got %d", c.TriageParallelism)
+	}
+	return nil
 }
 
 // Server state
 type Server struct {
-	cfg                 Config
-	ready               atomic.Bool
-	db                  *pgxpool.Pool
-	cache               *redis.Client
-	genai               *genai.Client
-	genaiCircuitBreaker *gobreaker.CircuitBreaker[*genai.GenerateContentResponse]
-	prompts             *PromptLibrary
+	cfg         Config
+	ready       atomic.Bool
+	db          *pgxpool.Pool
+	cache       *redis.Client
+	llm         map[string]LLMProvider
+	llmDefault  string
+	llmBreakers *llmBreakers
+	prompts     *PromptLibrary
+	triage      *triageWorkers
+	alerts      *Alerter // nil when alerting is not configured
+	fewShot     *fewShotPool
+	usage       *usageRecorder
+	embedder    common.EmbeddingProvider // nil when embeddings are not configured
 }
 
 func main() {
 	logLevel := common.InitSlog()
+	if len(os.Args) > 1 && os.Args[1] == "eval" {
+		os.Exit(runEval(os.Args[2:]))
+	}
 
 	s := &Server{
 		cfg: loadConfig(),
 	}
+	if err := s.cfg.validate(); err != nil {
+		slog.Error("invalid configuration", "error", err)
+		os.Exit(1)
+	}
 
 	db, err := common.ConnectPGXPoolWithRetry(context.Background(), s.cfg.DatabaseURL, logLevel, 10, 3*time.Second)
 	if err != nil {
@@ -61,6 +164,10 @@ func main() {
 		os.Exit(1)
 	}
 	defer db.Close()
+	if err := runMigrations(db); err != nil {
+		slog.Error("failed to run database migrations", "error", err)
+		os.Exit(1)
+	}
 	s.db = db
 
 	rdb := redis.NewClient(&redis.Options{Addr: s.cfg.RedisAddr})
@@ -75,46 +182,92 @@ func main() {
 
 	s.ready.Store(true)
 
-	prompts, err := NewPromptLibrary(promptsFS)
+	prompts, err := NewPromptLibraryWithDir(promptsFS, s.cfg.PromptsDir)
 	if err != nil {
 		slog.Error("failed to load prompts", "error", err)
 		os.Exit(1)
 	}
+	redactor, err := loadRedactor(s.cfg.RedactionConfig)
+	if err != nil {
+		slog.Error("failed to load redaction config", "path", s.cfg.RedactionConfig, "error", err)
+		os.Exit(1)
+	}
+	prompts.redactor = redactor
 	s.prompts = prompts
 
-	if s.cfg.GeminiAPIKey != "" {
-		httpLogger := slog.Default().With("component", "genai_http")
-		config := genai.ClientConfig{
-			APIKey:     s.cfg.GeminiAPIKey,
-			HTTPClient: newLoggingHTTPClient(httpLogger),
-		}
-		client, err := genai.NewClient(context.Background(), &config)
+	providers, defaultProvider, err := setupLLMProviders(context.Background(), s.cfg)
+	if err != nil {
+		slog.Error("failed to create LLM providers", "error", err)
+		os.Exit(1)
+	}
+	s.llm = providers
+	s.llmDefault = defaultProvider
+	slog.Info("LLM providers initialized", "default", defaultProvider)
+	s.llmBreakers = newLLMBreakers()
+
+	embedder, err := common.NewEmbeddingProvider(s.cfg.Embedding)
+	if err != nil {
+		slog.Error("failed to create embedding provider", "error", err)
+		os.Exit(1)
+	}
+	if embedder != nil {
+		s.embedder = embedder
+		slog.Info("semantic search enabled", "provider", s.cfg.Embedding.Provider, "model", embedder.Model())
+	}
+
+	if s.cfg.AlertsConfig != "" {
+		alerts, err := loadAlerter(s.cfg.AlertsConfig)
 		if err != nil {
-			slog.Error("failed to create gemini client", "error", err)
+			slog.Error("failed to load alerts config", "path", s.cfg.AlertsConfig, "error", err)
 			os.Exit(1)
 		}
-		s.genai = client
-		slog.Info("google genai client initialized")
-		s.genaiCircuitBreaker = gobreaker.NewCircuitBreaker[*genai.GenerateContentResponse](gobreaker.Settings{
-			Name:    "genai-client",
-			Timeout: 60 * time.Second,
-			OnStateChange: func(name string, from gobreaker.State, to gobreaker.State) {
-				slog.Debug("circuit breaker state change", "name", name, "from", from, "to", to)
-			},
-			IsSuccessful: nil,
-			IsExcluded:   nil,
-		})
-	} else {
-		slog.Warn("GEMINI_API_KEY not set, analysis will return a mock response")
+		s.alerts = alerts
+		slog.Info("alerting enabled", "channels", len(alerts.channels), "routes", len(alerts.routes))
+	}
+
+	s.fewShot = newFewShotPool(s.loadFewShotPool)
+	s.triage = newTriageWorkers(s.cfg.TriageWorkers)
+	workersCtx, workersCancel := context.WithCancel(context.Background())
+	s.startTriageWorkers(workersCtx)
+	s.usage = newUsageRecorder()
+	go s.runUsageRecorder(workersCtx)
+	if s.cfg.PromptsDir != "" {
+		go s.prompts.runPromptReloader(workersCtx, s.cfg.PromptsReload)
 	}
 
 	e := echo.New()
 	common.SetupEchoDefaults(e, "analyzer-svc", s.handleHealth, s.handleReady)
 	e.POST("/analyze", s.handleAnalyze)
+	e.POST("/analyze/stream", s.handleAnalyzeStream)
+	e.POST("/investigate", s.handleInvestigate)
+	e.POST("/sessions", s.handleCreateSession)
+	e.GET("/sessions/:id", s.handleGetSession)
+	e.POST("/sessions/:id/messages", s.handleSessionMessage)
 	e.GET("/events", s.handleEvents)
+	e.GET("/events/:id/similar", s.handleSimilarEvents)
+	e.POST("/events/search", s.handleSearchEvents)
 	e.GET("/summaries", s.handleSummaries)
 	e.POST("/triage/jobs", s.handleCreateTriageJob)
+	e.GET("/triage/jobs", s.handleListTriageJobs)
 	e.GET("/triage/jobs/:id", s.handleGetTriageJob)
+	e.DELETE("/triage/jobs/:id", s.handleCancelTriageJob)
+	e.POST("/triage/jobs/:id/feedback", s.handleCreateTriageFeedback)
+	e.GET("/triage/feedback", s.handleListTriageFeedback)
+	e.DELETE("/triage/feedback/:id", s.handleDeleteTriageFeedback)
+	e.POST("/triage/schedules", s.handleCreateTriageSchedule)
+	e.GET("/triage/schedules", s.handleListTriageSchedules)
+	e.GET("/triage/schedules/:id", s.handleGetTriageSchedule)
+	e.PATCH("/triage/schedules/:id", s.handleUpdateTriageSchedule)
+	e.DELETE("/triage/schedules/:id", s.handleDeleteTriageSchedule)
+	e.POST("/incidents", s.handleCreateIncident)
+	e.GET("/incidents", s.handleListIncidents)
+	e.GET("/incidents/:id", s.handleGetIncident)
+	e.PATCH("/incidents/:id", s.handleUpdateIncident)
+	e.POST("/incidents/:id/comments", s.handleCreateIncidentComment)
+	e.POST("/incidents/:id/events", s.handleLinkIncidentEvents)
+	e.DELETE("/incidents/:id/events/:event_id", s.handleUnlinkIncidentEvent)
+	e.GET("/usage", s.handleUsage)
+	e.GET("/prompts", s.handleListPrompts)
 
 	echoErrChan := make(chan error, 1)
 	go func() {
@@ -136,6 +289,14 @@ func main() {
 	}
 
 	s.ready.Store(false)
+	// running triage jobs go back to the queue for the other replicas
+	workersCancel()
+	s.triage.wg.Wait()
+	// alerts of the last completed jobs get a chance to go out
+	if s.alerts != nil {
+		s.alerts.Shutdown(alertShutdownGrace)
+	}
+	<-s.usage.done
 	time.Sleep(5 * time.Second)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
@@ -160,18 +321,23 @@ func (s *Server) handleReady(c echo.Context) error {
 }
 
 func newLoggingHTTPClient(logger *slog.Logger) *http.Client {
-	// TODO: instrument the genai client with prometheus metrics as well
 	return &http.Client{
 		Transport: &loggingRoundTripper{
-			base:   http.DefaultTransport,
-			logger: logger,
+			base:     http.DefaultTransport,
+			logger:   logger,
+			name:     "llm",
+			requests: llmHTTPRequests,
 		},
 	}
 }
 
+// loggingRoundTripper logs the requests of a client, named by name in the log messages, and counts them in requests,
+// by host and status code, unless it is nil.
 type loggingRoundTripper struct {
-	base   http.RoundTripper
-	logger *slog.Logger
+	base     http.RoundTripper
+	logger   *slog.Logger
+	name     string
+	requests *prometheus.CounterVec
 }
 
 func (l *loggingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
@@ -188,7 +354,8 @@ func (l *loggingRoundTripper) RoundTrip(req *http.Request) (*http.Response, erro
 	resp, err := base.RoundTrip(req)
 	latency := time.Since(start)
 	if err != nil {
-		l.logger.Warn("genai http request failed",
+		l.count(req.URL.Host, "error")
+		l.logger.Warn(l.name+" http request failed",
 			"method", req.Method,
 			"host", req.URL.Host,
 			"path", req.URL.Path,
@@ -198,7 +365,8 @@ func (l *loggingRoundTripper) RoundTrip(req *http.Request) (*http.Response, erro
 		return resp, err
 	}
 
-	l.logger.Debug("genai http request",
+	l.count(req.URL.Host, strconv.Itoa(resp.StatusCode))
+	l.logger.Debug(l.name+" http request",
 		"method", req.Method,
 		"host", req.URL.Host,
 		"path", req.URL.Path,
@@ -207,3 +375,9 @@ func (l *loggingRoundTripper) RoundTrip(req *http.Request) (*http.Response, erro
 	)
 	return resp, err
 }
+
+func (l *loggingRoundTripper) count(host, status string) {
+	if l.requests != nil {
+		l.requests.WithLabelValues(host, status).Inc()
+	}
+}
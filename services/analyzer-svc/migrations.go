@@ -0,0 +1,48 @@
+package main
+
+import (
+	"embed"
+	"errors"
+	"log/slog"
+
+	"github.com/golang-migrate/migrate/v4"
+	pgxdriver "github.com/golang-migrate/migrate/v4/database/pgx/v5"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+//go:embed migrations/*.sql
+var migrationsFS embed.FS
+
+func runMigrations(db *pgxpool.Pool) error {
+	sourceDriver, err := iofs.New(migrationsFS, "migrations")
+	if err != nil {
+		return err
+	}
+
+	sqlDB := stdlib.OpenDBFromPool(db)
+	defer sqlDB.Close()
+
+	driver, err := pgxdriver.WithInstance(sqlDB, &pgxdriver.Config{
+		// processor-svc owns the default migrations table for the events schema
+		MigrationsTable: "analyzer_schema_migrations",
+	})
+	if err != nil {
+		return err
+	}
+
+	m, err := migrate.NewWithInstance("iofs", sourceDriver, "pgx5", driver)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	if err := m.Up(); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return err
+	}
+
+	version, dirty, _ := m.Version()
+	slog.Info("database migrations complete", "version", version, "dirty", dirty)
+	return nil
+}
@@ -0,0 +1,5 @@
+-- 01_create_sessions.down.sql
+-- Drop analysis sessions and their messages.
+
+DROP TABLE IF EXISTS analysis_session_messages;
+DROP TABLE IF EXISTS analysis_sessions;
@@ -0,0 +1,20 @@
+-- 01_create_sessions.up.sql
+-- Create multi-turn analysis sessions and their message history.
+
+CREATE TABLE IF NOT EXISTS analysis_sessions (
+    id               TEXT PRIMARY KEY,
+    time_range_start TIMESTAMPTZ,
+    time_range_end   TIMESTAMPTZ,
+    event_ids        JSONB NOT NULL DEFAULT '[]',
+    created_at       TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at       TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS analysis_session_messages (
+    session_id  TEXT NOT NULL REFERENCES analysis_sessions(id) ON DELETE CASCADE,
+    seq         INT NOT NULL,
+    role        TEXT NOT NULL,
+    content     TEXT NOT NULL,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (session_id, seq)
+);
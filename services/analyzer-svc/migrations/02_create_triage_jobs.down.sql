@@ -0,0 +1,6 @@
+-- 02_create_triage_jobs.down.sql
+-- Drop triage jobs, tier 1 results and findings.
+
+DROP TABLE IF EXISTS triage_findings;
+DROP TABLE IF EXISTS triage_tier1_results;
+DROP TABLE IF EXISTS triage_jobs;
@@ -0,0 +1,39 @@
+-- 02_create_triage_jobs.up.sql
+-- Create triage jobs with their tier 1 results and tier 2 findings.
+
+CREATE TABLE IF NOT EXISTS triage_jobs (
+    id                TEXT PRIMARY KEY,
+    results_key       TEXT NOT NULL,
+    time_range_start  TIMESTAMPTZ NOT NULL,
+    time_range_end    TIMESTAMPTZ NOT NULL,
+    filter            JSONB,
+    status            TEXT NOT NULL,
+    error             TEXT NOT NULL DEFAULT '',
+    scanned_event_ids JSONB NOT NULL DEFAULT '[]',
+    created_at        TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at        TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_triage_jobs_created_at ON triage_jobs(created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_triage_jobs_status ON triage_jobs(status, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_triage_jobs_results_key ON triage_jobs(results_key, created_at DESC);
+
+CREATE TABLE IF NOT EXISTS triage_tier1_results (
+    job_id      TEXT PRIMARY KEY REFERENCES triage_jobs(id) ON DELETE CASCADE,
+    summary     TEXT NOT NULL,
+    high_risk   JSONB NOT NULL DEFAULT '[]',
+    medium_risk JSONB NOT NULL DEFAULT '[]',
+    low_risk    JSONB NOT NULL DEFAULT '[]'
+);
+
+CREATE TABLE IF NOT EXISTS triage_findings (
+    job_id    TEXT NOT NULL REFERENCES triage_jobs(id) ON DELETE CASCADE,
+    seq       INT NOT NULL,
+    priority  TEXT NOT NULL,
+    category  TEXT NOT NULL,
+    summary   TEXT NOT NULL,
+    event_ids JSONB NOT NULL DEFAULT '[]',
+    PRIMARY KEY (job_id, seq)
+);
+
+CREATE INDEX IF NOT EXISTS idx_triage_findings_priority ON triage_findings(priority);
@@ -0,0 +1,8 @@
+-- 03_add_triage_job_leases.down.sql
+-- Drop triage job lease columns.
+
+DROP INDEX IF EXISTS idx_triage_jobs_heartbeat;
+DROP INDEX IF EXISTS idx_triage_jobs_pending;
+ALTER TABLE triage_jobs DROP COLUMN IF EXISTS attempts;
+ALTER TABLE triage_jobs DROP COLUMN IF EXISTS heartbeat_at;
+ALTER TABLE triage_jobs DROP COLUMN IF EXISTS worker_id;
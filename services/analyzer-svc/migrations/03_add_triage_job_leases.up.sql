@@ -0,0 +1,9 @@
+-- 03_add_triage_job_leases.up.sql
+-- Track which worker runs a triage job and its last heartbeat, so jobs of dead workers can be reclaimed.
+
+ALTER TABLE triage_jobs ADD COLUMN IF NOT EXISTS worker_id TEXT;
+ALTER TABLE triage_jobs ADD COLUMN IF NOT EXISTS heartbeat_at TIMESTAMPTZ;
+ALTER TABLE triage_jobs ADD COLUMN IF NOT EXISTS attempts INT NOT NULL DEFAULT 0;
+
+CREATE INDEX IF NOT EXISTS idx_triage_jobs_pending ON triage_jobs(created_at) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS idx_triage_jobs_heartbeat ON triage_jobs(heartbeat_at) WHERE status = 'running';
@@ -0,0 +1,4 @@
+-- 04_add_triage_job_coverage.down.sql
+-- Drop triage job coverage.
+
+ALTER TABLE triage_jobs DROP COLUMN IF EXISTS coverage;
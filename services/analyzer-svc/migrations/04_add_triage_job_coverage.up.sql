@@ -0,0 +1,4 @@
+-- 04_add_triage_job_coverage.up.sql
+-- Record how much of the requested time range a triage job analyzed.
+
+ALTER TABLE triage_jobs ADD COLUMN IF NOT EXISTS coverage JSONB;
@@ -0,0 +1,7 @@
+-- 05_create_triage_schedules.down.sql
+-- Drop triage schedules and the schedule columns of triage jobs.
+
+DROP INDEX IF EXISTS idx_triage_jobs_schedule;
+ALTER TABLE triage_jobs DROP COLUMN IF EXISTS diff;
+ALTER TABLE triage_jobs DROP COLUMN IF EXISTS schedule_id;
+DROP TABLE IF EXISTS triage_schedules;
@@ -0,0 +1,23 @@
+-- 05_create_triage_schedules.up.sql
+-- Create recurring triage schedules, and link triage jobs to the schedule run that created them.
+
+CREATE TABLE IF NOT EXISTS triage_schedules (
+    id             TEXT PRIMARY KEY,
+    name           TEXT NOT NULL,
+    cron           TEXT NOT NULL,
+    window_seconds INT NOT NULL,
+    filter         JSONB,
+    enabled        BOOLEAN NOT NULL DEFAULT TRUE,
+    next_run_at    TIMESTAMPTZ NOT NULL,
+    last_run_at    TIMESTAMPTZ,
+    last_job_id    TEXT,
+    created_at     TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at     TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_triage_schedules_due ON triage_schedules(next_run_at) WHERE enabled;
+
+ALTER TABLE triage_jobs ADD COLUMN IF NOT EXISTS schedule_id TEXT REFERENCES triage_schedules(id) ON DELETE SET NULL;
+ALTER TABLE triage_jobs ADD COLUMN IF NOT EXISTS diff JSONB;
+
+CREATE INDEX IF NOT EXISTS idx_triage_jobs_schedule ON triage_jobs(schedule_id, created_at DESC);
@@ -0,0 +1,6 @@
+-- 06_create_incidents.down.sql
+-- Drop incidents, their comments and attached findings.
+
+DROP TABLE IF EXISTS incident_findings;
+DROP TABLE IF EXISTS incident_comments;
+DROP TABLE IF EXISTS incidents;
@@ -0,0 +1,44 @@
+-- 06_create_incidents.up.sql
+-- Create incidents, their comments and the triage findings attached to them.
+
+CREATE TABLE IF NOT EXISTS incidents (
+    id          TEXT PRIMARY KEY,
+    title       TEXT NOT NULL,
+    category    TEXT NOT NULL,
+    priority    TEXT NOT NULL,
+    status      TEXT NOT NULL,
+    assignee    TEXT NOT NULL DEFAULT '',
+    event_ids   JSONB NOT NULL DEFAULT '[]',
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    resolved_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_incidents_status ON incidents(status, updated_at DESC);
+CREATE INDEX IF NOT EXISTS idx_incidents_open_category ON incidents(lower(category))
+    WHERE status IN ('open', 'acknowledged');
+CREATE INDEX IF NOT EXISTS idx_incidents_event_ids ON incidents USING GIN (event_ids);
+
+CREATE TABLE IF NOT EXISTS incident_comments (
+    id          TEXT PRIMARY KEY,
+    incident_id TEXT NOT NULL REFERENCES incidents(id) ON DELETE CASCADE,
+    author      TEXT NOT NULL,
+    body        TEXT NOT NULL,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_incident_comments_incident ON incident_comments(incident_id, created_at);
+
+-- a copy of the finding, since a job's findings are replaced whenever the job is saved
+CREATE TABLE IF NOT EXISTS incident_findings (
+    incident_id TEXT NOT NULL REFERENCES incidents(id) ON DELETE CASCADE,
+    job_id      TEXT NOT NULL REFERENCES triage_jobs(id) ON DELETE CASCADE,
+    seq         INT NOT NULL,
+    priority    TEXT NOT NULL,
+    summary     TEXT NOT NULL,
+    event_ids   JSONB NOT NULL DEFAULT '[]',
+    attached_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (job_id, seq)
+);
+
+CREATE INDEX IF NOT EXISTS idx_incident_findings_incident ON incident_findings(incident_id, attached_at);
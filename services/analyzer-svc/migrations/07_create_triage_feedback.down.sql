@@ -0,0 +1,4 @@
+-- 07_create_triage_feedback.down.sql
+-- Drop analyst feedback on triage results.
+
+DROP TABLE IF EXISTS triage_feedback;
@@ -0,0 +1,20 @@
+-- 07_create_triage_feedback.up.sql
+-- Create analyst feedback on triage findings and tier 1 bucket ratings, used as few-shot examples.
+
+CREATE TABLE IF NOT EXISTS triage_feedback (
+    id         TEXT PRIMARY KEY,
+    job_id     TEXT REFERENCES triage_jobs(id) ON DELETE SET NULL,
+    kind       TEXT NOT NULL, -- finding or bucket
+    target     TEXT NOT NULL, -- finding seq or bucket ID
+    label      TEXT NOT NULL,
+    note       TEXT NOT NULL DEFAULT '',
+    author     TEXT NOT NULL DEFAULT '',
+    input      TEXT NOT NULL,
+    output     TEXT NOT NULL,
+    features   JSONB NOT NULL DEFAULT '[]',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (job_id, kind, target)
+);
+
+CREATE INDEX IF NOT EXISTS idx_triage_feedback_kind ON triage_feedback(kind, updated_at DESC);
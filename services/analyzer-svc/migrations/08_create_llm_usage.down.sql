@@ -0,0 +1,4 @@
+-- 08_create_llm_usage.down.sql
+-- Drop the LLM usage log.
+
+DROP TABLE IF EXISTS llm_usage;
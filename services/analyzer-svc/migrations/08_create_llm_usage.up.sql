@@ -0,0 +1,19 @@
+-- 08_create_llm_usage.up.sql
+-- Create the per-call LLM usage log: tokens, latency and errors by prompt, prompt version and model.
+
+CREATE TABLE IF NOT EXISTS llm_usage (
+    id             BIGSERIAL PRIMARY KEY,
+    created_at     TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    prompt         TEXT NOT NULL,
+    prompt_version TEXT NOT NULL,
+    provider       TEXT NOT NULL,
+    model          TEXT NOT NULL,
+    input_tokens   INT NOT NULL DEFAULT 0,
+    output_tokens  INT NOT NULL DEFAULT 0,
+    cached_tokens  INT NOT NULL DEFAULT 0,
+    latency_ms     INT NOT NULL,
+    error          TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS idx_llm_usage_created_at ON llm_usage(created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_llm_usage_prompt ON llm_usage(prompt, created_at DESC);
@@ -0,0 +1,4 @@
+-- 09_add_triage_job_prompts.down.sql
+-- Drop the prompt variants of triage jobs.
+
+ALTER TABLE triage_jobs DROP COLUMN IF EXISTS prompts;
@@ -0,0 +1,4 @@
+-- 09_add_triage_job_prompts.up.sql
+-- Record the prompt variants a triage job used, with the IDs cited in their answers.
+
+ALTER TABLE triage_jobs ADD COLUMN IF NOT EXISTS prompts JSONB;
@@ -0,0 +1,4 @@
+-- 10_add_session_filter.down.sql
+-- Drop the event filter of sessions.
+
+ALTER TABLE analysis_sessions DROP COLUMN IF EXISTS filter;
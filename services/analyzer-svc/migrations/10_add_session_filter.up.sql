@@ -0,0 +1,4 @@
+-- 10_add_session_filter.up.sql
+-- Record the event filter a session picked its events with.
+
+ALTER TABLE analysis_sessions ADD COLUMN IF NOT EXISTS filter JSONB;
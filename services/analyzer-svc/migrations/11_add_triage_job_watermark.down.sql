@@ -0,0 +1,4 @@
+-- 11_add_triage_job_watermark.down.sql
+-- Drop the watermark of triage jobs.
+
+ALTER TABLE triage_jobs DROP COLUMN IF EXISTS watermark;
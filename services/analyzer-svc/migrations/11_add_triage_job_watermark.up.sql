@@ -0,0 +1,4 @@
+-- 11_add_triage_job_watermark.up.sql
+-- Record the state of the events a triage job analyzed, so that new events in its range start a new job.
+
+ALTER TABLE triage_jobs ADD COLUMN IF NOT EXISTS watermark JSONB;
@@ -0,0 +1,4 @@
+-- 12_add_incident_finding_entities.down.sql
+-- Drop the entities of incident findings.
+
+ALTER TABLE incident_findings DROP COLUMN IF EXISTS entities;
@@ -0,0 +1,4 @@
+-- 12_add_incident_finding_entities.up.sql
+-- Record the entities named by the findings attached to incidents, to attach later findings naming them.
+
+ALTER TABLE incident_findings ADD COLUMN IF NOT EXISTS entities JSONB NOT NULL DEFAULT '[]';
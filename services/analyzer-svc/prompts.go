@@ -2,13 +2,16 @@ package main
 
 import (
 	"bytes"
-	"context"
+	"crypto/sha256"
 	"embed"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/fs"
-	"log/slog"
+	"path"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"text/template"
 	"time"
 
@@ -17,25 +20,39 @@ import (
 	"gopkg.in/yaml.v3"
 )
 
-const promptEventsLimit = 50
-
 //go:embed prompts/*.md
 var promptsFS embed.FS
 
 type PromptTemplate struct {
 	Config   *PromptConfig
 	Template *template.Template
+	Source   string // "embedded" or the path of the file
+	Digest   string // sha256 of the file
 }
 
 type PromptConfig struct {
+	Name        string `yaml:"-"` // file name without extension and variant suffix, e.g. triage_tier1
 	Version     string `yaml:"version"`
 	Description string `yaml:"description"`
 
+	// share of traffic among the variants of the prompt (files named <name>@<variant>.md); defaults to 1
+	Weight *int `yaml:"weight"`
+
+	Provider        string   `yaml:"provider"` // optional; defaults to the LLM_PROVIDER of the service
 	Model           string   `yaml:"model"`
 	Temperature     *float32 `yaml:"temperature"`
 	MaxOutputTokens *int     `yaml:"max_output_tokens"`
 	StopSequences   []string `yaml:"stop_sequences"`
 
+	// models of the same provider to use, in order, while the circuit breaker of the model is open
+	FallbackModels []string `yaml:"fallback_models"`
+
+	// optional cap on the tokens this prompt may use per UTC day, on top of LLM_DAILY_TOKEN_BUDGET
+	DailyTokenBudget int `yaml:"daily_token_budget"`
+
+	// tokens of the prompt given to events, for the prompts listing them; defaults to defaultContextTokenBudget
+	ContextTokenBudget int `yaml:"context_token_budget"`
+
 	InputVariables []PromptInput `yaml:"input_variables"`
 }
 
@@ -59,82 +76,234 @@ type PromptInput struct {
 	Desc string `yaml:"desc"`
 }
 
+// PromptLibrary holds the prompt templates, loaded from the embedded prompts/*.md files or, when a directory is
+// given, from the files of that directory that override them. Reload swaps the whole set at once, so a render never
+// mixes prompts of two reloads.
 type PromptLibrary struct {
+	embedded fs.FS
+	dir      string    // empty for embedded prompts only
+	redactor *Redactor // nil renders event data as is
+
+	set atomic.Pointer[promptSet]
+
+	mu          sync.Mutex
+	lastChecked time.Time
+	lastError   string
+}
+
+type promptSet struct {
 	Analyze       *PromptTemplate
+	Session       *PromptTemplate
+	Investigate   *PromptTemplate
 	Tier1Triaging *PromptTemplate
 	Tier2Triaging *PromptTemplate
+
+	variants  map[string][]*PromptTemplate // by prompt name, the default (base file) first
+	fallbacks []string                     // files missing from the prompts directory, served from the embedded ones
+	loadedAt  time.Time
+
+	redactor *Redactor
 }
 
 type PromptData struct {
-	Events        []common.Event
-	Question      string
-	OverflowCount int
+	Events     []common.Event
+	Question   string
+	Overflow   ContextOverflow // the events that didn't fit in the prompt, see packPromptEvents
+	Structured bool            // the answer is a list of claims citing the IDs of the events
+	Suspected  map[string]bool // IDs of the events that look like prompt injection attempts
+}
+
+type SessionPromptData struct {
+	PromptData
+	History         []SessionMessage
+	OmittedMessages int
 }
 
 type PromptPair struct {
 	System string
 	User   string
 	Config *PromptConfig
+
+	redaction *redaction     // placeholders of the values redacted from the prompt, restored in the answer
+	events    []common.Event // the events shown in the prompt, before redaction
 }
 
+// NewPromptLibrary loads the prompts embedded in fsys under prompts/.
 func NewPromptLibrary(fsys fs.FS) (*PromptLibrary, error) {
-	analyze, err := loadPromptTemplate(fsys, "prompts/analyze.md")
+	return NewPromptLibraryWithDir(fsys, "")
+}
+
+// NewPromptLibraryWithDir loads the prompts of dir, falling back to the embedded ones for the files dir doesn't have.
+func NewPromptLibraryWithDir(fsys fs.FS, dir string) (*PromptLibrary, error) {
+	embedded, err := fs.Sub(fsys, "prompts")
 	if err != nil {
 		return nil, err
 	}
-
-	tier1, err := loadPromptTemplate(fsys, "prompts/triage_tier1.md")
-	if err != nil {
+	p := &PromptLibrary{embedded: embedded, dir: dir}
+	if _, err := p.Reload(); err != nil {
 		return nil, err
 	}
+	return p, nil
+}
 
-	tier2, err := loadPromptTemplate(fsys, "prompts/triage_tier2.md")
-	if err != nil {
-		return nil, err
+// current returns the active prompt set, nil for an uninitialized library.
+func (p *PromptLibrary) current() *promptSet {
+	if p == nil {
+		return nil
 	}
+	return p.set.Load()
+}
 
-	return &PromptLibrary{
-		Analyze:       analyze,
-		Tier1Triaging: tier1,
-		Tier2Triaging: tier2,
-	}, nil
+// all returns the active prompt templates.
+func (p *PromptLibrary) all() []*PromptTemplate {
+	set := p.current()
+	if set == nil {
+		return nil
+	}
+	return set.all()
 }
 
 func (p *PromptLibrary) RenderAnalyzePrompt(question string, eventList []common.Event) (*PromptPair, error) {
-	if p == nil || p.Analyze == nil {
+	return p.forKey("").renderAnalyze(question, eventList, false)
+}
+
+// RenderStructuredAnalyzePrompt renders the analyze prompt for an answer made of claims citing event IDs, see
+// analyzeSchema.
+func (p *PromptLibrary) RenderStructuredAnalyzePrompt(question string, eventList []common.Event) (*PromptPair, error) {
+	return p.forKey("").renderAnalyze(question, eventList, true)
+}
+
+// RenderSessionPrompt renders a follow-up question of a session. The history is trimmed to the most recent messages
+// that fit in historyTokenBudget.
+func (p *PromptLibrary) RenderSessionPrompt(question string, eventList []common.Event, history []SessionMessage, historyTokenBudget int) (*PromptPair, error) {
+	return p.forKey("").renderSession(question, eventList, history, historyTokenBudget)
+}
+
+func (p *PromptLibrary) RenderInvestigatePrompt(data InvestigatePromptData) (*PromptPair, error) {
+	return p.forKey("").renderInvestigate(data)
+}
+
+// RenderTier1TriagingPrompt renders the tier 1 prompt, with analyst-labelled ratings of similar buckets as few-shot
+// examples.
+func (p *PromptLibrary) RenderTier1TriagingPrompt(summaries []common.EventSummary, examples []FewShotExample) (*PromptPair, error) {
+	return p.forKey("").renderTier1Triaging(summaries, examples)
+}
+
+// RenderTier2TriagingPrompt renders the tier 2 prompt, with analyst-labelled findings on similar events as few-shot
+// examples.
+func (p *PromptLibrary) RenderTier2TriagingPrompt(events []common.Event, examples []FewShotExample) (*PromptPair, error) {
+	return p.forKey("").renderTier2Triaging(events, examples)
+}
+
+func (set *promptSet) renderAnalyze(question string, eventList []common.Event, structured bool) (*PromptPair, error) {
+	if set == nil || set.Analyze == nil {
 		return nil, fmt.Errorf("prompt library is not initialized")
 	}
 
-	promptEvents, overflow := selectPromptEvents(eventList, promptEventsLimit)
+	shown, overflow := packPromptEvents(eventList, set.Analyze.Config.ContextTokenBudget)
+	promptEvents, suspected := guardEvents(shown)
+	redact := set.redactor.begin()
 	data := PromptData{
-		Events:        promptEvents,
-		Question:      question,
-		OverflowCount: overflow,
+		Events:     redact.events(promptEvents),
+		Question:   question,
+		Overflow:   overflow,
+		Structured: structured,
+		Suspected:  suspected,
+	}
+	countSuspectedInjections(set.Analyze.Config.Name, len(suspected))
+	prompt, err := renderPromptPair(set.Analyze, data, redact)
+	if err != nil {
+		return nil, err
+	}
+	prompt.events = shown
+	return prompt, nil
+}
+
+func (set *promptSet) renderSession(question string, eventList []common.Event, history []SessionMessage, historyTokenBudget int) (*PromptPair, error) {
+	if set == nil || set.Session == nil {
+		return nil, fmt.Errorf("session prompt not loaded")
+	}
+
+	shown, overflow := packPromptEvents(eventList, set.Session.Config.ContextTokenBudget)
+	promptEvents, suspected := guardEvents(shown)
+	kept := trimHistory(history, historyTokenBudget)
+	redact := set.redactor.begin()
+	data := SessionPromptData{
+		PromptData: PromptData{
+			Events:    redact.events(promptEvents),
+			Question:  question,
+			Overflow:  overflow,
+			Suspected: suspected,
+		},
+		History:         kept,
+		OmittedMessages: len(history) - len(kept),
+	}
+	countSuspectedInjections(set.Session.Config.Name, len(suspected))
+	return renderPromptPairAny(set.Session, data, redact)
+}
+
+func (set *promptSet) renderInvestigate(data InvestigatePromptData) (*PromptPair, error) {
+	if set == nil || set.Investigate == nil {
+		return nil, fmt.Errorf("investigate prompt not loaded")
 	}
-	return renderPromptPair(p.Analyze, data)
+	return renderPromptPairAny(set.Investigate, data, set.redactor.begin())
 }
 
-func (p *PromptLibrary) RenderTier1TriagingPrompt(summaries []common.EventSummary) (*PromptPair, error) {
-	if p == nil || p.Tier1Triaging == nil {
+func (set *promptSet) renderTier1Triaging(summaries []common.EventSummary, examples []FewShotExample) (*PromptPair, error) {
+	if set == nil || set.Tier1Triaging == nil {
 		return nil, fmt.Errorf("tier1 prompt not loaded")
 	}
-	data := struct{ Summaries []common.EventSummary }{Summaries: summaries}
-	return renderPromptPairAny(p.Tier1Triaging, data)
+	summaries, suspected := guardSummaries(summaries)
+	examples, suspectedExamples := guardExamples(examples)
+	countSuspectedInjections(set.Tier1Triaging.Config.Name, suspected+suspectedExamples)
+	data := struct {
+		Summaries []common.EventSummary
+		Examples  []FewShotExample
+	}{Summaries: summaries, Examples: examples}
+	return renderPromptPairAny(set.Tier1Triaging, data, set.redactor.begin())
 }
 
-func (p *PromptLibrary) RenderTier2TriagingPrompt(events []common.Event) (*PromptPair, error) {
-	if p == nil || p.Tier2Triaging == nil {
+func (set *promptSet) renderTier2Triaging(events []common.Event, examples []FewShotExample) (*PromptPair, error) {
+	if set == nil || set.Tier2Triaging == nil {
 		return nil, fmt.Errorf("tier2 prompt not loaded")
 	}
-	data := struct{ Events []common.Event }{Events: events}
-	return renderPromptPairAny(p.Tier2Triaging, data)
+	events, suspected := guardEvents(events)
+	examples, suspectedExamples := guardExamples(examples)
+	redact := set.redactor.begin()
+	data := struct {
+		Events    []common.Event
+		Examples  []FewShotExample
+		Suspected map[string]bool
+	}{Events: redact.events(events), Examples: examples, Suspected: suspected}
+	countSuspectedInjections(set.Tier2Triaging.Config.Name, len(suspected)+suspectedExamples)
+	return renderPromptPairAny(set.Tier2Triaging, data, redact)
 }
 
-func renderPromptPair(prompt *PromptTemplate, data PromptData) (*PromptPair, error) {
-	return renderPromptPairAny(prompt, data)
+// renderTier2Events renders only the user part of the tier 2 prompt, the one listing the events.
+func (set *promptSet) renderTier2Events(events []common.Event) (string, error) {
+	if set == nil || set.Tier2Triaging == nil {
+		return "", fmt.Errorf("tier2 prompt not loaded")
+	}
+	events, suspected := guardEvents(events)
+	redact := set.redactor.begin()
+	data := struct {
+		Events    []common.Event
+		Examples  []FewShotExample
+		Suspected map[string]bool
+	}{Events: redact.events(events), Suspected: suspected}
+	var buf bytes.Buffer
+	if err := set.Tier2Triaging.Template.ExecuteTemplate(&buf, "user", data); err != nil {
+		return "", fmt.Errorf("render user prompt: %w", err)
+	}
+	return redact.text(buf.String()), nil
 }
 
-func renderPromptPairAny(prompt *PromptTemplate, data any) (*PromptPair, error) {
+func renderPromptPair(prompt *PromptTemplate, data PromptData, redact *redaction) (*PromptPair, error) {
+	return renderPromptPairAny(prompt, data, redact)
+}
+
+// renderPromptPairAny renders the prompt and redacts it. The events of data should already be redacted by redact.
+func renderPromptPairAny(prompt *PromptTemplate, data any, redact *redaction) (*PromptPair, error) {
 	var systemBuf, userBuf bytes.Buffer
 
 	if prompt.Template.Lookup("system") != nil {
@@ -148,20 +317,36 @@ func renderPromptPairAny(prompt *PromptTemplate, data any) (*PromptPair, error)
 	}
 
 	return &PromptPair{
-		System: strings.TrimSpace(systemBuf.String()),
-		User:   strings.TrimSpace(userBuf.String()),
-		Config: prompt.Config,
+		System:    strings.TrimSpace(redact.text(systemBuf.String())),
+		User:      strings.TrimSpace(redact.text(userBuf.String())),
+		Config:    prompt.Config,
+		redaction: redact,
 	}, nil
 }
 
-func selectPromptEvents(eventList []common.Event, limit int) ([]common.Event, int) {
-	overflow := 0
-	if len(eventList) > limit {
-		overflow = len(eventList) - limit
-		eventList = eventList[:limit]
+// trimHistory keeps the longest suffix of the history that fits in the token budget. A non-positive budget keeps
+// everything.
+func trimHistory(history []SessionMessage, tokenBudget int) []SessionMessage {
+	if tokenBudget <= 0 {
+		return history
+	}
+
+	used := 0
+	start := len(history)
+	for start > 0 {
+		cost := estimateTokens(history[start-1].Role) + estimateTokens(history[start-1].Content)
+		if used+cost > tokenBudget {
+			break
+		}
+		used += cost
+		start--
 	}
+	return history[start:]
+}
 
-	return eventList, overflow
+// estimateTokens approximates the token count of a text, at roughly 4 characters per token.
+func estimateTokens(text string) int {
+	return (len(text) + 3) / 4
 }
 
 func truncatePayload(payload map[string]any, maxLen int) string {
@@ -176,8 +361,8 @@ func truncatePayload(payload map[string]any, maxLen int) string {
 	return s
 }
 
-func loadPromptTemplate(fsys fs.FS, path string) (*PromptTemplate, error) {
-	raw, err := fs.ReadFile(fsys, path)
+func loadPromptTemplate(fsys fs.FS, filePath string) (*PromptTemplate, error) {
+	raw, err := fs.ReadFile(fsys, filePath)
 	if err != nil {
 		return nil, err
 	}
@@ -190,7 +375,7 @@ func loadPromptTemplate(fsys fs.FS, path string) (*PromptTemplate, error) {
 		return nil, fmt.Errorf("prompt config missing frontmatter")
 	}
 
-	tmpl, err := template.New(path).Funcs(promptFuncMap()).Parse(body)
+	tmpl, err := template.New(filePath).Funcs(promptFuncMap()).Parse(body)
 	if err != nil {
 		return nil, err
 	}
@@ -199,11 +384,13 @@ func loadPromptTemplate(fsys fs.FS, path string) (*PromptTemplate, error) {
 	if err != nil {
 		return nil, err
 	}
+	parsed.Name, _, _ = strings.Cut(strings.TrimSuffix(path.Base(filePath), path.Ext(filePath)), "@")
 
-	slog.Info("loaded prompt", "path", path, "version", parsed.Version, "description", parsed.Description)
+	digest := sha256.Sum256(raw)
 	return &PromptTemplate{
 		Config:   parsed,
 		Template: tmpl,
+		Digest:   hex.EncodeToString(digest[:]),
 	}, nil
 }
 
@@ -232,6 +419,7 @@ func parsePromptConfig(frontmatter string) (*PromptConfig, error) {
 		return nil, fmt.Errorf("parse prompt config: %w", err)
 	}
 
+	config.Provider = strings.ToLower(strings.TrimSpace(config.Provider))
 	config.Model = strings.TrimSpace(config.Model)
 	if config.Model == "" {
 		return nil, fmt.Errorf("prompt config missing model")
@@ -275,36 +463,3 @@ func truncateString(value string, maxLen int) string {
 	}
 	return value[:maxLen-3] + "..."
 }
-
-func (s *Server) generateContent(ctx context.Context, prompt *PromptPair) (string, error) {
-	return s.generateContentWithSchema(ctx, prompt, nil)
-}
-
-func (s *Server) generateContentWithSchema(ctx context.Context, prompt *PromptPair, schema *genai.Schema) (string, error) {
-	if s.genai == nil {
-		return "(LLM unavailable; please configure your GEMINI_API_KEY env variable)", nil
-	}
-
-	genaiConfig := &genai.GenerateContentConfig{}
-	prompt.Config.ApplyTo(genaiConfig)
-	if prompt.System != "" {
-		genaiConfig.SystemInstruction = genai.NewContentFromText(prompt.System, genai.RoleUser)
-	}
-
-	if schema != nil {
-		genaiConfig.ResponseMIMEType = "application/json"
-		genaiConfig.ResponseSchema = schema
-	}
-
-	slog.Debug("calling LLM", "model", prompt.Config.Model, "structured", schema != nil, "prompt", prompt.User)
-
-	resp, err := s.genaiCircuitBreaker.Execute(func() (*genai.GenerateContentResponse, error) {
-		return s.genai.Models.GenerateContent(ctx, prompt.Config.Model, genai.Text(prompt.User), genaiConfig)
-	})
-	if err != nil {
-		return "", err
-	}
-	slog.Debug("LLM responded", "model", prompt.Config.Model, "structured", schema != nil, "body", resp.Text())
-
-	return strings.TrimSpace(resp.Text()), nil
-}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"cmp"
+	"math"
+	"slices"
+
+	"github.com/andreionoie/llm-event-analysis/pkg/common"
+)
+
+const (
+	// defaultContextTokenBudget is the share of an analyze or session prompt given to its events, for prompts that
+	// don't set context_token_budget.
+	defaultContextTokenBudget = 4000
+	// eventLineOverhead approximates the tokens of an event line besides its ID, source, type and payload.
+	eventLineOverhead = 12
+	// contextTimeSlots is the number of slices the time span of the events is cut in, to spread the picks over it.
+	contextTimeSlots = 12
+	// overflowGroupsShown is the number of types and sources listed in the summary of the events left out.
+	overflowGroupsShown = 10
+)
+
+// ContextOverflow summarizes the events left out of a prompt, by type and by source, most frequent first.
+type ContextOverflow struct {
+	Count    int
+	ByType   []OverflowGroup
+	BySource []OverflowGroup
+}
+
+type OverflowGroup struct {
+	Name  string
+	Count int
+}
+
+// eventTokens estimates the tokens of the line of the event in the prompt, where its payload is truncated.
+func eventTokens(e common.Event) int {
+	return eventLineOverhead + estimateTokens(e.Id+e.Source+e.Type) + estimateTokens(truncatePayload(e.Payload, 100))
+}
+
+// packPromptEvents picks the events shown in a prompt within its token budget. When they don't all fit, events are
+// picked one at a time by score: severity first, then the rarity of their type among the events, the types already
+// picked, and whether their time slot has an event yet, so that a burst of one kind of event can't crowd out the
+// rest. The picks are returned in their original order, with a summary of the events left out.
+func packPromptEvents(events []common.Event, tokenBudget int) ([]common.Event, ContextOverflow) {
+	if tokenBudget <= 0 {
+		tokenBudget = defaultContextTokenBudget
+	}
+	costs := make([]int, len(events))
+	total := 0
+	for i, e := range events {
+		costs[i] = eventTokens(e)
+		total += costs[i]
+	}
+	if total <= tokenBudget {
+		return events, ContextOverflow{}
+	}
+
+	typeCounts := map[string]int{}
+	first, last := events[0].Timestamp, events[0].Timestamp
+	for _, e := range events {
+		typeCounts[e.Type]++
+		if e.Timestamp.Before(first) {
+			first = e.Timestamp
+		}
+		if e.Timestamp.After(last) {
+			last = e.Timestamp
+		}
+	}
+	span := last.Sub(first)
+	slot := func(e common.Event) int {
+		if span <= 0 {
+			return 0
+		}
+		return min(int(e.Timestamp.Sub(first)*contextTimeSlots/span), contextTimeSlots-1)
+	}
+
+	picked := make([]bool, len(events))
+	pickedTypes := map[string]int{}
+	coveredSlots := map[int]bool{}
+	score := func(e common.Event) float64 {
+		severity := math.Pow(4, float64(e.Severity))
+		rarity := 1 + math.Log2(float64(len(events))/float64(typeCounts[e.Type]))
+		s := severity * rarity / float64(1+pickedTypes[e.Type])
+		if !coveredSlots[slot(e)] {
+			s += 2
+		}
+		return s
+	}
+
+	remaining := tokenBudget
+	for {
+		best := -1
+		var bestScore float64
+		for i, e := range events {
+			if picked[i] || costs[i] > remaining {
+				continue
+			}
+			// ties go to the first event, the newest as events are fetched
+			if s := score(e); best < 0 || s > bestScore {
+				best, bestScore = i, s
+			}
+		}
+		if best < 0 {
+			break
+		}
+		picked[best] = true
+		remaining -= costs[best]
+		pickedTypes[events[best].Type]++
+		coveredSlots[slot(events[best])] = true
+	}
+
+	shown := make([]common.Event, 0, len(events))
+	var left []common.Event
+	for i, e := range events {
+		if picked[i] {
+			shown = append(shown, e)
+		} else {
+			left = append(left, e)
+		}
+	}
+	return shown, summarizeOverflow(left)
+}
+
+// summarizeOverflow counts the events by type and by source. The names come from the events, so they are escaped
+// like the event fields of the prompt.
+func summarizeOverflow(events []common.Event) ContextOverflow {
+	byType, bySource := map[string]int{}, map[string]int{}
+	for _, e := range events {
+		byType[escapeUntrusted(e.Type)]++
+		bySource[escapeUntrusted(e.Source)]++
+	}
+	return ContextOverflow{
+		Count:    len(events),
+		ByType:   overflowGroups(byType),
+		BySource: overflowGroups(bySource),
+	}
+}
+
+// overflowGroups sorts the counts, most frequent first, keeping overflowGroupsShown of them and adding up the rest
+// as "other".
+func overflowGroups(counts map[string]int) []OverflowGroup {
+	groups := make([]OverflowGroup, 0, len(counts))
+	for name, count := range counts {
+		groups = append(groups, OverflowGroup{Name: name, Count: count})
+	}
+	slices.SortFunc(groups, func(a, b OverflowGroup) int {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), cmp.Compare(a.Name, b.Name))
+	})
+	if len(groups) <= overflowGroupsShown {
+		return groups
+	}
+	other := OverflowGroup{Name: "other"}
+	for _, g := range groups[overflowGroupsShown:] {
+		other.Count += g.Count
+	}
+	return append(groups[:overflowGroupsShown], other)
+}
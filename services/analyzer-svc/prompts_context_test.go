@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andreionoie/llm-event-analysis/pkg/common"
+)
+
+// noisyEvents returns n info http_request events a second apart, newest first, with a few critical and rare events
+// buried among them.
+func noisyEvents(n int) []common.Event {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	events := make([]common.Event, n)
+	for i := range events {
+		events[i] = common.Event{
+			Id:        fmt.Sprintf("evt-%d", i),
+			Timestamp: start.Add(time.Duration(n-i) * time.Second),
+			Source:    "web",
+			Severity:  common.SeverityInfo,
+			Type:      "http_request",
+			Payload:   map[string]any{"path": "/health"},
+		}
+	}
+	events[n/2].Severity, events[n/2].Type, events[n/2].Source = common.SeverityCritical, "privilege_escalation", "auth"
+	events[n-1].Severity, events[n-1].Type, events[n-1].Source = common.SeverityCritical, "malware_detected", "edr"
+	events[n/3].Type, events[n/3].Source = "dns_query", "dns"
+	return events
+}
+
+func TestPackPromptEventsKeepsRareAndSevereEvents(t *testing.T) {
+	events := noisyEvents(2000)
+	shown, overflow := packPromptEvents(events, 500)
+
+	var ids []string
+	for _, e := range shown {
+		ids = append(ids, e.Id)
+	}
+	for _, want := range []string{"evt-1000", "evt-1999", "evt-666"} {
+		if !slices.Contains(ids, want) {
+			t.Errorf("%s left out of %v", want, ids)
+		}
+	}
+	if !slices.IsSortedFunc(shown, func(a, b common.Event) int { return b.Timestamp.Compare(a.Timestamp) }) {
+		t.Error("picked events are not in their original order")
+	}
+	if used := len(shown); used < 5 || used > 30 {
+		t.Errorf("picked %d events for a budget of 500 tokens", used)
+	}
+	// the info events are spread over the range rather than all the newest
+	olderInfo := 0
+	for _, e := range shown {
+		if e.Type == "http_request" && e.Timestamp.Before(events[len(events)/2].Timestamp) {
+			olderInfo++
+		}
+	}
+	if olderInfo == 0 {
+		t.Errorf("info events only cover the newest half of the range: %v", ids)
+	}
+
+	if overflow.Count != len(events)-len(shown) {
+		t.Errorf("overflow count = %d, want %d", overflow.Count, len(events)-len(shown))
+	}
+	if len(overflow.ByType) != 1 || overflow.ByType[0] != (OverflowGroup{Name: "http_request", Count: overflow.Count}) {
+		t.Errorf("unexpected overflow by type %+v", overflow.ByType)
+	}
+}
+
+func TestPackPromptEventsWithinBudget(t *testing.T) {
+	events := noisyEvents(10)
+	shown, overflow := packPromptEvents(events, 0)
+	if len(shown) != len(events) || overflow.Count != 0 {
+		t.Errorf("events that fit the budget were left out: %d shown, overflow %+v", len(shown), overflow)
+	}
+}
+
+func TestOverflowGroupsCapsTheList(t *testing.T) {
+	counts := map[string]int{}
+	for i := range overflowGroupsShown + 3 {
+		counts[fmt.Sprintf("type-%02d", i)] = 100 - i
+	}
+	groups := overflowGroups(counts)
+	if len(groups) != overflowGroupsShown+1 || groups[0].Name != "type-00" {
+		t.Fatalf("unexpected groups %+v", groups)
+	}
+	if other := groups[overflowGroupsShown]; other.Name != "other" || other.Count != 90+89+88 {
+		t.Errorf("unexpected remainder %+v", other)
+	}
+}
+
+func TestAnalyzePromptSummarizesOverflow(t *testing.T) {
+	prompts, err := NewPromptLibrary(promptsFS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prompt, err := prompts.RenderStructuredAnalyzePrompt("what happened?", noisyEvents(2000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(prompt.User, "more events not shown, by type: http_request (") ||
+		!strings.Contains(prompt.User, "by source: web (") {
+		t.Errorf("overflow summary missing:\n%s", prompt.User)
+	}
+	if !strings.Contains(prompt.User, "[evt-1000]") || len(prompt.events) == 0 || len(prompt.events) == 2000 {
+		t.Errorf("expected a packed subset of the events, got %d", len(prompt.events))
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/andreionoie/llm-event-analysis/pkg/common"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var promptInjectionSuspected = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "analyzer_prompt_injection_suspected_total",
+		Help: "Events (tier 1: event types) and few-shot examples rendered into prompts that look like prompt injection attempts, partitioned by prompt",
+	},
+	[]string{"prompt"},
+)
+
+// suspectedInjectionMarker precedes the events suspected of prompt injection in the prompts, see the event templates.
+const suspectedInjectionMarker = "[SUSPECTED PROMPT INJECTION]"
+
+// injectedSeverity is the lowest severity an event suspected of prompt injection is shown with: text addressed to the
+// model is an attack in itself, whatever the event claims to be.
+const injectedSeverity = common.SeverityErr
+
+// injectionPatterns match text addressed to the model rather than describing activity. Words may be separated by
+// spaces, underscores or dashes, since event types and payload keys can carry them too.
+var injectionPatterns = compileInjectionPatterns(
+	`(ignore|disregard|forget|override)_(all_|any_)?(the_)?(previous|prior|above|earlier|preceding|system)_(instructions|prompts?|rules|context)`,
+	`(new|updated|real)_(system_)?instructions\b`,
+	`\byou_are_now\b`,
+	`\b(system|developer)_prompt\b`,
+	`\b(classify|rate|mark|label|report)_(this|these|it|them|the)(_(events?|buckets?|activity))?_as_(low|benign|safe|info|informational|p[45]|false_positive)`,
+	`\bdo_not_(flag|report|alert|escalate|mention)\b`,
+	`</?(system|assistant|user|untrusted_events|tool_result)>`,
+	`\bas_an_ai\b`,
+)
+
+func compileInjectionPatterns(patterns ...string) []*regexp.Regexp {
+	compiled := make([]*regexp.Regexp, len(patterns))
+	for i, p := range patterns {
+		compiled[i] = regexp.MustCompile(`(?i)` + strings.ReplaceAll(p, "_", `[\s_-]+`))
+	}
+	return compiled
+}
+
+// looksInjected reports whether the text matches an injection pattern.
+func looksInjected(text string) bool {
+	for _, re := range injectionPatterns {
+		if re.MatchString(text) {
+			return true
+		}
+	}
+	return false
+}
+
+// payloadLooksInjected reports whether any key or string of the payload matches an injection pattern.
+func payloadLooksInjected(v any) bool {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, value := range v {
+			if looksInjected(key) || payloadLooksInjected(value) {
+				return true
+			}
+		}
+	case []any:
+		for _, value := range v {
+			if payloadLooksInjected(value) {
+				return true
+			}
+		}
+	case string:
+		return looksInjected(v)
+	}
+	return false
+}
+
+// escapeUntrusted keeps a free-text field of an event on its line and inside the delimiters of the prompt: control
+// characters become spaces and angle brackets are escaped the way JSON payloads already have them.
+func escapeUntrusted(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, strings.NewReplacer("<", `\u003c`, ">", `\u003e`).Replace(s))
+}
+
+// guardEvents returns copies of the events ready to be rendered into the prompt: their free-text fields escaped, and
+// the ones that look like prompt injection attempts raised to injectedSeverity and returned in suspected, by ID.
+// Callers count the suspected events in promptInjectionSuspected once the prompt is rendered.
+func guardEvents(events []common.Event) (guarded []common.Event, suspected map[string]bool) {
+	if len(events) == 0 {
+		return events, nil
+	}
+	guarded = make([]common.Event, len(events))
+	for i, e := range events {
+		if looksInjected(e.Source) || looksInjected(e.Type) || payloadLooksInjected(e.Payload) {
+			if suspected == nil {
+				suspected = map[string]bool{}
+			}
+			suspected[e.Id] = true
+			e.Severity = max(e.Severity, injectedSeverity)
+		}
+		e.Source = escapeUntrusted(e.Source)
+		e.Type = escapeUntrusted(e.Type)
+		guarded[i] = e
+	}
+	return guarded, suspected
+}
+
+// countSuspectedInjections counts the events of a rendered prompt suspected of prompt injection.
+func countSuspectedInjections(prompt string, suspected int) {
+	if suspected > 0 {
+		promptInjectionSuspected.WithLabelValues(prompt).Add(float64(suspected))
+	}
+}
+
+// guardSummaries returns copies of the summaries with the event types escaped, since they come from the events, and
+// the number of event types that look like prompt injection attempts.
+func guardSummaries(summaries []common.EventSummary) (guarded []common.EventSummary, suspected int) {
+	guarded = make([]common.EventSummary, len(summaries))
+	for i, s := range summaries {
+		byType := make(map[string]int, len(s.ByType))
+		for eventType, count := range s.ByType {
+			if looksInjected(eventType) {
+				suspected++
+			}
+			byType[escapeUntrusted(eventType)] += count
+		}
+		s.ByType = byType
+		guarded[i] = s
+	}
+	return guarded, suspected
+}
+
+// guardExamples returns copies of the few-shot examples ready to be rendered into the system prompt. Their inputs and
+// the ratings quoting them come from the events, so they are escaped line by line, and the examples that look like
+// prompt injection attempts are left out: labelling a finding must not promote an attacker's text into the
+// instructions. It also returns the number of examples left out.
+func guardExamples(examples []FewShotExample) (guarded []FewShotExample, suspected int) {
+	for _, ex := range examples {
+		if looksInjected(ex.Input) || looksInjected(ex.Output) {
+			suspected++
+			continue
+		}
+		lines := strings.Split(ex.Input, "\n")
+		for i, line := range lines {
+			lines[i] = escapeUntrusted(line)
+		}
+		ex.Input = strings.Join(lines, "\n")
+		ex.Output = escapeUntrusted(ex.Output)
+		guarded = append(guarded, ex)
+	}
+	return guarded, suspected
+}
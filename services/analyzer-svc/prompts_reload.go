@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var promptReloads = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "analyzer_prompt_reloads_total",
+		Help: "Prompt reloads that changed the active prompts or failed, partitioned by result",
+	},
+	[]string{"result"},
+)
+
+// Reload loads and validates the prompt files, and swaps them in if any of them changed. On error the current
+// prompts stay active. Returns whether the prompts changed.
+func (p *PromptLibrary) Reload() (bool, error) {
+	set, err := p.load()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastChecked = time.Now().UTC()
+	if err != nil {
+		p.lastError = err.Error()
+		return false, err
+	}
+	p.lastError = ""
+
+	if current := p.set.Load(); current != nil && current.digest() == set.digest() {
+		return false, nil
+	}
+	for _, t := range set.all() {
+		slog.Info("loaded prompt", "name", t.Config.Name, "source", t.Source, "version", t.Config.Version,
+			"description", t.Config.Description)
+	}
+	if len(set.fallbacks) > 0 {
+		slog.Warn("prompt files missing from the prompts directory, using the embedded ones", "dir", p.dir,
+			"files", set.fallbacks)
+	}
+	p.set.Store(set)
+	return true, nil
+}
+
+func (p *PromptLibrary) load() (*promptSet, error) {
+	files, err := p.promptFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	set := &promptSet{loadedAt: time.Now().UTC(), variants: map[string][]*PromptTemplate{}}
+	for _, file := range files {
+		t, err := p.loadPrompt(file)
+		if err != nil {
+			return nil, fmt.Errorf("prompt %s: %w", file, err)
+		}
+		if p.dir != "" && t.Source == "embedded" {
+			set.fallbacks = append(set.fallbacks, file)
+		}
+		set.variants[t.Config.Name] = append(set.variants[t.Config.Name], t)
+	}
+	for name, dst := range set.fields() {
+		variants := set.variants[name]
+		if len(variants) == 0 {
+			return nil, fmt.Errorf("prompt %s: not found", name)
+		}
+		if err := validateVariants(variants); err != nil {
+			return nil, fmt.Errorf("prompt %s: %w", name, err)
+		}
+		*dst = variants[0]
+	}
+	if err := set.validate(); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+// promptFiles lists the prompt files, sorted, so that a prompt's base file comes before its variants.
+func (p *PromptLibrary) promptFiles() ([]string, error) {
+	files, err := fs.Glob(p.embedded, "*.md")
+	if err != nil {
+		return nil, err
+	}
+	if p.dir != "" {
+		dirFiles, err := fs.Glob(os.DirFS(p.dir), "*.md")
+		if err != nil {
+			return nil, err
+		}
+		files = uniqueStrings(append(files, dirFiles...))
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// loadPrompt reads a prompt file from the directory, if it has one, or else from the embedded prompts. Load reports
+// the files the directory is missing, which are easy to lose when a ConfigMap is edited.
+func (p *PromptLibrary) loadPrompt(file string) (*PromptTemplate, error) {
+	if p.dir != "" {
+		t, err := loadPromptTemplate(os.DirFS(p.dir), file)
+		if err == nil {
+			t.Source = filepath.Join(p.dir, file)
+			return t, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+	t, err := loadPromptTemplate(p.embedded, file)
+	if err != nil {
+		return nil, err
+	}
+	t.Source = "embedded"
+	return t, nil
+}
+
+// fields maps the prompt names to the fields holding their default variant.
+func (set *promptSet) fields() map[string]**PromptTemplate {
+	return map[string]**PromptTemplate{
+		"analyze":      &set.Analyze,
+		"session":      &set.Session,
+		"investigate":  &set.Investigate,
+		"triage_tier1": &set.Tier1Triaging,
+		"triage_tier2": &set.Tier2Triaging,
+	}
+}
+
+// validate renders every variant with empty data, which catches references to fields the prompt isn't given.
+func (set *promptSet) validate() error {
+	checks := map[string]func(t *PromptTemplate) (*PromptPair, error){
+		"analyze": func(t *PromptTemplate) (*PromptPair, error) {
+			if _, err := (&promptSet{Analyze: t}).renderAnalyze("question", nil, true); err != nil {
+				return nil, err
+			}
+			return (&promptSet{Analyze: t}).renderAnalyze("question", nil, false)
+		},
+		"session": func(t *PromptTemplate) (*PromptPair, error) {
+			history := []SessionMessage{{Role: "user", Content: "question"}}
+			return (&promptSet{Session: t}).renderSession("question", nil, history, 0)
+		},
+		"investigate": func(t *PromptTemplate) (*PromptPair, error) {
+			return (&promptSet{Investigate: t}).renderInvestigate(InvestigatePromptData{})
+		},
+		"triage_tier1": func(t *PromptTemplate) (*PromptPair, error) {
+			return (&promptSet{Tier1Triaging: t}).renderTier1Triaging(nil, []FewShotExample{{}})
+		},
+		"triage_tier2": func(t *PromptTemplate) (*PromptPair, error) {
+			return (&promptSet{Tier2Triaging: t}).renderTier2Triaging(nil, []FewShotExample{{}})
+		},
+	}
+	for name, variants := range set.variants {
+		render, ok := checks[name]
+		if !ok {
+			return fmt.Errorf("prompt %s: unknown prompt name", name)
+		}
+		for _, t := range variants {
+			if _, err := render(t); err != nil {
+				return fmt.Errorf("prompt %s version %s: %w", name, t.Config.Version, err)
+			}
+		}
+	}
+	return nil
+}
+
+// all returns every variant of every prompt, by name.
+func (set *promptSet) all() []*PromptTemplate {
+	var templates []*PromptTemplate
+	for _, name := range sortedKeys(set.variants) {
+		templates = append(templates, set.variants[name]...)
+	}
+	return templates
+}
+
+func (set *promptSet) digest() string {
+	var digests []string
+	for _, t := range set.all() {
+		digests = append(digests, t.Source+"@"+t.Digest)
+	}
+	return strings.Join(digests, ",")
+}
+
+// runPromptReloader reloads the prompts every interval until ctx is cancelled. Polling rather than watching
+// the directory also picks up the symlink swaps of mounted ConfigMaps.
+func (p *PromptLibrary) runPromptReloader(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			changed, err := p.Reload()
+			if err != nil {
+				slog.Error("failed to reload prompts, keeping the last good version", "dir", p.dir, "error", err)
+				promptReloads.WithLabelValues("error").Inc()
+			} else if changed {
+				slog.Info("reloaded prompts", "dir", p.dir)
+				promptReloads.WithLabelValues("changed").Inc()
+			}
+		}
+	}
+}
+
+// PromptInfo describes an active prompt.
+type PromptInfo struct {
+	Name             string `json:"name"`
+	Version          string `json:"version"`
+	Description      string `json:"description"`
+	Weight           int    `json:"weight"`
+	Provider         string `json:"provider,omitempty"`
+	Model            string `json:"model"`
+	DailyTokenBudget int    `json:"daily_token_budget,omitempty"`
+	Source           string `json:"source"`
+	Digest           string `json:"digest"`
+}
+
+// PromptsStatus is the response of GET /prompts.
+type PromptsStatus struct {
+	Dir         string       `json:"dir,omitempty"`
+	LoadedAt    time.Time    `json:"loaded_at"`
+	LastChecked time.Time    `json:"last_checked"`
+	LastError   string       `json:"last_error,omitempty"`         // set while the directory holds prompts that failed to load
+	Fallbacks   []string     `json:"embedded_fallbacks,omitempty"` // files missing from dir, served from the embedded ones
+	Prompts     []PromptInfo `json:"prompts"`
+}
+
+// status reports the active prompts along with the outcome of the last reload, taken together so that they agree.
+func (p *PromptLibrary) status() PromptsStatus {
+	p.mu.Lock()
+	status := PromptsStatus{Dir: p.dir, LastChecked: p.lastChecked, LastError: p.lastError, Prompts: []PromptInfo{}}
+	set := p.current()
+	p.mu.Unlock()
+
+	if set == nil {
+		return status
+	}
+	status.LoadedAt = set.loadedAt
+	status.Fallbacks = set.fallbacks
+	for _, t := range set.all() {
+		status.Prompts = append(status.Prompts, PromptInfo{
+			Name:             t.Config.Name,
+			Version:          t.Config.Version,
+			Description:      t.Config.Description,
+			Weight:           promptWeight(t),
+			Provider:         t.Config.Provider,
+			Model:            t.Config.Model,
+			DailyTokenBudget: t.Config.DailyTokenBudget,
+			Source:           t.Source,
+			Digest:           t.Digest,
+		})
+	}
+	return status
+}
+
+func (s *Server) handleListPrompts(c echo.Context) error {
+	return c.JSON(http.StatusOK, s.prompts.status())
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const testAnalyzePrompt = `---
+version: "9.0.0"
+model: "llama3"
+---
+{{define "user"}}{{.Question}} ({{len .Events}} events){{end}}
+`
+
+func TestPromptLibraryReloadsFromDir(t *testing.T) {
+	dir := t.TempDir()
+	analyzePath := filepath.Join(dir, "analyze.md")
+	if err := os.WriteFile(analyzePath, []byte(testAnalyzePrompt), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	lib, err := NewPromptLibraryWithDir(promptsFS, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := lib.status()
+	for _, p := range status.Prompts {
+		switch {
+		case p.Name == "analyze" && (p.Version != "9.0.0" || p.Source != analyzePath):
+			t.Errorf("analyze should come from the directory, got %+v", p)
+		case p.Name != "analyze" && p.Source != "embedded":
+			t.Errorf("%s should fall back to the embedded prompt, got %+v", p.Name, p)
+		}
+	}
+	if !slices.Contains(status.Fallbacks, "session.md") || slices.Contains(status.Fallbacks, "analyze.md") {
+		t.Errorf("files missing from the directory should be reported, got %v", status.Fallbacks)
+	}
+	prompt, err := lib.RenderAnalyzePrompt("what happened?", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prompt.User != "what happened? (0 events)" || prompt.Config.Model != "llama3" {
+		t.Errorf("unexpected prompt %+v", prompt)
+	}
+
+	if changed, err := lib.Reload(); err != nil || changed {
+		t.Errorf("unchanged files should not reload, got %v %v", changed, err)
+	}
+
+	// an unknown field only fails when rendered, which the reload validation does
+	broken := strings.Replace(testAnalyzePrompt, "{{.Question}}", "{{.Questoin}}", 1)
+	if err := os.WriteFile(analyzePath, []byte(broken), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lib.Reload(); err == nil {
+		t.Fatal("expected the broken prompt to fail validation")
+	}
+	if status := lib.status(); status.LastError == "" {
+		t.Error("the reload error should be reported")
+	}
+	if prompt, err := lib.RenderAnalyzePrompt("still there?", nil); err != nil || !strings.HasPrefix(prompt.User, "still there?") {
+		t.Errorf("the last good version should stay active, got %+v %v", prompt, err)
+	}
+
+	fixed := strings.Replace(testAnalyzePrompt, "9.0.0", "9.0.1", 1)
+	if err := os.WriteFile(analyzePath, []byte(fixed), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := lib.Reload(); err != nil || !changed {
+		t.Fatalf("expected the fixed prompt to load, got %v %v", changed, err)
+	}
+	if status := lib.status(); status.LastError != "" || lib.current().Analyze.Config.Version != "9.0.1" {
+		t.Errorf("unexpected status after fix %+v", status)
+	}
+}
+
+func TestPromptLibraryRejectsInvalidFrontmatter(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "session.md"), []byte("---\nversion: \"1\"\n---\n{{define \"user\"}}hi{{end}}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewPromptLibraryWithDir(promptsFS, dir); err == nil || !strings.Contains(err.Error(), "missing model") {
+		t.Errorf("expected missing model error, got %v", err)
+	}
+}
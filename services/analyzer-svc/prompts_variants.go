@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	promptCitedIDs = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "analyzer_prompt_cited_ids_total",
+			Help: "IDs cited in LLM answers, partitioned by prompt, prompt version and whether they were in the input",
+		},
+		[]string{"prompt", "version", "result"},
+	)
+	promptFeedback = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "analyzer_prompt_feedback_total",
+			Help: "Analyst feedback on triage results, partitioned by prompt, prompt version and label",
+		},
+		[]string{"prompt", "version", "label"},
+	)
+)
+
+// PromptRun records the variant of a prompt used by a triage job, and how many of the IDs cited in its answers
+// were not in its input.
+type PromptRun struct {
+	Version         string `json:"version"`
+	Model           string `json:"model,omitempty"`
+	CitedIDs        int    `json:"cited_ids"`
+	HallucinatedIDs int    `json:"hallucinated_ids"`
+}
+
+func promptWeight(t *PromptTemplate) int {
+	if t.Config.Weight == nil {
+		return 1
+	}
+	return *t.Config.Weight
+}
+
+// validateVariants checks that the variants of a prompt can be told apart by version, and that some get traffic.
+func validateVariants(variants []*PromptTemplate) error {
+	versions := map[string]bool{}
+	total := 0
+	for _, t := range variants {
+		if versions[t.Config.Version] {
+			return fmt.Errorf("version %q is used by more than one variant", t.Config.Version)
+		}
+		versions[t.Config.Version] = true
+		if promptWeight(t) < 0 {
+			return fmt.Errorf("version %q has a negative weight", t.Config.Version)
+		}
+		total += promptWeight(t)
+	}
+	if total == 0 {
+		return fmt.Errorf("all variants have weight 0")
+	}
+	return nil
+}
+
+// pickVariant picks a variant by weight. The same key always gets the same variant, so that a job or session sticks
+// to one variant; an empty key picks at random.
+func pickVariant(variants []*PromptTemplate, key string) *PromptTemplate {
+	if len(variants) == 1 {
+		return variants[0]
+	}
+
+	total := 0
+	for _, t := range variants {
+		total += promptWeight(t)
+	}
+	var n int
+	if key == "" {
+		n = rand.IntN(total)
+	} else {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(key))
+		n = int(h.Sum32() % uint32(total))
+	}
+	for _, t := range variants {
+		if n < promptWeight(t) {
+			return t
+		}
+		n -= promptWeight(t)
+	}
+	return variants[0]
+}
+
+// forKey returns the active prompts with a variant picked for each, see pickVariant.
+func (p *PromptLibrary) forKey(key string) *promptSet {
+	current := p.current()
+	if current == nil {
+		return nil
+	}
+	picked := *current
+	picked.redactor = p.redactor
+	for name, dst := range picked.fields() {
+		variantKey := ""
+		if key != "" {
+			// keyed per prompt, so that the picks of a job's prompts are independent
+			variantKey = name + ":" + key
+		}
+		if variants := current.variants[name]; len(variants) > 0 {
+			*dst = pickVariant(variants, variantKey)
+		}
+	}
+	return &picked
+}
+
+// isActive reports whether the prompt has an active variant of that version and model, so that what it answered
+// earlier is still what it would answer.
+func (p *PromptLibrary) isActive(name, version, model string) bool {
+	current := p.current()
+	if current == nil {
+		return false
+	}
+	for _, t := range current.variants[name] {
+		if t.Config.Version == version && t.Config.Model == model {
+			return true
+		}
+	}
+	return false
+}
+
+// jobPrompts are the prompt variants picked for a triage job, with the IDs cited in their answers across the job's
+// parallel LLM calls.
+type jobPrompts struct {
+	*promptSet
+
+	mu   sync.Mutex
+	runs map[string]*PromptRun
+}
+
+// triagePrompts picks the triage prompt variants for a job, the same ones every time the job runs.
+func (p *PromptLibrary) triagePrompts(jobID string) *jobPrompts {
+	set := p.forKey(jobID)
+	prompts := &jobPrompts{promptSet: set, runs: map[string]*PromptRun{}}
+	if set != nil {
+		for _, t := range []*PromptTemplate{set.Tier1Triaging, set.Tier2Triaging} {
+			prompts.runs[t.Config.Name] = &PromptRun{Version: t.Config.Version, Model: t.Config.Model}
+		}
+	}
+	return prompts
+}
+
+// recordCitedIDs counts the IDs cited in an answer to the prompt, of which hallucinated were not in its input.
+func (j *jobPrompts) recordCitedIDs(config *PromptConfig, cited, hallucinated int) {
+	if config == nil {
+		return
+	}
+	countCitedIDs(config, cited, hallucinated)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	run, ok := j.runs[config.Name]
+	if !ok {
+		run = &PromptRun{Version: config.Version}
+		j.runs[config.Name] = run
+	}
+	run.CitedIDs += cited
+	run.HallucinatedIDs += hallucinated
+}
+
+// countCitedIDs counts the IDs cited in an answer to the prompt in analyzer_prompt_cited_ids_total.
+func countCitedIDs(config *PromptConfig, cited, hallucinated int) {
+	if config == nil {
+		return
+	}
+	promptCitedIDs.WithLabelValues(config.Name, config.Version, "valid").Add(float64(cited - hallucinated))
+	promptCitedIDs.WithLabelValues(config.Name, config.Version, "hallucinated").Add(float64(hallucinated))
+}
+
+// snapshot returns a copy of the runs, for storing with the job.
+func (j *jobPrompts) snapshot() map[string]*PromptRun {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	runs := make(map[string]*PromptRun, len(j.runs))
+	for name, run := range j.runs {
+		copied := *run
+		runs[name] = &copied
+	}
+	return runs
+}
+
+// recordPromptFeedback counts an analyst verdict against the variant of the prompt that produced the rated answer:
+// tier 2 for findings, tier 1 for bucket ratings.
+func recordPromptFeedback(job *TriageJob, fb *TriageFeedback) {
+	name := "triage_tier2"
+	if fb.Kind == feedbackKindBucket {
+		name = "triage_tier1"
+	}
+	version := ""
+	if run := job.Prompts[name]; run != nil {
+		version = run.Version
+	}
+	promptFeedback.WithLabelValues(name, version, fb.Label).Inc()
+}
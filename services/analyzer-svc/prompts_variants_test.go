@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPromptLibraryLoadsVariants(t *testing.T) {
+	dir := t.TempDir()
+	variant := strings.Replace(testAnalyzePrompt, `version: "9.0.0"`, "version: \"9.1.0\"\nweight: 3", 1)
+	for file, content := range map[string]string{"analyze.md": testAnalyzePrompt, "analyze@b.md": variant} {
+		if err := os.WriteFile(filepath.Join(dir, file), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lib, err := NewPromptLibraryWithDir(promptsFS, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := lib.current().Analyze.Config.Version; v != "9.0.0" {
+		t.Errorf("the base file should be the default variant, got %s", v)
+	}
+
+	picks := map[string]int{}
+	for i := range 1000 {
+		picks[lib.forKey(fmt.Sprint("job-", i)).Analyze.Config.Version]++
+	}
+	if picks["9.1.0"] < 650 || picks["9.1.0"] > 850 {
+		t.Errorf("expected about 3 in 4 picks of the weighted variant, got %v", picks)
+	}
+
+	first := lib.forKey("job-1").Analyze.Config.Version
+	for range 10 {
+		if v := lib.forKey("job-1").Analyze.Config.Version; v != first {
+			t.Fatalf("the same key should stick to one variant, got %s and %s", first, v)
+		}
+	}
+}
+
+func TestPromptLibraryRejectsAmbiguousVariants(t *testing.T) {
+	dir := t.TempDir()
+	for _, file := range []string{"analyze.md", "analyze@b.md"} {
+		if err := os.WriteFile(filepath.Join(dir, file), []byte(testAnalyzePrompt), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := NewPromptLibraryWithDir(promptsFS, dir); err == nil || !strings.Contains(err.Error(), "more than one variant") {
+		t.Errorf("expected duplicate version error, got %v", err)
+	}
+}
+
+func TestJobPromptsCountCitedIDs(t *testing.T) {
+	lib, err := NewPromptLibrary(promptsFS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prompts := lib.triagePrompts("job-1")
+	prompts.recordCitedIDs(prompts.Tier2Triaging.Config, 5, 1)
+	prompts.recordCitedIDs(prompts.Tier2Triaging.Config, 3, 2)
+
+	runs := prompts.snapshot()
+	run := runs["triage_tier2"]
+	if run == nil || run.Version != prompts.Tier2Triaging.Config.Version || run.CitedIDs != 8 || run.HallucinatedIDs != 3 {
+		t.Errorf("unexpected tier 2 run %+v", run)
+	}
+	if run := runs["triage_tier1"]; run == nil || run.CitedIDs != 0 {
+		t.Errorf("tier 1 should be recorded without citations, got %+v", run)
+	}
+}
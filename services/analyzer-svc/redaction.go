@@ -0,0 +1,371 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/andreionoie/llm-event-analysis/pkg/common"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gopkg.in/yaml.v3"
+)
+
+var redactedValues = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "analyzer_redacted_values_total",
+		Help: "Sensitive values replaced by placeholders in LLM prompts, partitioned by kind",
+	},
+	[]string{"kind"},
+)
+
+const (
+	defaultEntropyMinLength = 24
+	defaultEntropyMinBits   = 4.0
+
+	// longest placeholder a streamed chunk can end in the middle of, e.g. [PASSWORD_12]
+	maxPlaceholderLen = 32
+)
+
+// RedactionConfig is loaded from the YAML file at REDACTION_CONFIG. Without one, the default detectors apply.
+type RedactionConfig struct {
+	Disabled bool               `yaml:"disabled"`
+	Patterns []RedactionPattern `yaml:"patterns"` // added to the default patterns
+	Keys     []string           `yaml:"keys"`     // added to the default keys
+	Entropy  RedactionEntropy   `yaml:"entropy"`
+}
+
+// RedactionPattern redacts the matches of Regex, or of its first group if it has one, as [<KIND>_<n>].
+type RedactionPattern struct {
+	Kind  string `yaml:"kind"`
+	Regex string `yaml:"regex"`
+}
+
+// RedactionEntropy redacts random-looking tokens, such as API keys: at least MinLength characters mixing letters and
+// digits, with at least MinBits of Shannon entropy per character. Hex strings and UUIDs are left alone, since hashes
+// and IDs are what the analysis is about.
+type RedactionEntropy struct {
+	Disabled  bool    `yaml:"disabled"`
+	MinLength int     `yaml:"min_length"` // default 24
+	MinBits   float64 `yaml:"min_bits"`   // default 4
+}
+
+var defaultRedactionPatterns = []RedactionPattern{
+	{Kind: "email", Regex: `[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}`},
+	{Kind: "token", Regex: `\beyJ[A-Za-z0-9_-]{8,}\.[A-Za-z0-9_-]{8,}\.[A-Za-z0-9_-]+`}, // JWT
+	{Kind: "token", Regex: `(?i)\bbearer\s+([A-Za-z0-9._~+/-]{8,}=*)`},
+	{Kind: "secret", Regex: `\b(?:AKIA|ASIA)[A-Z0-9]{16}\b`}, // AWS access key ID
+	{Kind: "password", Regex: `[A-Za-z][A-Za-z0-9+.-]*://[^/\s:@]+:([^/\s@]+)@`},
+	{Kind: "host", Regex: `(?i)\b(?:[a-z0-9](?:[a-z0-9-]*[a-z0-9])?\.)+(?:internal|local|localdomain|corp|lan|intranet)\b`},
+}
+
+// defaultRedactionKeys are payload keys whose values are redacted whatever they hold. Keys are compared lowercased,
+// without dashes and underscores.
+var defaultRedactionKeys = []string{
+	"password", "passwd", "pwd", "secret", "clientsecret", "token", "accesstoken", "refreshtoken", "idtoken",
+	"apikey", "accesskey", "secretkey", "privatekey", "authorization", "cookie", "setcookie", "credential",
+	"credentials",
+}
+
+var (
+	// a "key": "value" pair of a JSON object, the value possibly cut short by truncate
+	jsonStringPair = regexp.MustCompile(`"((?:[^"\\]|\\.)*)"\s*:\s*"((?:[^"\\]|\\.)*)`)
+	entropyToken   = regexp.MustCompile(`[A-Za-z0-9+=_-]+`) // without slashes, which would join URL paths
+	hexOrUUID      = regexp.MustCompile(`^(?:[0-9a-fA-F]+|[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12})$`)
+)
+
+// Redactor keeps sensitive values (emails, credentials, internal hostnames, ...) out of the prompts sent to the LLM.
+// They are swapped for placeholders such as [EMAIL_1], which are swapped back in the answers.
+type Redactor struct {
+	patterns []redactionPattern
+	keys     map[string]bool
+	entropy  RedactionEntropy
+}
+
+type redactionPattern struct {
+	kind string
+	re   *regexp.Regexp
+}
+
+// loadRedactor reads the redaction config at path, if any. Returns nil if redaction is disabled.
+func loadRedactor(path string) (*Redactor, error) {
+	var cfg RedactionConfig
+	if path != "" {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.Unmarshal(raw, &cfg); err != nil {
+			return nil, fmt.Errorf("parse redaction config: %w", err)
+		}
+	}
+	if cfg.Disabled {
+		return nil, nil
+	}
+	return newRedactor(cfg)
+}
+
+func newRedactor(cfg RedactionConfig) (*Redactor, error) {
+	r := &Redactor{keys: map[string]bool{}, entropy: cfg.Entropy}
+	for _, p := range append(defaultRedactionPatterns, cfg.Patterns...) {
+		if p.Kind == "" {
+			return nil, fmt.Errorf("redaction pattern %q has no kind", p.Regex)
+		}
+		re, err := regexp.Compile(p.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("redaction pattern %s: %w", p.Kind, err)
+		}
+		r.patterns = append(r.patterns, redactionPattern{kind: strings.ToUpper(p.Kind), re: re})
+	}
+	for _, key := range append(defaultRedactionKeys, cfg.Keys...) {
+		r.keys[normalizeRedactionKey(key)] = true
+	}
+	if r.entropy.MinLength <= 0 {
+		r.entropy.MinLength = defaultEntropyMinLength
+	}
+	if r.entropy.MinBits <= 0 {
+		r.entropy.MinBits = defaultEntropyMinBits
+	}
+	return r, nil
+}
+
+func normalizeRedactionKey(key string) string {
+	return strings.NewReplacer("-", "", "_", "").Replace(strings.ToLower(strings.TrimSpace(key)))
+}
+
+// redaction holds the placeholders of one prompt, numbered by kind in order of appearance, so that a value gets the
+// same placeholder everywhere in the prompt.
+type redaction struct {
+	r            *Redactor
+	placeholders map[string]string // by value
+	values       map[string]string // by placeholder
+	counts       map[string]int    // by kind
+}
+
+// begin starts the redaction of a prompt. A nil Redactor redacts nothing.
+func (r *Redactor) begin() *redaction {
+	if r == nil {
+		return nil
+	}
+	return &redaction{
+		r:            r,
+		placeholders: map[string]string{},
+		values:       map[string]string{},
+		counts:       map[string]int{},
+	}
+}
+
+func (x *redaction) placeholder(kind, value string) string {
+	if p, ok := x.placeholders[value]; ok {
+		return p
+	}
+	x.counts[kind]++
+	p := fmt.Sprintf("[%s_%d]", kind, x.counts[kind])
+	x.placeholders[value] = p
+	x.values[p] = value
+	redactedValues.WithLabelValues(kind).Inc()
+	return p
+}
+
+// events returns copies of the events with their payloads redacted. Redacting the payloads before they are rendered
+// catches the values of sensitive keys, and values that the template would truncate past recognition.
+func (x *redaction) events(events []common.Event) []common.Event {
+	if x == nil || len(events) == 0 {
+		return events
+	}
+	redacted := make([]common.Event, len(events))
+	for i, e := range events {
+		if e.Payload != nil {
+			e.Payload = x.value(e.Payload).(map[string]any)
+		}
+		redacted[i] = e
+	}
+	return redacted
+}
+
+func payloadString(v any) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+func (x *redaction) value(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		redacted := make(map[string]any, len(v))
+		// in key order, so that the placeholders are numbered the same way every time
+		for _, key := range slices.Sorted(maps.Keys(v)) {
+			value := v[key]
+			if x.r.keys[normalizeRedactionKey(key)] && value != nil {
+				redacted[key] = x.placeholder("SECRET", payloadString(value))
+				continue
+			}
+			redacted[key] = x.value(value)
+		}
+		return redacted
+	case []any:
+		redacted := make([]any, len(v))
+		for i, value := range v {
+			redacted[i] = x.value(value)
+		}
+		return redacted
+	case string:
+		return x.text(v)
+	default:
+		return v
+	}
+}
+
+// text redacts a rendered text: the values already redacted from the events, the values of sensitive keys in JSON
+// objects, and the matches of the patterns and of the entropy detector.
+func (x *redaction) text(s string) string {
+	if x == nil || s == "" {
+		return s
+	}
+	s = x.replaceKnown(s)
+	s = replaceSubmatch(jsonStringPair, s, func(m []string) (string, string) {
+		if m[2] == "" || x.values[m[2]] != "" || !x.r.keys[normalizeRedactionKey(m[1])] {
+			return "", ""
+		}
+		return m[2], x.placeholder("SECRET", m[2])
+	})
+	for _, p := range x.r.patterns {
+		s = replaceSubmatch(p.re, s, func(m []string) (string, string) {
+			value := m[0]
+			if len(m) > 1 {
+				value = m[1]
+			}
+			if value == "" {
+				return "", ""
+			}
+			return value, x.placeholder(p.kind, value)
+		})
+	}
+	if !x.r.entropy.Disabled {
+		s = entropyToken.ReplaceAllStringFunc(s, func(token string) string {
+			if !x.r.randomLooking(token) {
+				return token
+			}
+			return x.placeholder("SECRET", token)
+		})
+	}
+	return s
+}
+
+// replaceKnown replaces the values redacted so far, longest first, so that a value redacted from a payload is
+// redacted wherever else it shows up in the prompt.
+func (x *redaction) replaceKnown(s string) string {
+	values := make([]string, 0, len(x.placeholders))
+	for value := range x.placeholders {
+		if len(value) >= 4 {
+			values = append(values, value)
+		}
+	}
+	slices.SortFunc(values, func(a, b string) int {
+		if len(a) != len(b) {
+			return len(b) - len(a)
+		}
+		return strings.Compare(a, b)
+	})
+	for _, value := range values {
+		s = strings.ReplaceAll(s, value, x.placeholders[value])
+	}
+	return s
+}
+
+// replaceSubmatch replaces, in every match of re, the value returned by replace with its replacement. An empty value
+// leaves the match as is.
+func replaceSubmatch(re *regexp.Regexp, s string, replace func(m []string) (value, replacement string)) string {
+	return re.ReplaceAllStringFunc(s, func(match string) string {
+		value, replacement := replace(re.FindStringSubmatch(match))
+		if value == "" {
+			return match
+		}
+		return strings.Replace(match, value, replacement, 1)
+	})
+}
+
+func (r *Redactor) randomLooking(token string) bool {
+	if len(token) < r.entropy.MinLength || hexOrUUID.MatchString(token) {
+		return false
+	}
+	if !strings.ContainsAny(token, "0123456789") || strings.IndexFunc(token, isASCIILetter) < 0 {
+		return false
+	}
+	return shannonEntropy(token) >= r.entropy.MinBits
+}
+
+func isASCIILetter(c rune) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// shannonEntropy returns the entropy of the characters of s, in bits per character.
+func shannonEntropy(s string) float64 {
+	counts := map[rune]int{}
+	for _, c := range s {
+		counts[c]++
+	}
+	n := float64(len(s))
+	bits := 0.0
+	for _, count := range counts {
+		p := float64(count) / n
+		bits -= p * math.Log2(p)
+	}
+	return bits
+}
+
+// restore swaps the placeholders in an answer back for the values they stand for. In JSON answers, the values are
+// escaped as JSON strings.
+func (x *redaction) restore(text string, jsonAnswer bool) string {
+	if x == nil || len(x.values) == 0 {
+		return text
+	}
+	pairs := make([]string, 0, 2*len(x.values))
+	for p, value := range x.values {
+		if jsonAnswer {
+			quoted, _ := json.Marshal(value)
+			value = string(quoted[1 : len(quoted)-1])
+		}
+		pairs = append(pairs, p, value)
+	}
+	return strings.NewReplacer(pairs...).Replace(text)
+}
+
+// restoreStream wraps onChunk to restore the placeholders of a streamed answer. A chunk ending in the middle of a
+// placeholder is held back until the next one completes it; flush sends what is left at the end of the stream.
+func (x *redaction) restoreStream(onChunk func(string) error) (write func(string) error, flush func() error) {
+	if x == nil || len(x.values) == 0 {
+		return onChunk, func() error { return nil }
+	}
+	var pending string
+	write = func(chunk string) error {
+		pending += chunk
+		cut := len(pending)
+		if i := strings.LastIndexByte(pending, '['); i >= 0 && !strings.Contains(pending[i:], "]") &&
+			len(pending)-i < maxPlaceholderLen {
+			cut = i
+		}
+		out := pending[:cut]
+		pending = pending[cut:]
+		if out == "" {
+			return nil
+		}
+		return onChunk(x.restore(out, false))
+	}
+	flush = func() error {
+		if pending == "" {
+			return nil
+		}
+		out := pending
+		pending = ""
+		return onChunk(x.restore(out, false))
+	}
+	return write, flush
+}
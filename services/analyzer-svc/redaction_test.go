@@ -0,0 +1,135 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andreionoie/llm-event-analysis/pkg/common"
+)
+
+func newTestRedactingLibrary(t *testing.T) *PromptLibrary {
+	t.Helper()
+	prompts, err := NewPromptLibrary(promptsFS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prompts.redactor, err = newRedactor(RedactionConfig{Keys: []string{"session-key"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return prompts
+}
+
+func TestRedactedPromptAndRestoredAnswer(t *testing.T) {
+	const (
+		email    = "bob.smith@example.com"
+		password = "hunter2!"
+		host     = "db-01.prod.internal"
+		custom   = "abc-123"
+		uuid     = "3f2504e0-4f89-41d3-9a0c-0305e82c3301"
+	)
+	events := []common.Event{{
+		Id:        uuid,
+		Timestamp: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+		Source:    "auth",
+		Type:      "login_failed",
+		Payload: map[string]any{
+			"user":  email,
+			"host":  host,
+			"login": map[string]any{"password": password, "session-key": custom},
+		},
+	}}
+
+	prompts := newTestRedactingLibrary(t)
+	prompt, err := prompts.RenderStructuredAnalyzePrompt("what did "+email+" do?", events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{email, password, host, custom} {
+		if strings.Contains(prompt.System+prompt.User, secret) {
+			t.Errorf("prompt leaks %q:\n%s", secret, prompt.User)
+		}
+	}
+	if !strings.Contains(prompt.User, uuid) {
+		t.Errorf("prompt lost the event ID:\n%s", prompt.User)
+	}
+	if strings.Count(prompt.User, "[EMAIL_1]") != 2 {
+		t.Errorf("expected the same placeholder for the email in the question and the payload:\n%s", prompt.User)
+	}
+
+	answer := prompt.redaction.restore("[EMAIL_1] logged in to [HOST_1]", false)
+	if want := email + " logged in to " + host; answer != want {
+		t.Errorf("restored %q, want %q", answer, want)
+	}
+
+	// the same events render the same placeholders, so that cassettes and caches keep matching
+	again, err := prompts.RenderStructuredAnalyzePrompt("what did "+email+" do?", events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.User != prompt.User {
+		t.Errorf("redaction is not deterministic:\n%s\n%s", prompt.User, again.User)
+	}
+}
+
+func TestRedactionEntropy(t *testing.T) {
+	r, err := newRedactor(RedactionConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		token    string
+		redacted bool
+	}{
+		{"sk9Xq2Lm7Vb4Tz1Rw8Yp3Nc6Hd5Kf0Gj", true},
+		{"9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08", false}, // hash
+		{"3f2504e0-4f89-41d3-9a0c-0305e82c3301", false},                             // UUID
+		{"user_login_failed_2024_01_15", false},
+		{"connection_blocked_by_policy", false},
+	} {
+		got := r.begin().text("value " + tc.token)
+		if redacted := !strings.Contains(got, tc.token); redacted != tc.redacted {
+			t.Errorf("%s: redacted = %v, want %v (%s)", tc.token, redacted, tc.redacted, got)
+		}
+	}
+}
+
+func TestRestoreJSONAnswer(t *testing.T) {
+	r, err := newRedactor(RedactionConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	redact := r.begin()
+	p := redact.placeholder("SECRET", `pa"ss`)
+	got := redact.restore(`{"summary":"password `+p+` reused"}`, true)
+	if want := `{"summary":"password pa\"ss reused"}`; got != want {
+		t.Errorf("restored %s, want %s", got, want)
+	}
+}
+
+func TestRestoreStreamAcrossChunks(t *testing.T) {
+	r, err := newRedactor(RedactionConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	redact := r.begin()
+	redact.text("contact alice@example.com")
+
+	var out strings.Builder
+	write, flush := redact.restoreStream(func(chunk string) error {
+		out.WriteString(chunk)
+		return nil
+	})
+	for _, chunk := range []string{"ask [EM", "AIL_1] about [sic", "] it"} {
+		if err := write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := flush(); err != nil {
+		t.Fatal(err)
+	}
+	if want := "ask alice@example.com about [sic] it"; out.String() != want {
+		t.Errorf("streamed %q, want %q", out.String(), want)
+	}
+}
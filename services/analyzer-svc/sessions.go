@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/andreionoie/llm-event-analysis/pkg/common"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	sessionRoleUser      = "user"
+	sessionRoleAssistant = "assistant"
+)
+
+// Session is a multi-turn investigation. The events picked when the session was created stay pinned as the
+// context of every later turn.
+type Session struct {
+	ID        string            `json:"id"`
+	TimeRange *common.TimeRange `json:"time_range,omitempty"`
+	Filter    *EventFilter      `json:"filter,omitempty"`
+	EventIDs  []string          `json:"event_ids"`
+	Messages  []SessionMessage  `json:"messages"`
+	CreatedAt time.Time         `json:"created_at"`
+	UpdatedAt time.Time         `json:"updated_at"`
+}
+
+type SessionMessage struct {
+	Role      string    `json:"role"` // user, assistant
+	Content   string    `json:"content"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type CreateSessionRequest struct {
+	Question  string            `json:"question,omitempty"` // optional first turn
+	MaxEvents int               `json:"max_events,omitempty"`
+	TimeRange *common.TimeRange `json:"time_range,omitempty"`
+	Filter    *EventFilter      `json:"filter,omitempty"`
+}
+
+type SessionMessageRequest struct {
+	Content string `json:"content"`
+}
+
+func (s *Server) handleCreateSession(c echo.Context) error {
+	var req CreateSessionRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid request body")
+	}
+	if req.TimeRange != nil {
+		if err := req.TimeRange.Validate(); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+	}
+	if err := req.Filter.Validate(); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if req.Filter.IsEmpty() {
+		req.Filter = nil
+	}
+
+	ctx := c.Request().Context()
+
+	maxEvents := req.MaxEvents
+	if maxEvents <= 0 || maxEvents > s.cfg.MaxEvents {
+		maxEvents = s.cfg.MaxEvents
+	}
+	events, err := s.queryContextEvents(ctx, EventQuery{TimeRange: req.TimeRange, Filter: req.Filter, Limit: maxEvents})
+	if err != nil {
+		slog.Error("failed to fetch events", "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fetch events")
+	}
+
+	now := time.Now().UTC()
+	session := &Session{
+		ID:        uuid.NewString(),
+		TimeRange: req.TimeRange,
+		Filter:    req.Filter,
+		EventIDs:  make([]string, 0, len(events)),
+		Messages:  []SessionMessage{},
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	for _, e := range events {
+		session.EventIDs = append(session.EventIDs, e.Id)
+	}
+
+	// the first turn is answered before anything is saved, so that a failed answer leaves no session behind
+	if question := strings.TrimSpace(req.Question); question != "" {
+		turn, err := s.askSession(ctx, session, events, question)
+		if err != nil {
+			slog.Error("session turn failed", "session_id", session.ID, "error", err)
+			return llmHTTPError(err, "analysis failed")
+		}
+		session.Messages = turn
+	}
+
+	if err := s.insertSession(ctx, session); err != nil {
+		slog.Error("failed to save session", "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to create session")
+	}
+
+	return c.JSON(http.StatusCreated, session)
+}
+
+func (s *Server) handleGetSession(c echo.Context) error {
+	session, err := s.loadSession(c.Request().Context(), c.Param("id"))
+	if err != nil {
+		return sessionLoadError(err)
+	}
+	return c.JSON(http.StatusOK, session)
+}
+
+func (s *Server) handleSessionMessage(c echo.Context) error {
+	var req SessionMessageRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid request body")
+	}
+	question := strings.TrimSpace(req.Content)
+	if question == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "content is required")
+	}
+
+	ctx := c.Request().Context()
+
+	session, err := s.loadSession(ctx, c.Param("id"))
+	if err != nil {
+		return sessionLoadError(err)
+	}
+
+	events, err := s.fetchEventsByIDs(ctx, session.EventIDs)
+	if err != nil {
+		slog.Error("failed to fetch session events", "session_id", session.ID, "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fetch events")
+	}
+
+	answer, err := s.answerSessionTurn(ctx, session, events, question)
+	if err != nil {
+		slog.Error("session turn failed", "session_id", session.ID, "error", err)
+		return llmHTTPError(err, "analysis failed")
+	}
+
+	return c.JSON(http.StatusOK, answer)
+}
+
+// answerSessionTurn answers a question in the context of the session, and persists both the question and the
+// answer. The in-memory session is updated as well.
+func (s *Server) answerSessionTurn(ctx context.Context, session *Session, events []common.Event, question string) (SessionMessage, error) {
+	turn, err := s.askSession(ctx, session, events, question)
+	if err != nil {
+		return SessionMessage{}, err
+	}
+	if err := s.appendSessionMessages(ctx, session.ID, turn...); err != nil {
+		return SessionMessage{}, err
+	}
+
+	session.Messages = append(session.Messages, turn...)
+	session.UpdatedAt = turn[1].CreatedAt
+	return turn[1], nil
+}
+
+// askSession answers a question in the context of the session, without saving anything. Returns the question and
+// the answer, as the messages of the turn.
+func (s *Server) askSession(ctx context.Context, session *Session, events []common.Event, question string) ([]SessionMessage, error) {
+	// keyed on the session, so that all its turns are answered by the same variant
+	prompt, err := s.prompts.forKey(session.ID).renderSession(question, events, session.Messages, s.cfg.SessionHistoryTokens)
+	if err != nil {
+		return nil, err
+	}
+
+	answer, err := s.generateContent(ctx, prompt)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	return []SessionMessage{
+		{Role: sessionRoleUser, Content: question, CreatedAt: now},
+		{Role: sessionRoleAssistant, Content: answer, CreatedAt: now},
+	}, nil
+}
+
+func sessionLoadError(err error) error {
+	if errors.Is(err, errSessionNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, "session not found")
+	}
+	slog.Error("failed to load session", "error", err)
+	return echo.NewHTTPError(http.StatusInternalServerError, "failed to load session")
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/andreionoie/llm-event-analysis/pkg/common"
+	"github.com/jackc/pgx/v5"
+)
+
+var errSessionNotFound = errors.New("session not found")
+
+// insertSession saves a new session along with the messages it already has.
+func (s *Server) insertSession(ctx context.Context, session *Session) error {
+	eventIDs, err := json.Marshal(session.EventIDs)
+	if err != nil {
+		return err
+	}
+	var filter []byte
+	if session.Filter != nil {
+		if filter, err = json.Marshal(session.Filter); err != nil {
+			return err
+		}
+	}
+
+	var start, end any
+	if session.TimeRange != nil {
+		start, end = session.TimeRange.Start, session.TimeRange.End
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	_, err = tx.Exec(ctx,
+		`INSERT INTO analysis_sessions (id, time_range_start, time_range_end, filter, event_ids, created_at, updated_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $6)`,
+		session.ID, start, end, filter, eventIDs, session.CreatedAt,
+	)
+	if err != nil {
+		return err
+	}
+	for i, msg := range session.Messages {
+		_, err := tx.Exec(ctx,
+			`INSERT INTO analysis_session_messages (session_id, seq, role, content, created_at)
+			 VALUES ($1, $2, $3, $4, $5)`,
+			session.ID, i+1, msg.Role, msg.Content, msg.CreatedAt,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// loadSession returns the session with its full message history, oldest message first.
+func (s *Server) loadSession(ctx context.Context, id string) (*Session, error) {
+	var session Session
+	var start, end *time.Time
+	var filter, eventIDs []byte
+	err := s.db.QueryRow(ctx,
+		`SELECT id, time_range_start, time_range_end, filter, event_ids, created_at, updated_at
+		 FROM analysis_sessions WHERE id = $1`,
+		id,
+	).Scan(&session.ID, &start, &end, &filter, &eventIDs, &session.CreatedAt, &session.UpdatedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, errSessionNotFound
+		}
+		return nil, err
+	}
+	if start != nil && end != nil {
+		session.TimeRange = &common.TimeRange{Start: *start, End: *end}
+	}
+	if len(filter) > 0 {
+		if err := json.Unmarshal(filter, &session.Filter); err != nil {
+			return nil, err
+		}
+	}
+	if err := json.Unmarshal(eventIDs, &session.EventIDs); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query(ctx,
+		`SELECT role, content, created_at FROM analysis_session_messages
+		 WHERE session_id = $1 ORDER BY seq`,
+		id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	session.Messages = []SessionMessage{}
+	for rows.Next() {
+		var msg SessionMessage
+		if err := rows.Scan(&msg.Role, &msg.Content, &msg.CreatedAt); err != nil {
+			return nil, err
+		}
+		session.Messages = append(session.Messages, msg)
+	}
+	return &session, rows.Err()
+}
+
+// appendSessionMessages adds messages at the end of the session history. The session row is locked, so that
+// concurrent turns on the same session get consecutive sequence numbers.
+func (s *Server) appendSessionMessages(ctx context.Context, sessionID string, messages ...SessionMessage) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	// the lock has to be taken by its own statement, so the next one sees messages committed while we waited
+	var locked string
+	err = tx.QueryRow(ctx, `SELECT id FROM analysis_sessions WHERE id = $1 FOR UPDATE`, sessionID).Scan(&locked)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return errSessionNotFound
+		}
+		return err
+	}
+
+	var nextSeq int
+	err = tx.QueryRow(ctx,
+		`SELECT COALESCE(MAX(seq), 0) + 1 FROM analysis_session_messages WHERE session_id = $1`,
+		sessionID,
+	).Scan(&nextSeq)
+	if err != nil {
+		return err
+	}
+
+	for i, msg := range messages {
+		_, err := tx.Exec(ctx,
+			`INSERT INTO analysis_session_messages (session_id, seq, role, content, created_at)
+			 VALUES ($1, $2, $3, $4, $5)`,
+			sessionID, nextSeq+i, msg.Role, msg.Content, msg.CreatedAt,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(ctx, `UPDATE analysis_sessions SET updated_at = NOW() WHERE id = $1`, sessionID); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
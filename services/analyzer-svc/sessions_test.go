@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTrimHistory(t *testing.T) {
+	history := []SessionMessage{
+		{Role: sessionRoleUser, Content: strings.Repeat("a", 400)}, // ~100 tokens
+		{Role: sessionRoleAssistant, Content: strings.Repeat("b", 400)},
+		{Role: sessionRoleUser, Content: "short follow-up"},
+		{Role: sessionRoleAssistant, Content: "short answer"},
+	}
+
+	if got := trimHistory(history, 0); len(got) != 4 {
+		t.Errorf("no budget should keep everything, kept %d", len(got))
+	}
+
+	got := trimHistory(history, 150)
+	if len(got) != 3 || got[0].Content != history[1].Content {
+		t.Errorf("expected the 3 most recent messages, got %d starting with %q", len(got), got[0].Content)
+	}
+
+	if got := trimHistory(history, 1); len(got) != 0 {
+		t.Errorf("tiny budget should drop everything, kept %d", len(got))
+	}
+}
+
+func TestRenderSessionPrompt(t *testing.T) {
+	lib, err := NewPromptLibrary(promptsFS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	history := []SessionMessage{
+		{Role: sessionRoleUser, Content: strings.Repeat("old ", 200)},
+		{Role: sessionRoleUser, Content: "which IPs were blocked?"},
+		{Role: sessionRoleAssistant, Content: "10.0.0.5 and 10.0.0.6"},
+	}
+	prompt, err := lib.RenderSessionPrompt("did those IPs appear yesterday?", nil, history, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"(1 earlier messages omitted)", "assistant: 10.0.0.5 and 10.0.0.6", "did those IPs appear yesterday?"} {
+		if !strings.Contains(prompt.User, want) {
+			t.Errorf("prompt is missing %q:\n%s", want, prompt.User)
+		}
+	}
+}
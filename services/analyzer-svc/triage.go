@@ -3,9 +3,11 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/andreionoie/llm-event-analysis/pkg/common"
@@ -15,21 +17,42 @@ import (
 )
 
 const (
-	triageJobTimeout = 2 * time.Minute
-	tier2EventLimit  = 100
+	tier2EventLimit = 100
+
+	defaultTriageJobsLimit = 20
+	maxTriageJobsLimit     = 100
 )
 
+var triageJobStatuses = map[string]bool{
+	"pending": true, "running": true, "complete": true, "failed": true, "cancelled": true,
+}
+
 type TriageJobRequest struct {
 	TimeRange common.TimeRange `json:"time_range"`
+	Filter    *EventFilter     `json:"filter,omitempty"`
 }
 
 type TriageJob struct {
 	ID        string           `json:"id"`
 	TimeRange common.TimeRange `json:"time_range"`
-	Status    string           `json:"status"` // pending, running, complete, failed
+	Filter    *EventFilter     `json:"filter,omitempty"`
+	Status    string           `json:"status"` // pending, running, complete, failed, cancelled
 	Error     string           `json:"error,omitempty"`
 	CreatedAt time.Time        `json:"created_at"`
+	UpdatedAt time.Time        `json:"updated_at"`
+	WorkerID  string           `json:"worker_id,omitempty"`
+	Attempts  int              `json:"attempts"`
+
+	ScheduleID string      `json:"schedule_id,omitempty"` // set for runs of a triage schedule
+	Diff       *TriageDiff `json:"diff,omitempty"`        // scheduled runs only, against the previous run
 
+	// prompt variants used, by prompt name
+	Prompts map[string]*PromptRun `json:"prompts,omitempty"`
+	// state of the events in range when the job ran (or, until then, was created)
+	Watermark *DataWatermark `json:"watermark,omitempty"`
+
+	FindingCount    int             `json:"finding_count"`
+	Coverage        *TriageCoverage `json:"coverage,omitempty"`
 	Tier1           *Tier1Result    `json:"tier1,omitempty"`
 	Findings        []TriageFinding `json:"findings,omitempty"`
 	ScannedEventIDs []string        `json:"scanned_event_ids,omitempty"`
@@ -46,6 +69,10 @@ type BucketRisk struct {
 	BucketID   string  `json:"bucket_id"`
 	Reason     string  `json:"reason"`
 	Confidence float64 `json:"confidence"`
+
+	// the bucket summary as the model saw it, kept for analyst feedback
+	Input    string   `json:"input,omitempty"`
+	Features []string `json:"features,omitempty"`
 }
 
 type TriageFinding struct {
@@ -107,27 +134,61 @@ func (s *Server) handleCreateTriageJob(c echo.Context) error {
 	if err := req.TimeRange.Validate(); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
+	if err := req.Filter.Validate(); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if req.Filter.IsEmpty() {
+		req.Filter = nil
+	}
+
+	ctx := c.Request().Context()
+
+	// idempotency - don't trigger another job for the same time range and filter, unless the previous one failed.
+	// Checked first, so that retries get their job back even while the queue is full
+	resultsCacheKey := triageResultsCacheKey(req.TimeRange, req.Filter)
+	watermark := s.triageWatermark(ctx, req.TimeRange, req.Filter)
+	if existing := s.findTriageJob(ctx, resultsCacheKey, watermark); existing != nil {
+		return c.JSON(http.StatusOK, existing)
+	}
+
+	queued, err := s.countQueuedTriageJobs(ctx)
+	if err != nil {
+		slog.Error("failed to count queued triage jobs", "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to create job")
+	}
+	if queued >= s.cfg.TriageMaxQueued {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "triage queue is full, retry later")
+	}
 
-	// idempotency - don't trigger another job for the same time range
-	resultsCacheKey := triageResultsCacheKey(req.TimeRange)
-	if cached := s.getCachedTriageJobByKey(c.Request().Context(), resultsCacheKey); cached != nil {
-		return c.JSON(http.StatusOK, cached)
+	// refuse upfront rather than queue a job that can only fail
+	prompts := s.prompts.current()
+	for _, prompt := range []*PromptTemplate{prompts.Tier1Triaging, prompts.Tier2Triaging} {
+		if err := s.checkTokenBudget(ctx, prompt.Config); err != nil {
+			return llmHTTPError(err, "failed to create job")
+		}
 	}
 
+	now := time.Now().UTC()
 	job := &TriageJob{
 		ID:        uuid.NewString(),
 		TimeRange: req.TimeRange,
+		Filter:    req.Filter,
 		Status:    "pending",
-		CreatedAt: time.Now().UTC(),
+		CreatedAt: now,
+		UpdatedAt: now,
+		Watermark: watermark,
 	}
 
-	if err := s.cacheTriageJob(c.Request().Context(), job, resultsCacheKey); err != nil {
+	if err := s.insertTriageJob(ctx, job, resultsCacheKey); err != nil {
 		slog.Error("failed to save triage job", "error", err)
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to create job")
 	}
+	if err := s.cacheTriageJob(ctx, job, resultsCacheKey); err != nil {
+		slog.Debug("failed to cache triage job", "job_id", job.ID, "error", err)
+	}
 
-	// spawn long-running goroutine in the background
-	go s.processTriageJob(context.Background(), job, resultsCacheKey)
+	// the job waits in the queue until a worker of any replica picks it up
+	s.triage.notify()
 
 	return c.JSON(http.StatusAccepted, map[string]string{
 		"job_id": job.ID,
@@ -141,78 +202,259 @@ func (s *Server) handleGetTriageJob(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "job_id required")
 	}
 
-	cached := s.getCachedTriageJob(c.Request().Context(), jobID)
-	if cached == nil {
-		return echo.NewHTTPError(http.StatusNotFound, "job not found")
+	ctx := c.Request().Context()
+	job, err := s.getTriageJob(ctx, jobID)
+	if err != nil {
+		if errors.Is(err, errTriageJobNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "job not found")
+		}
+		slog.Error("failed to load triage job", "job_id", jobID, "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to load job")
+	}
+
+	return c.JSON(http.StatusOK, job)
+}
+
+func (s *Server) handleCancelTriageJob(c echo.Context) error {
+	jobID := c.Param("id")
+	ctx := c.Request().Context()
+
+	cancelled, err := s.cancelTriageJob(ctx, jobID)
+	if err != nil {
+		slog.Error("failed to cancel triage job", "job_id", jobID, "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to cancel job")
 	}
+	s.triage.cancel(jobID)
+	s.invalidateCachedTriageJob(ctx, jobID)
 
-	// basic timeout check; TODO: heartbeat and garbage collector worker
-	if cached.Status == "pending" && time.Since(cached.CreatedAt) > triageJobTimeout {
-		cached.Status = "failed"
-		cached.Error = "job timed out"
-		_ = s.cacheTriageJob(c.Request().Context(), cached, triageResultsCacheKey(cached.TimeRange))
+	job, err := s.getTriageJob(ctx, jobID)
+	if err != nil {
+		if errors.Is(err, errTriageJobNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "job not found")
+		}
+		slog.Error("failed to load triage job", "job_id", jobID, "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to load job")
+	}
+	if !cancelled && job.Status != "cancelled" {
+		return echo.NewHTTPError(http.StatusConflict, "job already "+job.Status)
 	}
 
-	return c.JSON(http.StatusOK, cached)
+	return c.JSON(http.StatusOK, job)
 }
 
+func (s *Server) handleListTriageJobs(c echo.Context) error {
+	timeRange, err := parseTimeRangeParams(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	limit, err := parseLimitParam(c, defaultTriageJobsLimit, maxTriageJobsLimit)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	status := strings.TrimSpace(c.QueryParam("status"))
+	if status != "" && !triageJobStatuses[status] {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid status")
+	}
+
+	jobs, err := s.listTriageJobs(c.Request().Context(), TriageJobQuery{
+		Status:     status,
+		ScheduleID: strings.TrimSpace(c.QueryParam("schedule_id")),
+		TimeRange:  timeRange,
+		Limit:      limit,
+	})
+	if err != nil {
+		slog.Error("failed to list triage jobs", "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to list jobs")
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"jobs":  jobs,
+		"count": len(jobs),
+	})
+}
+
+// getTriageJob reads the job from the cache, falling back to the database.
+func (s *Server) getTriageJob(ctx context.Context, jobID string) (*TriageJob, error) {
+	if cached := s.getCachedTriageJob(ctx, jobID); cached != nil {
+		return cached, nil
+	}
+
+	job, err := s.loadTriageJob(ctx, jobID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.cacheTriageJob(ctx, job, triageResultsCacheKey(job.TimeRange, job.Filter)); err != nil {
+		slog.Debug("failed to cache triage job", "job_id", job.ID, "error", err)
+	}
+	return job, nil
+}
+
+// findTriageJob returns the latest job for the results key created within the dedup TTL that has not failed or been
+// cancelled, or nil if there is none.
+func (s *Server) findTriageJob(ctx context.Context, resultsKey string, watermark *DataWatermark) *TriageJob {
+	since := time.Now().Add(-s.cfg.TriageDedupTTL)
+	if cached := s.getCachedTriageJobByKey(ctx, resultsKey); cached != nil && cached.Status != "failed" &&
+		cached.Status != "cancelled" && cached.CreatedAt.After(since) {
+		if s.triageJobCurrent(cached, watermark) {
+			return cached
+		}
+		return nil
+	}
+
+	jobID, err := s.findTriageJobID(ctx, resultsKey, since)
+	if err != nil {
+		slog.Warn("failed to look up existing triage job", "error", err)
+		return nil
+	}
+	if jobID == "" {
+		return nil
+	}
+	job, err := s.getTriageJob(ctx, jobID)
+	if err != nil {
+		slog.Warn("failed to load existing triage job", "job_id", jobID, "error", err)
+		return nil
+	}
+	if !s.triageJobCurrent(job, watermark) {
+		return nil
+	}
+	return job
+}
+
+// triageWatermark returns the watermark of the events in the range and filter of a triage job, or nil if it can't
+// be computed.
+func (s *Server) triageWatermark(ctx context.Context, tr common.TimeRange, filter *EventFilter) *DataWatermark {
+	w, err := s.eventsWatermark(ctx, EventQuery{TimeRange: &tr, Filter: filter})
+	if err != nil {
+		slog.Warn("failed to compute events watermark", "error", err)
+		return nil
+	}
+	return &w
+}
+
+// triageJobCurrent reports whether an earlier job still stands for a new request: no event was inserted into or
+// deleted from its range since, and the prompt variants it used are still active with the same models.
+func (s *Server) triageJobCurrent(job *TriageJob, watermark *DataWatermark) bool {
+	if watermark == nil || job.Watermark == nil || !job.Watermark.Equal(*watermark) {
+		slog.Debug("existing triage job is stale, events changed", "job_id", job.ID)
+		return false
+	}
+	for name, run := range job.Prompts {
+		if !s.prompts.isActive(name, run.Version, run.Model) {
+			slog.Debug("existing triage job is stale, prompt changed", "job_id", job.ID, "prompt", name)
+			return false
+		}
+	}
+	return true
+}
+
+// saveTriageJob persists the job, then refreshes its cache entry. Postgres is the source of truth, so the cache is
+// left alone when the job could not be saved, e.g. because it was cancelled meanwhile. Returns whether it was saved.
+func (s *Server) saveTriageJob(ctx context.Context, job *TriageJob, cacheKey string) bool {
+	job.FindingCount = len(job.Findings)
+	if err := s.updateTriageJob(ctx, job); err != nil {
+		if errors.Is(err, errTriageJobNotOwned) {
+			slog.Info("triage job no longer owned, dropping update", "job_id", job.ID, "status", job.Status)
+		} else {
+			slog.Error("failed to save triage job", "job_id", job.ID, "status", job.Status, "error", err)
+		}
+		return false
+	}
+	if err := s.cacheTriageJob(ctx, job, cacheKey); err != nil {
+		slog.Debug("failed to cache triage job", "job_id", job.ID, "error", err)
+	}
+	return true
+}
+
+// failTriageJob marks the job as failed. Interrupted jobs are left alone: cancelled jobs keep their status, and jobs
+// interrupted by shutdown are released by the worker.
+func (s *Server) failTriageJob(ctx context.Context, job *TriageJob, cacheKey, message string) {
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		message = "job timed out"
+	case ctx.Err() != nil:
+		return
+	}
+	job.Status = "failed"
+	job.Error = message
+	s.saveTriageJob(context.WithoutCancel(ctx), job, cacheKey)
+}
+
+// processTriageJob runs both tiers of a job claimed by this worker. ctx is cancelled when the job is cancelled.
 func (s *Server) processTriageJob(ctx context.Context, job *TriageJob, cacheKey string) {
+	// results are saved even if the job gets cancelled right after the last tier, the update is then a no-op
+	saveCtx := context.WithoutCancel(ctx)
+
 	defer func() {
 		if r := recover(); r != nil {
 			slog.Error("triage job panicked", "job_id", job.ID, "panic", r)
 			job.Status = "failed"
 			job.Error = "internal error"
-			_ = s.cacheTriageJob(ctx, job, cacheKey)
+			s.saveTriageJob(saveCtx, job, cacheKey)
 		}
 	}()
 
-	job.Status = "running"
-	_ = s.cacheTriageJob(ctx, job, cacheKey)
+	// the cached copy still says pending; it is dropped rather than overwritten, since the job may have been
+	// cancelled since it was claimed and readers then fall back to the database
+	s.invalidateCachedTriageJob(saveCtx, job.ID)
+
+	// taken before any data is read, so that events inserted meanwhile make the results stale
+	if watermark := s.triageWatermark(ctx, job.TimeRange, job.Filter); watermark != nil {
+		job.Watermark = watermark
+	}
 
-	// tier 1: analyze pre-computed summaries from DB
-	tier1, validBuckets, err := s.runTriageTier1(ctx, job.TimeRange)
+	// tier 1: analyze pre-computed summaries from DB, chunk by chunk
+	prompts := s.prompts.triagePrompts(job.ID)
+	tier1, coverage, err := s.runTriageTier1(ctx, prompts, job.TimeRange, job.Filter)
+	job.Prompts = prompts.snapshot()
 	if err != nil {
 		slog.Error("tier 1 failed", "job_id", job.ID, "error", err)
-		job.Status = "failed"
-		job.Error = "tier 1 analysis failed"
-		_ = s.cacheTriageJob(ctx, job, cacheKey)
+		s.failTriageJob(ctx, job, cacheKey, llmErrorMessage(err, "tier 1 analysis failed"))
 		return
 	}
-
-	// validate bucket IDs against what we actually have, guarding against hallucinations
-	tier1.HighRisk = filterValidBuckets(tier1.HighRisk, validBuckets)
-	tier1.MediumRisk = filterValidBuckets(tier1.MediumRisk, validBuckets)
 	job.Tier1 = tier1
+	job.Coverage = coverage
 
 	// tier 2 only if high/medium risk found in structured LLM response
 	flagged := append(tier1.HighRisk, tier1.MediumRisk...)
 	if len(flagged) == 0 {
-		job.Status = "complete"
-		_ = s.cacheTriageJob(ctx, job, cacheKey)
+		s.completeTriageJob(saveCtx, job, cacheKey)
 		return
 	}
 
-	findings, eventIDs, err := s.runTriageTier2(ctx, flagged)
+	findings, eventIDs, err := s.runTriageTier2(ctx, prompts, flagged, job.Filter, coverage)
+	job.Prompts = prompts.snapshot()
 	if err != nil {
 		slog.Error("tier 2 failed", "job_id", job.ID, "error", err)
-		job.Status = "failed"
-		job.Error = "tier 2 analysis failed"
-		_ = s.cacheTriageJob(ctx, job, cacheKey)
+		s.failTriageJob(ctx, job, cacheKey, llmErrorMessage(err, "tier 2 analysis failed"))
 		return
 	}
 
 	job.Findings = findings
 	job.ScannedEventIDs = eventIDs
-	job.Status = "complete"
-	_ = s.cacheTriageJob(ctx, job, cacheKey)
+	s.completeTriageJob(saveCtx, job, cacheKey)
 }
 
-func (s *Server) runTriageTier1(ctx context.Context, timeRange common.TimeRange) (*Tier1Result, map[string]bool, error) {
-	summaries, err := s.fetchSummaries(ctx, &timeRange, 50)
-	if err != nil {
-		return nil, nil, err
+func (s *Server) completeTriageJob(ctx context.Context, job *TriageJob, cacheKey string) {
+	if job.ScheduleID != "" {
+		diff, err := s.diffScheduledRun(ctx, job)
+		if err != nil {
+			// the findings matter more than the diff, so the job still completes
+			slog.Warn("failed to diff scheduled triage run", "job_id", job.ID, "error", err)
+		}
+		job.Diff = diff
+	}
+	job.Status = "complete"
+	if s.saveTriageJob(ctx, job, cacheKey) {
+		s.attachTriageFindings(ctx, job)
+		s.notifyTriageAlerts(ctx, job)
 	}
+}
 
+// classifyTier1 asks the LLM to rate the given summary buckets. Returns the set of bucket IDs that were sent,
+// for validating the response against hallucinations.
+func (s *Server) classifyTier1(ctx context.Context, prompts *jobPrompts, summaries []common.EventSummary) (*Tier1Result, map[string]bool, error) {
 	if len(summaries) == 0 {
 		return &Tier1Result{Summary: "No events found in time range"}, nil, nil
 	}
@@ -223,7 +465,8 @@ func (s *Server) runTriageTier1(ctx context.Context, timeRange common.TimeRange)
 		validBuckets[sum.BucketStart.Format(time.RFC3339)] = true
 	}
 
-	prompt, err := s.prompts.RenderTier1TriagingPrompt(summaries)
+	examples := s.fewShotExamples(ctx, feedbackKindBucket, summaryFeatures(summaries))
+	prompt, err := prompts.renderTier1Triaging(summaries, examples)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -237,66 +480,59 @@ func (s *Server) runTriageTier1(ctx context.Context, timeRange common.TimeRange)
 	if err := json.Unmarshal([]byte(resp), &result); err != nil {
 		return nil, nil, fmt.Errorf("failed to parse tier 1 response: %w", err)
 	}
+	attachTier1Inputs(&result, summaries)
 
 	return &result, validBuckets, nil
 }
 
-func (s *Server) runTriageTier2(ctx context.Context, flagged []BucketRisk) ([]TriageFinding, []string, error) {
-	var allEvents []common.Event
-	var allIDs []string
-
-	for _, bucket := range flagged {
-		bucketTime, err := time.Parse(time.RFC3339, bucket.BucketID)
-		if err != nil {
-			continue
-		}
-
-		// fetch events from DB for this bucket's time window
-		timeRange := common.TimeRange{
-			Start: bucketTime,
-			End:   bucketTime.Add(5 * time.Minute), // TODO: store bucket end as part of prompt
-		}
-		events, err := s.fetchEvents(ctx, &timeRange, tier2EventLimit)
-		if err != nil {
-			slog.Warn("failed to fetch events for bucket", "bucket", bucket.BucketID, "error", err)
-			continue
-		}
-
-		for _, e := range events {
-			allEvents = append(allEvents, e)
-			allIDs = append(allIDs, e.Id)
-		}
-	}
-
-	if len(allEvents) == 0 {
-		return nil, nil, nil
-	}
-
-	prompt, err := s.prompts.RenderTier2TriagingPrompt(allEvents)
+// classifyTier2 asks the LLM for findings on the given events, keeping only evidence IDs that were actually sent.
+func (s *Server) classifyTier2(ctx context.Context, prompts *jobPrompts, events []common.Event, examples []FewShotExample) ([]TriageFinding, error) {
+	prompt, err := prompts.renderTier2Triaging(events, examples)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
 	resp, err := s.generateContentWithSchema(ctx, prompt, tier2Schema)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
 	var findings []TriageFinding
 	if err := json.Unmarshal([]byte(resp), &findings); err != nil {
-		return nil, nil, fmt.Errorf("failed to parse tier 2 response: %w", err)
+		return nil, fmt.Errorf("failed to parse tier 2 response: %w", err)
 	}
 
 	// filter valid event IDs from findings, making sure they are not hallucinated
-	validIDs := make(map[string]bool, len(allIDs))
-	for _, id := range allIDs {
-		validIDs[id] = true
+	validIDs := make(map[string]bool, len(events))
+	for _, e := range events {
+		validIDs[e.Id] = true
 	}
+	cited, kept := 0, 0
 	for i := range findings {
+		cited += len(findings[i].EventIDs)
 		findings[i].EventIDs = filterValidIDs(findings[i].EventIDs, validIDs)
+		kept += len(findings[i].EventIDs)
 	}
+	prompts.recordCitedIDs(prompt.Config, cited, cited-kept)
+
+	return findings, nil
+}
 
-	return findings, allIDs, nil
+// attachTier1Inputs copies onto every rating the summary of its bucket as it was rendered into the prompt, so that
+// feedback on the rating labels what the model actually saw.
+func attachTier1Inputs(result *Tier1Result, summaries []common.EventSummary) {
+	byID := make(map[string]common.EventSummary, len(summaries))
+	for _, sum := range summaries {
+		byID[sum.BucketStart.Format(time.RFC3339)] = sum
+	}
+	for _, buckets := range [][]BucketRisk{result.HighRisk, result.MediumRisk, result.LowRisk} {
+		for i := range buckets {
+			if sum, ok := byID[buckets[i].BucketID]; ok {
+				buckets[i].Input = formatTier1Example(sum)
+				buckets[i].Features = sortedKeys(summaryFeatures([]common.EventSummary{sum}))
+			}
+		}
+	}
 }
 
 func filterValidBuckets(buckets []BucketRisk, valid map[string]bool) []BucketRisk {
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andreionoie/llm-event-analysis/pkg/common"
+)
+
+// tier1ChunkBuckets is the number of summary buckets rated by a single tier 1 prompt.
+const tier1ChunkBuckets = 50
+
+// TriageCoverage reports how much of the requested time range tier 1 actually looked at, and how many of the
+// flagged events tier 2 classified.
+type TriageCoverage struct {
+	TotalChunks  int     `json:"total_chunks"`
+	Chunks       int     `json:"chunks"` // chunks analyzed successfully
+	FailedChunks int     `json:"failed_chunks"`
+	Buckets      int     `json:"buckets"` // summary buckets rated by the LLM
+	Ratio        float64 `json:"ratio"`   // analyzed fraction of the time range, 0-1
+	Truncated    bool    `json:"truncated,omitempty"`
+
+	Tier2Batches       int `json:"tier2_batches,omitempty"`
+	Tier2FailedBatches int `json:"tier2_failed_batches,omitempty"`
+	Tier2SkippedEvents int `json:"tier2_skipped_events,omitempty"` // flagged events that were not classified
+	// flagged buckets holding more than the events fetched per bucket; only their newest events are classified
+	Tier2TruncatedBuckets int `json:"tier2_truncated_buckets,omitempty"`
+}
+
+// tier1Chunk is the tier 1 result of one part of the time range.
+type tier1Chunk struct {
+	TimeRange common.TimeRange
+	Result    *Tier1Result
+	Buckets   int
+	Err       error
+}
+
+// splitTriageRange splits the time range into chunks of at most bucketsPerChunk summary buckets, newest first.
+// Chunk bounds follow the bucket grid, so that a bucket never falls into two chunks.
+func splitTriageRange(tr common.TimeRange, bucket time.Duration, bucketsPerChunk int) []common.TimeRange {
+	var chunks []common.TimeRange
+	end := tr.End
+	for !end.Before(tr.Start) {
+		start := end.Truncate(bucket).Add(-time.Duration(bucketsPerChunk-1) * bucket)
+		if start.Before(tr.Start) {
+			start = tr.Start
+		}
+		chunks = append(chunks, common.TimeRange{Start: start, End: end})
+		end = start.Add(-time.Nanosecond)
+	}
+	return chunks
+}
+
+// runTriageTier1 rates the summary buckets of the time range. Long ranges are split into chunks, rated in parallel
+// (map), then merged into a single ranking (reduce). At most TRIAGE_MAX_CHUNKS of the newest chunks are analyzed.
+func (s *Server) runTriageTier1(ctx context.Context, prompts *jobPrompts, timeRange common.TimeRange, filter *EventFilter) (*Tier1Result, *TriageCoverage, error) {
+	ranges := splitTriageRange(timeRange, s.cfg.SummaryBucket, tier1ChunkBuckets)
+	coverage := &TriageCoverage{TotalChunks: len(ranges)}
+	if len(ranges) > s.cfg.TriageMaxChunks {
+		ranges = ranges[:s.cfg.TriageMaxChunks]
+		coverage.Truncated = true
+	}
+
+	chunks := make([]tier1Chunk, len(ranges))
+	sem := make(chan struct{}, s.cfg.TriageParallelism)
+	var wg sync.WaitGroup
+	for i, tr := range ranges {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			chunks[i] = s.runTriageTier1Chunk(ctx, prompts, tr, filter)
+		}()
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	result := mergeTier1Chunks(chunks, coverage, timeRange)
+	if coverage.Chunks == 0 && coverage.FailedChunks > 0 {
+		return nil, nil, fmt.Errorf("all %d tier 1 chunks failed: %w", coverage.FailedChunks, chunks[0].Err)
+	}
+	return result, coverage, nil
+}
+
+func (s *Server) runTriageTier1Chunk(ctx context.Context, prompts *jobPrompts, timeRange common.TimeRange, filter *EventFilter) tier1Chunk {
+	chunk := tier1Chunk{TimeRange: timeRange}
+
+	var summaries []common.EventSummary
+	if filter.IsEmpty() {
+		summaries, chunk.Err = s.fetchSummaries(ctx, &timeRange, tier1ChunkBuckets)
+	} else {
+		// pre-computed summaries cover all events, so scoped triage aggregates its own
+		summaries, chunk.Err = s.aggregateSummaries(ctx, &timeRange, filter, tier1ChunkBuckets)
+	}
+	if chunk.Err != nil {
+		return chunk
+	}
+	chunk.Buckets = len(summaries)
+	if len(summaries) == 0 {
+		return chunk
+	}
+
+	result, validBuckets, err := s.classifyTier1(ctx, prompts, summaries)
+	if err != nil {
+		slog.Warn("tier 1 chunk failed", "start", timeRange.Start, "end", timeRange.End, "error", err)
+		chunk.Err = err
+		return chunk
+	}
+
+	// validate bucket IDs per chunk, guarding against hallucinations
+	cited := len(result.HighRisk) + len(result.MediumRisk) + len(result.LowRisk)
+	result.HighRisk = filterValidBuckets(result.HighRisk, validBuckets)
+	result.MediumRisk = filterValidBuckets(result.MediumRisk, validBuckets)
+	result.LowRisk = filterValidBuckets(result.LowRisk, validBuckets)
+	kept := len(result.HighRisk) + len(result.MediumRisk) + len(result.LowRisk)
+	prompts.recordCitedIDs(prompts.Tier1Triaging.Config, cited, cited-kept)
+	chunk.Result = result
+	return chunk
+}
+
+// mergeTier1Chunks reduces the chunk results into a single ranking, most confident first, and fills in the
+// coverage.
+func mergeTier1Chunks(chunks []tier1Chunk, coverage *TriageCoverage, timeRange common.TimeRange) *Tier1Result {
+	merged := &Tier1Result{}
+	var summaries []string
+	var covered time.Duration
+
+	for _, chunk := range chunks {
+		if chunk.Err != nil {
+			coverage.FailedChunks++
+			continue
+		}
+		coverage.Chunks++
+		coverage.Buckets += chunk.Buckets
+		covered += chunk.TimeRange.End.Sub(chunk.TimeRange.Start)
+		if chunk.Result == nil {
+			continue
+		}
+
+		merged.HighRisk = append(merged.HighRisk, chunk.Result.HighRisk...)
+		merged.MediumRisk = append(merged.MediumRisk, chunk.Result.MediumRisk...)
+		merged.LowRisk = append(merged.LowRisk, chunk.Result.LowRisk...)
+		if summary := strings.TrimSpace(chunk.Result.Summary); summary != "" {
+			summaries = append(summaries, fmt.Sprintf("[%s - %s] %s",
+				chunk.TimeRange.Start.UTC().Format(time.RFC3339), chunk.TimeRange.End.UTC().Format(time.RFC3339), summary))
+		}
+	}
+
+	rankBuckets(merged.HighRisk)
+	rankBuckets(merged.MediumRisk)
+	rankBuckets(merged.LowRisk)
+
+	switch {
+	case len(summaries) == 0:
+		merged.Summary = "No events found in time range"
+	case len(summaries) == 1 && len(chunks) == 1:
+		merged.Summary = chunks[0].Result.Summary
+	default:
+		// oldest chunk first reads more naturally
+		for i, j := 0, len(summaries)-1; i < j; i, j = i+1, j-1 {
+			summaries[i], summaries[j] = summaries[j], summaries[i]
+		}
+		merged.Summary = strings.Join(summaries, "\n")
+	}
+
+	// chunks are separated by a nanosecond, rounding hides the gaps
+	if total := timeRange.End.Sub(timeRange.Start); total > 0 {
+		coverage.Ratio = min(math.Round(float64(covered)/float64(total)*1e4)/1e4, 1)
+	} else if coverage.Chunks > 0 {
+		coverage.Ratio = 1
+	}
+
+	return merged
+}
+
+// rankBuckets orders buckets by confidence, newest first on ties.
+func rankBuckets(buckets []BucketRisk) {
+	sort.SliceStable(buckets, func(i, j int) bool {
+		if buckets[i].Confidence != buckets[j].Confidence {
+			return buckets[i].Confidence > buckets[j].Confidence
+		}
+		return buckets[i].BucketID > buckets[j].BucketID
+	})
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/andreionoie/llm-event-analysis/pkg/common"
+)
+
+func TestSplitTriageRange(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	tr := common.TimeRange{Start: start, End: start.Add(100 * time.Minute)}
+
+	// 5 minute buckets, 10 per chunk: 50 minutes per chunk
+	chunks := splitTriageRange(tr, 5*time.Minute, 10)
+	if len(chunks) != 3 {
+		t.Fatalf("expected 3 chunks, got %d: %+v", len(chunks), chunks)
+	}
+
+	if !chunks[0].End.Equal(tr.End) || !chunks[0].Start.Equal(start.Add(55*time.Minute)) {
+		t.Errorf("newest chunk should hold the last 10 buckets, got %+v", chunks[0])
+	}
+	if !chunks[2].Start.Equal(tr.Start) {
+		t.Errorf("oldest chunk should start at the range start, got %+v", chunks[2])
+	}
+	for i := 1; i < len(chunks); i++ {
+		if !chunks[i].End.Before(chunks[i-1].Start) {
+			t.Errorf("chunks %d and %d overlap", i-1, i)
+		}
+	}
+
+	single := splitTriageRange(common.TimeRange{Start: start, End: start.Add(time.Minute)}, 5*time.Minute, 10)
+	if len(single) != 1 {
+		t.Errorf("expected a short range to fit one chunk, got %d", len(single))
+	}
+}
+
+func TestMergeTier1Chunks(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	tr := common.TimeRange{Start: start, End: start.Add(3 * time.Hour)}
+	chunks := []tier1Chunk{
+		{
+			TimeRange: common.TimeRange{Start: start.Add(2 * time.Hour), End: tr.End},
+			Buckets:   2,
+			Result: &Tier1Result{
+				Summary:  "newer",
+				HighRisk: []BucketRisk{{BucketID: "b4", Confidence: 0.6}},
+			},
+		},
+		{
+			TimeRange: common.TimeRange{Start: start.Add(time.Hour), End: start.Add(2*time.Hour - time.Nanosecond)},
+			Err:       errors.New("llm unavailable"),
+		},
+		{
+			TimeRange: common.TimeRange{Start: start, End: start.Add(time.Hour - time.Nanosecond)},
+			Buckets:   3,
+			Result: &Tier1Result{
+				Summary:    "older",
+				HighRisk:   []BucketRisk{{BucketID: "b1", Confidence: 0.9}},
+				MediumRisk: []BucketRisk{{BucketID: "b2", Confidence: 0.5}},
+			},
+		},
+	}
+
+	coverage := &TriageCoverage{TotalChunks: 3}
+	merged := mergeTier1Chunks(chunks, coverage, tr)
+
+	if len(merged.HighRisk) != 2 || merged.HighRisk[0].BucketID != "b1" {
+		t.Errorf("high risk buckets not ranked by confidence: %+v", merged.HighRisk)
+	}
+	if len(merged.MediumRisk) != 1 {
+		t.Errorf("expected medium risk bucket to be kept, got %+v", merged.MediumRisk)
+	}
+	if coverage.Chunks != 2 || coverage.FailedChunks != 1 || coverage.Buckets != 5 {
+		t.Errorf("unexpected coverage %+v", coverage)
+	}
+	if coverage.Ratio < 0.66 || coverage.Ratio > 0.67 {
+		t.Errorf("expected two thirds of the range covered, got %v", coverage.Ratio)
+	}
+	want := "[2026-01-01T00:00:00Z - 2026-01-01T00:59:59Z] older\n[2026-01-01T02:00:00Z - 2026-01-01T03:00:00Z] newer"
+	if merged.Summary != want {
+		t.Errorf("summary:\n got %q\nwant %q", merged.Summary, want)
+	}
+}
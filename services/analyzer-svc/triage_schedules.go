@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/robfig/cron/v3"
+)
+
+const (
+	triageSchedulerInterval = 15 * time.Second
+	maxTriageWindow         = 30 * 24 * time.Hour
+)
+
+// TriageSchedule runs a triage job over the last WindowSeconds every time its cron expression fires.
+type TriageSchedule struct {
+	ID            string       `json:"id"`
+	Name          string       `json:"name"`
+	Cron          string       `json:"cron"` // standard 5-field cron, or descriptors like @every 15m
+	WindowSeconds int          `json:"window_seconds"`
+	Filter        *EventFilter `json:"filter,omitempty"`
+	Enabled       bool         `json:"enabled"`
+	NextRunAt     time.Time    `json:"next_run_at"`
+	LastRunAt     *time.Time   `json:"last_run_at,omitempty"`
+	LastJobID     string       `json:"last_job_id,omitempty"`
+	CreatedAt     time.Time    `json:"created_at"`
+	UpdatedAt     time.Time    `json:"updated_at"`
+}
+
+type CreateTriageScheduleRequest struct {
+	Name          string       `json:"name"`
+	Cron          string       `json:"cron"`
+	WindowSeconds int          `json:"window_seconds"`
+	Filter        *EventFilter `json:"filter,omitempty"`
+	Enabled       *bool        `json:"enabled,omitempty"` // defaults to true
+}
+
+type UpdateTriageScheduleRequest struct {
+	Cron          *string `json:"cron,omitempty"`
+	WindowSeconds *int    `json:"window_seconds,omitempty"`
+	Enabled       *bool   `json:"enabled,omitempty"`
+}
+
+// TriageDiff compares the findings of a scheduled run with the previous completed run of the same schedule.
+type TriageDiff struct {
+	PreviousJobID string          `json:"previous_job_id,omitempty"`
+	New           []TriageFinding `json:"new"`
+	Persisting    []TriageFinding `json:"persisting"`
+	Resolved      []TriageFinding `json:"resolved"`
+}
+
+func nextTriageScheduleRun(expr string, after time.Time) (time.Time, error) {
+	sched, err := cron.ParseStandard(expr)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid cron expression: %w", err)
+	}
+	next := sched.Next(after)
+	if next.IsZero() {
+		return time.Time{}, fmt.Errorf("cron expression never fires")
+	}
+	return next.UTC(), nil
+}
+
+func validateTriageWindow(windowSeconds int) error {
+	window := time.Duration(windowSeconds) * time.Second
+	if window <= 0 || window > maxTriageWindow {
+		return fmt.Errorf("window_seconds must be between 1 and %d", int(maxTriageWindow.Seconds()))
+	}
+	return nil
+}
+
+func (s *Server) handleCreateTriageSchedule(c echo.Context) error {
+	var req CreateTriageScheduleRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid request body")
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "name is required")
+	}
+	if err := validateTriageWindow(req.WindowSeconds); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err := req.Filter.Validate(); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if req.Filter.IsEmpty() {
+		req.Filter = nil
+	}
+
+	now := time.Now().UTC()
+	nextRun, err := nextTriageScheduleRun(req.Cron, now)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	sched := &TriageSchedule{
+		ID:            uuid.NewString(),
+		Name:          req.Name,
+		Cron:          strings.TrimSpace(req.Cron),
+		WindowSeconds: req.WindowSeconds,
+		Filter:        req.Filter,
+		Enabled:       req.Enabled == nil || *req.Enabled,
+		NextRunAt:     nextRun,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	if err := s.insertTriageSchedule(c.Request().Context(), sched); err != nil {
+		slog.Error("failed to save triage schedule", "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to create schedule")
+	}
+
+	return c.JSON(http.StatusCreated, sched)
+}
+
+func (s *Server) handleListTriageSchedules(c echo.Context) error {
+	schedules, err := s.listTriageSchedules(c.Request().Context())
+	if err != nil {
+		slog.Error("failed to list triage schedules", "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to list schedules")
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"schedules": schedules,
+		"count":     len(schedules),
+	})
+}
+
+func (s *Server) handleGetTriageSchedule(c echo.Context) error {
+	sched, err := s.loadTriageSchedule(c.Request().Context(), c.Param("id"))
+	if err != nil {
+		return triageScheduleError(err)
+	}
+	return c.JSON(http.StatusOK, sched)
+}
+
+func (s *Server) handleUpdateTriageSchedule(c echo.Context) error {
+	var req UpdateTriageScheduleRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid request body")
+	}
+
+	ctx := c.Request().Context()
+	sched, err := s.loadTriageSchedule(ctx, c.Param("id"))
+	if err != nil {
+		return triageScheduleError(err)
+	}
+
+	if req.WindowSeconds != nil {
+		if err := validateTriageWindow(*req.WindowSeconds); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		sched.WindowSeconds = *req.WindowSeconds
+	}
+	if req.Enabled != nil {
+		sched.Enabled = *req.Enabled
+	}
+	if req.Cron != nil || req.Enabled != nil {
+		// resuming or rescheduling starts from now, without catching up on missed runs
+		if req.Cron != nil {
+			sched.Cron = strings.TrimSpace(*req.Cron)
+		}
+		nextRun, err := nextTriageScheduleRun(sched.Cron, time.Now().UTC())
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		sched.NextRunAt = nextRun
+	}
+
+	if err := s.updateTriageSchedule(ctx, sched); err != nil {
+		return triageScheduleError(err)
+	}
+	return c.JSON(http.StatusOK, sched)
+}
+
+func (s *Server) handleDeleteTriageSchedule(c echo.Context) error {
+	if err := s.deleteTriageSchedule(c.Request().Context(), c.Param("id")); err != nil {
+		return triageScheduleError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func triageScheduleError(err error) error {
+	if errors.Is(err, errTriageScheduleNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, "schedule not found")
+	}
+	slog.Error("triage schedule operation failed", "error", err)
+	return echo.NewHTTPError(http.StatusInternalServerError, "schedule operation failed")
+}
+
+// runTriageScheduler enqueues a job for every due schedule. The jobs are run by the worker pool like any other.
+func (s *Server) runTriageScheduler(ctx context.Context) {
+	ticker := time.NewTicker(triageSchedulerInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for ctx.Err() == nil {
+			job, err := s.startDueTriageSchedule(ctx, time.Now().UTC())
+			if err != nil {
+				if ctx.Err() == nil {
+					slog.Error("failed to start scheduled triage", "error", err)
+				}
+				break
+			}
+			if job == nil {
+				break
+			}
+			slog.Info("scheduled triage job queued", "schedule_id", job.ScheduleID, "job_id", job.ID)
+			s.triage.notify()
+		}
+	}
+}
+
+// diffScheduledRun compares the findings of a scheduled job with the previous completed run of its schedule.
+func (s *Server) diffScheduledRun(ctx context.Context, job *TriageJob) (*TriageDiff, error) {
+	previous, err := s.findPreviousScheduledRun(ctx, job)
+	if err != nil {
+		return nil, err
+	}
+	if previous == nil {
+		return diffFindings("", nil, job.Findings), nil
+	}
+	return diffFindings(previous.ID, previous.Findings, job.Findings), nil
+}
+
+// diffFindings pairs every current finding with at most one previous finding. A finding persists when the previous
+// run had the same finding (see sameFinding), or else one of the same category about the same entity; unpaired
+// previous findings are resolved.
+func diffFindings(previousJobID string, previous, current []TriageFinding) *TriageDiff {
+	diff := &TriageDiff{
+		PreviousJobID: previousJobID,
+		New:           []TriageFinding{},
+		Persisting:    []TriageFinding{},
+		Resolved:      []TriageFinding{},
+	}
+
+	paired := make([]bool, len(previous))
+	pair := func(match func(a, b TriageFinding) bool, f TriageFinding) bool {
+		for i, p := range previous {
+			if !paired[i] && match(p, f) {
+				paired[i] = true
+				return true
+			}
+		}
+		return false
+	}
+	// exact matches first, so that entity matches don't take their pair
+	unpaired := make([]bool, len(current))
+	for i, f := range current {
+		unpaired[i] = !pair(sameFinding, f)
+	}
+	for i, f := range current {
+		if unpaired[i] && !pair(sameFindingEntity, f) {
+			diff.New = append(diff.New, f)
+		} else {
+			diff.Persisting = append(diff.Persisting, f)
+		}
+	}
+
+	for i, p := range previous {
+		if !paired[i] {
+			diff.Resolved = append(diff.Resolved, p)
+		}
+	}
+	return diff
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/andreionoie/llm-event-analysis/pkg/common"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+var errTriageScheduleNotFound = errors.New("triage schedule not found")
+
+const triageScheduleSelect = `SELECT id, name, cron, window_seconds, filter, enabled, next_run_at, last_run_at,
+	COALESCE(last_job_id, ''), created_at, updated_at
+	FROM triage_schedules`
+
+func scanTriageSchedule(row pgx.Row) (*TriageSchedule, error) {
+	var sched TriageSchedule
+	var filter []byte
+	err := row.Scan(&sched.ID, &sched.Name, &sched.Cron, &sched.WindowSeconds, &filter, &sched.Enabled,
+		&sched.NextRunAt, &sched.LastRunAt, &sched.LastJobID, &sched.CreatedAt, &sched.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if len(filter) > 0 {
+		if err := json.Unmarshal(filter, &sched.Filter); err != nil {
+			return nil, err
+		}
+	}
+	return &sched, nil
+}
+
+func (s *Server) insertTriageSchedule(ctx context.Context, sched *TriageSchedule) error {
+	filter, err := json.Marshal(sched.Filter)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(ctx,
+		`INSERT INTO triage_schedules (id, name, cron, window_seconds, filter, enabled, next_run_at, created_at, updated_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $8)`,
+		sched.ID, sched.Name, sched.Cron, sched.WindowSeconds, filter, sched.Enabled, sched.NextRunAt, sched.CreatedAt,
+	)
+	return err
+}
+
+func (s *Server) loadTriageSchedule(ctx context.Context, id string) (*TriageSchedule, error) {
+	sched, err := scanTriageSchedule(s.db.QueryRow(ctx, triageScheduleSelect+` WHERE id = $1`, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errTriageScheduleNotFound
+	}
+	return sched, err
+}
+
+func (s *Server) listTriageSchedules(ctx context.Context) ([]TriageSchedule, error) {
+	rows, err := s.db.Query(ctx, triageScheduleSelect+` ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	schedules := []TriageSchedule{}
+	for rows.Next() {
+		sched, err := scanTriageSchedule(rows)
+		if err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, *sched)
+	}
+	return schedules, rows.Err()
+}
+
+// updateTriageSchedule saves the editable fields of the schedule.
+func (s *Server) updateTriageSchedule(ctx context.Context, sched *TriageSchedule) error {
+	sched.UpdatedAt = time.Now().UTC()
+	tag, err := s.db.Exec(ctx,
+		`UPDATE triage_schedules SET cron = $2, window_seconds = $3, enabled = $4, next_run_at = $5, updated_at = $6
+		 WHERE id = $1`,
+		sched.ID, sched.Cron, sched.WindowSeconds, sched.Enabled, sched.NextRunAt, sched.UpdatedAt,
+	)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errTriageScheduleNotFound
+	}
+	return nil
+}
+
+func (s *Server) deleteTriageSchedule(ctx context.Context, id string) error {
+	tag, err := s.db.Exec(ctx, `DELETE FROM triage_schedules WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errTriageScheduleNotFound
+	}
+	return nil
+}
+
+// startDueTriageSchedule enqueues a triage job for the most overdue enabled schedule, and moves the schedule to its
+// next run. Returns nil when no schedule is due. Replicas skip schedules locked by each other, so every run is
+// enqueued once.
+func (s *Server) startDueTriageSchedule(ctx context.Context, now time.Time) (*TriageJob, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	sched, err := scanTriageSchedule(tx.QueryRow(ctx,
+		triageScheduleSelect+` WHERE enabled AND next_run_at <= $1 ORDER BY next_run_at LIMIT 1 FOR UPDATE SKIP LOCKED`,
+		now,
+	))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	job := &TriageJob{
+		ID: uuid.NewString(),
+		TimeRange: common.TimeRange{
+			Start: now.Add(-time.Duration(sched.WindowSeconds) * time.Second),
+			End:   now,
+		},
+		Filter:     sched.Filter,
+		Status:     "pending",
+		ScheduleID: sched.ID,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	if err := insertTriageJobWith(ctx, tx, job, triageResultsCacheKey(job.TimeRange, job.Filter)); err != nil {
+		return nil, err
+	}
+
+	// runs missed while no replica was up are not backfilled, the schedule continues from now
+	nextRun, err := nextTriageScheduleRun(sched.Cron, now)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(ctx,
+		`UPDATE triage_schedules SET next_run_at = $2, last_run_at = $3, last_job_id = $4, updated_at = $3
+		 WHERE id = $1`,
+		sched.ID, nextRun, now, job.ID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return job, tx.Commit(ctx)
+}
+
+// findPreviousScheduledRun returns the latest completed job of the schedule created before the given job, or nil.
+func (s *Server) findPreviousScheduledRun(ctx context.Context, job *TriageJob) (*TriageJob, error) {
+	var id string
+	err := s.db.QueryRow(ctx,
+		`SELECT id FROM triage_jobs
+		 WHERE schedule_id = $1 AND status = 'complete' AND created_at < $2 AND id <> $3
+		 ORDER BY created_at DESC LIMIT 1`,
+		job.ScheduleID, job.CreatedAt, job.ID,
+	).Scan(&id)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return s.loadTriageJob(ctx, id)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestNextTriageScheduleRun(t *testing.T) {
+	now := time.Date(2026, 1, 1, 10, 7, 30, 0, time.UTC)
+
+	next, err := nextTriageScheduleRun("*/15 * * * *", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2026, 1, 1, 10, 15, 0, 0, time.UTC); !next.Equal(want) {
+		t.Errorf("got %v, want %v", next, want)
+	}
+
+	next, err = nextTriageScheduleRun("@every 15m", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := now.Add(15 * time.Minute); !next.Equal(want) {
+		t.Errorf("got %v, want %v", next, want)
+	}
+
+	if _, err := nextTriageScheduleRun("every quarter hour", now); err == nil {
+		t.Error("expected invalid cron expression to fail")
+	}
+}
+
+func TestDiffFindings(t *testing.T) {
+	previous := []TriageFinding{
+		{Priority: "P2", Category: "brute_force", Summary: "logins from 10.0.0.5", EventIDs: []string{"e1"}},
+		{Priority: "P3", Category: "malware", Summary: "odd binary", EventIDs: []string{"e2"}},
+		{Priority: "P3", Category: "brute_force", Summary: "logins from 10.0.0.9", EventIDs: []string{"e3"}},
+	}
+	current := []TriageFinding{
+		// same category and source address, new evidence: persists
+		{Priority: "P2", Category: "brute_force", Summary: "more failed logins from 10.0.0.5", EventIDs: []string{"e10"}},
+		// shares evidence with the second brute force finding, which it should be paired with
+		{Priority: "P2", Category: "brute_force", Summary: "logins from 10.0.0.9 continue", EventIDs: []string{"e3", "e11"}},
+		{Priority: "P1", Category: "exfiltration", Summary: "large upload", EventIDs: []string{"e12"}},
+	}
+
+	diff := diffFindings("job-1", previous, current)
+	if diff.PreviousJobID != "job-1" {
+		t.Errorf("previous job ID not set")
+	}
+	if len(diff.New) != 1 || diff.New[0].Category != "exfiltration" {
+		t.Errorf("unexpected new findings %+v", diff.New)
+	}
+	if len(diff.Persisting) != 2 {
+		t.Errorf("expected both brute force findings to persist, got %+v", diff.Persisting)
+	}
+	if len(diff.Resolved) != 1 || diff.Resolved[0].Category != "malware" {
+		t.Errorf("unexpected resolved findings %+v", diff.Resolved)
+	}
+
+	first := diffFindings("", nil, current)
+	if len(first.New) != 3 || len(first.Persisting) != 0 || len(first.Resolved) != 0 {
+		t.Errorf("first run should report every finding as new, got %+v", first)
+	}
+}
+
+func TestDiffFindingsSameCategoryDifferentEntity(t *testing.T) {
+	previous := []TriageFinding{
+		{Priority: "P2", Category: "brute_force", Summary: "logins from 10.0.0.5 against vpn.corp.example", EventIDs: []string{"e1"}},
+	}
+	current := []TriageFinding{
+		{Priority: "P2", Category: "brute_force", Summary: "password spraying from 10.0.0.7", EventIDs: []string{"e2"}},
+	}
+
+	diff := diffFindings("job-1", previous, current)
+	if len(diff.New) != 1 || len(diff.Persisting) != 0 || len(diff.Resolved) != 1 {
+		t.Errorf("unrelated findings of one category should not be paired, got %+v", diff)
+	}
+}
+
+func TestFindingEntities(t *testing.T) {
+	got := findingEntities(TriageFinding{
+		Summary: "Bob@Corp.example logged in from 10.0.0.5 on web-01.corp.example, dropping " +
+			"d41d8cd98f00b204e9800998ecf8427e. Then 10.0.0.5 again.",
+	})
+	want := []string{"bob@corp.example", "10.0.0.5", "web-01.corp.example", "d41d8cd98f00b204e9800998ecf8427e"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
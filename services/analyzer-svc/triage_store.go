@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/andreionoie/llm-event-analysis/pkg/common"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+var (
+	errTriageJobNotFound = errors.New("triage job not found")
+	errTriageJobNotOwned = errors.New("triage job is no longer run by this worker")
+)
+
+// TriageJobQuery selects past triage jobs, newest first. Empty fields don't filter.
+type TriageJobQuery struct {
+	Status     string
+	ScheduleID string
+	TimeRange  *common.TimeRange // jobs whose triaged time range overlaps this one
+	Limit      int
+}
+
+// dbExecutor is implemented by both the pool and transactions.
+type dbExecutor interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+}
+
+func (s *Server) insertTriageJob(ctx context.Context, job *TriageJob, resultsKey string) error {
+	return insertTriageJobWith(ctx, s.db, job, resultsKey)
+}
+
+func insertTriageJobWith(ctx context.Context, db dbExecutor, job *TriageJob, resultsKey string) error {
+	filter, err := json.Marshal(job.Filter)
+	if err != nil {
+		return err
+	}
+	watermark, err := json.Marshal(job.Watermark)
+	if err != nil {
+		return err
+	}
+
+	var scheduleID any
+	if job.ScheduleID != "" {
+		scheduleID = job.ScheduleID
+	}
+
+	_, err = db.Exec(ctx,
+		`INSERT INTO triage_jobs (id, results_key, time_range_start, time_range_end, filter, status, schedule_id,
+		     created_at, updated_at, watermark)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $8, $9)`,
+		job.ID, resultsKey, job.TimeRange.Start, job.TimeRange.End, filter, job.Status, scheduleID, job.CreatedAt,
+		watermark,
+	)
+	return err
+}
+
+// updateTriageJob persists the job status and whatever results it has so far. Only the worker running the job may
+// update it; once the job was cancelled or reclaimed, errTriageJobNotOwned is returned.
+func (s *Server) updateTriageJob(ctx context.Context, job *TriageJob) error {
+	scannedIDs, err := json.Marshal(nonNil(job.ScannedEventIDs))
+	if err != nil {
+		return err
+	}
+	coverage, err := json.Marshal(job.Coverage)
+	if err != nil {
+		return err
+	}
+	diff, err := json.Marshal(job.Diff)
+	if err != nil {
+		return err
+	}
+	prompts, err := json.Marshal(job.Prompts)
+	if err != nil {
+		return err
+	}
+	watermark, err := json.Marshal(job.Watermark)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	job.UpdatedAt = time.Now().UTC()
+	tag, err := tx.Exec(ctx,
+		`UPDATE triage_jobs SET status = $2, error = $3, scanned_event_ids = $4, coverage = $5, diff = $6,
+		     prompts = $9, watermark = $10, updated_at = $7
+		 WHERE id = $1 AND worker_id = $8 AND status = 'running'`,
+		job.ID, job.Status, job.Error, scannedIDs, coverage, diff, job.UpdatedAt, job.WorkerID, prompts, watermark,
+	)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errTriageJobNotOwned
+	}
+
+	if job.Tier1 != nil {
+		high, _ := json.Marshal(nonNil(job.Tier1.HighRisk))
+		medium, _ := json.Marshal(nonNil(job.Tier1.MediumRisk))
+		low, _ := json.Marshal(nonNil(job.Tier1.LowRisk))
+		_, err := tx.Exec(ctx,
+			`INSERT INTO triage_tier1_results (job_id, summary, high_risk, medium_risk, low_risk)
+			 VALUES ($1, $2, $3, $4, $5)
+			 ON CONFLICT (job_id) DO UPDATE SET summary = EXCLUDED.summary, high_risk = EXCLUDED.high_risk,
+			     medium_risk = EXCLUDED.medium_risk, low_risk = EXCLUDED.low_risk`,
+			job.ID, job.Tier1.Summary, high, medium, low,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(ctx, `DELETE FROM triage_findings WHERE job_id = $1`, job.ID); err != nil {
+		return err
+	}
+	for i, f := range job.Findings {
+		eventIDs, _ := json.Marshal(nonNil(f.EventIDs))
+		_, err := tx.Exec(ctx,
+			`INSERT INTO triage_findings (job_id, seq, priority, category, summary, event_ids)
+			 VALUES ($1, $2, $3, $4, $5, $6)`,
+			job.ID, i+1, f.Priority, f.Category, f.Summary, eventIDs,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+// loadTriageJob returns the job with its tier 1 result and findings.
+func (s *Server) loadTriageJob(ctx context.Context, id string) (*TriageJob, error) {
+	job, err := scanTriageJob(s.db.QueryRow(ctx, triageJobSelect+` WHERE j.id = $1`, id))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, errTriageJobNotFound
+		}
+		return nil, err
+	}
+
+	var tier1 Tier1Result
+	var high, medium, low []byte
+	err = s.db.QueryRow(ctx,
+		`SELECT summary, high_risk, medium_risk, low_risk FROM triage_tier1_results WHERE job_id = $1`,
+		id,
+	).Scan(&tier1.Summary, &high, &medium, &low)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+	case err != nil:
+		return nil, err
+	default:
+		_ = json.Unmarshal(high, &tier1.HighRisk)
+		_ = json.Unmarshal(medium, &tier1.MediumRisk)
+		_ = json.Unmarshal(low, &tier1.LowRisk)
+		job.Tier1 = &tier1
+	}
+
+	rows, err := s.db.Query(ctx,
+		`SELECT priority, category, summary, event_ids FROM triage_findings WHERE job_id = $1 ORDER BY seq`,
+		id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var f TriageFinding
+		var eventIDs []byte
+		if err := rows.Scan(&f.Priority, &f.Category, &f.Summary, &eventIDs); err != nil {
+			return nil, err
+		}
+		_ = json.Unmarshal(eventIDs, &f.EventIDs)
+		job.Findings = append(job.Findings, f)
+	}
+	return job, rows.Err()
+}
+
+// findTriageJobID returns the ID of the latest job for the results key created since the given time that has not
+// failed or been cancelled, or "" if there is none.
+func (s *Server) findTriageJobID(ctx context.Context, resultsKey string, since time.Time) (string, error) {
+	var id string
+	err := s.db.QueryRow(ctx,
+		`SELECT id FROM triage_jobs WHERE results_key = $1 AND status NOT IN ('failed', 'cancelled') AND created_at >= $2
+		 ORDER BY created_at DESC LIMIT 1`,
+		resultsKey, since,
+	).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", nil
+	}
+	return id, err
+}
+
+// listTriageJobs returns jobs without their tier 1 results and findings; only the number of findings is set.
+func (s *Server) listTriageJobs(ctx context.Context, q TriageJobQuery) ([]TriageJob, error) {
+	conds := &sqlConditions{}
+	if q.Status != "" {
+		conds.add("j.status = %s", q.Status)
+	}
+	if q.ScheduleID != "" {
+		conds.add("j.schedule_id = %s", q.ScheduleID)
+	}
+	if q.TimeRange != nil {
+		conds.add("j.time_range_start <= %s AND j.time_range_end >= %s", q.TimeRange.End, q.TimeRange.Start)
+	}
+	query := triageJobSelect + conds.whereClause() + ` ORDER BY j.created_at DESC LIMIT ` + conds.nextPlaceholder()
+	args := append(conds.args, q.Limit)
+
+	rows, err := s.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := make([]TriageJob, 0, q.Limit)
+	for rows.Next() {
+		job, err := scanTriageJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, *job)
+	}
+	return jobs, rows.Err()
+}
+
+const triageJobSelect = `SELECT j.id, j.time_range_start, j.time_range_end, j.filter, j.status, j.error,
+	j.scanned_event_ids, j.coverage, j.diff, j.prompts, j.watermark, COALESCE(j.schedule_id, ''), j.created_at,
+	j.updated_at,
+	COALESCE(j.worker_id, ''), j.attempts,
+	(SELECT COUNT(*) FROM triage_findings f WHERE f.job_id = j.id)
+	FROM triage_jobs j`
+
+func scanTriageJob(row pgx.Row) (*TriageJob, error) {
+	var job TriageJob
+	var filter, scannedIDs, coverage, diff, prompts, watermark []byte
+	err := row.Scan(&job.ID, &job.TimeRange.Start, &job.TimeRange.End, &filter, &job.Status, &job.Error,
+		&scannedIDs, &coverage, &diff, &prompts, &watermark, &job.ScheduleID, &job.CreatedAt, &job.UpdatedAt,
+		&job.WorkerID, &job.Attempts, &job.FindingCount)
+	if err != nil {
+		return nil, err
+	}
+	if len(filter) > 0 {
+		if err := json.Unmarshal(filter, &job.Filter); err != nil {
+			return nil, err
+		}
+	}
+	if err := json.Unmarshal(scannedIDs, &job.ScannedEventIDs); err != nil {
+		return nil, err
+	}
+	if len(coverage) > 0 {
+		if err := json.Unmarshal(coverage, &job.Coverage); err != nil {
+			return nil, err
+		}
+	}
+	if len(diff) > 0 {
+		if err := json.Unmarshal(diff, &job.Diff); err != nil {
+			return nil, err
+		}
+	}
+	if len(prompts) > 0 {
+		if err := json.Unmarshal(prompts, &job.Prompts); err != nil {
+			return nil, err
+		}
+	}
+	if len(watermark) > 0 {
+		if err := json.Unmarshal(watermark, &job.Watermark); err != nil {
+			return nil, err
+		}
+	}
+	return &job, nil
+}
+
+func (s *Server) countQueuedTriageJobs(ctx context.Context) (int, error) {
+	var count int
+	err := s.db.QueryRow(ctx, `SELECT COUNT(*) FROM triage_jobs WHERE status = 'pending'`).Scan(&count)
+	return count, err
+}
+
+// claimTriageJob marks the oldest pending job as running on this worker and returns it, or nil if the queue is
+// empty. Concurrent claims from other workers and replicas skip the locked row.
+func (s *Server) claimTriageJob(ctx context.Context, workerID string) (*TriageJob, error) {
+	var id string
+	err := s.db.QueryRow(ctx,
+		`UPDATE triage_jobs SET status = 'running', worker_id = $1, heartbeat_at = NOW(), attempts = attempts + 1,
+		     updated_at = NOW()
+		 WHERE id = (SELECT id FROM triage_jobs WHERE status = 'pending' ORDER BY created_at
+		             LIMIT 1 FOR UPDATE SKIP LOCKED)
+		 RETURNING id`,
+		workerID,
+	).Scan(&id)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return s.loadTriageJob(ctx, id)
+}
+
+// heartbeatTriageJob extends the lease of a running job. Returns false when the worker no longer owns the job,
+// because it was cancelled or reclaimed.
+func (s *Server) heartbeatTriageJob(ctx context.Context, jobID, workerID string) (bool, error) {
+	tag, err := s.db.Exec(ctx,
+		`UPDATE triage_jobs SET heartbeat_at = NOW() WHERE id = $1 AND worker_id = $2 AND status = 'running'`,
+		jobID, workerID,
+	)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// releaseTriageJob puts a job that was interrupted by shutdown back in the queue, without counting the attempt.
+func (s *Server) releaseTriageJob(ctx context.Context, jobID, workerID string) error {
+	_, err := s.db.Exec(ctx,
+		`UPDATE triage_jobs SET status = 'pending', worker_id = NULL, heartbeat_at = NULL,
+		     attempts = GREATEST(attempts - 1, 0), updated_at = NOW()
+		 WHERE id = $1 AND worker_id = $2 AND status = 'running'`,
+		jobID, workerID,
+	)
+	return err
+}
+
+// reclaimStaleTriageJobs requeues running jobs whose worker stopped sending heartbeats before staleBefore. Jobs
+// that already used maxAttempts are failed instead. Returns the IDs of the affected jobs.
+func (s *Server) reclaimStaleTriageJobs(ctx context.Context, staleBefore time.Time, maxAttempts int) ([]string, error) {
+	rows, err := s.db.Query(ctx,
+		`UPDATE triage_jobs SET
+		     status = CASE WHEN attempts >= $2 THEN 'failed' ELSE 'pending' END,
+		     error = CASE WHEN attempts >= $2 THEN 'job abandoned by its workers' ELSE error END,
+		     worker_id = NULL, heartbeat_at = NULL, updated_at = NOW()
+		 WHERE status = 'running' AND heartbeat_at < $1
+		 RETURNING id`,
+		staleBefore, maxAttempts,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// cancelTriageJob marks a pending or running job as cancelled. Returns false when the job had already finished.
+func (s *Server) cancelTriageJob(ctx context.Context, jobID string) (bool, error) {
+	tag, err := s.db.Exec(ctx,
+		`UPDATE triage_jobs SET status = 'cancelled', error = $2, updated_at = NOW()
+		 WHERE id = $1 AND status IN ('pending', 'running')`,
+		jobID, triageCancelledMessage,
+	)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// nonNil makes nil slices marshal as an empty JSON array.
+func nonNil[T any](s []T) []T {
+	if s == nil {
+		return []T{}
+	}
+	return s
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andreionoie/llm-event-analysis/pkg/common"
+)
+
+// runTriageTier2 classifies the events of the flagged buckets. The events are split into batches whose prompt fits
+// TRIAGE_TIER2_TOKEN_BUDGET, classified in parallel, and the findings of all batches are merged. Returns the IDs of
+// all classified events.
+func (s *Server) runTriageTier2(ctx context.Context, prompts *jobPrompts, flagged []BucketRisk, filter *EventFilter, coverage *TriageCoverage) ([]TriageFinding, []string, error) {
+	var allEvents []common.Event
+
+	// flagged buckets come ranked, so events of the least confident buckets are the first to be skipped
+	for _, bucket := range flagged {
+		bucketTime, err := time.Parse(time.RFC3339, bucket.BucketID)
+		if err != nil {
+			continue
+		}
+
+		// fetch events from DB for this bucket's time window
+		timeRange := common.TimeRange{
+			Start: bucketTime,
+			End:   bucketTime.Add(s.cfg.SummaryBucket - time.Nanosecond),
+		}
+		// one more than the limit, to tell full buckets from truncated ones
+		events, err := s.queryEvents(ctx, EventQuery{TimeRange: &timeRange, Filter: filter, Limit: tier2EventLimit + 1})
+		if err != nil {
+			slog.Warn("failed to fetch events for bucket", "bucket", bucket.BucketID, "error", err)
+			continue
+		}
+		if len(events) > tier2EventLimit {
+			// the newest events are kept
+			events = events[:tier2EventLimit]
+			coverage.Tier2TruncatedBuckets++
+		}
+		allEvents = append(allEvents, events...)
+	}
+	if coverage.Tier2TruncatedBuckets > 0 {
+		slog.Warn("tier 2 event limit reached, skipping the oldest events of buckets",
+			"buckets", coverage.Tier2TruncatedBuckets, "limit", tier2EventLimit)
+	}
+
+	if len(allEvents) == 0 {
+		return nil, nil, nil
+	}
+
+	// one set of examples for the whole job, so that every batch prompt has the same overhead
+	examples := s.fewShotExamples(ctx, feedbackKindFinding, eventFeatures(allEvents))
+	batches, examples, err := s.tier2Batches(prompts.promptSet, allEvents, examples)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(batches) > s.cfg.Tier2MaxBatches {
+		for _, skipped := range batches[s.cfg.Tier2MaxBatches:] {
+			coverage.Tier2SkippedEvents += len(skipped)
+		}
+		batches = batches[:s.cfg.Tier2MaxBatches]
+		slog.Warn("tier 2 batch limit reached, skipping events", "skipped", coverage.Tier2SkippedEvents)
+	}
+	coverage.Tier2Batches = len(batches)
+
+	results := make([][]TriageFinding, len(batches))
+	errs := make([]error, len(batches))
+	sem := make(chan struct{}, s.cfg.TriageParallelism)
+	var wg sync.WaitGroup
+	for i, batch := range batches {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			results[i], errs[i] = s.classifyTier2(ctx, prompts, batch, examples)
+		}()
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	var findings []TriageFinding
+	var scannedIDs []string
+	var lastErr error
+	for i, batch := range batches {
+		if errs[i] != nil {
+			slog.Warn("tier 2 batch failed", "events", len(batch), "error", errs[i])
+			coverage.Tier2FailedBatches++
+			coverage.Tier2SkippedEvents += len(batch)
+			lastErr = errs[i]
+			continue
+		}
+		findings = append(findings, results[i]...)
+		for _, e := range batch {
+			scannedIDs = append(scannedIDs, e.Id)
+		}
+	}
+	if coverage.Tier2FailedBatches == len(batches) {
+		return nil, nil, fmt.Errorf("all %d tier 2 batches failed: %w", len(batches), lastErr)
+	}
+
+	return mergeFindings(findings), scannedIDs, nil
+}
+
+// tier2Batches splits the events into batches whose rendered tier 2 prompt, examples included, fits the token budget.
+// The full prompt is rendered once; each event is costed once by the characters it adds to the event list, so that
+// batches are cut on a running total. When the examples leave no room for the largest event, the least similar ones
+// are dropped; the examples kept are returned with the batches. It fails when the prompt has no room for the largest
+// event even without examples.
+func (s *Server) tier2Batches(prompts *promptSet, events []common.Event, examples []FewShotExample) ([][]common.Event, []FewShotExample, error) {
+	noEvents, err := prompts.renderTier2Events(nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	costs := make([]int, len(events))
+	largest := 0
+	for i, e := range events {
+		single, err := prompts.renderTier2Events([]common.Event{e})
+		if err != nil {
+			return nil, nil, err
+		}
+		costs[i] = len(single) - len(noEvents)
+		largest = max(largest, costs[i])
+	}
+
+	// costs are in characters, the budget is converted the way estimateTokens converts them
+	var budget int
+	for kept := len(examples); ; kept-- {
+		empty, err := prompts.renderTier2Triaging(nil, examples[:kept])
+		if err != nil {
+			return nil, nil, err
+		}
+		budget = (s.cfg.Tier2TokenBudget - promptTokens(empty)) * 4
+		if budget >= largest {
+			if kept < len(examples) {
+				slog.Warn("tier 2 token budget too small for the few-shot examples, dropping some",
+					"dropped", len(examples)-kept, "budget", s.cfg.Tier2TokenBudget)
+			}
+			examples = examples[:kept]
+			break
+		}
+		if kept == 0 {
+			return nil, nil, fmt.Errorf("tier 2 token budget of %d leaves no room for events", s.cfg.Tier2TokenBudget)
+		}
+	}
+	return batchByTokens(events, costs, budget), examples, nil
+}
+
+// batchByTokens splits items into consecutive batches whose summed cost stays within the budget. An item that is
+// over budget on its own gets a batch of its own.
+func batchByTokens[T any](items []T, costs []int, budget int) [][]T {
+	var batches [][]T
+	var current []T
+	used := 0
+	for i, item := range items {
+		if len(current) > 0 && used+costs[i] > budget {
+			batches = append(batches, current)
+			current, used = nil, 0
+		}
+		current = append(current, item)
+		used += costs[i]
+	}
+	if len(current) > 0 {
+		batches = append(batches, current)
+	}
+	return batches
+}
+
+func promptTokens(prompt *PromptPair) int {
+	return estimateTokens(prompt.System) + estimateTokens(prompt.User)
+}
+
+// mergeFindings deduplicates findings reported by several tier 2 batches. Findings of the same category are merged
+// when they share evidence or have the same summary: the merged finding keeps the highest priority, and the union of
+// the evidence IDs. The result is ordered by priority.
+func mergeFindings(findings []TriageFinding) []TriageFinding {
+	var merged []TriageFinding
+	for _, f := range findings {
+		f.EventIDs = uniqueStrings(f.EventIDs)
+
+		target := -1
+		for i := range merged {
+			if sameFinding(merged[i], f) {
+				target = i
+				break
+			}
+		}
+		if target < 0 {
+			merged = append(merged, f)
+			continue
+		}
+
+		m := &merged[target]
+		if f.Priority < m.Priority { // P1 sorts before P5
+			m.Priority = f.Priority
+			m.Summary = f.Summary
+		}
+		m.EventIDs = uniqueStrings(append(m.EventIDs, f.EventIDs...))
+	}
+
+	sort.SliceStable(merged, func(i, j int) bool {
+		return merged[i].Priority < merged[j].Priority
+	})
+	return merged
+}
+
+func sameFinding(a, b TriageFinding) bool {
+	if !strings.EqualFold(strings.TrimSpace(a.Category), strings.TrimSpace(b.Category)) {
+		return false
+	}
+	if strings.EqualFold(strings.TrimSpace(a.Summary), strings.TrimSpace(b.Summary)) {
+		return true
+	}
+	for _, id := range a.EventIDs {
+		for _, other := range b.EventIDs {
+			if id == other {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// findingEntityPattern matches the entities a finding summary may name: IPv4 addresses, emails, host or domain names
+// and file hashes.
+var findingEntityPattern = regexp.MustCompile(
+	`\b(?:\d{1,3}\.){3}\d{1,3}\b|[\w.+-]+@[\w-]+(?:\.[\w-]+)+|\b[a-zA-Z][\w-]*(?:\.[\w-]+)+\b|\b[a-fA-F0-9]{32,}\b`)
+
+// findingEntities returns the entities named in the summary of a finding, lowercased.
+func findingEntities(f TriageFinding) []string {
+	matches := findingEntityPattern.FindAllString(f.Summary, -1)
+	for i, m := range matches {
+		matches[i] = strings.ToLower(m)
+	}
+	return uniqueStrings(matches)
+}
+
+// sameFindingEntity reports whether two findings of the same category name a common entity. Used to follow a
+// finding across runs over different events, which share no evidence.
+func sameFindingEntity(a, b TriageFinding) bool {
+	if !strings.EqualFold(strings.TrimSpace(a.Category), strings.TrimSpace(b.Category)) {
+		return false
+	}
+	entities := findingEntities(b)
+	for _, entity := range findingEntities(a) {
+		if slices.Contains(entities, entity) {
+			return true
+		}
+	}
+	return false
+}
+
+func uniqueStrings(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	out := values[:0:0]
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			out = append(out, v)
+		}
+	}
+	return out
+}
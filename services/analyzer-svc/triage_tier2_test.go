@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andreionoie/llm-event-analysis/pkg/common"
+)
+
+func TestBatchByTokens(t *testing.T) {
+	items := []string{"a", "b", "c", "d", "e"}
+	costs := []int{4, 4, 4, 20, 1}
+
+	got := batchByTokens(items, costs, 10)
+	want := [][]string{{"a", "b"}, {"c"}, {"d"}, {"e"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if got := batchByTokens([]string{}, nil, 10); len(got) != 0 {
+		t.Errorf("expected no batches, got %v", got)
+	}
+}
+
+func TestTier2BatchesFitTokenBudget(t *testing.T) {
+	s, _ := newSequenceTestServer(t)
+	s.cfg.Tier2TokenBudget = 1000
+
+	events := make([]common.Event, 60)
+	for i := range events {
+		events[i] = common.Event{
+			Id:        fmt.Sprintf("evt-%d", i),
+			Timestamp: time.Date(2026, 1, 1, 0, i, 0, 0, time.UTC),
+			Source:    "auth",
+			Type:      "login_failed",
+			Payload:   map[string]any{"user": strings.Repeat("x", 100)},
+		}
+	}
+
+	batches, _, err := s.tier2Batches(s.prompts.current(), events, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batches) < 2 {
+		t.Fatalf("expected events to be split, got %d batch", len(batches))
+	}
+
+	total := 0
+	for _, batch := range batches {
+		total += len(batch)
+		prompt, err := s.prompts.RenderTier2TriagingPrompt(batch, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tokens := promptTokens(prompt); tokens > s.cfg.Tier2TokenBudget {
+			t.Errorf("batch of %d events uses %d tokens, over budget", len(batch), tokens)
+		}
+	}
+	if total != len(events) {
+		t.Errorf("batches hold %d events, want %d", total, len(events))
+	}
+}
+
+func TestTier2BatchesTrimExamplesOverBudget(t *testing.T) {
+	s, _ := newSequenceTestServer(t)
+	s.cfg.Tier2TokenBudget = 1000
+
+	events := []common.Event{{Id: "evt-1", Timestamp: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), Source: "auth", Type: "login_failed"}}
+	examples := make([]FewShotExample, 10)
+	for i := range examples {
+		examples[i] = FewShotExample{Input: strings.Repeat("login_failed from 10.0.0.4 ", 10), Output: "P3 brute_force", Label: "correct"}
+	}
+
+	batches, kept, err := s.tier2Batches(s.prompts.current(), events, examples)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kept) == 0 || len(kept) == len(examples) {
+		t.Fatalf("expected some examples to be dropped, kept %d", len(kept))
+	}
+	prompt, err := s.prompts.RenderTier2TriagingPrompt(batches[0], kept)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokens := promptTokens(prompt); tokens > s.cfg.Tier2TokenBudget {
+		t.Errorf("prompt uses %d tokens, over budget", tokens)
+	}
+
+	s.cfg.Tier2TokenBudget = 100
+	if _, _, err := s.tier2Batches(s.prompts.current(), events, examples); err == nil {
+		t.Error("expected an error when the prompt alone is over budget")
+	}
+}
+
+func TestMergeFindings(t *testing.T) {
+	findings := []TriageFinding{
+		{Priority: "P3", Category: "brute_force", Summary: "repeated logins", EventIDs: []string{"e1", "e2"}},
+		{Priority: "P4", Category: "malware", Summary: "odd binary", EventIDs: []string{"e5"}},
+		{Priority: "P2", Category: "Brute_Force", Summary: "password spraying", EventIDs: []string{"e2", "e3"}},
+		{Priority: "P4", Category: "malware", Summary: "Odd binary ", EventIDs: []string{"e6", "e6"}},
+		{Priority: "P4", Category: "exfiltration", Summary: "large upload", EventIDs: []string{"e1"}},
+	}
+
+	got := mergeFindings(findings)
+	want := []TriageFinding{
+		{Priority: "P2", Category: "brute_force", Summary: "password spraying", EventIDs: []string{"e1", "e2", "e3"}},
+		{Priority: "P4", Category: "malware", Summary: "odd binary", EventIDs: []string{"e5", "e6"}},
+		{Priority: "P4", Category: "exfiltration", Summary: "large upload", EventIDs: []string{"e1"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v\nwant %+v", got, want)
+	}
+}
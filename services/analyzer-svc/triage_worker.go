@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	triagePollInterval     = 5 * time.Second
+	triageMaxAttempts      = 3
+	triageStaleHeartbeats  = 3 // missed heartbeats before a running job is reclaimed
+	triageReleaseTimeout   = 5 * time.Second
+	triageCancelledMessage = "cancelled by user"
+)
+
+// triageWorkers runs queued triage jobs with bounded concurrency. The queue itself is the set of pending jobs in
+// Postgres, so every replica's workers pull from it, and jobs of a replica that died are reclaimed by the others
+// once its heartbeats stop.
+type triageWorkers struct {
+	id   string
+	wake chan struct{}
+	wg   sync.WaitGroup
+
+	mu      sync.Mutex
+	running map[string]context.CancelFunc
+}
+
+func newTriageWorkers(concurrency int) *triageWorkers {
+	host, _ := os.Hostname()
+	return &triageWorkers{
+		id:      host + "-" + uuid.NewString()[:8],
+		wake:    make(chan struct{}, concurrency),
+		running: map[string]context.CancelFunc{},
+	}
+}
+
+// notify wakes up an idle worker, so a new job doesn't wait for the next poll.
+func (w *triageWorkers) notify() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// cancel stops the job if it is running on this replica. Jobs running elsewhere notice on their next heartbeat.
+func (w *triageWorkers) cancel(jobID string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if cancel, ok := w.running[jobID]; ok {
+		cancel()
+	}
+}
+
+func (w *triageWorkers) track(jobID string, cancel context.CancelFunc) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.running[jobID] = cancel
+}
+
+func (w *triageWorkers) untrack(jobID string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.running, jobID)
+}
+
+// startTriageWorkers starts the workers, the reaper of stale jobs and the scheduler. They stop when ctx is
+// cancelled; jobs still running at that point are put back in the queue.
+func (s *Server) startTriageWorkers(ctx context.Context) {
+	for range s.cfg.TriageWorkers {
+		s.triage.wg.Add(1)
+		go func() {
+			defer s.triage.wg.Done()
+			s.runTriageWorker(ctx)
+		}()
+	}
+
+	s.triage.wg.Add(1)
+	go func() {
+		defer s.triage.wg.Done()
+		s.reapStaleTriageJobs(ctx)
+	}()
+
+	s.triage.wg.Add(1)
+	go func() {
+		defer s.triage.wg.Done()
+		s.runTriageScheduler(ctx)
+	}()
+
+	slog.Info("triage workers started", "worker_id", s.triage.id, "concurrency", s.cfg.TriageWorkers)
+}
+
+func (s *Server) runTriageWorker(ctx context.Context) {
+	ticker := time.NewTicker(triagePollInterval)
+	defer ticker.Stop()
+
+	for {
+		// drain the queue before waiting again
+		for ctx.Err() == nil {
+			job, err := s.claimTriageJob(ctx, s.triage.id)
+			if err != nil {
+				if ctx.Err() == nil {
+					slog.Error("failed to claim triage job", "error", err)
+				}
+				break
+			}
+			if job == nil {
+				break
+			}
+			s.runClaimedTriageJob(ctx, job)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.triage.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// runClaimedTriageJob runs the job under its own context, which is cancelled by DELETE /triage/jobs/:id, by losing
+// the lease, by the job timeout or by shutdown.
+func (s *Server) runClaimedTriageJob(workerCtx context.Context, job *TriageJob) {
+	jobCtx, cancel := context.WithTimeout(workerCtx, s.cfg.TriageJobTimeout)
+	defer cancel()
+	s.triage.track(job.ID, cancel)
+	defer s.triage.untrack(job.ID)
+
+	heartbeatDone := make(chan struct{})
+	go func() {
+		defer close(heartbeatDone)
+		s.heartbeatTriageJobUntilDone(jobCtx, job.ID, cancel)
+	}()
+
+	s.processTriageJob(jobCtx, job, triageResultsCacheKey(job.TimeRange, job.Filter))
+	cancel()
+	<-heartbeatDone
+
+	// interrupted by shutdown: hand the job over to another worker
+	if workerCtx.Err() != nil {
+		ctx, cancelRelease := context.WithTimeout(context.Background(), triageReleaseTimeout)
+		defer cancelRelease()
+		if err := s.releaseTriageJob(ctx, job.ID, s.triage.id); err != nil {
+			slog.Error("failed to release triage job", "job_id", job.ID, "error", err)
+		}
+		s.invalidateCachedTriageJob(ctx, job.ID)
+	}
+}
+
+func (s *Server) heartbeatTriageJobUntilDone(ctx context.Context, jobID string, cancel context.CancelFunc) {
+	ticker := time.NewTicker(s.cfg.TriageHeartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			owned, err := s.heartbeatTriageJob(ctx, jobID, s.triage.id)
+			if err != nil {
+				if ctx.Err() == nil {
+					slog.Warn("failed to send triage job heartbeat", "job_id", jobID, "error", err)
+				}
+				continue
+			}
+			if !owned {
+				slog.Info("triage job cancelled or reclaimed, stopping", "job_id", jobID)
+				cancel()
+				return
+			}
+		}
+	}
+}
+
+func (s *Server) reapStaleTriageJobs(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.TriageHeartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			staleBefore := time.Now().Add(-triageStaleHeartbeats * s.cfg.TriageHeartbeat)
+			ids, err := s.reclaimStaleTriageJobs(ctx, staleBefore, triageMaxAttempts)
+			if err != nil {
+				if !errors.Is(err, context.Canceled) {
+					slog.Error("failed to reclaim stale triage jobs", "error", err)
+				}
+				continue
+			}
+			for _, id := range ids {
+				slog.Warn("reclaimed stale triage job", "job_id", id)
+				s.invalidateCachedTriageJob(ctx, id)
+			}
+			if len(ids) > 0 {
+				s.triage.notify()
+			}
+		}
+	}
+}
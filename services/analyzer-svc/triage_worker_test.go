@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/andreionoie/llm-event-analysis/pkg/common"
+)
+
+func TestTriageWorkersCancel(t *testing.T) {
+	w := newTriageWorkers(2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w.track("job-1", cancel)
+
+	w.cancel("job-2") // not running here, no-op
+	if ctx.Err() != nil {
+		t.Fatal("cancelling another job stopped job-1")
+	}
+
+	w.cancel("job-1")
+	if ctx.Err() == nil {
+		t.Fatal("job-1 was not cancelled")
+	}
+
+	w.untrack("job-1")
+	if len(w.running) != 0 {
+		t.Errorf("expected no running jobs, got %d", len(w.running))
+	}
+}
+
+func TestTriageWorkersNotifyDoesNotBlock(t *testing.T) {
+	w := newTriageWorkers(1)
+	for range 5 {
+		w.notify()
+	}
+	if len(w.wake) != 1 {
+		t.Errorf("expected one pending wake-up, got %d", len(w.wake))
+	}
+}
+
+func TestTriageJobLease(t *testing.T) {
+	s := &Server{db: newTestDB(t)}
+	ctx := context.Background()
+
+	now := time.Now().UTC()
+	tr := common.TimeRange{Start: now.Add(-time.Hour), End: now}
+	job := &TriageJob{ID: "job-1", TimeRange: tr, Status: "pending", CreatedAt: now, UpdatedAt: now}
+	if err := s.insertTriageJob(ctx, job, triageResultsCacheKey(tr, nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	claimed, err := s.claimTriageJob(ctx, "worker-1")
+	if err != nil || claimed == nil {
+		t.Fatalf("failed to claim the job: %v", err)
+	}
+	if claimed.Status != "running" || claimed.WorkerID != "worker-1" || claimed.Attempts != 1 {
+		t.Errorf("unexpected claimed job: status %s, worker %s, attempts %d", claimed.Status, claimed.WorkerID, claimed.Attempts)
+	}
+	if other, err := s.claimTriageJob(ctx, "worker-2"); err != nil || other != nil {
+		t.Fatalf("a running job should not be claimed twice: %v, %v", other, err)
+	}
+
+	if ok, err := s.heartbeatTriageJob(ctx, job.ID, "worker-1"); err != nil || !ok {
+		t.Errorf("owner heartbeat refused: %v, %v", ok, err)
+	}
+	if ok, err := s.heartbeatTriageJob(ctx, job.ID, "worker-2"); err != nil || ok {
+		t.Errorf("heartbeat from another worker accepted: %v, %v", ok, err)
+	}
+
+	// a job with a fresh heartbeat is not stale
+	if ids, err := s.reclaimStaleTriageJobs(ctx, time.Now().Add(-time.Minute), triageMaxAttempts); err != nil || len(ids) != 0 {
+		t.Fatalf("live job reclaimed: %v, %v", ids, err)
+	}
+	ids, err := s.reclaimStaleTriageJobs(ctx, time.Now().Add(time.Minute), triageMaxAttempts)
+	if err != nil || !slices.Equal(ids, []string{job.ID}) {
+		t.Fatalf("stale job not reclaimed: %v, %v", ids, err)
+	}
+	if ok, _ := s.heartbeatTriageJob(ctx, job.ID, "worker-1"); ok {
+		t.Error("the previous owner kept its lease after the job was reclaimed")
+	}
+
+	reclaimed, err := s.claimTriageJob(ctx, "worker-2")
+	if err != nil || reclaimed == nil || reclaimed.ID != job.ID || reclaimed.Attempts != 2 {
+		t.Fatalf("requeued job not claimed again: %+v, %v", reclaimed, err)
+	}
+
+	// out of attempts, the job fails instead of being requeued
+	if _, err := s.reclaimStaleTriageJobs(ctx, time.Now().Add(time.Minute), 2); err != nil {
+		t.Fatal(err)
+	}
+	failed, err := s.loadTriageJob(ctx, job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed.Status != "failed" {
+		t.Errorf("expected the job to fail after its last attempt, got %s", failed.Status)
+	}
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/andreionoie/llm-event-analysis/pkg/common"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	usageBufferSize    = 1000
+	usageBatchSize     = 100
+	usageFlushInterval = 2 * time.Second
+	usageFlushTimeout  = 5 * time.Second
+	defaultUsageWindow = 24 * time.Hour
+
+	tokenBudgetKeyPrefix = "llm_tokens:"
+	tokenBudgetKeyTTL    = 48 * time.Hour
+
+	// output tokens reserved for prompts that don't set max_output_tokens
+	defaultOutputTokenReserve = 1024
+)
+
+var (
+	llmRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "analyzer_llm_requests_total",
+			Help: "LLM calls, partitioned by prompt, prompt version, model and status",
+		},
+		[]string{"prompt", "version", "model", "status"},
+	)
+	llmTokens = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "analyzer_llm_tokens_total",
+			Help: "Tokens used by LLM calls, partitioned by prompt, prompt version, model and kind (input, output, cached)",
+		},
+		[]string{"prompt", "version", "model", "kind"},
+	)
+	llmLatency = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "analyzer_llm_request_seconds",
+			Help:    "Latency of LLM calls, partitioned by prompt, prompt version and model",
+			Buckets: prometheus.ExponentialBuckets(0.25, 2, 10),
+		},
+		[]string{"prompt", "version", "model"},
+	)
+	llmHTTPRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "analyzer_llm_http_requests_total",
+			Help: "HTTP requests made by the LLM clients, partitioned by host and status code",
+		},
+		[]string{"host", "status"},
+	)
+	llmBudgetRejections = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "analyzer_llm_budget_rejections_total",
+			Help: "LLM calls refused because a daily token budget was used up, partitioned by prompt",
+		},
+		[]string{"prompt"},
+	)
+)
+
+// UsageRecord is one LLM call, as stored in the llm_usage table.
+type UsageRecord struct {
+	CreatedAt     time.Time
+	Prompt        string
+	PromptVersion string
+	Provider      string
+	Model         string
+	Usage         LLMUsage
+	Latency       time.Duration
+	Error         string
+}
+
+// UsageSummary aggregates the calls of one prompt version and model.
+type UsageSummary struct {
+	Prompt        string    `json:"prompt"`
+	PromptVersion string    `json:"prompt_version"`
+	Model         string    `json:"model"`
+	Calls         int64     `json:"calls"`
+	Errors        int64     `json:"errors"`
+	InputTokens   int64     `json:"input_tokens"`
+	OutputTokens  int64     `json:"output_tokens"`
+	CachedTokens  int64     `json:"cached_tokens"`
+	AvgLatencyMs  float64   `json:"avg_latency_ms"`
+	LastCallAt    time.Time `json:"last_call_at"`
+}
+
+// TokenBudgetStatus reports today's token use against a daily budget.
+type TokenBudgetStatus struct {
+	Scope   string    `json:"scope"` // "all" or a prompt name
+	Used    int64     `json:"used"`
+	Budget  int64     `json:"budget"`
+	ResetAt time.Time `json:"reset_at"`
+}
+
+// TokenBudgetError is returned instead of calling the LLM once a daily token budget is used up.
+type TokenBudgetError struct {
+	TokenBudgetStatus
+}
+
+func (e *TokenBudgetError) Error() string {
+	scope := "all prompts"
+	if e.Scope != "all" {
+		scope = "prompt " + e.Scope
+	}
+	return fmt.Sprintf("daily LLM token budget for %s is used up (%d of %d tokens), resets at %s",
+		scope, e.Used, e.Budget, e.ResetAt.Format(time.RFC3339))
+}
+
+// llmHTTPError maps a failed LLM call to an HTTP error. Exhausted budgets are reported as such, anything else as
+// the given message.
+func llmHTTPError(err error, message string) *echo.HTTPError {
+	if budgetErr, ok := asTokenBudgetError(err); ok {
+		return echo.NewHTTPError(http.StatusTooManyRequests, budgetErr.Error())
+	}
+	return echo.NewHTTPError(http.StatusInternalServerError, message)
+}
+
+// llmErrorMessage is the client facing message for a failed LLM call, for errors reported outside of HTTP status.
+func llmErrorMessage(err error, message string) string {
+	if budgetErr, ok := asTokenBudgetError(err); ok {
+		return budgetErr.Error()
+	}
+	return message
+}
+
+func asTokenBudgetError(err error) (*TokenBudgetError, bool) {
+	var budgetErr *TokenBudgetError
+	return budgetErr, errors.As(err, &budgetErr)
+}
+
+// usageRecorder buffers usage records, which a single writer inserts in batches, so that LLM calls don't wait on
+// the database. Records are dropped when the buffer is full.
+type usageRecorder struct {
+	records chan UsageRecord
+	done    chan struct{}
+}
+
+func newUsageRecorder() *usageRecorder {
+	return &usageRecorder{
+		records: make(chan UsageRecord, usageBufferSize),
+		done:    make(chan struct{}),
+	}
+}
+
+// recordLLMCall accounts for a finished LLM call: metrics, the daily budget counters and the usage table.
+func (s *Server) recordLLMCall(ctx context.Context, prompt *PromptPair, provider string, reserved *tokenReservation, resp *LLMResponse, latency time.Duration, callErr error) {
+	rec := UsageRecord{
+		CreatedAt: time.Now().UTC(),
+		Provider:  provider,
+		Latency:   latency,
+	}
+	if prompt.Config != nil {
+		rec.Prompt = prompt.Config.Name
+		rec.PromptVersion = prompt.Config.Version
+		rec.Model = prompt.Config.Model
+	}
+	if resp != nil {
+		rec.Usage = resp.Usage
+		if resp.Model != "" {
+			rec.Model = resp.Model
+		}
+	}
+
+	status := "ok"
+	if callErr != nil {
+		status = "error"
+		rec.Error = callErr.Error()
+	}
+	llmRequests.WithLabelValues(rec.Prompt, rec.PromptVersion, rec.Model, status).Inc()
+	llmLatency.WithLabelValues(rec.Prompt, rec.PromptVersion, rec.Model).Observe(latency.Seconds())
+	llmTokens.WithLabelValues(rec.Prompt, rec.PromptVersion, rec.Model, "input").Add(float64(rec.Usage.InputTokens))
+	llmTokens.WithLabelValues(rec.Prompt, rec.PromptVersion, rec.Model, "output").Add(float64(rec.Usage.OutputTokens))
+	llmTokens.WithLabelValues(rec.Prompt, rec.PromptVersion, rec.Model, "cached").Add(float64(rec.Usage.CachedTokens))
+
+	s.settleTokenBudget(context.WithoutCancel(ctx), reserved, rec.Prompt, rec.Usage, rec.CreatedAt)
+
+	if s.usage != nil {
+		select {
+		case s.usage.records <- rec:
+		default:
+			slog.Warn("usage buffer full, dropping LLM usage record", "prompt", rec.Prompt)
+		}
+	}
+}
+
+// runUsageRecorder writes buffered usage records until ctx is cancelled, then flushes what is left.
+func (s *Server) runUsageRecorder(ctx context.Context) {
+	defer close(s.usage.done)
+
+	ticker := time.NewTicker(usageFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]UsageRecord, 0, usageBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		flushCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), usageFlushTimeout)
+		defer cancel()
+		if err := s.insertUsageRecords(flushCtx, batch); err != nil {
+			slog.Error("failed to store LLM usage", "records", len(batch), "error", err)
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			for {
+				select {
+				case rec := <-s.usage.records:
+					batch = append(batch, rec)
+				default:
+					flush()
+					return
+				}
+			}
+		case rec := <-s.usage.records:
+			batch = append(batch, rec)
+			if len(batch) >= usageBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func tokenBudgetKey(day time.Time, prompt string) string {
+	key := tokenBudgetKeyPrefix + day.UTC().Format(time.DateOnly)
+	if prompt != "" {
+		key += ":" + prompt
+	}
+	return key
+}
+
+func nextBudgetReset(now time.Time) time.Time {
+	return now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+}
+
+// tokenReservation is the estimate of a call's tokens, added to the daily counters before the call is made.
+type tokenReservation struct {
+	day    time.Time
+	tokens int64
+}
+
+// reservedTokens estimates the tokens of a call: its prompt, and its output up to max_output_tokens.
+func reservedTokens(prompt *PromptPair) int64 {
+	output := defaultOutputTokenReserve
+	if prompt.Config != nil && prompt.Config.MaxOutputTokens != nil {
+		output = *prompt.Config.MaxOutputTokens
+	}
+	return int64(promptTokens(prompt) + output)
+}
+
+// incrTokenCounters adds tokens (negative to refund) to the day's global and prompt counters, shared by all
+// replicas through Redis, and returns their new values.
+func (s *Server) incrTokenCounters(ctx context.Context, day time.Time, prompt string, tokens int64) (global, perPrompt int64, err error) {
+	pipe := s.cache.Pipeline()
+	var counters []*redis.IntCmd
+	for _, key := range []string{tokenBudgetKey(day, ""), tokenBudgetKey(day, prompt)} {
+		counters = append(counters, pipe.IncrBy(ctx, key, tokens))
+		pipe.Expire(ctx, key, tokenBudgetKeyTTL)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, 0, err
+	}
+	return counters[0].Val(), counters[1].Val(), nil
+}
+
+// reserveTokenBudget adds the estimated tokens of the call to today's counters before it is made, so that
+// concurrent calls, across replicas, can't all pass the check and overshoot the budget together. It returns a
+// TokenBudgetError, and takes nothing, when the estimate doesn't fit in the global or the prompt's daily budget.
+// Like the check, the reservation fails open: if Redis is unavailable, the call goes ahead and nil is returned.
+func (s *Server) reserveTokenBudget(ctx context.Context, prompt *PromptPair) (*tokenReservation, error) {
+	if s.cache == nil {
+		return nil, nil
+	}
+	name := ""
+	if prompt.Config != nil {
+		name = prompt.Config.Name
+	}
+	now := time.Now()
+	reserved := &tokenReservation{day: now, tokens: reservedTokens(prompt)}
+
+	global, perPrompt, err := s.incrTokenCounters(ctx, now, name, reserved.tokens)
+	if err != nil {
+		slog.Warn("failed to reserve LLM token budget", "prompt", name, "error", err)
+		return nil, nil
+	}
+
+	var exceeded *TokenBudgetStatus
+	if budget := int64(s.cfg.LLMDailyTokenBudget); budget > 0 && global > budget {
+		exceeded = &TokenBudgetStatus{Scope: "all", Used: global - reserved.tokens, Budget: budget}
+	} else if prompt.Config != nil && prompt.Config.DailyTokenBudget > 0 && perPrompt > int64(prompt.Config.DailyTokenBudget) {
+		exceeded = &TokenBudgetStatus{Scope: name, Used: perPrompt - reserved.tokens, Budget: int64(prompt.Config.DailyTokenBudget)}
+	}
+	if exceeded == nil {
+		return reserved, nil
+	}
+
+	if _, _, err := s.incrTokenCounters(context.WithoutCancel(ctx), now, name, -reserved.tokens); err != nil {
+		slog.Warn("failed to release LLM token budget", "prompt", name, "error", err)
+	}
+	exceeded.ResetAt = nextBudgetReset(now)
+	llmBudgetRejections.WithLabelValues(name).Inc()
+	return nil, &TokenBudgetError{*exceeded}
+}
+
+// settleTokenBudget replaces the reservation of a finished call with the tokens it actually used, refunding the
+// difference; without a reservation, the tokens are added as they are. Cached input tokens count like any other.
+func (s *Server) settleTokenBudget(ctx context.Context, reserved *tokenReservation, prompt string, usage LLMUsage, now time.Time) {
+	if s.cache == nil {
+		return
+	}
+	tokens := int64(usage.InputTokens + usage.OutputTokens)
+	day := now
+	if reserved != nil {
+		day, tokens = reserved.day, tokens-reserved.tokens
+	}
+	if tokens == 0 {
+		return
+	}
+	if _, _, err := s.incrTokenCounters(ctx, day, prompt, tokens); err != nil {
+		slog.Warn("failed to charge LLM token budget", "prompt", prompt, "error", err)
+	}
+}
+
+// tokenBudgets returns today's use of the global budget and of the prompt's own budget, for the budgets that are set.
+func (s *Server) tokenBudgets(ctx context.Context, config *PromptConfig, now time.Time) ([]TokenBudgetStatus, error) {
+	var budgets []TokenBudgetStatus
+	if s.cfg.LLMDailyTokenBudget > 0 {
+		budgets = append(budgets, TokenBudgetStatus{Scope: "all", Budget: int64(s.cfg.LLMDailyTokenBudget)})
+	}
+	if config != nil && config.DailyTokenBudget > 0 {
+		budgets = append(budgets, TokenBudgetStatus{Scope: config.Name, Budget: int64(config.DailyTokenBudget)})
+	}
+	if len(budgets) == 0 || s.cache == nil {
+		return nil, nil
+	}
+
+	for i := range budgets {
+		prompt := ""
+		if budgets[i].Scope != "all" {
+			prompt = budgets[i].Scope
+		}
+		used, err := s.cache.Get(ctx, tokenBudgetKey(now, prompt)).Int64()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return nil, err
+		}
+		budgets[i].Used = used
+		budgets[i].ResetAt = nextBudgetReset(now)
+	}
+	return budgets, nil
+}
+
+// checkTokenBudget returns a TokenBudgetError when the global or the prompt's daily budget is used up, without
+// reserving anything; LLM calls themselves go through reserveTokenBudget. The check fails open: if Redis is
+// unavailable, the call goes ahead.
+func (s *Server) checkTokenBudget(ctx context.Context, config *PromptConfig) error {
+	budgets, err := s.tokenBudgets(ctx, config, time.Now())
+	if err != nil {
+		slog.Warn("failed to check LLM token budget", "error", err)
+		return nil
+	}
+	for _, b := range budgets {
+		if b.Used >= b.Budget {
+			prompt := ""
+			if config != nil {
+				prompt = config.Name
+			}
+			llmBudgetRejections.WithLabelValues(prompt).Inc()
+			return &TokenBudgetError{b}
+		}
+	}
+	return nil
+}
+
+// handleUsage reports LLM usage per prompt version and model over a time range (default: the last 24 hours), along
+// with today's budgets.
+func (s *Server) handleUsage(c echo.Context) error {
+	timeRange, err := parseTimeRangeParams(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if timeRange == nil {
+		now := time.Now().UTC()
+		timeRange = &common.TimeRange{Start: now.Add(-defaultUsageWindow), End: now}
+	}
+
+	ctx := c.Request().Context()
+	usage, err := s.summarizeUsage(ctx, *timeRange, c.QueryParam("prompt"))
+	if err != nil {
+		slog.Error("failed to summarize LLM usage", "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to load usage")
+	}
+
+	budgets := []TokenBudgetStatus{}
+	seen := map[string]bool{}
+	for _, prompt := range s.prompts.all() {
+		statuses, err := s.tokenBudgets(ctx, prompt.Config, time.Now())
+		if err != nil {
+			slog.Error("failed to load LLM token budgets", "error", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to load budgets")
+		}
+		for _, b := range statuses {
+			if !seen[b.Scope] {
+				seen[b.Scope] = true
+				budgets = append(budgets, b)
+			}
+		}
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"time_range": timeRange,
+		"usage":      usage,
+		"budgets":    budgets,
+	})
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+
+	"github.com/andreionoie/llm-event-analysis/pkg/common"
+	"github.com/jackc/pgx/v5"
+)
+
+func (s *Server) insertUsageRecords(ctx context.Context, records []UsageRecord) error {
+	_, err := s.db.CopyFrom(ctx,
+		pgx.Identifier{"llm_usage"},
+		[]string{"created_at", "prompt", "prompt_version", "provider", "model", "input_tokens", "output_tokens",
+			"cached_tokens", "latency_ms", "error"},
+		pgx.CopyFromSlice(len(records), func(i int) ([]any, error) {
+			r := records[i]
+			return []any{r.CreatedAt, r.Prompt, r.PromptVersion, r.Provider, r.Model, r.Usage.InputTokens,
+				r.Usage.OutputTokens, r.Usage.CachedTokens, r.Latency.Milliseconds(), r.Error}, nil
+		}),
+	)
+	return err
+}
+
+// summarizeUsage groups the calls in the time range by prompt, prompt version and model, busiest first. An empty
+// prompt doesn't filter.
+func (s *Server) summarizeUsage(ctx context.Context, timeRange common.TimeRange, prompt string) ([]UsageSummary, error) {
+	conds := &sqlConditions{}
+	conds.add("created_at >= %s", timeRange.Start)
+	conds.add("created_at < %s", timeRange.End)
+	if prompt != "" {
+		conds.add("prompt = %s", prompt)
+	}
+
+	rows, err := s.db.Query(ctx,
+		`SELECT prompt, prompt_version, model, COUNT(*), COUNT(*) FILTER (WHERE error <> ''),
+		     SUM(input_tokens), SUM(output_tokens), SUM(cached_tokens), AVG(latency_ms), MAX(created_at)
+		 FROM llm_usage`+conds.whereClause()+`
+		 GROUP BY prompt, prompt_version, model
+		 ORDER BY SUM(input_tokens) + SUM(output_tokens) DESC, prompt, prompt_version, model`,
+		conds.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usage := []UsageSummary{}
+	for rows.Next() {
+		var u UsageSummary
+		if err := rows.Scan(&u.Prompt, &u.PromptVersion, &u.Model, &u.Calls, &u.Errors, &u.InputTokens,
+			&u.OutputTokens, &u.CachedTokens, &u.AvgLatencyMs, &u.LastCallAt); err != nil {
+			return nil, err
+		}
+		usage = append(usage, u)
+	}
+	return usage, rows.Err()
+}
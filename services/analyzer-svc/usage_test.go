@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenBudgetKey(t *testing.T) {
+	now := time.Date(2026, 3, 1, 23, 30, 0, 0, time.FixedZone("CET", 3600))
+	if got := tokenBudgetKey(now, ""); got != "llm_tokens:2026-03-01" {
+		t.Errorf("global key = %q", got)
+	}
+	if got := tokenBudgetKey(now, "analyze"); got != "llm_tokens:2026-03-01:analyze" {
+		t.Errorf("prompt key = %q", got)
+	}
+	if got := nextBudgetReset(now); !got.Equal(time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("budget should reset at the next UTC midnight, got %s", got)
+	}
+}
+
+func TestLLMHTTPErrorForExhaustedBudget(t *testing.T) {
+	budgetErr := &TokenBudgetError{TokenBudgetStatus{
+		Scope:   "triage_tier1",
+		Used:    10500,
+		Budget:  10000,
+		ResetAt: time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC),
+	}}
+	want := "daily LLM token budget for prompt triage_tier1 is used up (10500 of 10000 tokens), resets at 2026-03-02T00:00:00Z"
+
+	httpErr := llmHTTPError(fmt.Errorf("all 3 tier 1 chunks failed: %w", budgetErr), "analysis failed")
+	if httpErr.Code != http.StatusTooManyRequests || httpErr.Message != want {
+		t.Errorf("got %d %v", httpErr.Code, httpErr.Message)
+	}
+
+	if httpErr := llmHTTPError(errors.New("boom"), "analysis failed"); httpErr.Code != http.StatusInternalServerError || httpErr.Message != "analysis failed" {
+		t.Errorf("other errors should keep the generic message, got %d %v", httpErr.Code, httpErr.Message)
+	}
+}
+
+func TestTokenBudgetReservation(t *testing.T) {
+	rdb, mr := newTestCache(t)
+	s := &Server{cfg: Config{LLMDailyTokenBudget: 1000}, cache: rdb}
+	ctx := context.Background()
+
+	maxOutput := 100
+	prompt := &PromptPair{
+		Config: &PromptConfig{Name: "analyze", MaxOutputTokens: &maxOutput, DailyTokenBudget: 500},
+		User:   strings.Repeat("x", 400), // 100 tokens
+	}
+	global, perPrompt := tokenBudgetKey(time.Now(), ""), tokenBudgetKey(time.Now(), "analyze")
+	counter := func(key string) string {
+		v, _ := mr.Get(key)
+		return v
+	}
+
+	// the estimate is taken upfront, and the difference refunded once the call is done
+	first, err := s.reserveTokenBudget(ctx, prompt)
+	if err != nil || first == nil || first.tokens != 200 {
+		t.Fatalf("unexpected reservation %+v, %v", first, err)
+	}
+	second, err := s.reserveTokenBudget(ctx, prompt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counter(global) != "400" || counter(perPrompt) != "400" {
+		t.Errorf("both reservations should be counted, got %s and %s", counter(global), counter(perPrompt))
+	}
+	s.settleTokenBudget(ctx, first, "analyze", LLMUsage{InputTokens: 120, OutputTokens: 30}, time.Now())
+	s.settleTokenBudget(ctx, second, "analyze", LLMUsage{}, time.Now()) // failed call
+	if counter(global) != "150" || counter(perPrompt) != "150" {
+		t.Errorf("expected the actual usage after settling, got %s and %s", counter(global), counter(perPrompt))
+	}
+
+	// a call that doesn't fit in the prompt budget is refused, and leaves the counters as they were
+	mr.Set(perPrompt, "350")
+	_, err = s.reserveTokenBudget(ctx, prompt)
+	budgetErr, ok := asTokenBudgetError(err)
+	if !ok || budgetErr.Scope != "analyze" || budgetErr.Used != 350 || budgetErr.Budget != 500 {
+		t.Fatalf("expected the prompt budget to refuse the call, got %v", err)
+	}
+	if counter(global) != "150" || counter(perPrompt) != "350" {
+		t.Errorf("refused reservation should be released, got %s and %s", counter(global), counter(perPrompt))
+	}
+
+	// the global budget applies to every prompt
+	mr.Set(global, "900")
+	prompt.Config.DailyTokenBudget = 0
+	if _, err := s.reserveTokenBudget(ctx, prompt); err == nil {
+		t.Error("expected the global budget to refuse the call")
+	} else if budgetErr, _ := asTokenBudgetError(err); budgetErr == nil || budgetErr.Scope != "all" {
+		t.Errorf("unexpected error %v", err)
+	}
+}
@@ -27,9 +27,10 @@ func registerDBMetrics(db *pgxpool.Pool) (*sql.DB, error) {
 	return sqlDB, nil
 }
 
-func (s *Server) insertEvent(ctx context.Context, event *common.Event) error {
+// insertEvent inserts the event, reporting whether it was inserted: an event whose ID is already stored is skipped.
+func (s *Server) insertEvent(ctx context.Context, event *common.Event) (bool, error) {
 	if s.db == nil {
-		return errors.New("database not configured")
+		return false, errors.New("database not configured")
 	}
 
 	payloadJSON := []byte("{}")
@@ -37,7 +38,7 @@ func (s *Server) insertEvent(ctx context.Context, event *common.Event) error {
 		var err error
 		payloadJSON, err = json.Marshal(event.Payload)
 		if err != nil {
-			return err
+			return false, err
 		}
 	}
 
@@ -54,25 +55,27 @@ func (s *Server) insertEvent(ctx context.Context, event *common.Event) error {
 		payloadJSON,
 	)
 	if err != nil {
-		return err
+		return false, err
 	}
 	if result.RowsAffected() == 0 {
-		return nil
+		return false, nil
 	}
 
 	if err := s.updateSummary(ctx, event); err != nil {
 		// TODO: alert on cumulative summary update failures
 		slog.Error("failed to update event summary", "error", err, "event_id", event.Id)
 	}
-	return nil
+	return true, nil
 }
 
-func (s *Server) insertEventsBatch(ctx context.Context, events []*common.Event) error {
+// insertEventsBatch inserts the events and returns the ones inserted, which on the row-by-row fallback leaves out the
+// events already stored.
+func (s *Server) insertEventsBatch(ctx context.Context, events []*common.Event) ([]*common.Event, error) {
 	if s.db == nil {
-		return errors.New("database not configured")
+		return nil, errors.New("database not configured")
 	}
 	if len(events) == 0 {
-		return nil
+		return nil, nil
 	}
 
 	rows := make([][]any, 0, len(events))
@@ -82,7 +85,7 @@ func (s *Server) insertEventsBatch(ctx context.Context, events []*common.Event)
 			var err error
 			payloadJSON, err = json.Marshal(event.Payload)
 			if err != nil {
-				return err
+				return nil, err
 			}
 		}
 
@@ -109,16 +112,21 @@ func (s *Server) insertEventsBatch(ctx context.Context, events []*common.Event)
 		}
 	}
 
-	return nil
+	return events, nil
 }
 
-func (s *Server) insertEventsFallback(ctx context.Context, events []*common.Event) error {
+func (s *Server) insertEventsFallback(ctx context.Context, events []*common.Event) ([]*common.Event, error) {
+	inserted := make([]*common.Event, 0, len(events))
 	for _, event := range events {
-		if err := s.insertEvent(ctx, event); err != nil {
-			return err
+		ok, err := s.insertEvent(ctx, event)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			inserted = append(inserted, event)
 		}
 	}
-	return nil
+	return inserted, nil
 }
 
 func (s *Server) updateSummary(ctx context.Context, event *common.Event) error {
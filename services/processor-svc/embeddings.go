@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/andreionoie/llm-event-analysis/pkg/common"
+	"github.com/jackc/pgx/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const embedMaxAttempts = 3
+
+var embeddedEvents = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "processor_embedded_events_total",
+		Help: "Events sent for embedding, partitioned by result: ok, failed, or dropped when the embedder fell behind",
+	},
+	[]string{"result"},
+)
+
+// enqueueEmbeddings hands stored events to the embedder. Embedding is best effort and never holds up ingestion: when
+// the embedder falls behind, events are dropped and stay without an embedding.
+func (s *Server) enqueueEmbeddings(events []*common.Event) {
+	if s.embedder == nil {
+		return
+	}
+	for _, event := range events {
+		select {
+		case s.embedCh <- event:
+		default:
+			embeddedEvents.WithLabelValues("dropped").Inc()
+		}
+	}
+}
+
+// runEmbedder embeds the queued events in batches of EMBEDDING_BATCH_SIZE, or whatever is queued every flush
+// interval, until ctx is cancelled.
+func (s *Server) runEmbedder(ctx context.Context) {
+	batch := make([]*common.Event, 0, s.cfg.EmbeddingBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := s.embedEvents(ctx, batch); err != nil {
+			slog.Error("failed to embed events", "error", err, "count", len(batch))
+			embeddedEvents.WithLabelValues("failed").Add(float64(len(batch)))
+		} else {
+			embeddedEvents.WithLabelValues("ok").Add(float64(len(batch)))
+		}
+		batch = batch[:0]
+	}
+
+	ticker := time.NewTicker(s.cfg.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case event := <-s.embedCh:
+			batch = append(batch, event)
+			if len(batch) >= s.cfg.EmbeddingBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// embedEvents embeds the events and stores their vectors, retrying failed embedding calls with exponential backoff.
+func (s *Server) embedEvents(ctx context.Context, events []*common.Event) error {
+	texts := make([]string, len(events))
+	for i, event := range events {
+		texts[i] = common.EventEmbeddingText(*event)
+	}
+
+	var vectors [][]float32
+	var err error
+	backoff := time.Second
+	for attempt := 1; attempt <= embedMaxAttempts; attempt++ {
+		vectors, err = s.embedder.Embed(ctx, texts)
+		if err == nil || attempt == embedMaxAttempts {
+			break
+		}
+		slog.Warn("embedding failed, retrying", "attempt", attempt, "error", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	if err != nil {
+		return err
+	}
+
+	model := s.embedder.Model()
+	batch := &pgx.Batch{}
+	for i, event := range events {
+		batch.Queue(
+			`INSERT INTO event_embeddings (event_id, model, embedding)
+			 VALUES ($1, $2, $3::vector)
+			 ON CONFLICT (event_id, model) DO UPDATE SET embedding = EXCLUDED.embedding, embedded_at = NOW()`,
+			event.Id,
+			model,
+			common.FormatVector(vectors[i]),
+		)
+	}
+	return s.db.SendBatch(ctx, batch).Close()
+}
@@ -27,6 +27,9 @@ type Config struct {
 	SummaryBucket      time.Duration
 	BatchSize          int
 	FlushInterval      time.Duration
+
+	Embedding          common.EmbeddingConfig
+	EmbeddingBatchSize int
 }
 
 func loadConfig() Config {
@@ -41,6 +44,8 @@ func loadConfig() Config {
 		SummaryBucket:      time.Second * time.Duration(common.GetenvOrDefaultInt("SUMMARY_BUCKET_SECONDS", "300")),
 		BatchSize:          common.GetenvOrDefaultInt("PROCESSOR_BATCH_SIZE", "100"),
 		FlushInterval:      time.Millisecond * time.Duration(common.GetenvOrDefaultInt("PROCESSOR_FLUSH_INTERVAL_MS", "500")),
+		Embedding:          common.LoadEmbeddingConfig(),
+		EmbeddingBatchSize: common.GetenvOrDefaultInt("EMBEDDING_BATCH_SIZE", "32"),
 	}
 }
 
@@ -51,6 +56,8 @@ type Server struct {
 	consumer    *kgo.Client
 	dlqProducer *kgo.Client
 	db          *pgxpool.Pool
+	embedder    common.EmbeddingProvider // nil when embeddings are disabled
+	embedCh     chan *common.Event
 }
 
 func main() {
@@ -129,7 +136,26 @@ func main() {
 		}
 	}
 
+	embedder, err := common.NewEmbeddingProvider(s.cfg.Embedding)
+	if err != nil {
+		slog.Error("failed to create embedding provider", "error", err)
+		os.Exit(1)
+	}
+
+	if embedder != nil {
+		if err := runEmbeddingsMigrations(context.Background(), db); err != nil {
+			slog.Error("failed to run embeddings migrations", "error", err)
+			os.Exit(1)
+		}
+	}
+
 	kafkaCtx, kafkaCancel := context.WithCancel(context.Background())
+	if embedder != nil {
+		s.embedder = embedder
+		s.embedCh = make(chan *common.Event, s.cfg.BatchSize*10)
+		go s.runEmbedder(kafkaCtx)
+		slog.Info("event embeddings enabled", "provider", s.cfg.Embedding.Provider, "model", embedder.Model())
+	}
 	batchCh := make(chan batchItem, s.cfg.BatchSize*2)
 	go s.processBatches(kafkaCtx, batchCh)
 	go s.consume(kafkaCtx, batchCh)
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"embed"
 	"errors"
+	"fmt"
 	"log/slog"
 
 	"github.com/golang-migrate/migrate/v4"
@@ -12,11 +14,39 @@ import (
 	"github.com/jackc/pgx/v5/stdlib"
 )
 
-//go:embed migrations/*.sql
+//go:embed migrations/*.sql migrations/embeddings/*.sql
 var migrationsFS embed.FS
 
 func runMigrations(db *pgxpool.Pool) error {
-	sourceDriver, err := iofs.New(migrationsFS, "migrations")
+	return runMigrationSet(db, "migrations", pgxdriver.DefaultMigrationsTable)
+}
+
+// runEmbeddingsMigrations creates the tables of event embeddings, which are only migrated with embeddings enabled, so
+// that the service runs on a database without pgvector otherwise. The vector extension is created when missing,
+// which needs a role allowed to: the error says how to create it otherwise.
+func runEmbeddingsMigrations(ctx context.Context, db *pgxpool.Pool) error {
+	var available, installed bool
+	err := db.QueryRow(ctx,
+		`SELECT EXISTS (SELECT 1 FROM pg_available_extensions WHERE name = 'vector'),
+		        EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'vector')`,
+	).Scan(&available, &installed)
+	if err != nil {
+		return err
+	}
+	if !available {
+		return errors.New("embeddings need the pgvector extension, which the database server does not have: " +
+			"install pgvector or disable embeddings by unsetting EMBEDDING_PROVIDER")
+	}
+	if !installed {
+		if _, err := db.Exec(ctx, `CREATE EXTENSION IF NOT EXISTS vector`); err != nil {
+			return fmt.Errorf("create the vector extension (as a superuser: CREATE EXTENSION vector;): %w", err)
+		}
+	}
+	return runMigrationSet(db, "migrations/embeddings", "schema_migrations_embeddings")
+}
+
+func runMigrationSet(db *pgxpool.Pool, dir, table string) error {
+	sourceDriver, err := iofs.New(migrationsFS, dir)
 	if err != nil {
 		return err
 	}
@@ -24,7 +54,7 @@ func runMigrations(db *pgxpool.Pool) error {
 	sqlDB := stdlib.OpenDBFromPool(db)
 	defer sqlDB.Close()
 
-	driver, err := pgxdriver.WithInstance(sqlDB, &pgxdriver.Config{})
+	driver, err := pgxdriver.WithInstance(sqlDB, &pgxdriver.Config{MigrationsTable: table})
 	if err != nil {
 		return err
 	}
@@ -40,6 +70,6 @@ func runMigrations(db *pgxpool.Pool) error {
 	}
 
 	version, dirty, _ := m.Version()
-	slog.Info("database migrations complete", "version", version, "dirty", dirty)
+	slog.Info("database migrations complete", "migrations", dir, "version", version, "dirty", dirty)
 	return nil
 }
@@ -0,0 +1,5 @@
+-- 03_add_events_keyset_index.down.sql
+-- Drop keyset pagination and source indexes.
+
+DROP INDEX IF EXISTS idx_events_source;
+DROP INDEX IF EXISTS idx_events_timestamp_id;
@@ -0,0 +1,5 @@
+-- 03_add_events_keyset_index.up.sql
+-- Index events for keyset pagination ordered by (timestamp, id), and for filtering by source.
+
+CREATE INDEX IF NOT EXISTS idx_events_timestamp_id ON events(timestamp DESC, id DESC);
+CREATE INDEX IF NOT EXISTS idx_events_source ON events(source);
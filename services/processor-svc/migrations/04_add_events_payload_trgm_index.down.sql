@@ -0,0 +1,4 @@
+-- 04_add_events_payload_trgm_index.down.sql
+-- Drop the payload trigram index.
+
+DROP INDEX IF EXISTS idx_events_payload_trgm;
@@ -0,0 +1,5 @@
+-- 04_add_events_payload_trgm_index.up.sql
+-- Index the payload text with trigrams, for looking up events mentioning an entity (LIKE '%value%').
+
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+CREATE INDEX IF NOT EXISTS idx_events_payload_trgm ON events USING GIN ((payload::text) gin_trgm_ops);
@@ -0,0 +1,4 @@
+-- 05_add_events_created_at_index.down.sql
+-- Drop the insertion time index.
+
+DROP INDEX IF EXISTS idx_events_created_at;
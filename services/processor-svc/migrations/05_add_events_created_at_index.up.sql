@@ -0,0 +1,4 @@
+-- 05_add_events_created_at_index.up.sql
+-- Index events by insertion time, for the analyzer's cache watermarks (latest event inserted).
+
+CREATE INDEX IF NOT EXISTS idx_events_created_at ON events(created_at DESC);
@@ -0,0 +1,4 @@
+-- 01_create_event_embeddings.down.sql
+-- Drop the event embeddings; the vector extension is left installed.
+
+DROP TABLE IF EXISTS event_embeddings;
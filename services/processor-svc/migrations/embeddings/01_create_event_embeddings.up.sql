@@ -0,0 +1,13 @@
+-- 01_create_event_embeddings.up.sql
+-- Store an embedding of each event per embedding model, indexed for cosine similarity search. Only run with
+-- embeddings enabled; needs the vector extension of pgvector, which runEmbeddingsMigrations checks for.
+
+CREATE TABLE IF NOT EXISTS event_embeddings (
+    event_id     TEXT NOT NULL REFERENCES events(id) ON DELETE CASCADE,
+    model        TEXT NOT NULL,
+    embedding    vector(768) NOT NULL,
+    embedded_at  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (event_id, model)
+);
+
+CREATE INDEX IF NOT EXISTS idx_event_embeddings_hnsw ON event_embeddings USING hnsw (embedding vector_cosine_ops);
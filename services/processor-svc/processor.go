@@ -86,7 +86,8 @@ func (s *Server) processBatches(ctx context.Context, batchCh <-chan batchItem) {
 			}
 		}
 
-		if err := s.insertEventsBatch(ctx, events); err != nil {
+		inserted, err := s.insertEventsBatch(ctx, events)
+		if err != nil {
 			// reprocess the records since we haven't committed anything yet
 			// insertEventsBatch will automatically fallback to row-by-row insert if it fails
 			slog.Error("failed to write event batch", "error", err, "count", len(events))
@@ -100,6 +101,7 @@ func (s *Server) processBatches(ctx context.Context, batchCh <-chan batchItem) {
 			batch = batch[:0]
 			return
 		}
+		s.enqueueEmbeddings(inserted)
 
 		for _, item := range batch {
 			if item.event == nil {